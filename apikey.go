@@ -0,0 +1,56 @@
+package library
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, which tells them apart from JWTs in the
+// authorization metadata.
+const apiKeyPrefix = "lib_"
+
+// APIKey is a key authenticating a client, such as a service or a script.
+// Only the hash of the key is stored, the key itself is shown once when it
+// is created.
+type APIKey struct {
+	ID          string    `json:"id"` // The random id of the key
+	DisplayName string    `json:"displayName"`
+	KeyHash     string    `json:"keyHash"` // The hex encoded SHA-256 of the key
+	CreateTime  time.Time `json:"createTime"`
+}
+
+// NewAPIKey creates an API key with a new random id and secret. It returns
+// the key to hand to the client together with the APIKey to store.
+func NewAPIKey(displayName string, now time.Time) (string, APIKey, error) {
+	if strings.TrimSpace(displayName) == "" {
+		return "", APIKey{}, fmt.Errorf("an API key must have a display name")
+	}
+	id, err := newResourceID()
+	if err != nil {
+		return "", APIKey{}, fmt.Errorf("failed to create API key id, %w", err)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, fmt.Errorf("failed to create API key, %w", err)
+	}
+
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return key, APIKey{
+		ID:          id,
+		DisplayName: displayName,
+		KeyHash:     hashAPIKey(key),
+		CreateTime:  now,
+	}, nil
+}
+
+// hashAPIKey returns the hash an API key is stored and looked up by. The keys
+// are random, so a single SHA-256 is enough to protect them.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,173 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// checks if we have implementat all the different functions
+var _ librarypb.AuditServiceServer = new(libraryServiceServer)
+
+// AuditEvent is a recorded change of a resource. The events are appended in
+// the same transaction as the change and never changed or removed.
+type AuditEvent struct {
+	ID        string    `json:"id"`        // The random id in 'auditEvents/{id}'
+	Principal string    `json:"principal"` // Empty if authentication is disabled
+	Method    string    `json:"method"`    // The RPC which made the change
+	Resource  string    `json:"resource"`  // The name of the changed resource
+	Before    string    `json:"before"`    // The JSON of the resource, empty if it was created
+	After     string    `json:"after"`     // The JSON of the resource, empty if it was purged
+	EventTime time.Time `json:"eventTime"`
+}
+
+// auditQuery selects the audit events to list.
+type auditQuery struct {
+	pageSize int
+	// resource is the name of the resource of the events, if set.
+	resource string
+	// startTime and endTime bound the event times, unless they are zero.
+	startTime time.Time
+	endTime   time.Time
+	// after holds the ordering values of the last event of the previous page.
+	after []string
+}
+
+// newAuditEvent creates the audit event of a change of a resource by the
+// principal of the call, with the JSON of the resource before and after the
+// change. The before message is nil if the resource was created, and the
+// after message nil if it was purged.
+func newAuditEvent(ctx context.Context, method, resource string,
+	before, after proto.Message, now time.Time) (AuditEvent, error) {
+	id, err := newResourceID()
+	if err != nil {
+		return AuditEvent{}, fmt.Errorf("failed to create audit event id, %w", err)
+	}
+	e := AuditEvent{ID: id, Method: method, Resource: resource, EventTime: now}
+	if p, ok := principalFromContext(ctx); ok {
+		e.Principal = p.Subject
+	}
+	if e.Before, err = snapshot(before); err != nil {
+		return AuditEvent{}, err
+	}
+	if e.After, err = snapshot(after); err != nil {
+		return AuditEvent{}, err
+	}
+	return e, nil
+}
+
+// snapshot returns the JSON of the message as the clients see it, or an empty
+// string if the message is nil.
+func snapshot(m proto.Message) (string, error) {
+	if m == nil {
+		return "", nil
+	}
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit snapshot, %w", err)
+	}
+	return string(b), nil
+}
+
+// auditBook appends the audit event of a change of the book to the store.
+// The before book is nil if the book was created, and the after book is nil
+// if it was purged.
+func auditBook(ctx context.Context, tx AuditStore, method string,
+	before, after *Book) error {
+	var beforeProto, afterProto proto.Message
+	var isbn string
+	if before != nil {
+		beforeProto, isbn = before.AsProto(), before.ISBN
+	}
+	if after != nil {
+		afterProto, isbn = after.AsProto(), after.ISBN
+	}
+	e, err := newAuditEvent(ctx, method, "books/"+isbn, beforeProto,
+		afterProto, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.AppendAuditEvent(ctx, e)
+}
+
+// AsProto converts the AuditEvent to a *librarypb.AuditEvent.
+func (e *AuditEvent) AsProto() *librarypb.AuditEvent {
+	return &librarypb.AuditEvent{
+		Name:      "auditEvents/" + e.ID,
+		Principal: e.Principal,
+		Method:    e.Method,
+		Resource:  e.Resource,
+		Before:    snapshotStruct(e.Before),
+		After:     snapshotStruct(e.After),
+		EventTime: timestamppb.New(e.EventTime),
+	}
+}
+
+// snapshotStruct converts the JSON of a snapshot to a *structpb.Struct, or nil
+// if there is no snapshot.
+func snapshotStruct(s string) *structpb.Struct {
+	if s == "" {
+		return nil
+	}
+	st := &structpb.Struct{}
+	if err := protojson.Unmarshal([]byte(s), st); err != nil {
+		return nil
+	}
+	return st
+}
+
+// ListAuditEvents retreives a page of the audit events ordered by their
+// event time, optionally only those of a resource or within a time range.
+func (s *libraryServiceServer) ListAuditEvents(ctx context.Context,
+	req *librarypb.ListAuditEventsRequest) (*librarypb.ListAuditEventsResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	q := auditQuery{pageSize: pageSize, resource: req.GetResource()}
+	if strings.HasPrefix(q.resource, "books/") {
+		// the events of a book are found by any form of its ISBN
+		q.resource = "books/" + isbnFromName(q.resource)
+	}
+	if req.GetStartTime() != nil {
+		q.startTime = req.GetStartTime().AsTime()
+	}
+	if req.GetEndTime() != nil {
+		q.endTime = req.GetEndTime().AsTime()
+	}
+	if !q.startTime.IsZero() && !q.endTime.IsZero() && !q.startTime.Before(q.endTime) {
+		return nil, invalidFieldsError([]*errdetails.BadRequest_FieldViolation{{
+			Field:       "end_time",
+			Description: "must be after the start_time",
+		}})
+	}
+
+	checksum := listChecksum(fmt.Sprintf("%s\x00%s\x00%s", q.resource,
+		formatTime(q.startTime), formatTime(q.endTime)), "auditEvents", false)
+	if q.after, err = parsePageToken(req.GetPageToken(), checksum, 2); err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	events, next, err := s.store.ListAuditEvents(ctx, q)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListAuditEventsResponse{}
+	for _, event := range events {
+		resp.AuditEvents = append(resp.AuditEvents, event.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
@@ -0,0 +1,149 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The prefixes of the subjects of the principals.
+const (
+	apiKeySubjectPrefix = "apiKeys/"
+	userSubjectPrefix   = "users/"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Subject string // 'apiKeys/{id}' for an API key, 'users/{sub}' for a JWT
+	Role    string // The role of the principal, set once the call is authorized
+}
+
+// systemPrincipal is the principal of the changes the server makes by itself,
+// such as purging the expired books. It can not be bound to a role.
+var systemPrincipal = principal{Subject: "system"}
+
+// principalKey is the context key of the principal.
+type principalKey struct{}
+
+// withPrincipal returns a context holding the authenticated principal.
+func withPrincipal(ctx context.Context, p principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFromContext returns the authenticated principal of the request, if
+// the request was authenticated.
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// Authenticator authenticates the calls by the bearer token in their
+// authorization metadata, which is either an API key stored in the store or
+// a JWT signed by one of the configured keys. The gateway forwards the HTTP
+// Authorization header as the authorization metadata.
+type Authenticator struct {
+	store APIKeyStore
+	jwt   *jwtVerifier
+	log   *zap.SugaredLogger
+}
+
+// NewAuthenticator creates an Authenticator looking up the API keys in the
+// store and verifying the JWTs by the configuration.
+func NewAuthenticator(store APIKeyStore, logger *zap.SugaredLogger,
+	cfg JWTConfig) (*Authenticator, error) {
+	verifier, err := newJWTVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{store: store, jwt: verifier, log: logger}, nil
+}
+
+// UnaryInterceptor rejects the calls which are not authenticated with
+// Unauthenticated, and passes the principal of the others to the handler in
+// the context.
+func (a *Authenticator) UnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	p, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(withPrincipal(ctx, p), req)
+}
+
+// StreamInterceptor rejects the streaming calls like UnaryInterceptor, and
+// passes the principal of the others to the handler in the context of the
+// stream.
+func (a *Authenticator) StreamInterceptor(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	p, err := a.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &principalStream{ServerStream: ss,
+		ctx: withPrincipal(ss.Context(), p)})
+}
+
+// principalStream is a server stream whose context holds the principal.
+type principalStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context holding the principal.
+func (s *principalStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate returns the principal of the bearer token in the
+// authorization metadata of the call.
+func (a *Authenticator) authenticate(ctx context.Context) (principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) != 1 {
+		return principal{}, status.Errorf(codes.Unauthenticated,
+			"the authorization metadata must hold one bearer API key or JWT")
+	}
+	scheme, token := splitAuthorization(values[0])
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return principal{}, status.Errorf(codes.Unauthenticated,
+			"the authorization must be on the format 'Bearer {token}'")
+	}
+
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		key, err := a.store.GetAPIKeyByHash(ctx, hashAPIKey(token))
+		if errors.Is(err, ErrNotFound) {
+			return principal{}, status.Errorf(codes.Unauthenticated, "invalid API key")
+		}
+		if err != nil {
+			a.log.Errorw("failed to look up API key", "error", err)
+			return principal{}, status.Errorf(codes.Internal, "internal storage error")
+		}
+		return principal{Subject: apiKeySubjectPrefix + key.ID}, nil
+	}
+
+	claims, err := a.jwt.verify(token, time.Now())
+	if err != nil {
+		return principal{}, status.Errorf(codes.Unauthenticated, "invalid JWT: %v", err)
+	}
+	// the sub claim is chosen by the issuer, so it is namespaced to never be
+	// taken for an API key
+	return principal{Subject: userSubjectPrefix + claims.Subject}, nil
+}
+
+// splitAuthorization splits the value of an authorization header into the
+// scheme and the credentials.
+func splitAuthorization(value string) (string, string) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexByte(value, ' ')
+	if i < 0 {
+		return value, ""
+	}
+	return value[:i], strings.TrimSpace(value[i+1:])
+}
@@ -0,0 +1,167 @@
+package library
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("a shared secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwksKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "jwks-key",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(jwksKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(jwksKey.E)).Bytes()),
+	}}})
+	require.NoError(t, err)
+
+	store := NewMemoryStorage()
+	key, apiKey, err := NewAPIKey("importer", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAPIKey(ctx, apiKey))
+
+	auth, err := NewAuthenticator(store, zap.NewNop().Sugar(), JWTConfig{
+		HS256Secrets:    [][]byte{secret},
+		RS256PublicKeys: []*rsa.PublicKey{&rsaKey.PublicKey},
+		JWKS:            jwks,
+		Issuer:          "https://login.example.com",
+		Audience:        "library",
+	})
+	require.NoError(t, err)
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"sub": "alice",
+		"iss": "https://login.example.com",
+		"aud": []string{"library", "other"},
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for k, v := range claims {
+			c[k] = v
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authorization []string
+		wantSubject   string
+	}{
+		{"api key", []string{"Bearer " + key}, "apiKeys/" + apiKey.ID},
+		{"HS256", []string{"Bearer " + signHS256(t, secret, claims)}, "users/alice"},
+		{"RS256", []string{"bearer " + signRS256(t, rsaKey, "", claims)}, "users/alice"},
+		{"JWKS", []string{"Bearer " + signRS256(t, jwksKey, "jwks-key", claims)}, "users/alice"},
+		// a JWT can not pass for an API key, which may be bound to another role
+		{"sub of an api key", []string{"Bearer " + signHS256(t, secret,
+			with(map[string]interface{}{"sub": "apiKeys/" + apiKey.ID}))},
+			"users/apiKeys/" + apiKey.ID},
+		{"missing", nil, ""},
+		{"twice", []string{"Bearer " + key, "Bearer " + key}, ""},
+		{"other scheme", []string{"Basic " + key}, ""},
+		{"unknown api key", []string{"Bearer " + apiKeyPrefix + "unknown"}, ""},
+		{"wrong secret", []string{"Bearer " + signHS256(t, []byte("other"), claims)}, ""},
+		{"wrong kid", []string{"Bearer " + signRS256(t, jwksKey, "other", claims)}, ""},
+		{"expired", []string{"Bearer " + signHS256(t, secret,
+			with(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}))}, ""},
+		{"no exp", []string{"Bearer " + signHS256(t, secret,
+			with(map[string]interface{}{"exp": nil}))}, ""},
+		{"not yet valid", []string{"Bearer " + signHS256(t, secret,
+			with(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}))}, ""},
+		{"other issuer", []string{"Bearer " + signHS256(t, secret,
+			with(map[string]interface{}{"iss": "https://evil.example.com"}))}, ""},
+		{"other audience", []string{"Bearer " + signHS256(t, secret,
+			with(map[string]interface{}{"aud": "other"}))}, ""},
+		{"alg none", []string{"Bearer " + unsignedJWT(t, claims)}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			md := metadata.MD{}
+			for _, value := range tc.authorization {
+				md.Append("authorization", value)
+			}
+			var got principal
+			_, err := auth.UnaryInterceptor(metadata.NewIncomingContext(ctx, md), nil,
+				&grpc.UnaryServerInfo{FullMethod: "/library.LibraryService/ListBooks"},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					got, _ = principalFromContext(ctx)
+					return nil, nil
+				})
+			if tc.wantSubject == "" {
+				require.Equal(t, codes.Unauthenticated, status.Code(err), err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.wantSubject, got.Subject)
+		})
+	}
+}
+
+// signHS256 creates a JWT of the claims signed with the secret.
+func signHS256(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	signed := jwtSigningInput(t, map[string]string{"alg": "HS256", "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signRS256 creates a JWT of the claims signed with the RSA key, with the key
+// id unless it is empty.
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string,
+	claims map[string]interface{}) string {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := jwtSigningInput(t, header, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// unsignedJWT creates a JWT of the claims with the alg none.
+func unsignedJWT(t *testing.T, claims map[string]interface{}) string {
+	return jwtSigningInput(t, map[string]string{"alg": "none"}, claims) + "."
+}
+
+// jwtSigningInput encodes the header and the claims of a JWT.
+func jwtSigningInput(t *testing.T, header map[string]string,
+	claims map[string]interface{}) string {
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	return fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(h),
+		base64.RawURLEncoding.EncodeToString(c))
+}
@@ -0,0 +1,234 @@
+package library
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Author is a person credited for one or more books.
+type Author struct {
+	ID         string    `json:"id"` // The random id in 'authors/{id}'
+	FirstName  string    `json:"firstName"`
+	LastName   string    `json:"lastName"`
+	CreateTime time.Time `json:"createTime"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// The field paths of an Author which can be validated and updated.
+const (
+	fieldFirstName = "first_name"
+	fieldLastName  = "last_name"
+)
+
+// updatableAuthorFields are the field paths which are allowed in the update
+// mask of an author.
+var updatableAuthorFields = []string{
+	fieldFirstName,
+	fieldLastName,
+}
+
+// validateAuthorFields validates the given field paths of the author and
+// returns a violation for every invalid field.
+func validateAuthorFields(a Author,
+	paths []string) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	for _, path := range paths {
+		switch path {
+		case fieldFirstName:
+			if description, ok := checkText("authors", path, a.FirstName); !ok {
+				violation(path, description)
+			}
+		case fieldLastName:
+			if description, ok := checkText("authors", path, a.LastName); !ok {
+				violation(path, description)
+			}
+		}
+	}
+	return violations
+}
+
+// authorUpdatePaths resolves the paths of the update mask of an author. An
+// empty mask or the '*' path selects all updatable fields.
+func authorUpdatePaths(maskPaths []string) ([]string,
+	[]*errdetails.BadRequest_FieldViolation) {
+	if len(maskPaths) == 0 {
+		return updatableAuthorFields, nil
+	}
+
+	var paths []string
+	for _, path := range maskPaths {
+		switch path {
+		case "*":
+			return updatableAuthorFields, nil
+		case fieldFirstName, fieldLastName:
+			paths = append(paths, path)
+		case fieldName, fieldCreateTime, fieldUpdateTime:
+			return nil, updateMaskViolation("field %q is immutable", path)
+		default:
+			return nil, updateMaskViolation("unknown field %q", path)
+		}
+	}
+	return paths, nil
+}
+
+// newResourceID creates the random id of a new author or publisher.
+func newResourceID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorIDFromName returns the id of an author name on the format
+// 'authors/{id}'.
+func authorIDFromName(name string) string {
+	return strings.TrimPrefix(name, "authors/")
+}
+
+// NewAuthorFromProto converts a *librarypb.Author to an Author.
+func NewAuthorFromProto(a *librarypb.Author) Author {
+	return Author{
+		ID:        authorIDFromName(a.GetName()),
+		FirstName: normalizeText(a.GetFirstName()),
+		LastName:  normalizeText(a.GetLastName()),
+	}
+}
+
+// AsProto converts the Author to a *librarypb.Author.
+func (a *Author) AsProto() *librarypb.Author {
+	return &librarypb.Author{
+		Name:       "authors/" + a.ID,
+		FirstName:  a.FirstName,
+		LastName:   a.LastName,
+		CreateTime: timestamppb.New(a.CreateTime),
+		UpdateTime: timestamppb.New(a.UpdateTime),
+	}
+}
+
+// CreateAuthor creates an author with a new random id.
+func (s *libraryServiceServer) CreateAuthor(ctx context.Context,
+	req *librarypb.CreateAuthorRequest) (*librarypb.Author, error) {
+
+	author := NewAuthorFromProto(req.GetAuthor())
+	if violations := validateAuthorFields(author, updatableAuthorFields); violations != nil {
+		return nil, invalidFieldsError(inField("author", violations))
+	}
+
+	id, err := newResourceID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create author id")
+	}
+	author.ID = id
+	author.CreateTime = time.Now()
+	author.UpdateTime = author.CreateTime
+
+	if err := s.store.CreateAuthor(ctx, author); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return author.AsProto(), nil
+}
+
+// GetAuthor retreives a specific author.
+func (s *libraryServiceServer) GetAuthor(ctx context.Context,
+	req *librarypb.GetAuthorRequest) (*librarypb.Author, error) {
+
+	author, err := s.store.GetAuthor(ctx, authorIDFromName(req.GetName()))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return author.AsProto(), nil
+}
+
+// ListAuthors retreives a page of the authors ordered by their names.
+func (s *libraryServiceServer) ListAuthors(ctx context.Context,
+	req *librarypb.ListAuthorsRequest) (*librarypb.ListAuthorsResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	checksum := listChecksum("", "authors", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 3)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	authors, next, err := s.store.ListAuthors(ctx, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListAuthorsResponse{}
+	for _, author := range authors {
+		resp.Authors = append(resp.Authors, author.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// UpdateAuthor updates the names of an author. Only the fields in the update
+// mask are written, or all the fields if the mask is empty.
+func (s *libraryServiceServer) UpdateAuthor(ctx context.Context,
+	req *librarypb.UpdateAuthorRequest) (*librarypb.Author, error) {
+
+	paths, violations := authorUpdatePaths(req.GetUpdateMask().GetPaths())
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
+	}
+	update := NewAuthorFromProto(req.GetAuthor())
+	if violations := validateAuthorFields(update, paths); violations != nil {
+		return nil, invalidFieldsError(inField("author", violations))
+	}
+
+	var author Author
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if author, err = tx.GetAuthor(ctx, update.ID); err != nil {
+			return err
+		}
+		for _, path := range paths {
+			switch path {
+			case fieldFirstName:
+				author.FirstName = update.FirstName
+			case fieldLastName:
+				author.LastName = update.LastName
+			}
+		}
+		author.UpdateTime = time.Now()
+		return tx.UpdateAuthor(ctx, author)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return author.AsProto(), nil
+}
+
+// DeleteAuthor deletes an author which is not credited for any book.
+func (s *libraryServiceServer) DeleteAuthor(ctx context.Context,
+	req *librarypb.DeleteAuthorRequest) (*emptypb.Empty, error) {
+
+	if err := s.store.DeleteAuthor(ctx, authorIDFromName(req.GetName())); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &emptypb.Empty{}, nil
+}
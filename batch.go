@@ -0,0 +1,209 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchSize is the maximum number of books in a batch request.
+const maxBatchSize = 1000
+
+// errBatchFailed rolls back the transaction of an all-or-nothing batch in
+// which some of the books failed.
+var errBatchFailed = errors.New("batch failed")
+
+// BatchCreateBooks creates several books in one database transaction. The
+// books which fail validation or can not be stored are reported by their
+// index in the response. In all-or-nothing mode no book is created if any of
+// them failed.
+func (s *libraryServiceServer) BatchCreateBooks(ctx context.Context,
+	req *librarypb.BatchCreateBooksRequest) (*librarypb.BatchCreateBooksResponse, error) {
+
+	if len(req.GetRequests()) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"at most %d books can be created in one batch", maxBatchSize)
+	}
+
+	resp := &librarypb.BatchCreateBooksResponse{}
+	var newBooks []Book
+	var indexes []int // the request index of each of the new books
+
+	for i, r := range req.GetRequests() {
+		newBook, err := newBookFromRequest(r)
+		if err != nil {
+			resp.Errors = append(resp.Errors, batchItemError(i,
+				inRequest(i, err)))
+			continue
+		}
+		newBooks = append(newBooks, newBook)
+		indexes = append(indexes, i)
+	}
+	if req.GetAllOrNothing() && len(resp.Errors) != 0 {
+		return resp, nil
+	}
+
+	var created []*librarypb.Book
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		failed := false
+		for i, newBook := range newBooks {
+			if err := tx.InsertIntoDatabase(ctx, newBook); err != nil {
+				resp.Errors = append(resp.Errors, batchItemError(indexes[i],
+					s.toStatus(err)))
+				failed = true
+				continue
+			}
+			written, err := tx.FindSpecificBook(ctx, newBook.ISBN)
+			if err != nil {
+				return err
+			}
+			if err := auditBook(ctx, tx, "BatchCreateBooks", nil, &written); err != nil {
+				return err
+			}
+			created = append(created, written.AsProto())
+		}
+		if failed && req.GetAllOrNothing() {
+			return errBatchFailed
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		resp.Books = created
+		s.changes.notify()
+	case !errors.Is(err, errBatchFailed):
+		return nil, s.toStatus(err)
+	}
+
+	sortBatchItemErrors(resp.Errors)
+	return resp, nil
+}
+
+// BatchGetBooks retreives several books at once, in the order of the
+// requested names. It fails if any of the books did not exist.
+func (s *libraryServiceServer) BatchGetBooks(ctx context.Context,
+	req *librarypb.BatchGetBooksRequest) (*librarypb.BatchGetBooksResponse, error) {
+
+	if len(req.GetNames()) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"at most %d books can be read in one batch", maxBatchSize)
+	}
+
+	isbns := make([]string, len(req.GetNames()))
+	for i, name := range req.GetNames() {
+		isbns[i] = isbnFromName(name)
+	}
+	books, err := s.store.FindBooks(ctx, isbns)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.BatchGetBooksResponse{}
+	for i, isbn := range isbns {
+		book, ok := books[isbn]
+		if !ok || (book.IsDeleted() && !req.GetShowDeleted()) {
+			return nil, status.Errorf(codes.NotFound,
+				"the book %q did not exist in the library", req.GetNames()[i])
+		}
+		resp.Books = append(resp.Books, book.AsProto())
+	}
+	return resp, nil
+}
+
+// BatchDeleteBooks deletes several books in one database transaction. The
+// books which could not be deleted are reported by their index in the
+// response. In all-or-nothing mode no book is deleted if any of them failed.
+func (s *libraryServiceServer) BatchDeleteBooks(ctx context.Context,
+	req *librarypb.BatchDeleteBooksRequest) (*librarypb.BatchDeleteBooksResponse, error) {
+
+	if len(req.GetNames()) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"at most %d books can be deleted in one batch", maxBatchSize)
+	}
+
+	isbns := make([]string, len(req.GetNames()))
+	for i, name := range req.GetNames() {
+		isbns[i] = isbnFromName(name)
+	}
+	deleteTime := time.Now()
+	expireTime := deleteTime.Add(s.deletedBookRetention)
+
+	resp := &librarypb.BatchDeleteBooksResponse{}
+	var deleted []*librarypb.Book
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		failed := false
+		for i, isbn := range isbns {
+			// the book is read in the transaction of the delete, so the
+			// audited book is the one which was deleted
+			before, err := tx.FindSpecificBook(ctx, isbn)
+			if err == nil {
+				err = tx.SoftDeleteBook(ctx, isbn, deleteTime, expireTime)
+			}
+			if errors.Is(err, ErrConflict) {
+				err = ErrNotFound // the book was already deleted
+			}
+			if err != nil {
+				resp.Errors = append(resp.Errors, batchItemError(i,
+					s.toStatus(err)))
+				failed = true
+				continue
+			}
+			book, err := tx.FindSpecificBook(ctx, isbn)
+			if err != nil {
+				return err
+			}
+			if err := auditBook(ctx, tx, "BatchDeleteBooks", &before, &book); err != nil {
+				return err
+			}
+			deleted = append(deleted, book.AsProto())
+		}
+		if failed && req.GetAllOrNothing() {
+			return errBatchFailed
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		resp.Books = deleted
+		s.changes.notify()
+	case !errors.Is(err, errBatchFailed):
+		return nil, s.toStatus(err)
+	}
+	return resp, nil
+}
+
+// batchItemError creates the error of the batch item with the given index.
+func batchItemError(index int, err error) *librarypb.BatchItemError {
+	return &librarypb.BatchItemError{
+		Index:  int32(index),
+		Status: status.Convert(err).Proto(),
+	}
+}
+
+// inRequest prefixes the fields of the violations of a failed validation with
+// the request of the batch they belong to, e.g. requests[0].book.title.
+// Other errors are returned as they are.
+func inRequest(index int, err error) error {
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		if br, ok := detail.(*errdetails.BadRequest); ok {
+			return invalidFieldsError(inField(fmt.Sprintf("requests[%d]", index),
+				br.GetFieldViolations()))
+		}
+	}
+	return err
+}
+
+// sortBatchItemErrors orders the errors by the index of their item.
+func sortBatchItemErrors(errs []*librarypb.BatchItemError) {
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].GetIndex() < errs[j].GetIndex()
+	})
+}
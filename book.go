@@ -7,91 +7,256 @@ import (
 	"time"
 
 	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/NicolaiMordrup/library/isbn"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Struct for the book properties.
 type Book struct {
-	ISBN       string    `json:"isbn"` // The identification of the books
-	Title      string    `json:"title"`
-	CreateTime time.Time `json:"createTime"` // The time of creation of book instance
-	UpdateTime time.Time `json:"updateTime"` // The time of update for book instance
-	Publisher  string    `json:"publisher"`
-	Author     Author    `json:"author"` // Embedded author struct
+	ISBN          string       `json:"isbn"` // The identification of the books
+	Title         string       `json:"title"`
+	CreateTime    time.Time    `json:"createTime"`    // The time of creation of book instance
+	UpdateTime    time.Time    `json:"updateTime"`    // The time of update for book instance
+	Publisher     string       `json:"publisher"`     // The id in 'publishers/{id}'
+	PublisherName string       `json:"publisherName"` // Filled in when read from a store
+	Authors       []BookAuthor `json:"authors"`       // In the order they are credited
+	DeleteTime    time.Time    `json:"deleteTime"`    // Zero unless the book is deleted
+	ExpireTime    time.Time    `json:"expireTime"`    // The time a deleted book is purged
+	// The numbers of copies which are not withdrawn and which are available,
+	// filled in when read from a store.
+	TotalCopies     int `json:"totalCopies"`
+	AvailableCopies int `json:"availableCopies"`
+	// The latest revision of the book, or the revision read from the history
+	// of the book, filled in when read from a store.
+	RevisionID         string    `json:"revisionId"`
+	RevisionCreateTime time.Time `json:"revisionCreateTime"`
 }
 
-// Struct for the books Author properties.
-type Author struct {
+// BookAuthor references an author of a book together with the role the
+// author had.
+type BookAuthor struct {
+	AuthorID string `json:"authorId"`
+	Role     string `json:"role"`
+	// The name of the author, filled in when the book is read from a store.
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 }
 
+// The roles an author can have in a book.
+const (
+	roleAuthor      = "author"
+	roleEditor      = "editor"
+	roleTranslator  = "translator"
+	roleIllustrator = "illustrator"
+)
+
+// validRoles are the roles which can be stored.
+var validRoles = map[string]bool{
+	roleAuthor:      true,
+	roleEditor:      true,
+	roleTranslator:  true,
+	roleIllustrator: true,
+}
+
 // The regex patterns for the validate function
 var (
-	isbnPattern      = regexp.MustCompile(`^\d{13}$`)
-	titlePattern     = regexp.MustCompile(`.`)
-	firstNamePattern = regexp.MustCompile(`^[a-zA-Z]+(?:\s+[a-zA-Z]+)*$`)
-	LastNamePattern  = regexp.MustCompile(`^[a-zA-Z]+(?:\s+[a-zA-Z]+)*$`)
-	publisherPattern = regexp.MustCompile(`^[a-zA-Z]+(?:\s+[a-zA-Z]+)*$`)
+	authorIDPattern    = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	publisherIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
 )
 
-// validate if the given input given is correct.
-// if correct we return boolean true, otherwise boolean false.
-func validate(b Book) error {
-	var fieldErrors []string
+// The field paths of a Book which can be validated and updated.
+const (
+	fieldName       = "name"
+	fieldTitle      = "title"
+	fieldPublisher  = "publisher"
+	fieldAuthors    = "authors"
+	fieldCreateTime = "create_time"
+	fieldUpdateTime = "update_time"
+	fieldEtag       = "etag"
+)
+
+// updatableFields are the field paths which are allowed in an update mask.
+var updatableFields = []string{
+	fieldTitle,
+	fieldPublisher,
+	fieldAuthors,
+}
 
-	if matchedISBN := isbnPattern.MatchString(b.ISBN); !matchedISBN {
-		fieldErrors = append(fieldErrors, " isbn ")
+// validate validates all the fields of a new book and returns a violation for
+// every invalid field.
+func validate(b Book) []*errdetails.BadRequest_FieldViolation {
+	return validateFields(b, append([]string{fieldName}, updatableFields...))
+}
+
+// validateFields validates only the given field paths of the book and returns
+// a violation for every invalid field.
+func validateFields(b Book,
+	paths []string) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
 	}
-	if matchedTitle := titlePattern.MatchString(b.Title); !matchedTitle {
-		fieldErrors = append(fieldErrors, " title ")
+
+	for _, path := range paths {
+		switch path {
+		case fieldName:
+			// the isbn has been normalized if valid, so only a canonical
+			// ISBN-13 is accepted
+			if normalized, err := isbn.Normalize(b.ISBN); err != nil ||
+				normalized != b.ISBN {
+				violation(path, "must be an ISBN-10 or ISBN-13 with a valid check"+
+					" digit, such as '978-0-306-40615-7'")
+			}
+		case fieldTitle:
+			if description, ok := checkText("books", path, b.Title); !ok {
+				violation(path, description)
+			}
+		case fieldAuthors:
+			if len(b.Authors) == 0 {
+				violation(path, "must have at least one author")
+			}
+			for i, a := range b.Authors {
+				if !authorIDPattern.MatchString(a.AuthorID) {
+					violation(fmt.Sprintf("%s[%d].author", path, i),
+						"must be an author in the format 'authors/{id}'")
+				}
+				if !validRoles[a.Role] {
+					violation(fmt.Sprintf("%s[%d].role", path, i),
+						"must be the role of an author")
+				}
+			}
+		case fieldPublisher:
+			if !publisherIDPattern.MatchString(b.Publisher) {
+				violation(path, "must be a publisher in the format 'publishers/{id}'")
+			}
+		}
 	}
-	if matchedFirstName := firstNamePattern.MatchString(b.Author.FirstName); !matchedFirstName {
-		fieldErrors = append(fieldErrors, " authors firstname ")
+	return violations
+}
+
+// updatePaths resolves the paths of an update mask to the updatable field
+// paths. An empty mask or the '*' path selects all updatable fields. Paths
+// which are unknown or immutable gives an error naming the field.
+func updatePaths(maskPaths []string) ([]string,
+	[]*errdetails.BadRequest_FieldViolation) {
+	if len(maskPaths) == 0 {
+		return updatableFields, nil
 	}
-	if matchedLastName := LastNamePattern.MatchString(b.Author.LastName); !matchedLastName {
-		fieldErrors = append(fieldErrors, " authors lastname ")
+
+	var paths []string
+	for _, path := range maskPaths {
+		switch path {
+		case "*":
+			return updatableFields, nil
+		case fieldTitle, fieldPublisher, fieldAuthors:
+			paths = append(paths, path)
+		case fieldName, fieldCreateTime, fieldUpdateTime, fieldEtag:
+			// the etag is computed from the book, and checked as a
+			// precondition of the update whatever the mask
+			return nil, updateMaskViolation("field %q is immutable", path)
+		default:
+			return nil, updateMaskViolation("unknown field %q", path)
+		}
 	}
-	if matchedPublisher := publisherPattern.MatchString(b.Publisher); !matchedPublisher {
-		fieldErrors = append(fieldErrors, " Publishers name")
+	return paths, nil
+}
+
+// applyUpdate copies the given field paths from update to the existing book.
+func applyUpdate(existing, update Book, paths []string) Book {
+	for _, path := range paths {
+		switch path {
+		case fieldTitle:
+			existing.Title = update.Title
+		case fieldPublisher:
+			existing.Publisher = update.Publisher
+		case fieldAuthors:
+			existing.Authors = update.Authors
+		}
 	}
+	return existing
+}
 
-	if len(fieldErrors) != 0 {
-		return fmt.Errorf("validation failed, field error(s):%v."+
-			" Fix these error before proceeding",
-			strings.Join(fieldErrors, ", "))
+// isbnFromName returns the isbn of a book name on the format 'books/{isbn}'.
+// A bare isbn is accepted as well. A valid ISBN-10 or ISBN-13 is normalized to
+// its canonical ISBN-13, so hyphenated input and ISBN-10s name the same book,
+// and an invalid isbn is returned as is.
+func isbnFromName(name string) string {
+	id := strings.TrimPrefix(name, "books/")
+	if normalized, err := isbn.Normalize(id); err == nil {
+		return normalized
 	}
-	return nil
+	return id
 }
 
 // NewBookFromProto converts a *librarypb.Book which is on the proto fromat
 // to the Book instance such that the database can deal with it.
 func NewBookFromProto(b *librarypb.Book) Book {
 	return Book{
-		ISBN:       b.GetName(),
-		Title:      b.GetTitle(),
-		Publisher:  b.GetPublisher(),
+		ISBN:       isbnFromName(b.GetName()),
+		Title:      normalizeText(b.GetTitle()),
+		Publisher:  publisherIDFromName(b.GetPublisher()),
 		CreateTime: b.GetCreateTime().AsTime(),
 		UpdateTime: b.GetUpdateTime().AsTime(),
-		Author: Author{
-			FirstName: b.Author.GetFirstName(),
-			LastName:  b.Author.GetLastName(),
-		},
+		Authors:    bookAuthorsFromProto(b.GetAuthors()),
+	}
+}
+
+// bookAuthorsFromProto converts the author references of a book. An
+// unspecified role is the author role.
+func bookAuthorsFromProto(authors []*librarypb.BookAuthor) []BookAuthor {
+	var bookAuthors []BookAuthor
+	for _, a := range authors {
+		role := roleAuthor
+		if a.GetRole() != librarypb.BookAuthor_ROLE_UNSPECIFIED {
+			role = strings.ToLower(strings.TrimPrefix(a.GetRole().String(), "ROLE_"))
+		}
+		bookAuthors = append(bookAuthors, BookAuthor{
+			AuthorID: authorIDFromName(a.GetAuthor()),
+			Role:     role,
+		})
 	}
+	return bookAuthors
 }
 
 // AsProto converts a Book instance to the *librarypb.Book which is of proto
 // instance such that the response can deal with it.
 func (b *Book) AsProto() *librarypb.Book {
-	return &librarypb.Book{
-		Name:       b.ISBN,
-		Title:      b.Title,
-		Publisher:  b.Publisher,
-		CreateTime: timestamppb.New(b.CreateTime),
-		UpdateTime: timestamppb.New(b.UpdateTime),
-		Author: &librarypb.Author{
-			FirstName: b.Author.FirstName,
-			LastName:  b.Author.LastName,
-		},
+	pb := &librarypb.Book{
+		Name:            b.ISBN,
+		HyphenatedIsbn:  isbn.Hyphenate(b.ISBN),
+		Title:           b.Title,
+		CreateTime:      timestamppb.New(b.CreateTime),
+		UpdateTime:      timestamppb.New(b.UpdateTime),
+		Etag:            b.Etag(),
+		TotalCopies:     int32(b.TotalCopies),
+		AvailableCopies: int32(b.AvailableCopies),
 	}
+	if b.Publisher != "" {
+		pb.Publisher = "publishers/" + b.Publisher
+	}
+	for _, a := range b.Authors {
+		pb.Authors = append(pb.Authors, &librarypb.BookAuthor{
+			Author: "authors/" + a.AuthorID,
+			Role: librarypb.BookAuthor_Role(
+				librarypb.BookAuthor_Role_value["ROLE_"+strings.ToUpper(a.Role)]),
+		})
+	}
+	if b.IsDeleted() {
+		pb.DeleteTime = timestamppb.New(b.DeleteTime)
+		pb.ExpireTime = timestamppb.New(b.ExpireTime)
+	}
+	if b.RevisionID != "" {
+		pb.RevisionId = b.RevisionID
+		pb.RevisionCreateTime = timestamppb.New(b.RevisionCreateTime)
+	}
+	return pb
+}
+
+// IsDeleted reports whether the book has been deleted but not yet purged.
+func (b *Book) IsDeleted() bool {
+	return !b.DeleteTime.IsZero()
 }
@@ -0,0 +1,309 @@
+package library
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// checks if we have implementat all the different functions
+var _ librarypb.BranchServiceServer = new(libraryServiceServer)
+
+// Branch is a branch of the library, which owns copies of the books.
+type Branch struct {
+	ID          string    `json:"id"` // The id in 'branches/{id}', chosen on creation
+	DisplayName string    `json:"displayName"`
+	Address     string    `json:"address"` // May be empty
+	CreateTime  time.Time `json:"createTime"`
+	UpdateTime  time.Time `json:"updateTime"`
+}
+
+// The field paths of a Branch which can be validated and updated, besides
+// fieldDisplayName.
+const (
+	fieldAddress           = "address"
+	fieldBranchID          = "branch_id"
+	fieldDestinationBranch = "destination_branch"
+)
+
+// updatableBranchFields are the field paths which are allowed in the update
+// mask of a branch.
+var updatableBranchFields = []string{
+	fieldDisplayName,
+	fieldAddress,
+}
+
+// validateBranchFields validates the given field paths of the branch and
+// returns a violation for every invalid field.
+func validateBranchFields(b Branch,
+	paths []string) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	for _, path := range paths {
+		switch path {
+		case fieldDisplayName:
+			if strings.TrimSpace(b.DisplayName) == "" ||
+				utf8.RuneCountInString(b.DisplayName) > 100 {
+				violation(path, "must be 1 to 100 characters")
+			}
+		case fieldAddress:
+			if utf8.RuneCountInString(b.Address) > 200 {
+				violation(path, "must be at most 200 characters")
+			}
+		}
+	}
+	return violations
+}
+
+// branchUpdatePaths resolves the paths of the update mask of a branch. An
+// empty mask or the '*' path selects all updatable fields.
+func branchUpdatePaths(maskPaths []string) ([]string,
+	[]*errdetails.BadRequest_FieldViolation) {
+	if len(maskPaths) == 0 {
+		return updatableBranchFields, nil
+	}
+
+	var paths []string
+	for _, path := range maskPaths {
+		switch path {
+		case "*":
+			return updatableBranchFields, nil
+		case fieldDisplayName, fieldAddress:
+			paths = append(paths, path)
+		case fieldName, fieldCreateTime, fieldUpdateTime:
+			return nil, updateMaskViolation("field %q is immutable", path)
+		default:
+			return nil, updateMaskViolation("unknown field %q", path)
+		}
+	}
+	return paths, nil
+}
+
+// applyBranchUpdate copies the given field paths from update to the existing
+// branch.
+func applyBranchUpdate(existing, update Branch, paths []string) Branch {
+	for _, path := range paths {
+		switch path {
+		case fieldDisplayName:
+			existing.DisplayName = update.DisplayName
+		case fieldAddress:
+			existing.Address = update.Address
+		}
+	}
+	return existing
+}
+
+// NewBranchFromProto converts a *librarypb.Branch to a Branch.
+func NewBranchFromProto(b *librarypb.Branch) Branch {
+	return Branch{
+		ID:          branchFromName(b.GetName()),
+		DisplayName: b.GetDisplayName(),
+		Address:     b.GetAddress(),
+	}
+}
+
+// AsProto converts the Branch to a *librarypb.Branch.
+func (b *Branch) AsProto() *librarypb.Branch {
+	return &librarypb.Branch{
+		Name:        "branches/" + b.ID,
+		DisplayName: b.DisplayName,
+		Address:     b.Address,
+		CreateTime:  timestamppb.New(b.CreateTime),
+		UpdateTime:  timestamppb.New(b.UpdateTime),
+	}
+}
+
+// CreateBranch creates a branch with the id chosen by the client.
+func (s *libraryServiceServer) CreateBranch(ctx context.Context,
+	req *librarypb.CreateBranchRequest) (*librarypb.Branch, error) {
+
+	branch := NewBranchFromProto(req.GetBranch())
+	branch.ID = req.GetBranchId()
+	violations := inField("branch", validateBranchFields(branch, updatableBranchFields))
+	if !branchPattern.MatchString(branch.ID) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       fieldBranchID,
+			Description: "must be lowercase letters and digits separated by dashes",
+		})
+	}
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
+	}
+	branch.CreateTime = time.Now()
+	branch.UpdateTime = branch.CreateTime
+
+	if err := s.store.CreateBranch(ctx, branch); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return branch.AsProto(), nil
+}
+
+// GetBranch retreives a specific branch.
+func (s *libraryServiceServer) GetBranch(ctx context.Context,
+	req *librarypb.GetBranchRequest) (*librarypb.Branch, error) {
+
+	branch, err := s.store.GetBranch(ctx, branchFromName(req.GetName()))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return branch.AsProto(), nil
+}
+
+// ListBranches retreives a page of the branches ordered by their ids.
+func (s *libraryServiceServer) ListBranches(ctx context.Context,
+	req *librarypb.ListBranchesRequest) (*librarypb.ListBranchesResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	checksum := listChecksum("", "branches", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 1)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	branches, next, err := s.store.ListBranches(ctx, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListBranchesResponse{}
+	for _, branch := range branches {
+		resp.Branches = append(resp.Branches, branch.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// UpdateBranch updates a branch. Only the fields in the update mask are
+// written, or all the fields if the mask is empty.
+func (s *libraryServiceServer) UpdateBranch(ctx context.Context,
+	req *librarypb.UpdateBranchRequest) (*librarypb.Branch, error) {
+
+	paths, violations := branchUpdatePaths(req.GetUpdateMask().GetPaths())
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
+	}
+	update := NewBranchFromProto(req.GetBranch())
+	if violations := validateBranchFields(update, paths); violations != nil {
+		return nil, invalidFieldsError(inField("branch", violations))
+	}
+
+	var branch Branch
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if branch, err = tx.GetBranch(ctx, update.ID); err != nil {
+			return err
+		}
+		branch = applyBranchUpdate(branch, update, paths)
+		branch.UpdateTime = time.Now()
+		return tx.UpdateBranch(ctx, branch)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return branch.AsProto(), nil
+}
+
+// DeleteBranch deletes a branch which owns no copies, together with its
+// opening hours and closures.
+func (s *libraryServiceServer) DeleteBranch(ctx context.Context,
+	req *librarypb.DeleteBranchRequest) (*emptypb.Empty, error) {
+
+	if err := s.store.DeleteBranch(ctx, branchFromName(req.GetName())); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// TransferCopy sends an available copy to another branch. The copy is in
+// transit, and can not be lent or held, until it is received.
+func (s *libraryServiceServer) TransferCopy(ctx context.Context,
+	req *librarypb.TransferCopyRequest) (*librarypb.Copy, error) {
+
+	isbn, id := copyFromName(req.GetName())
+	destination := req.GetDestinationBranch()
+	if !branchPattern.MatchString(destination) {
+		return nil, invalidFieldsError([]*errdetails.BadRequest_FieldViolation{{
+			Field:       fieldDestinationBranch,
+			Description: "must be lowercase letters and digits separated by dashes",
+		}})
+	}
+
+	var c Copy
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if c, err = tx.GetCopy(ctx, isbn, id); err != nil {
+			return err
+		}
+		switch {
+		case c.Status != statusAvailable:
+			return status.Errorf(codes.FailedPrecondition,
+				"only an available copy can be transferred, the copy is %s", c.Status)
+		case c.Branch == destination:
+			return status.Errorf(codes.FailedPrecondition,
+				"the copy already belongs to the branch %q", destination)
+		}
+		if _, err := tx.GetBranch(ctx, destination); err != nil {
+			return err
+		}
+		c.Status = statusInTransit
+		c.TransferBranch = destination
+		c.UpdateTime = s.now()
+		return tx.UpdateCopy(ctx, c)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return c.AsProto(), nil
+}
+
+// ReceiveCopy receives a copy in transit at its destination branch, which
+// becomes the branch of the copy. A copy sent for a hold is held for it,
+// other copies are made available or held for the next waiting hold.
+func (s *libraryServiceServer) ReceiveCopy(ctx context.Context,
+	req *librarypb.ReceiveCopyRequest) (*librarypb.Copy, error) {
+
+	isbn, id := copyFromName(req.GetName())
+	now := s.now()
+	var c Copy
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if c, err = tx.GetCopy(ctx, isbn, id); err != nil {
+			return err
+		}
+		if c.Status != statusInTransit {
+			return status.Errorf(codes.FailedPrecondition,
+				"the copy is not in transit, the copy is %s", c.Status)
+		}
+		c.Branch = c.TransferBranch
+		c.TransferBranch = ""
+		c.Status = statusAvailable
+		if err := s.receiveForHold(ctx, tx, &c, now); err != nil {
+			return err
+		}
+		c.UpdateTime = now
+		return tx.UpdateCopy(ctx, c)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return c.AsProto(), nil
+}
@@ -0,0 +1,115 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newBranchServer creates a circulation server with a central and an east
+// branch, and one copy of the book owned by the central branch.
+func newBranchServer(t *testing.T) (*libraryServiceServer, *time.Time) {
+	ctx := context.Background()
+	s, clock := newCirculationServer(t)
+	require.NoError(t, s.store.CreateBranch(ctx, testBranch("central", "central")))
+	require.NoError(t, s.store.CreateBranch(ctx, testBranch("east", "east")))
+	c := testCopy(testCirculationISBN, "c1", "barcodec1", statusAvailable)
+	c.Branch = "central"
+	require.NoError(t, s.store.CreateCopy(ctx, c))
+	return s, clock
+}
+
+func TestTransferCopy(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newBranchServer(t)
+	transfer := func(destination string) (*librarypb.Copy, error) {
+		return s.TransferCopy(ctx, &librarypb.TransferCopyRequest{
+			Name: copyName("c1"), DestinationBranch: destination})
+	}
+	receive := func() (*librarypb.Copy, error) {
+		return s.ReceiveCopy(ctx, &librarypb.ReceiveCopyRequest{Name: copyName("c1")})
+	}
+	availableAt := func(branch string) int {
+		resp, err := s.ListBooks(ctx, &librarypb.ListBooksRequest{
+			AvailableAtBranch: branch})
+		require.NoError(t, err)
+		return len(resp.GetBook())
+	}
+	require.Equal(t, 1, availableAt("central"))
+
+	_, err := transfer("central")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = transfer("west")
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = receive()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// a copy in transit can not be lent or transferred again
+	c, err := transfer("east")
+	require.NoError(t, err)
+	require.Equal(t, librarypb.Copy_STATUS_IN_TRANSIT, c.GetStatus())
+	require.Equal(t, "central", c.GetBranch())
+	require.Equal(t, "east", c.GetTransferBranch())
+	require.Zero(t, availableAt("central"))
+	require.Zero(t, availableAt("east"))
+	_, err = checkout(s, "c1", testMemberID)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = transfer("central")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// once received it belongs to the destination
+	c, err = receive()
+	require.NoError(t, err)
+	require.Equal(t, librarypb.Copy_STATUS_AVAILABLE, c.GetStatus())
+	require.Equal(t, "east", c.GetBranch())
+	require.Empty(t, c.GetTransferBranch())
+	require.Equal(t, 1, availableAt("east"))
+	loan, err := checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+	require.Equal(t, "east", loan.GetBranch())
+}
+
+func TestTransferCopyForHold(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newBranchServer(t)
+	require.NoError(t, s.store.CreateMember(ctx, testMember("00000000000000b2",
+		"leia", "organa", "87654321")))
+	_, err := checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+	hold, err := s.PlaceHold(ctx, &librarypb.PlaceHoldRequest{
+		Parent: "books/" + testCirculationISBN,
+		Hold: &librarypb.Hold{Member: "members/00000000000000b2",
+			PickupBranch: "east"},
+	})
+	require.NoError(t, err)
+	getHold := func() *librarypb.Hold {
+		got, err := s.GetHold(ctx, &librarypb.GetHoldRequest{Name: hold.GetName()})
+		require.NoError(t, err)
+		return got
+	}
+
+	// a copy returned at another branch than the pickup branch is sent there
+	_, err = s.ReturnCopy(ctx, &librarypb.ReturnCopyRequest{Name: copyName("c1")})
+	require.NoError(t, err)
+	c, err := s.store.GetCopy(ctx, testCirculationISBN, "c1")
+	require.NoError(t, err)
+	require.Equal(t, statusInTransit, c.Status)
+	require.Equal(t, "east", c.TransferBranch)
+	require.Equal(t, librarypb.Hold_STATE_WAITING, getHold().GetState())
+	require.Equal(t, copyName("c1"), getHold().GetCopy())
+
+	// and held for the hold once received
+	*clock = clock.Add(48 * time.Hour)
+	received, err := s.ReceiveCopy(ctx, &librarypb.ReceiveCopyRequest{Name: copyName("c1")})
+	require.NoError(t, err)
+	require.Equal(t, librarypb.Copy_STATUS_ON_HOLD, received.GetStatus())
+	require.Equal(t, "east", received.GetBranch())
+	got := getHold()
+	require.Equal(t, librarypb.Hold_STATE_READY, got.GetState())
+	require.Equal(t, clock.Add(s.holdPickupPeriod), got.GetPickupExpireTime().AsTime())
+}
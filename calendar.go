@@ -0,0 +1,608 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// checks if we have implementat all the different functions
+var _ librarypb.CalendarServiceServer = new(libraryServiceServer)
+
+// OpeningHours are the weekly opening hours of a branch.
+type OpeningHours struct {
+	Branch  string          `json:"branch"`
+	Periods []OpeningPeriod `json:"periods"` // Ordered by day and open time
+}
+
+// OpeningPeriod is a period of a day of the week during which a branch is
+// open.
+type OpeningPeriod struct {
+	Day       int    `json:"day"`       // From 1 for Monday to 7 for Sunday
+	OpenTime  string `json:"openTime"`  // On the format HH:MM
+	CloseTime string `json:"closeTime"` // On the format HH:MM
+}
+
+// Closure is a day, or a range of days, on which a branch is closed.
+type Closure struct {
+	Branch     string    `json:"branch"`
+	ID         string    `json:"id"` // The random id in 'branches/{branch}/closures/{id}'
+	Kind       string    `json:"kind"`
+	StartDate  string    `json:"startDate"` // On the format YYYY-MM-DD
+	EndDate    string    `json:"endDate"`   // The last closed day, on the format YYYY-MM-DD
+	Reason     string    `json:"reason"`    // May be empty
+	CreateTime time.Time `json:"createTime"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// The kinds of a closure.
+const (
+	kindHoliday = "holiday"
+	kindClosure = "closure"
+)
+
+// The field paths of the opening hours and the closures which can be
+// validated and updated.
+const (
+	fieldBranch    = "branch"
+	fieldPeriods   = "periods"
+	fieldKind      = "kind"
+	fieldStartDate = "start_date"
+	fieldEndDate   = "end_date"
+	fieldReason    = "reason"
+)
+
+// updatableClosureFields are the field paths which are allowed in the update
+// mask of a closure.
+var updatableClosureFields = []string{
+	fieldKind,
+	fieldStartDate,
+	fieldEndDate,
+	fieldReason,
+}
+
+// clockLayout is the layout of the opening and closing times on the format
+// HH:MM.
+const clockLayout = "15:04"
+
+// maxClosedDays is the number of days searched for an open day when moving a
+// due date. A branch which is closed for longer is treated as open.
+const maxClosedDays = 366
+
+// isoWeekday returns the day of the week of t from 1 for Monday to 7 for
+// Sunday.
+func isoWeekday(t time.Time) int {
+	return (int(t.Weekday())+6)%7 + 1
+}
+
+// validateOpeningHours validates the periods of the opening hours and returns
+// a violation for every invalid field.
+func validateOpeningHours(h OpeningHours) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	for i, p := range h.Periods {
+		field := fmt.Sprintf("%s[%d].", fieldPeriods, i)
+		if p.Day < 1 || p.Day > 7 {
+			violation(field+"day", "must be a day of the week")
+		}
+		opens, openErr := time.Parse(clockLayout, p.OpenTime)
+		if openErr != nil {
+			violation(field+"open_time", "must be a time in the format 'HH:MM'")
+		}
+		closes, err := time.Parse(clockLayout, p.CloseTime)
+		switch {
+		case err != nil:
+			violation(field+"close_time", "must be a time in the format 'HH:MM'")
+		case openErr == nil && !closes.After(opens):
+			violation(field+"close_time", "must be after the open_time")
+		}
+	}
+	if violations != nil {
+		return violations
+	}
+
+	// the periods are only compared once they are valid
+	periods := append([]OpeningPeriod(nil), h.Periods...)
+	sort.Slice(periods, func(i, j int) bool {
+		if periods[i].Day != periods[j].Day {
+			return periods[i].Day < periods[j].Day
+		}
+		return periods[i].OpenTime < periods[j].OpenTime
+	})
+	for i := 1; i < len(periods); i++ {
+		if periods[i].Day == periods[i-1].Day && periods[i].OpenTime < periods[i-1].CloseTime {
+			violation(fieldPeriods, "must not overlap on the same day")
+			break
+		}
+	}
+	return violations
+}
+
+// validateClosure validates the fields of the closure and returns a violation
+// for every invalid field.
+func validateClosure(c Closure) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	if c.Kind != kindHoliday && c.Kind != kindClosure {
+		violation(fieldKind, "must be a kind of closure")
+	}
+	_, startErr := time.Parse(dateLayout, c.StartDate)
+	if startErr != nil {
+		violation(fieldStartDate, "must be a date in the format 'YYYY-MM-DD'")
+	}
+	_, err := time.Parse(dateLayout, c.EndDate)
+	switch {
+	case err != nil:
+		violation(fieldEndDate, "must be a date in the format 'YYYY-MM-DD'")
+	case startErr == nil && c.EndDate < c.StartDate:
+		violation(fieldEndDate, "must not be before the start_date")
+	}
+	if len(c.Reason) > 200 {
+		violation(fieldReason, "must be at most 200 characters")
+	}
+	return violations
+}
+
+// closureUpdatePaths resolves the paths of the update mask of a closure. An
+// empty mask or the '*' path selects all updatable fields.
+func closureUpdatePaths(maskPaths []string) ([]string,
+	[]*errdetails.BadRequest_FieldViolation) {
+	if len(maskPaths) == 0 {
+		return updatableClosureFields, nil
+	}
+
+	var paths []string
+	for _, path := range maskPaths {
+		switch path {
+		case "*":
+			return updatableClosureFields, nil
+		case fieldKind, fieldStartDate, fieldEndDate, fieldReason:
+			paths = append(paths, path)
+		case fieldName, fieldCreateTime, fieldUpdateTime:
+			return nil, updateMaskViolation("field %q is immutable", path)
+		default:
+			return nil, updateMaskViolation("unknown field %q", path)
+		}
+	}
+	return paths, nil
+}
+
+// applyClosureUpdate copies the given field paths from update to the existing
+// closure.
+func applyClosureUpdate(existing, update Closure, paths []string) Closure {
+	for _, path := range paths {
+		switch path {
+		case fieldKind:
+			existing.Kind = update.Kind
+		case fieldStartDate:
+			existing.StartDate = update.StartDate
+		case fieldEndDate:
+			existing.EndDate = update.EndDate
+		case fieldReason:
+			existing.Reason = update.Reason
+		}
+	}
+	return existing
+}
+
+// branchFromName returns the id of a branch name on the format
+// 'branches/{branch}', or of the name of a resource of the branch such as
+// 'branches/{branch}/openingHours'.
+func branchFromName(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 || parts[0] != "branches" {
+		return ""
+	}
+	return parts[1]
+}
+
+// closureFromName returns the branch and the id of a closure name on the
+// format 'branches/{branch}/closures/{id}'. Both are empty if the name is
+// malformed.
+func closureFromName(name string) (string, string) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "branches" || parts[2] != "closures" {
+		return "", ""
+	}
+	return parts[1], parts[3]
+}
+
+// checkBranch returns an InvalidArgument status if the branch is not a valid
+// branch id.
+func checkBranch(branch string) error {
+	if !branchPattern.MatchString(branch) {
+		return status.Errorf(codes.InvalidArgument,
+			"the branch must be lowercase letters and digits separated by dashes")
+	}
+	return nil
+}
+
+// NewOpeningHoursFromProto converts a *librarypb.OpeningHours to
+// OpeningHours. Periods with an unspecified day get day 0.
+func NewOpeningHoursFromProto(h *librarypb.OpeningHours) OpeningHours {
+	hours := OpeningHours{Branch: branchFromName(h.GetName())}
+	for _, p := range h.GetPeriods() {
+		hours.Periods = append(hours.Periods, OpeningPeriod{
+			Day:       int(p.GetDay()),
+			OpenTime:  p.GetOpenTime(),
+			CloseTime: p.GetCloseTime(),
+		})
+	}
+	return hours
+}
+
+// AsProto converts the OpeningHours to a *librarypb.OpeningHours.
+func (h *OpeningHours) AsProto() *librarypb.OpeningHours {
+	hours := &librarypb.OpeningHours{
+		Name: "branches/" + h.Branch + "/openingHours",
+	}
+	for _, p := range h.Periods {
+		hours.Periods = append(hours.Periods, &librarypb.OpeningPeriod{
+			Day:       librarypb.DayOfWeek(p.Day),
+			OpenTime:  p.OpenTime,
+			CloseTime: p.CloseTime,
+		})
+	}
+	return hours
+}
+
+// NewClosureFromProto converts a *librarypb.Closure to a Closure. An
+// unspecified kind is left empty.
+func NewClosureFromProto(c *librarypb.Closure) Closure {
+	branch, id := closureFromName(c.GetName())
+	closure := Closure{
+		Branch:    branch,
+		ID:        id,
+		StartDate: c.GetStartDate(),
+		EndDate:   c.GetEndDate(),
+		Reason:    c.GetReason(),
+	}
+	if c.GetKind() != librarypb.Closure_KIND_UNSPECIFIED {
+		closure.Kind = strings.ToLower(strings.TrimPrefix(c.GetKind().String(), "KIND_"))
+	}
+	return closure
+}
+
+// AsProto converts the Closure to a *librarypb.Closure.
+func (c *Closure) AsProto() *librarypb.Closure {
+	return &librarypb.Closure{
+		Name: "branches/" + c.Branch + "/closures/" + c.ID,
+		Kind: librarypb.Closure_Kind(
+			librarypb.Closure_Kind_value["KIND_"+strings.ToUpper(c.Kind)]),
+		StartDate:  c.StartDate,
+		EndDate:    c.EndDate,
+		Reason:     c.Reason,
+		CreateTime: timestamppb.New(c.CreateTime),
+		UpdateTime: timestamppb.New(c.UpdateTime),
+	}
+}
+
+// calendar tells on which days a branch is open.
+type calendar struct {
+	hours    OpeningHours
+	closures []Closure
+}
+
+// loadCalendar reads the opening hours of the branch and its closures from
+// the from day to the to day. Without a branch the calendar is always open.
+func loadCalendar(ctx context.Context, tx CalendarStore, branch string,
+	from, to time.Time) (calendar, error) {
+	if branch == "" {
+		return calendar{}, nil
+	}
+	hours, err := tx.GetOpeningHours(ctx, branch)
+	if err != nil {
+		return calendar{}, err
+	}
+	closures, err := tx.ListClosuresBetween(ctx, branch, from.Format(dateLayout),
+		to.Format(dateLayout))
+	if err != nil {
+		return calendar{}, err
+	}
+	return calendar{hours: hours, closures: closures}, nil
+}
+
+// isOpen reports whether the branch is open on the day. A branch without
+// opening hours is open on every day it is not closed.
+func (c calendar) isOpen(day time.Time) bool {
+	if len(c.hours.Periods) > 0 {
+		weekday := isoWeekday(day)
+		open := false
+		for _, p := range c.hours.Periods {
+			if p.Day == weekday {
+				open = true
+				break
+			}
+		}
+		if !open {
+			return false
+		}
+	}
+	date := day.Format(dateLayout)
+	for _, closure := range c.closures {
+		if closure.StartDate <= date && date <= closure.EndDate {
+			return false
+		}
+	}
+	return true
+}
+
+// lateDays returns the number of days the branch was open after the due date
+// until the copy of a loan was returned.
+func (c calendar) lateDays(due, returned time.Time) int {
+	days := 0
+	for day := due.AddDate(0, 0, 1); !day.After(returned); day = day.AddDate(0, 0, 1) {
+		if c.isOpen(day) {
+			days++
+		}
+	}
+	return days
+}
+
+// dueDate returns the first day the branch is open on or after the day the
+// given number of days after from.
+func dueDate(ctx context.Context, tx CalendarStore, branch string, from time.Time,
+	days int) (string, error) {
+	due := from.AddDate(0, 0, days)
+	last := due.AddDate(0, 0, maxClosedDays)
+	cal, err := loadCalendar(ctx, tx, branch, due, last)
+	if err != nil {
+		return "", err
+	}
+	for day := due; day.Before(last); day = day.AddDate(0, 0, 1) {
+		if cal.isOpen(day) {
+			return day.Format(dateLayout), nil
+		}
+	}
+	return due.Format(dateLayout), nil
+}
+
+// GetOpeningHours retreives the weekly opening hours of a branch.
+func (s *libraryServiceServer) GetOpeningHours(ctx context.Context,
+	req *librarypb.GetOpeningHoursRequest) (*librarypb.OpeningHours, error) {
+
+	hours, err := s.store.GetOpeningHours(ctx, branchFromName(req.GetName()))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return hours.AsProto(), nil
+}
+
+// UpdateOpeningHours replaces the weekly opening hours of a branch. The due
+// dates of the loans which have already been checked out are not moved.
+func (s *libraryServiceServer) UpdateOpeningHours(ctx context.Context,
+	req *librarypb.UpdateOpeningHoursRequest) (*librarypb.OpeningHours, error) {
+
+	hours := NewOpeningHoursFromProto(req.GetOpeningHours())
+	if err := checkBranch(hours.Branch); err != nil {
+		return nil, err
+	}
+	if violations := validateOpeningHours(hours); violations != nil {
+		return nil, invalidFieldsError(inField("opening_hours", violations))
+	}
+
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		if err := tx.SetOpeningHours(ctx, hours); err != nil {
+			return err
+		}
+		var err error
+		hours, err = tx.GetOpeningHours(ctx, hours.Branch)
+		return err
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return hours.AsProto(), nil
+}
+
+// CreateClosure creates a closure of a branch with a new random id.
+func (s *libraryServiceServer) CreateClosure(ctx context.Context,
+	req *librarypb.CreateClosureRequest) (*librarypb.Closure, error) {
+
+	closure := NewClosureFromProto(req.GetClosure())
+	closure.Branch = branchFromName(req.GetParent())
+	if err := checkBranch(closure.Branch); err != nil {
+		return nil, err
+	}
+	if violations := validateClosure(closure); violations != nil {
+		return nil, invalidFieldsError(inField("closure", violations))
+	}
+
+	id, err := newResourceID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create closure id")
+	}
+	closure.ID = id
+	closure.CreateTime = time.Now()
+	closure.UpdateTime = closure.CreateTime
+
+	if err := s.store.CreateClosure(ctx, closure); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return closure.AsProto(), nil
+}
+
+// GetClosure retreives a specific closure of a branch.
+func (s *libraryServiceServer) GetClosure(ctx context.Context,
+	req *librarypb.GetClosureRequest) (*librarypb.Closure, error) {
+
+	branch, id := closureFromName(req.GetName())
+	closure, err := s.store.GetClosure(ctx, branch, id)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return closure.AsProto(), nil
+}
+
+// ListClosures retreives a page of the closures of a branch ordered by their
+// start dates.
+func (s *libraryServiceServer) ListClosures(ctx context.Context,
+	req *librarypb.ListClosuresRequest) (*librarypb.ListClosuresResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	branch := branchFromName(req.GetParent())
+	checksum := listChecksum(branch, "closures", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 2)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	closures, next, err := s.store.ListClosures(ctx, branch, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListClosuresResponse{}
+	for _, closure := range closures {
+		resp.Closures = append(resp.Closures, closure.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// UpdateClosure updates a closure. Only the fields in the update mask are
+// written, or all the fields if the mask is empty.
+func (s *libraryServiceServer) UpdateClosure(ctx context.Context,
+	req *librarypb.UpdateClosureRequest) (*librarypb.Closure, error) {
+
+	paths, violations := closureUpdatePaths(req.GetUpdateMask().GetPaths())
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
+	}
+	update := NewClosureFromProto(req.GetClosure())
+
+	var closure Closure
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if closure, err = tx.GetClosure(ctx, update.Branch, update.ID); err != nil {
+			return err
+		}
+		closure = applyClosureUpdate(closure, update, paths)
+		// the dates are validated together once the update is applied
+		if violations := validateClosure(closure); violations != nil {
+			return invalidFieldsError(inField("closure", violations))
+		}
+		closure.UpdateTime = time.Now()
+		return tx.UpdateClosure(ctx, closure)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return closure.AsProto(), nil
+}
+
+// DeleteClosure deletes a closure. The due dates of the loans which have
+// already been checked out are not moved.
+func (s *libraryServiceServer) DeleteClosure(ctx context.Context,
+	req *librarypb.DeleteClosureRequest) (*emptypb.Empty, error) {
+
+	branch, id := closureFromName(req.GetName())
+	if err := s.store.DeleteClosure(ctx, branch, id); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// ExportClosures exports the closures of a branch which have not ended yet as
+// an iCalendar file with an all-day event per closure.
+func (s *libraryServiceServer) ExportClosures(ctx context.Context,
+	req *librarypb.ExportClosuresRequest) (*httpbody.HttpBody, error) {
+
+	branch := branchFromName(req.GetParent())
+	now := s.now()
+	closures, err := s.store.ListClosuresBetween(ctx, branch, now.Format(dateLayout),
+		"9999-12-31")
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	var events []icsEvent
+	for _, closure := range closures {
+		summary := "Closed"
+		if closure.Reason != "" {
+			summary += ": " + closure.Reason
+		}
+		events = append(events, icsEvent{
+			UID:       "branches/" + closure.Branch + "/closures/" + closure.ID,
+			Summary:   summary,
+			StartDate: closure.StartDate,
+			EndDate:   closure.EndDate,
+		})
+	}
+	return &httpbody.HttpBody{
+		ContentType: icsContentType,
+		Data:        encodeICS(events, now),
+	}, nil
+}
+
+// ExportDueDates exports the due dates of the copies a member has on loan as
+// an iCalendar file with an all-day event per loan.
+func (s *libraryServiceServer) ExportDueDates(ctx context.Context,
+	req *librarypb.ExportDueDatesRequest) (*httpbody.HttpBody, error) {
+
+	memberID := memberIDFromName(req.GetMember())
+	var events []icsEvent
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		if _, err := tx.GetMember(ctx, memberID); err != nil {
+			return err
+		}
+		var after []string
+		for {
+			loans, next, err := tx.ListLoans(ctx, memberID, false, maxPageSize, after)
+			if err != nil {
+				return err
+			}
+			for _, loan := range loans {
+				title := "books/" + loan.ISBN
+				if book, err := tx.FindSpecificBook(ctx, loan.ISBN); err == nil {
+					title = book.Title
+				}
+				events = append(events, icsEvent{
+					UID:         "loans/" + loan.ID,
+					Summary:     "Return " + title,
+					Description: "books/" + loan.ISBN + "/copies/" + loan.CopyID,
+					StartDate:   loan.DueDate,
+					EndDate:     loan.DueDate,
+				})
+			}
+			if next == nil {
+				return nil
+			}
+			after = next
+		}
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &httpbody.HttpBody{
+		ContentType: icsContentType,
+		Data:        encodeICS(events, s.now()),
+	}, nil
+}
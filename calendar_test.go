@@ -0,0 +1,114 @@
+package library
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+)
+
+// newCalendarServer creates a circulation server with a central branch open
+// on weekdays and closed from Wednesday the 22nd to Friday the 24th of
+// September 2021, owning one copy of the book.
+func newCalendarServer(t *testing.T) (*libraryServiceServer, *time.Time) {
+	ctx := context.Background()
+	s, clock := newCirculationServer(t)
+	require.NoError(t, s.store.CreateBranch(ctx, testBranch("central", "central")))
+	hours := OpeningHours{Branch: "central"}
+	for day := 1; day <= 5; day++ {
+		hours.Periods = append(hours.Periods,
+			OpeningPeriod{Day: day, OpenTime: "09:00", CloseTime: "17:00"})
+	}
+	require.NoError(t, s.store.SetOpeningHours(ctx, hours))
+	closure := testClosure("central", "00000000000000f1", "2021-09-22", "2021-09-24")
+	closure.Reason = "inventory, and painting"
+	require.NoError(t, s.store.CreateClosure(ctx, closure))
+	c := testCopy(testCirculationISBN, "c1", "barcodec1", statusAvailable)
+	c.Branch = "central"
+	require.NoError(t, s.store.CreateCopy(ctx, c))
+	return s, clock
+}
+
+func TestDueDateSkipsClosedDays(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newCalendarServer(t)
+
+	// 21 days after Wednesday the 1st the branch is closed until the weekend
+	// has passed
+	loan, err := checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+	require.Equal(t, "central", loan.GetBranch())
+	require.Equal(t, "2021-09-27", loan.GetDueDate())
+
+	// only the days the branch was open after the due date are fined
+	*clock = time.Date(2021, 10, 4, 12, 0, 0, 0, time.UTC)
+	_, err = s.ReturnCopy(ctx, &librarypb.ReturnCopyRequest{Name: copyName("c1")})
+	require.NoError(t, err)
+	resp, err := s.ListLedgerEntries(ctx, &librarypb.ListLedgerEntriesRequest{
+		Parent: "members/" + testMemberID})
+	require.NoError(t, err)
+	require.Len(t, resp.GetLedgerEntries(), 1)
+	require.Equal(t, 5*DefaultFinePolicy.DailyRateCents,
+		resp.GetLedgerEntries()[0].GetAmountCents())
+}
+
+func TestExportDueDates(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newCalendarServer(t)
+	loan, err := checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+
+	body, err := s.ExportDueDates(ctx, &librarypb.ExportDueDatesRequest{
+		Member: "members/" + testMemberID})
+	require.NoError(t, err)
+	require.Equal(t, icsContentType, body.GetContentType())
+	require.Equal(t, []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//NicolaiMordrup//library//EN",
+		"CALSCALE:GREGORIAN",
+		"BEGIN:VEVENT",
+		"UID:" + loan.GetName() + "@library",
+		"DTSTAMP:20210901T120000Z",
+		"DTSTART;VALUE=DATE:20210927",
+		"DTEND;VALUE=DATE:20210928",
+		"SUMMARY:Return star wars",
+		"DESCRIPTION:" + copyName("c1"),
+		"TRANSP:TRANSPARENT",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, strings.Split(string(body.GetData()), "\r\n"))
+
+	// returned loans are not exported
+	_, err = s.ReturnCopy(ctx, &librarypb.ReturnCopyRequest{Name: copyName("c1")})
+	require.NoError(t, err)
+	body, err = s.ExportDueDates(ctx, &librarypb.ExportDueDatesRequest{
+		Member: "members/" + testMemberID})
+	require.NoError(t, err)
+	require.NotContains(t, string(body.GetData()), "BEGIN:VEVENT")
+}
+
+func TestExportClosures(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newCalendarServer(t)
+	export := func() string {
+		body, err := s.ExportClosures(ctx, &librarypb.ExportClosuresRequest{
+			Parent: "branches/central"})
+		require.NoError(t, err)
+		require.Equal(t, icsContentType, body.GetContentType())
+		return string(body.GetData())
+	}
+
+	got := export()
+	require.Contains(t, got, "\r\nDTSTART;VALUE=DATE:20210922\r\n")
+	require.Contains(t, got, "\r\nDTEND;VALUE=DATE:20210925\r\n")
+	require.Contains(t, got, "\r\nSUMMARY:Closed: inventory\\, and painting\r\n")
+
+	// a closure which has ended is not exported
+	*clock = time.Date(2021, 9, 25, 12, 0, 0, 0, time.UTC)
+	require.NotContains(t, export(), "BEGIN:VEVENT")
+}
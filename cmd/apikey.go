@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	library "github.com/NicolaiMordrup/library"
+)
+
+// apiKeyUsage describes the apikey command.
+const apiKeyUsage = `usage:
+  library apikey create <display name>  creates a key and prints it once
+  library apikey list                   lists the keys
+  library apikey delete <id>            deletes a key`
+
+// runAPIKeyCommand creates, lists or deletes the API keys in the store.
+func runAPIKeyCommand(ctx context.Context, store library.APIKeyStore,
+	args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand\n%s", apiKeyUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		key, apiKey, err := library.NewAPIKey(strings.Join(args[1:], " "), time.Now())
+		if err != nil {
+			return err
+		}
+		if err := store.CreateAPIKey(ctx, apiKey); err != nil {
+			return err
+		}
+		fmt.Printf("created API key %s, send it as 'Authorization: Bearer %s'\n",
+			apiKey.ID, key)
+	case "list":
+		keys, err := store.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			fmt.Printf("%s\t%s\t%s\n", k.ID,
+				k.CreateTime.Format(time.RFC3339), k.DisplayName)
+		}
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("delete takes the id of the key\n%s", apiKeyUsage)
+		}
+		return store.DeleteAPIKey(ctx, args[1])
+	default:
+		return fmt.Errorf("unknown subcommand %q\n%s", args[0], apiKeyUsage)
+	}
+	return nil
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	library "github.com/NicolaiMordrup/library"
@@ -33,6 +35,58 @@ func main() {
 	}
 	minDurationBetweenUpdates, err := time.ParseDuration(minDurationBetweenUpdatesStr)
 	check(err, "failed to parse min duration between updates")
+	deletedBookRetentionStr := "720h"
+	if envVal := os.Getenv("DELETED_BOOK_RETENTION"); envVal != "" {
+		deletedBookRetentionStr = envVal
+	}
+	deletedBookRetention, err := time.ParseDuration(deletedBookRetentionStr)
+	check(err, "failed to parse deleted book retention")
+	purgeIntervalStr := "1h"
+	if envVal := os.Getenv("PURGE_INTERVAL"); envVal != "" {
+		purgeIntervalStr = envVal
+	}
+	purgeInterval, err := time.ParseDuration(purgeIntervalStr)
+	check(err, "failed to parse purge interval")
+	holdPickupPeriodStr := "168h"
+	if envVal := os.Getenv("HOLD_PICKUP_PERIOD"); envVal != "" {
+		holdPickupPeriodStr = envVal
+	}
+	holdPickupPeriod, err := time.ParseDuration(holdPickupPeriodStr)
+	check(err, "failed to parse hold pickup period")
+	holdExpiryIntervalStr := "5m"
+	if envVal := os.Getenv("HOLD_EXPIRY_INTERVAL"); envVal != "" {
+		holdExpiryIntervalStr = envVal
+	}
+	holdExpiryInterval, err := time.ParseDuration(holdExpiryIntervalStr)
+	check(err, "failed to parse hold expiry interval")
+	fines := library.DefaultFinePolicy
+	if envVal := os.Getenv("FINE_CURRENCY"); envVal != "" {
+		fines.CurrencyCode = envVal
+	}
+	fines.DailyRateCents = envCents("FINE_DAILY_RATE_CENTS", fines.DailyRateCents)
+	fines.MaxFineCents = envCents("FINE_MAX_CENTS", fines.MaxFineCents)
+	fines.ReplacementCents = envCents("LOST_ITEM_CHARGE_CENTS", fines.ReplacementCents)
+	fines.BlockThresholdCents = envCents("FINE_BLOCK_THRESHOLD_CENTS",
+		fines.BlockThresholdCents)
+	authDisabled := os.Getenv("AUTH_DISABLED") == "true"
+	jwtConfig := library.JWTConfig{
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+	}
+	if envVal := os.Getenv("JWT_HS256_SECRET"); envVal != "" {
+		jwtConfig.HS256Secrets = [][]byte{[]byte(envVal)}
+	}
+	if envVal := os.Getenv("JWT_RS256_PUBLIC_KEY_FILE"); envVal != "" {
+		data, err := os.ReadFile(envVal)
+		check(err, "failed to read JWT public key file")
+		public, err := library.ParseRSAPublicKeyPEM(data)
+		check(err, "failed to parse JWT public key file")
+		jwtConfig.RS256PublicKeys = []*rsa.PublicKey{public}
+	}
+	if envVal := os.Getenv("JWT_JWKS_FILE"); envVal != "" {
+		jwtConfig.JWKS, err = os.ReadFile(envVal)
+		check(err, "failed to read JWKS file")
+	}
 
 	// Setup logger
 	structuredLogger, _ := zap.NewProduction()
@@ -42,6 +96,20 @@ func main() {
 	db, err := library.NewDB(connstr)
 	check(err, "failed to open sqlite connection")
 	check(library.EnsureSchema(db), "migration failed")
+	store := library.NewDBStorage(db, log)
+
+	// The apikey and role commands manage the API keys and the role bindings
+	// instead of running the servers
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		check(runAPIKeyCommand(context.Background(), store, os.Args[2:]),
+			"apikey command failed")
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "role" {
+		check(runRoleCommand(context.Background(), store, os.Args[2:]),
+			"role command failed")
+		return
+	}
 
 	// Creating  errgroup such that we can use go routines to start the
 	// grpc server and grpc gateway
@@ -49,14 +117,42 @@ func main() {
 	grpcAddr := ":8001"
 	addr := fmt.Sprintf(":%v", portStr)
 
+	myServer := library.NewServer(store,
+		log, minDurationBetweenUpdates, deletedBookRetention, holdPickupPeriod,
+		fines)
+
+	// Every call must be authenticated and authorized by the role of its
+	// principal unless the authentication is disabled
+	var serverOptions []grpc.ServerOption
+	if authDisabled {
+		log.Warn("authentication is disabled, anyone can call the services")
+	} else {
+		authenticator, err := library.NewAuthenticator(store, log, jwtConfig)
+		check(err, "failed to configure authentication")
+		authorizer := library.NewAuthorizer(store, log)
+		serverOptions = append(serverOptions,
+			grpc.ChainUnaryInterceptor(
+				authenticator.UnaryInterceptor, authorizer.UnaryInterceptor),
+			grpc.ChainStreamInterceptor(
+				authenticator.StreamInterceptor, authorizer.StreamInterceptor))
+	}
+
 	// Initialize and starting the grpc Server
 	g.Go(func() error {
-
-		myServer := library.NewServer(db, log, minDurationBetweenUpdates)
 		log.Infow("starting grpc server",
 			"addr", addr,
 		)
-		return myServer.RunGRPCServer(addr)
+		return myServer.RunGRPCServer(addr, serverOptions...)
+	})
+
+	// Purges the deleted books once their retention has passed
+	g.Go(func() error {
+		return myServer.RunPurger(ctx, purgeInterval)
+	})
+
+	// Expires the holds whose copies have not been picked up in time
+	g.Go(func() error {
+		return myServer.RunHoldExpirer(ctx, holdExpiryInterval)
 	})
 
 	// Initialize and starting the grpc gateway
@@ -69,6 +165,13 @@ func main() {
 					}
 				}
 				setErr(librarypb.RegisterLibraryServiceHandler(ctx, gwMux, conn))
+				setErr(librarypb.RegisterMemberServiceHandler(ctx, gwMux, conn))
+				setErr(librarypb.RegisterCirculationServiceHandler(ctx, gwMux, conn))
+				setErr(librarypb.RegisterFinesServiceHandler(ctx, gwMux, conn))
+				setErr(librarypb.RegisterCalendarServiceHandler(ctx, gwMux, conn))
+				setErr(librarypb.RegisterBranchServiceHandler(ctx, gwMux, conn))
+				setErr(librarypb.RegisterAccessServiceHandler(ctx, gwMux, conn))
+				setErr(librarypb.RegisterAuditServiceHandler(ctx, gwMux, conn))
 				return retErr
 			},
 		)
@@ -80,6 +183,18 @@ func main() {
 	}
 }
 
+// envCents reads an amount in the minor unit of a currency from the
+// environment variable, or returns def if the variable is not set.
+func envCents(name string, def int64) int64 {
+	envVal := os.Getenv(name)
+	if envVal == "" {
+		return def
+	}
+	cents, err := strconv.ParseInt(envVal, 10, 64)
+	check(err, "failed to parse "+name)
+	return cents
+}
+
 // checks if we have any error. If so then we
 func check(err error, msg string) {
 	structuredLogger, _ := zap.NewProduction()
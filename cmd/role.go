@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	library "github.com/NicolaiMordrup/library"
+)
+
+// roleUsage describes the role command.
+const roleUsage = `usage:
+  library role set <principal> <patron|librarian|admin>  binds a role to a principal
+  library role list                                      lists the role bindings
+  library role delete <principal>                        removes the role of a principal`
+
+// runRoleCommand sets, lists or deletes the role bindings in the store, e.g.
+// to bind the first admin.
+func runRoleCommand(ctx context.Context, store library.RoleBindingStore,
+	args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand\n%s", roleUsage)
+	}
+
+	switch args[0] {
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("set takes the principal and the role\n%s", roleUsage)
+		}
+		binding, err := library.NewRoleBinding(args[1], args[2], time.Now())
+		if err != nil {
+			return err
+		}
+		return store.SetRoleBinding(ctx, binding)
+	case "list":
+		var after []string
+		for {
+			bindings, next, err := store.ListRoleBindings(ctx, 100, after)
+			if err != nil {
+				return err
+			}
+			for _, b := range bindings {
+				fmt.Printf("%s\t%s\n", b.Principal, b.Role)
+			}
+			if next == nil {
+				return nil
+			}
+			after = next
+		}
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("delete takes the principal\n%s", roleUsage)
+		}
+		return store.DeleteRoleBinding(ctx, args[1])
+	}
+	return fmt.Errorf("unknown subcommand %q\n%s", args[0], roleUsage)
+}
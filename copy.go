@@ -0,0 +1,405 @@
+package library
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Copy is a physical copy of a book.
+type Copy struct {
+	ISBN            string    `json:"isbn"` // The book of the copy
+	ID              string    `json:"id"`   // The random id in 'books/{isbn}/copies/{id}'
+	Barcode         string    `json:"barcode"`
+	AcquisitionDate string    `json:"acquisitionDate"` // On the format YYYY-MM-DD, may be empty
+	PriceCents      int64     `json:"priceCents"`
+	CurrencyCode    string    `json:"currencyCode"`
+	Condition       string    `json:"condition"` // May be empty
+	ShelfLocation   string    `json:"shelfLocation"`
+	Status          string    `json:"status"`
+	Branch          string    `json:"branch"`         // The owning branch, may be empty
+	TransferBranch  string    `json:"transferBranch"` // The destination while in transit
+	CreateTime      time.Time `json:"createTime"`
+	UpdateTime      time.Time `json:"updateTime"`
+}
+
+// The conditions of a copy.
+const (
+	conditionNew  = "new"
+	conditionGood = "good"
+	conditionFair = "fair"
+	conditionPoor = "poor"
+)
+
+// validConditions are the conditions which can be stored. A copy may also
+// have no condition.
+var validConditions = map[string]bool{
+	conditionNew:  true,
+	conditionGood: true,
+	conditionFair: true,
+	conditionPoor: true,
+}
+
+// The statuses of a copy.
+const (
+	statusAvailable = "available"
+	statusOnLoan    = "on_loan"
+	statusLost      = "lost"
+	statusInRepair  = "in_repair"
+	statusWithdrawn = "withdrawn"
+	statusOnHold    = "on_hold"
+	statusInTransit = "in_transit"
+)
+
+// validStatuses are the statuses which can be stored.
+var validStatuses = map[string]bool{
+	statusAvailable: true,
+	statusOnLoan:    true,
+	statusLost:      true,
+	statusInRepair:  true,
+	statusWithdrawn: true,
+	statusOnHold:    true,
+	statusInTransit: true,
+}
+
+// circulationStatuses are the statuses which are only set by lending and
+// returning the copies, by holding them for the members and by transferring
+// them between the branches.
+var circulationStatuses = map[string]bool{
+	statusOnLoan:    true,
+	statusOnHold:    true,
+	statusInTransit: true,
+}
+
+// The field paths of a Copy which can be validated and updated.
+const (
+	fieldBarcode         = "barcode"
+	fieldAcquisitionDate = "acquisition_date"
+	fieldPriceCents      = "price_cents"
+	fieldCurrencyCode    = "currency_code"
+	fieldCondition       = "condition"
+	fieldShelfLocation   = "shelf_location"
+	fieldStatus          = "status"
+)
+
+// updatableCopyFields are the field paths which are allowed in the update mask
+// of a copy.
+var updatableCopyFields = []string{
+	fieldBarcode,
+	fieldAcquisitionDate,
+	fieldPriceCents,
+	fieldCurrencyCode,
+	fieldCondition,
+	fieldShelfLocation,
+	fieldStatus,
+}
+
+// The regex patterns for validating a copy.
+var (
+	barcodePattern  = regexp.MustCompile(`^[0-9A-Za-z]+(?:-[0-9A-Za-z]+)*$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// validateCopy validates all the fields of the copy and returns a violation
+// for every invalid field.
+func validateCopy(c Copy) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	if !barcodePattern.MatchString(c.Barcode) {
+		violation(fieldBarcode, "must be letters and digits separated by dashes")
+	}
+	if c.AcquisitionDate != "" {
+		if _, err := time.Parse(dateLayout, c.AcquisitionDate); err != nil {
+			violation(fieldAcquisitionDate, "must be a date in the format 'YYYY-MM-DD'")
+		}
+	}
+	if c.PriceCents < 0 {
+		violation(fieldPriceCents, "must not be negative")
+	}
+	if (c.CurrencyCode != "" || c.PriceCents != 0) &&
+		!currencyPattern.MatchString(c.CurrencyCode) {
+		violation(fieldCurrencyCode, "must be an ISO 4217 currency code such as"+
+			" 'DKK' when the copy has a price")
+	}
+	if c.Condition != "" && !validConditions[c.Condition] {
+		violation(fieldCondition, "must be a condition")
+	}
+	if !validStatuses[c.Status] {
+		violation(fieldStatus, "must be a status")
+	}
+	if c.Branch != "" && !branchPattern.MatchString(c.Branch) {
+		violation(fieldBranch, "must be lowercase letters and digits separated by dashes")
+	}
+	return violations
+}
+
+// copyUpdatePaths resolves the paths of the update mask of a copy. An empty
+// mask or the '*' path selects all updatable fields.
+func copyUpdatePaths(maskPaths []string) ([]string,
+	[]*errdetails.BadRequest_FieldViolation) {
+	if len(maskPaths) == 0 {
+		return updatableCopyFields, nil
+	}
+
+	var paths []string
+	for _, path := range maskPaths {
+		switch path {
+		case "*":
+			return updatableCopyFields, nil
+		case fieldBarcode, fieldAcquisitionDate, fieldPriceCents,
+			fieldCurrencyCode, fieldCondition, fieldShelfLocation, fieldStatus:
+			paths = append(paths, path)
+		case fieldName, fieldCreateTime, fieldUpdateTime:
+			return nil, updateMaskViolation("field %q is immutable", path)
+		case fieldBranch:
+			return nil, updateMaskViolation("field %q is changed by"+
+				" transferring the copy", path)
+		default:
+			return nil, updateMaskViolation("unknown field %q", path)
+		}
+	}
+	return paths, nil
+}
+
+// applyCopyUpdate copies the given field paths from update to the existing
+// copy.
+func applyCopyUpdate(existing, update Copy, paths []string) Copy {
+	for _, path := range paths {
+		switch path {
+		case fieldBarcode:
+			existing.Barcode = update.Barcode
+		case fieldAcquisitionDate:
+			existing.AcquisitionDate = update.AcquisitionDate
+		case fieldPriceCents:
+			existing.PriceCents = update.PriceCents
+		case fieldCurrencyCode:
+			existing.CurrencyCode = update.CurrencyCode
+		case fieldCondition:
+			existing.Condition = update.Condition
+		case fieldShelfLocation:
+			existing.ShelfLocation = update.ShelfLocation
+		case fieldStatus:
+			existing.Status = update.Status
+		}
+	}
+	return existing
+}
+
+// copyFromName returns the isbn and the id of a copy name on the format
+// 'books/{isbn}/copies/{id}'. Both are empty if the name is malformed.
+func copyFromName(name string) (string, string) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "books" || parts[2] != "copies" {
+		return "", ""
+	}
+	return parts[1], parts[3]
+}
+
+// NewCopyFromProto converts a *librarypb.Copy to a Copy. An unspecified
+// condition or status is left empty.
+func NewCopyFromProto(c *librarypb.Copy) Copy {
+	isbn, id := copyFromName(c.GetName())
+	cp := Copy{
+		ISBN:            isbn,
+		ID:              id,
+		Barcode:         c.GetBarcode(),
+		AcquisitionDate: c.GetAcquisitionDate(),
+		PriceCents:      c.GetPriceCents(),
+		CurrencyCode:    c.GetCurrencyCode(),
+		ShelfLocation:   c.GetShelfLocation(),
+		Branch:          c.GetBranch(),
+	}
+	if c.GetCondition() != librarypb.Copy_CONDITION_UNSPECIFIED {
+		cp.Condition = strings.ToLower(
+			strings.TrimPrefix(c.GetCondition().String(), "CONDITION_"))
+	}
+	if c.GetStatus() != librarypb.Copy_STATUS_UNSPECIFIED {
+		cp.Status = strings.ToLower(
+			strings.TrimPrefix(c.GetStatus().String(), "STATUS_"))
+	}
+	return cp
+}
+
+// AsProto converts the Copy to a *librarypb.Copy.
+func (c *Copy) AsProto() *librarypb.Copy {
+	return &librarypb.Copy{
+		Name:            "books/" + c.ISBN + "/copies/" + c.ID,
+		Barcode:         c.Barcode,
+		AcquisitionDate: c.AcquisitionDate,
+		PriceCents:      c.PriceCents,
+		CurrencyCode:    c.CurrencyCode,
+		Condition: librarypb.Copy_Condition(
+			librarypb.Copy_Condition_value["CONDITION_"+strings.ToUpper(c.Condition)]),
+		ShelfLocation: c.ShelfLocation,
+		Status: librarypb.Copy_Status(
+			librarypb.Copy_Status_value["STATUS_"+strings.ToUpper(c.Status)]),
+		Branch:         c.Branch,
+		TransferBranch: c.TransferBranch,
+		CreateTime:     timestamppb.New(c.CreateTime),
+		UpdateTime:     timestamppb.New(c.UpdateTime),
+	}
+}
+
+// CreateCopy adds a copy with a new random id to a book which is not deleted,
+// owned by an existing branch if one is given. A copy without a status is
+// available, and a new copy can neither be on loan, on hold nor in transit.
+// An available copy is held, or sent, for the first waiting hold.
+func (s *libraryServiceServer) CreateCopy(ctx context.Context,
+	req *librarypb.CreateCopyRequest) (*librarypb.Copy, error) {
+
+	c := NewCopyFromProto(req.GetCopy())
+	c.ISBN = isbnFromName(req.GetParent())
+	if c.Status == "" {
+		c.Status = statusAvailable
+	}
+	if violations := validateCopy(c); violations != nil {
+		return nil, invalidFieldsError(inField("copy", violations))
+	}
+	if circulationStatuses[c.Status] {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"a copy is only put on loan, on hold or in transit by the circulation")
+	}
+
+	id, err := newResourceID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create copy id")
+	}
+	c.ID = id
+	c.CreateTime = time.Now()
+	c.UpdateTime = c.CreateTime
+
+	err = s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		book, err := tx.FindSpecificBook(ctx, c.ISBN)
+		if err != nil {
+			return err
+		}
+		if book.IsDeleted() {
+			return ErrNotFound
+		}
+		if c.Branch != "" {
+			if _, err := tx.GetBranch(ctx, c.Branch); err != nil {
+				return err
+			}
+		}
+		if err := s.holdCopy(ctx, tx, &c, c.CreateTime); err != nil {
+			return err
+		}
+		return tx.CreateCopy(ctx, c)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return c.AsProto(), nil
+}
+
+// GetCopy retreives a specific copy of a book.
+func (s *libraryServiceServer) GetCopy(ctx context.Context,
+	req *librarypb.GetCopyRequest) (*librarypb.Copy, error) {
+
+	isbn, id := copyFromName(req.GetName())
+	c, err := s.store.GetCopy(ctx, isbn, id)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return c.AsProto(), nil
+}
+
+// ListCopies retreives a page of the copies of a book ordered by their
+// barcodes.
+func (s *libraryServiceServer) ListCopies(ctx context.Context,
+	req *librarypb.ListCopiesRequest) (*librarypb.ListCopiesResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	isbn := isbnFromName(req.GetParent())
+	checksum := listChecksum(isbn, "copies", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 2)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	if _, err := s.store.FindSpecificBook(ctx, isbn); err != nil {
+		return nil, s.toStatus(err)
+	}
+	copies, next, err := s.store.ListCopies(ctx, isbn, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListCopiesResponse{}
+	for _, c := range copies {
+		resp.Copies = append(resp.Copies, c.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// UpdateCopy updates a copy. Only the fields in the update mask are written,
+// or all the fields if the mask is empty. The status can not be changed to or
+// from on loan, on hold or in transit, which is done by the circulation. A
+// copy which becomes available is held, or sent, for the first waiting hold.
+func (s *libraryServiceServer) UpdateCopy(ctx context.Context,
+	req *librarypb.UpdateCopyRequest) (*librarypb.Copy, error) {
+
+	paths, violations := copyUpdatePaths(req.GetUpdateMask().GetPaths())
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
+	}
+	update := NewCopyFromProto(req.GetCopy())
+
+	var c Copy
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if c, err = tx.GetCopy(ctx, update.ISBN, update.ID); err != nil {
+			return err
+		}
+		previous := c.Status
+		c = applyCopyUpdate(c, update, paths)
+		if violations := validateCopy(c); violations != nil {
+			return invalidFieldsError(inField("copy", violations))
+		}
+		if c.Status != previous &&
+			(circulationStatuses[previous] || circulationStatuses[c.Status]) {
+			return status.Errorf(codes.FailedPrecondition, "the status of a copy is"+
+				" only changed to or from on loan, on hold or in transit by the circulation")
+		}
+		c.UpdateTime = time.Now()
+		if err := s.holdCopy(ctx, tx, &c, c.UpdateTime); err != nil {
+			return err
+		}
+		return tx.UpdateCopy(ctx, c)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return c.AsProto(), nil
+}
+
+// DeleteCopy deletes a copy which is neither on loan, on hold nor in transit.
+func (s *libraryServiceServer) DeleteCopy(ctx context.Context,
+	req *librarypb.DeleteCopyRequest) (*emptypb.Empty, error) {
+
+	isbn, id := copyFromName(req.GetName())
+	if err := s.store.DeleteCopy(ctx, isbn, id); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &emptypb.Empty{}, nil
+}
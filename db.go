@@ -5,6 +5,8 @@ import (
 	"embed"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/sqlite"
@@ -17,11 +19,20 @@ import (
 //go:embed migrations
 var migrations embed.FS
 
-const schemaVersion = 2
+const schemaVersion = 19
+
+// busyTimeout is how long a statement waits for the lock of a concurrent
+// transaction before failing.
+const busyTimeout = 5 * time.Second
 
 // NewDB opens a connection to the sqlite database.
 func NewDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s%s_pragma=busy_timeout(%d)",
+		dbPath, sep, busyTimeout.Milliseconds()))
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite db err, %w", err)
 	}
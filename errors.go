@@ -0,0 +1,232 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The errors returned by a BookStore. Other errors returned by a store are
+// unexpected failures of the storage itself.
+var (
+	// ErrNotFound is returned when the book did not exist.
+	ErrNotFound = errors.New("the book did not exist in the library")
+	// ErrAlreadyExists is returned when a book with the same isbn already
+	// existed.
+	ErrAlreadyExists = errors.New("the book with this isbn already existed")
+	// ErrConflict is returned when the book was not in the state required by
+	// the operation, e.g. deleting a book which was already deleted.
+	ErrConflict = errors.New("the book was modified concurrently")
+	// ErrInUse is returned when a resource can not be removed because other
+	// resources refer to it, or can not be lent because it is already in use.
+	ErrInUse = errors.New("the resource is still in use")
+)
+
+// errBusy is returned when a concurrent transaction wrote first, such as
+// another update of the same book. The call may be retried.
+var errBusy = &storeError{
+	"the database was written by a concurrent transaction, please retry", ErrConflict}
+
+// The errors of the authors, matching the store errors with errors.Is.
+var (
+	errAuthorNotFound = &storeError{"the author did not exist", ErrNotFound}
+	errAuthorInUse    = &storeError{
+		"the author is credited for books, which must be updated first", ErrInUse}
+)
+
+// The errors of the publishers, matching the store errors with errors.Is.
+var (
+	errPublisherNotFound = &storeError{"the publisher did not exist", ErrNotFound}
+	errPublisherInUse    = &storeError{
+		"the publisher has books, which must be updated first unless force is set",
+		ErrInUse}
+)
+
+// The errors of the copies, matching the store errors with errors.Is.
+var (
+	errCopyNotFound  = &storeError{"the copy did not exist", ErrNotFound}
+	errBarcodeExists = &storeError{"a copy with this barcode already existed", ErrAlreadyExists}
+	errCopyOnLoan    = &storeError{"the copy is on loan and must be returned first", ErrInUse}
+	errCopyOnHold    = &storeError{
+		"the copy is held for a member, whose hold must be cancelled first", ErrInUse}
+	errCopyInTransit = &storeError{
+		"the copy is in transit and must be received first", ErrInUse}
+	errBookHasLoans = &storeError{"the book has copies on loan or on hold," +
+		" which must be returned or cancelled first", ErrInUse}
+)
+
+// The errors of the book revisions, matching the store errors with errors.Is.
+var (
+	errRevisionNotFound = &storeError{"the revision of the book did not exist", ErrNotFound}
+)
+
+// The errors of the members, matching the store errors with errors.Is.
+var (
+	errMemberNotFound   = &storeError{"the member did not exist", ErrNotFound}
+	errCardNumberExists = &storeError{
+		"a member with this card number already existed", ErrAlreadyExists}
+	errMemberHasLoans = &storeError{
+		"the member has copies on loan, which must be returned first", ErrInUse}
+	errMemberHasBalance = &storeError{
+		"the member has a balance, which must be settled first", ErrInUse}
+)
+
+// The errors of the loans, matching the store errors with errors.Is.
+var (
+	errLoanNotFound     = &storeError{"the loan did not exist", ErrNotFound}
+	errCopyNotOnLoan    = &storeError{"the copy is not on loan", ErrNotFound}
+	errCopyNotAvailable = &storeError{"the copy is not available for loan", ErrInUse}
+	errLoanReturned     = &storeError{"the loan has already been returned", ErrConflict}
+)
+
+// The errors of the branches, matching the store errors with errors.Is.
+var (
+	errBranchNotFound = &storeError{"the branch did not exist", ErrNotFound}
+	errBranchExists   = &storeError{"a branch with this id already existed", ErrAlreadyExists}
+	errBranchInUse    = &storeError{"the branch owns copies, or copies are sent to it," +
+		" which must be transferred first", ErrInUse}
+)
+
+// The errors of the API keys, matching the store errors with errors.Is.
+var (
+	errAPIKeyNotFound = &storeError{"the API key did not exist", ErrNotFound}
+)
+
+// The errors of the role bindings, matching the store errors with errors.Is.
+var (
+	errRoleBindingNotFound = &storeError{"the principal has no role binding", ErrNotFound}
+)
+
+// The errors of the calendars, matching the store errors with errors.Is.
+var (
+	errClosureNotFound = &storeError{"the closure did not exist", ErrNotFound}
+)
+
+// The errors of the holds, matching the store errors with errors.Is.
+var (
+	errHoldNotFound  = &storeError{"the hold did not exist", ErrNotFound}
+	errHoldExists    = &storeError{"the member already has a hold on the book", ErrAlreadyExists}
+	errNoWaitingHold = &storeError{"no member is waiting for the book", ErrNotFound}
+	errCopyNotOnHold = &storeError{"the copy is not held for a member", ErrNotFound}
+)
+
+// unknownAuthorError is returned when a book credits an author which did not
+// exist.
+func unknownAuthorError(id string) error {
+	return &storeError{
+		fmt.Sprintf("the author %q of the book did not exist", "authors/"+id),
+		ErrNotFound}
+}
+
+// unknownPublisherError is returned when a book refers to a publisher which
+// did not exist.
+func unknownPublisherError(id string) error {
+	return &storeError{
+		fmt.Sprintf("the publisher %q of the book did not exist", "publishers/"+id),
+		ErrNotFound}
+}
+
+// storeError is a store error with a message describing the resource.
+type storeError struct {
+	msg  string
+	kind error // one of the store errors
+}
+
+func (e *storeError) Error() string { return e.msg }
+
+func (e *storeError) Unwrap() error { return e.kind }
+
+// toStatus translates an error returned by the store into the gRPC status
+// sent to the client. Unexpected errors are logged and reported as internal
+// errors without their details.
+func (s *libraryServiceServer) toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ErrInUse):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	s.log.Errorw("storage failure", "error", err)
+	return status.Errorf(codes.Internal, "internal storage error")
+}
+
+// inField prefixes the field paths of the violations with the field of the
+// request holding the validated message, e.g. 'title' becomes 'book.title'.
+func inField(field string,
+	violations []*errdetails.BadRequest_FieldViolation) []*errdetails.BadRequest_FieldViolation {
+	for _, v := range violations {
+		v.Field = field + "." + v.Field
+	}
+	return violations
+}
+
+// invalidFieldsError creates the InvalidArgument status of a failed
+// validation, with a google.rpc.BadRequest detail holding the violations.
+func invalidFieldsError(violations []*errdetails.BadRequest_FieldViolation) error {
+	fields := make([]string, len(violations))
+	for i, v := range violations {
+		fields[i] = v.GetField()
+	}
+	st, err := status.New(codes.InvalidArgument, fmt.Sprintf(
+		"validation failed, field error(s): %v. Fix these error before proceeding",
+		strings.Join(fields, ", "))).
+		WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return st.Err()
+}
+
+// fieldUpdateMaskPaths is the field of the paths of an update mask.
+const fieldUpdateMaskPaths = "update_mask.paths"
+
+// updateMaskViolation creates the violation of an update mask holding a path
+// which can not be updated. The format describes the path.
+func updateMaskViolation(format,
+	path string) []*errdetails.BadRequest_FieldViolation {
+	return []*errdetails.BadRequest_FieldViolation{{
+		Field:       fieldUpdateMaskPaths,
+		Description: fmt.Sprintf(format, path),
+	}}
+}
+
+// fieldError is returned when a parameter of a request such as the filter or
+// the page_token of a list is invalid.
+type fieldError struct {
+	field       string // the field path of the parameter
+	description string // the description of the violation
+}
+
+func (e *fieldError) Error() string {
+	return "invalid " + e.field + ", " + e.description
+}
+
+// invalidArgumentError creates the InvalidArgument status of an invalid
+// request. A fieldError is reported with a google.rpc.BadRequest detail
+// naming its field.
+func invalidArgumentError(err error) error {
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		return invalidFieldsError([]*errdetails.BadRequest_FieldViolation{{
+			Field:       fe.field,
+			Description: fe.description,
+		}})
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
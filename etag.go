@@ -0,0 +1,80 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The metadata key the gateway forwards the HTTP If-Match header as.
+const ifMatchMetadataKey = "grpcgateway-if-match"
+
+// etagPreconditionType is the type of the precondition violation returned
+// when the If-Match header does not match the etag of a book.
+const etagPreconditionType = "ETAG"
+
+// Etag computes the entity tag of the stored book. It changes whenever any
+// field of the book is updated, but not when the name of an author changes.
+func (b *Book) Etag() string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%t\x00%s",
+		b.ISBN, b.Title, b.Publisher,
+		formatTime(b.CreateTime), formatTime(b.UpdateTime),
+		b.IsDeleted(), formatTime(b.DeleteTime))
+	for _, a := range b.Authors {
+		fmt.Fprintf(h, "\x00%s\x00%s", a.AuthorID, a.Role)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// checkEtag verifies that the etag sent in the request and the If-Match
+// values forwarded by the gateway matches the etag of the stored book.
+func checkEtag(ctx context.Context, requestEtag string, b Book) error {
+	etag := b.Etag()
+	if requestEtag != "" && requestEtag != etag {
+		return status.Errorf(codes.Aborted,
+			"the book has been modified, the etag did not match")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, ifMatch := range md.Get(ifMatchMetadataKey) {
+		if !matchEtag(ifMatch, etag) {
+			st, err := status.New(codes.FailedPrecondition,
+				"the book has been modified, If-Match did not match the etag").
+				WithDetails(&errdetails.PreconditionFailure{
+					Violations: []*errdetails.PreconditionFailure_Violation{{
+						Type:        etagPreconditionType,
+						Subject:     "books/" + b.ISBN,
+						Description: "If-Match did not match the etag",
+					}},
+				})
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			return st.Err()
+		}
+	}
+	return nil
+}
+
+// matchEtag reports whether a If-Match or If-None-Match header value, which
+// is a comma separated list of quoted etags or '*', matches the etag.
+func matchEtag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if strings.Trim(candidate, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
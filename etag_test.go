@@ -0,0 +1,76 @@
+package library
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckEtag(t *testing.T) {
+	b := testBook("9780000000001", "star wars")
+	etag := b.Etag()
+	ifMatch := func(values ...string) context.Context {
+		md := metadata.MD{}
+		for _, v := range values {
+			md.Append(ifMatchMetadataKey, v)
+		}
+		return metadata.NewIncomingContext(context.Background(), md)
+	}
+
+	for name, tc := range map[string]struct {
+		ctx         context.Context
+		requestEtag string
+		want        codes.Code
+	}{
+		"no precondition":        {context.Background(), "", codes.OK},
+		"body etag matches":      {context.Background(), etag, codes.OK},
+		"body etag mismatch":     {context.Background(), "0000000000000000", codes.Aborted},
+		"If-Match matches":       {ifMatch(`"` + etag + `"`), "", codes.OK},
+		"If-Match any":           {ifMatch("*"), "", codes.OK},
+		"If-Match in a list":     {ifMatch(`"0000000000000000", "` + etag + `"`), "", codes.OK},
+		"If-Match mismatch":      {ifMatch(`"0000000000000000"`), "", codes.FailedPrecondition},
+		"every If-Match matches": {ifMatch(`"`+etag+`"`, `"x"`), "", codes.FailedPrecondition},
+		"both mismatch":          {ifMatch(`"x"`), "0000000000000000", codes.Aborted},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := checkEtag(tc.ctx, tc.requestEtag, b)
+			require.Equal(t, tc.want, status.Code(err))
+			if tc.want != codes.FailedPrecondition {
+				return
+			}
+			// the gateway responds 412 by the precondition violation
+			details := status.Convert(err).Details()
+			require.Len(t, details, 1)
+			failure := details[0].(*errdetails.PreconditionFailure)
+			require.Equal(t, etagPreconditionType, failure.GetViolations()[0].GetType())
+			require.Equal(t, "books/"+b.ISBN, failure.GetViolations()[0].GetSubject())
+		})
+	}
+}
+
+func TestMatchEtag(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`abc`, true},
+		{`W/"abc"`, true},
+		{`*`, true},
+		{` "x" , W/"abc"`, true},
+		{`"x", *`, true},
+		{`"abcd"`, false},
+		{`"ab"`, false},
+		{`W/"x"`, false},
+		{``, false},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			require.Equal(t, tc.want, matchEtag(tc.header, "abc"))
+		})
+	}
+}
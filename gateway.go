@@ -1,15 +1,22 @@
 package library
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 // RunGRPCGateway initlaizes and starts a grpc gateway
@@ -21,12 +28,36 @@ func RunGRPCGateway(
 	registerHandlersFunc func(context.Context, *runtime.ServeMux, *grpc.ClientConn) error,
 ) error {
 	gatewayMux := runtime.NewServeMux(
-		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
-			MarshalOptions: protojson.MarshalOptions{
-				UseProtoNames:   true,
-				EmitUnpopulated: true,
+		// the HttpBody responses, such as the iCalendar exports, are written
+		// as they are
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.HTTPBodyMarshaler{
+			Marshaler: &runtime.JSONPb{
+				MarshalOptions: protojson.MarshalOptions{
+					UseProtoNames:   true,
+					EmitUnpopulated: true,
+				},
 			},
 		}),
+		// the changes of WatchBooks can be streamed as newline delimited JSON
+		// or as server-sent events
+		runtime.WithMarshalerOption(ndjsonContentType, &ndjsonMarshaler{
+			JSONPb: &runtime.JSONPb{
+				MarshalOptions: protojson.MarshalOptions{
+					UseProtoNames:   true,
+					EmitUnpopulated: true,
+				},
+			},
+		}),
+		runtime.WithMarshalerOption(eventStreamContentType, &eventStreamMarshaler{
+			JSONPb: &runtime.JSONPb{
+				MarshalOptions: protojson.MarshalOptions{
+					UseProtoNames:   true,
+					EmitUnpopulated: true,
+				},
+			},
+		}),
+		runtime.WithForwardResponseOption(setEtagHeader),
+		runtime.WithErrorHandler(gatewayErrorHandler),
 	)
 
 	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
@@ -43,13 +74,17 @@ func RunGRPCGateway(
 		return err
 	}
 
-	// Register handlers towards the gRPC server
+	// Register handlers towards the gRPC server. The handlers forward the
+	// Authorization header of a request as the authorization metadata of the
+	// call, which authenticates the call.
 	if err := registerHandlersFunc(ctx, gatewayMux, conn); err != nil {
 		return fmt.Errorf("register handler err, %w", err)
 	}
 
 	// Start gateway
 	var gatewayServerMux http.Handler = gatewayMux
+	gatewayServerMux = notModifiedHandler(gatewayServerMux)
+	gatewayServerMux = lastEventIDHandler(gatewayServerMux)
 
 	server := &http.Server{
 		Addr:     grpcAddr,
@@ -70,3 +105,207 @@ func RunGRPCGateway(
 		return ctx.Err()
 	}
 }
+
+// setEtagHeader sets the HTTP ETag header on responses containing a book.
+func setEtagHeader(_ context.Context, w http.ResponseWriter, m proto.Message) error {
+	if book, ok := m.(*librarypb.Book); ok && book.GetEtag() != "" {
+		w.Header().Set("ETag", strconv.Quote(book.GetEtag()))
+	}
+	return nil
+}
+
+// gatewayErrorHandler responds with 412 Precondition Failed when the If-Match
+// header did not match the etag of a book, challenges the client for a bearer
+// token when the call was not authenticated, and otherwise responds as the
+// default error handler.
+func gatewayErrorHandler(
+	ctx context.Context,
+	mux *runtime.ServeMux,
+	marshaler runtime.Marshaler,
+	w http.ResponseWriter,
+	r *http.Request,
+	err error,
+) {
+	st := status.Convert(err)
+	if st.Code() == codes.Unauthenticated {
+		// the default error handler sets the message as the challenge
+		w = &challengeResponseWriter{
+			ResponseWriter: w,
+			challenge:      `Bearer realm="library"`,
+		}
+	}
+	for _, detail := range st.Details() {
+		failure, ok := detail.(*errdetails.PreconditionFailure)
+		if !ok {
+			continue
+		}
+		for _, violation := range failure.GetViolations() {
+			if violation.GetType() == etagPreconditionType {
+				w = &statusResponseWriter{
+					ResponseWriter: w,
+					status:         http.StatusPreconditionFailed,
+				}
+			}
+		}
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+// statusResponseWriter replaces the status code written to the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(int) {
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// challengeResponseWriter replaces the WWW-Authenticate header of the
+// response.
+type challengeResponseWriter struct {
+	http.ResponseWriter
+	challenge string
+}
+
+func (w *challengeResponseWriter) WriteHeader(status int) {
+	w.Header().Set("WWW-Authenticate", w.challenge)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// notModifiedHandler responds with 304 Not Modified to GET requests whose
+// If-None-Match header matches the ETag of the response. The streams of
+// WatchBooks never end, so they are not buffered.
+func notModifiedHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		if r.Method != http.MethodGet || ifNoneMatch == "" ||
+			r.URL.Path == watchBooksPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponseWriter{header: http.Header{}}
+		next.ServeHTTP(buffered, r)
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+
+		for key, values := range buffered.header {
+			w.Header()[key] = values
+		}
+		etag, err := strconv.Unquote(buffered.header.Get("ETag"))
+		if buffered.status == http.StatusOK && err == nil &&
+			matchEtag(ifNoneMatch, etag) {
+			w.Header().Del("Content-Type")
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(buffered.status)
+		_, _ = w.Write(buffered.body.Bytes())
+	})
+}
+
+// bufferedResponseWriter keeps the response in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// the content types of the streams of WatchBooks besides JSON
+const (
+	ndjsonContentType      = "application/x-ndjson"
+	eventStreamContentType = "text/event-stream"
+)
+
+// watchBooksPath is the path of WatchBooks in the gateway.
+const watchBooksPath = "/books:watch"
+
+// ndjsonMarshaler writes the events of a stream as newline delimited JSON.
+type ndjsonMarshaler struct {
+	*runtime.JSONPb
+}
+
+func (m *ndjsonMarshaler) ContentType(interface{}) string {
+	return ndjsonContentType
+}
+
+// eventStreamMarshaler writes the events of a stream as server-sent events.
+// The data of an event is the JSON of the message, and the id of a
+// BookEvent is its resume token, so an EventSource resumes after the last
+// event it received when it reconnects. An error ending the stream is sent
+// as an error event.
+type eventStreamMarshaler struct {
+	*runtime.JSONPb
+}
+
+func (m *eventStreamMarshaler) ContentType(interface{}) string {
+	return eventStreamContentType
+}
+
+// Marshal writes the chunk of a stream as an event, ending with the newline
+// which the delimiter follows.
+func (m *eventStreamMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	switch chunk := v.(type) {
+	case map[string]interface{}:
+		if e, ok := chunk["result"].(*librarypb.BookEvent); ok && e.GetResumeToken() != "" {
+			fmt.Fprintf(&buf, "id: %s\n", e.GetResumeToken())
+		}
+		v = chunk["result"]
+	case map[string]proto.Message:
+		buf.WriteString("event: error\n")
+		v = chunk["error"]
+	}
+	data, err := m.JSONPb.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// Delimiter ends an event with an empty line.
+func (m *eventStreamMarshaler) Delimiter() []byte {
+	return []byte("\n")
+}
+
+// lastEventIDHandler passes the Last-Event-ID header, which an EventSource
+// sends when it reconnects, to WatchBooks as the resume token unless the
+// request has one.
+func lastEventIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if r.URL.Path == watchBooksPath && lastEventID != "" {
+			query := r.URL.Query()
+			if query.Get("resume_token") == "" {
+				query.Set("resume_token", lastEventID)
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package library
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestNotModifiedHandler(t *testing.T) {
+	const etag = "73c2741930cd2919"
+	// book responds with a book and its ETag, like the gateway
+	book := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", strconv.Quote(etag))
+		_, _ = w.Write([]byte(`{"name":"9780000000001"}`))
+	})
+
+	for name, tc := range map[string]struct {
+		method, ifNoneMatch string
+		want                int
+	}{
+		"no If-None-Match":    {http.MethodGet, "", http.StatusOK},
+		"matching":            {http.MethodGet, `"` + etag + `"`, http.StatusNotModified},
+		"weak":                {http.MethodGet, `W/"` + etag + `"`, http.StatusNotModified},
+		"any":                 {http.MethodGet, "*", http.StatusNotModified},
+		"in a list":           {http.MethodGet, `"x", "` + etag + `"`, http.StatusNotModified},
+		"not matching":        {http.MethodGet, `"0000000000000000"`, http.StatusOK},
+		"not a GET":           {http.MethodPatch, `"` + etag + `"`, http.StatusOK},
+		"unquoted in header":  {http.MethodGet, etag, http.StatusNotModified},
+		"only a weak W/ part": {http.MethodGet, `W/""`, http.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/books/9780000000001", nil)
+			if tc.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			notModifiedHandler(book).ServeHTTP(w, r)
+
+			require.Equal(t, tc.want, w.Code)
+			require.Equal(t, strconv.Quote(etag), w.Header().Get("ETag"))
+			if tc.want == http.StatusNotModified {
+				require.Empty(t, w.Body.String())
+				require.Empty(t, w.Header().Get("Content-Type"))
+				return
+			}
+			require.JSONEq(t, `{"name":"9780000000001"}`, w.Body.String())
+		})
+	}
+
+	t.Run("errors are passed on", func(t *testing.T) {
+		notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"code":5}`))
+		})
+		r := httptest.NewRequest(http.MethodGet, "/books/9780000000001", nil)
+		r.Header.Set("If-None-Match", "*")
+		w := httptest.NewRecorder()
+		notModifiedHandler(notFound).ServeHTTP(w, r)
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Equal(t, `{"code":5}`, w.Body.String())
+	})
+}
+
+func TestGatewayErrorHandler(t *testing.T) {
+	b := testBook("9780000000001", "star wars")
+	ifMatch := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(ifMatchMetadataKey, `"0000000000000000"`))
+
+	for name, tc := range map[string]struct {
+		err       error
+		want      int
+		challenge string
+	}{
+		"If-Match mismatch": {checkEtag(ifMatch, "", b), http.StatusPreconditionFailed, ""},
+		"etag mismatch": {checkEtag(context.Background(), "0000000000000000", b),
+			http.StatusConflict, ""},
+		"other precondition": {status.Error(codes.FailedPrecondition, "in use"),
+			http.StatusBadRequest, ""},
+		"unauthenticated": {status.Error(codes.Unauthenticated, "no token"),
+			http.StatusUnauthorized, `Bearer realm="library"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/books/9780000000001", nil)
+			w := httptest.NewRecorder()
+			gatewayErrorHandler(context.Background(), runtime.NewServeMux(),
+				&runtime.JSONPb{}, w, r, tc.err)
+
+			require.Equal(t, tc.want, w.Code)
+			require.Equal(t, tc.challenge, w.Header().Get("WWW-Authenticate"))
+			require.Contains(t, w.Body.String(), status.Convert(tc.err).Message())
+		})
+	}
+}
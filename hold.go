@@ -0,0 +1,426 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Hold is a hold of a member on a book. The waiting holds of a book are
+// served in the order they were placed.
+type Hold struct {
+	ISBN             string    `json:"isbn"` // The book of the hold
+	ID               string    `json:"id"`   // The random id in 'books/{isbn}/holds/{id}'
+	MemberID         string    `json:"memberId"`
+	PickupBranch     string    `json:"pickupBranch"`
+	State            string    `json:"state"`
+	CopyID           string    `json:"copyId"` // The held copy, or the copy sent to the pickup branch
+	PlaceTime        time.Time `json:"placeTime"`
+	PickupExpireTime time.Time `json:"pickupExpireTime"` // Set while the hold is ready
+	UpdateTime       time.Time `json:"updateTime"`
+}
+
+// The states of a hold.
+const (
+	holdWaiting   = "waiting"
+	holdReady     = "ready"
+	holdFulfilled = "fulfilled"
+	holdCancelled = "cancelled"
+	holdExpired   = "expired"
+)
+
+// IsActive reports whether the hold is waiting or ready.
+func (h *Hold) IsActive() bool {
+	return h.State == holdWaiting || h.State == holdReady
+}
+
+// The field paths of a Hold which are validated.
+const (
+	fieldMember       = "member"
+	fieldPickupBranch = "pickup_branch"
+)
+
+// branchPattern is the regex pattern of the id of a branch, e.g. 'central' or
+// 'north-side'.
+var branchPattern = regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`)
+
+// validateHold validates the fields of a new hold and returns a violation for
+// every invalid field.
+func validateHold(h Hold) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	if h.MemberID == "" || strings.Contains(h.MemberID, "/") {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       fieldMember,
+			Description: "must be a member name such as 'members/{member}'",
+		})
+	}
+	if !branchPattern.MatchString(h.PickupBranch) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       fieldPickupBranch,
+			Description: "must be lowercase letters and digits separated by dashes",
+		})
+	}
+	return violations
+}
+
+// holdFromName returns the isbn and the id of a hold name on the format
+// 'books/{isbn}/holds/{id}'. Both are empty if the name is malformed.
+func holdFromName(name string) (string, string) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "books" || parts[2] != "holds" {
+		return "", ""
+	}
+	return parts[1], parts[3]
+}
+
+// NewHoldFromProto converts a *librarypb.Hold to a Hold. Only the fields set
+// by the clients are converted.
+func NewHoldFromProto(h *librarypb.Hold) Hold {
+	isbn, id := holdFromName(h.GetName())
+	return Hold{
+		ISBN:         isbn,
+		ID:           id,
+		MemberID:     strings.TrimPrefix(h.GetMember(), "members/"),
+		PickupBranch: h.GetPickupBranch(),
+	}
+}
+
+// AsProto converts the Hold to a *librarypb.Hold.
+func (h *Hold) AsProto() *librarypb.Hold {
+	hold := &librarypb.Hold{
+		Name:         "books/" + h.ISBN + "/holds/" + h.ID,
+		Member:       "members/" + h.MemberID,
+		PickupBranch: h.PickupBranch,
+		State: librarypb.Hold_State(
+			librarypb.Hold_State_value["STATE_"+strings.ToUpper(h.State)]),
+		PlaceTime:  timestamppb.New(h.PlaceTime),
+		UpdateTime: timestamppb.New(h.UpdateTime),
+	}
+	if h.CopyID != "" {
+		hold.Copy = "books/" + h.ISBN + "/copies/" + h.CopyID
+	}
+	if !h.PickupExpireTime.IsZero() {
+		hold.PickupExpireTime = timestamppb.New(h.PickupExpireTime)
+	}
+	return hold
+}
+
+// holdCopy holds an available copy for the waiting hold on its book which was
+// placed first, if any, and writes the hold. A copy of another branch than the
+// pickup branch of the hold is sent there instead, and held once it is
+// received. The caller writes the copy.
+func (s *libraryServiceServer) holdCopy(ctx context.Context, tx HoldStore,
+	c *Copy, now time.Time) error {
+	if c.Status != statusAvailable {
+		return nil
+	}
+	hold, err := tx.NextWaitingHold(ctx, c.ISBN)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hold.CopyID = c.ID
+	hold.UpdateTime = now
+	if c.Branch != "" && c.Branch != hold.PickupBranch {
+		c.Status = statusInTransit
+		c.TransferBranch = hold.PickupBranch
+		return tx.UpdateHold(ctx, hold)
+	}
+	hold.State = holdReady
+	hold.PickupExpireTime = now.Add(s.holdPickupPeriod)
+	c.Status = statusOnHold
+	return tx.UpdateHold(ctx, hold)
+}
+
+// receiveForHold holds a copy received at its branch for the hold it was sent
+// for. If that hold has been cancelled in the meantime, the copy is held for
+// the next waiting hold instead, if any. The caller writes the copy.
+func (s *libraryServiceServer) receiveForHold(ctx context.Context, tx HoldStore,
+	c *Copy, now time.Time) error {
+	hold, err := tx.GetHoldOfCopy(ctx, c.ISBN, c.ID)
+	if errors.Is(err, ErrNotFound) {
+		return s.holdCopy(ctx, tx, c, now)
+	}
+	if err != nil {
+		return err
+	}
+	hold.State = holdReady
+	hold.PickupExpireTime = now.Add(s.holdPickupPeriod)
+	hold.UpdateTime = now
+	c.Status = statusOnHold
+	return tx.UpdateHold(ctx, hold)
+}
+
+// copyHoldStore is the storage of the copies and the holds used to release
+// the copies to the holds.
+type copyHoldStore interface {
+	CopyStore
+	HoldStore
+}
+
+// releaseCopy makes a returned copy, or a copy which is no longer held,
+// available again or holds it for the next waiting hold on its book.
+func (s *libraryServiceServer) releaseCopy(ctx context.Context, tx copyHoldStore,
+	isbn, copyID string, now time.Time) error {
+	c, err := tx.GetCopy(ctx, isbn, copyID)
+	if err != nil {
+		return err
+	}
+	c.Status = statusAvailable
+	if err := s.holdCopy(ctx, tx, &c, now); err != nil {
+		return err
+	}
+	c.UpdateTime = now
+	return tx.UpdateCopy(ctx, c)
+}
+
+// fulfillHold closes the hold the copy is held for when its member checks out
+// the copy, and makes the copy available for the checkout.
+func fulfillHold(ctx context.Context, tx copyHoldStore, c Copy, memberID string,
+	now time.Time) error {
+	hold, err := tx.GetHoldOfCopy(ctx, c.ISBN, c.ID)
+	if err != nil {
+		return err
+	}
+	if hold.MemberID != memberID {
+		return status.Errorf(codes.FailedPrecondition,
+			"the copy is held for another member")
+	}
+	hold.State = holdFulfilled
+	hold.UpdateTime = now
+	if err := tx.UpdateHold(ctx, hold); err != nil {
+		return err
+	}
+	c.Status = statusAvailable
+	c.UpdateTime = now
+	return tx.UpdateCopy(ctx, c)
+}
+
+// holdableCopies returns the number of copies of the book which circulate,
+// leaving out the lost, the withdrawn and those in repair, and the number of
+// them which are available for checkout at the pickup branch. A copy which
+// belongs to no branch can be checked out at any branch.
+func holdableCopies(ctx context.Context, tx CopyStore, isbn,
+	pickupBranch string) (int, int, error) {
+	var total, available int
+	var after []string
+	for {
+		copies, next, err := tx.ListCopies(ctx, isbn, maxPageSize, after)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, c := range copies {
+			switch {
+			case c.Status == statusLost || c.Status == statusInRepair ||
+				c.Status == statusWithdrawn:
+				continue
+			case c.Status == statusAvailable &&
+				(c.Branch == "" || c.Branch == pickupBranch):
+				available++
+			}
+			total++
+		}
+		if next == nil {
+			return total, available, nil
+		}
+		after = next
+	}
+}
+
+// PlaceHold queues a member for a book without a copy available for checkout
+// at the pickup branch, to pick up the copy at that branch. A member can only
+// have one waiting or ready hold on a book.
+func (s *libraryServiceServer) PlaceHold(ctx context.Context,
+	req *librarypb.PlaceHoldRequest) (*librarypb.Hold, error) {
+
+	hold := NewHoldFromProto(req.GetHold())
+	if violations := validateHold(hold); violations != nil {
+		return nil, invalidFieldsError(inField("hold", violations))
+	}
+	id, err := newResourceID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create hold id")
+	}
+	hold.ISBN = isbnFromName(req.GetParent())
+	hold.ID = id
+	hold.State = holdWaiting
+	hold.PlaceTime = s.now()
+	hold.UpdateTime = hold.PlaceTime
+
+	err = s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		book, err := tx.FindSpecificBook(ctx, hold.ISBN)
+		if err != nil {
+			return err
+		}
+		if book.IsDeleted() {
+			return ErrNotFound
+		}
+		total, available, err := holdableCopies(ctx, tx, hold.ISBN,
+			hold.PickupBranch)
+		switch {
+		case err != nil:
+			return err
+		case total == 0:
+			return status.Errorf(codes.FailedPrecondition,
+				"the book has no copies which can be held")
+		case available > 0:
+			return status.Errorf(codes.FailedPrecondition,
+				"the book has copies available for checkout at the branch %q",
+				hold.PickupBranch)
+		}
+		member, err := tx.GetMember(ctx, hold.MemberID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkMayBorrow(ctx, tx, member, hold.PlaceTime); err != nil {
+			return err
+		}
+		if _, err := tx.GetBranch(ctx, hold.PickupBranch); err != nil {
+			return err
+		}
+		return tx.CreateHold(ctx, hold)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return hold.AsProto(), nil
+}
+
+// GetHold retreives a specific hold on a book.
+func (s *libraryServiceServer) GetHold(ctx context.Context,
+	req *librarypb.GetHoldRequest) (*librarypb.Hold, error) {
+
+	isbn, id := holdFromName(req.GetName())
+	hold, err := s.store.GetHold(ctx, isbn, id)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return hold.AsProto(), nil
+}
+
+// CancelHold cancels a waiting or ready hold. The copy held for a ready hold
+// is held for the next waiting hold, or made available.
+func (s *libraryServiceServer) CancelHold(ctx context.Context,
+	req *librarypb.CancelHoldRequest) (*librarypb.Hold, error) {
+
+	isbn, id := holdFromName(req.GetName())
+	now := s.now()
+	var hold Hold
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if hold, err = tx.GetHold(ctx, isbn, id); err != nil {
+			return err
+		}
+		if !hold.IsActive() {
+			return status.Errorf(codes.FailedPrecondition,
+				"the hold is already %s", hold.State)
+		}
+		wasReady := hold.State == holdReady
+		hold.State = holdCancelled
+		hold.UpdateTime = now
+		if err := tx.UpdateHold(ctx, hold); err != nil {
+			return err
+		}
+		if wasReady {
+			return s.releaseCopy(ctx, tx, hold.ISBN, hold.CopyID, now)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return hold.AsProto(), nil
+}
+
+// ListHolds retreives a page of the holds on a book in the order they were
+// placed. Closed holds are only listed if show_closed is set.
+func (s *libraryServiceServer) ListHolds(ctx context.Context,
+	req *librarypb.ListHoldsRequest) (*librarypb.ListHoldsResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	isbn := isbnFromName(req.GetParent())
+	checksum := listChecksum(isbn, "holds", req.GetShowClosed())
+	after, err := parsePageToken(req.GetPageToken(), checksum, 2)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	holds, next, err := s.store.ListHolds(ctx, isbn, req.GetShowClosed(),
+		pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListHoldsResponse{}
+	for _, hold := range holds {
+		resp.Holds = append(resp.Holds, hold.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// ExpireHolds expires the ready holds whose copies have not been picked up
+// before now, and holds the copies for the next waiting holds. It returns the
+// number of expired holds.
+func (s *libraryServiceServer) ExpireHolds(ctx context.Context,
+	now time.Time) (int, error) {
+	var expired int
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		holds, err := tx.ListExpiredHolds(ctx, now)
+		if err != nil {
+			return err
+		}
+		for _, hold := range holds {
+			hold.State = holdExpired
+			hold.UpdateTime = now
+			if err := tx.UpdateHold(ctx, hold); err != nil {
+				return err
+			}
+			if err := s.releaseCopy(ctx, tx, hold.ISBN, hold.CopyID, now); err != nil {
+				return err
+			}
+		}
+		expired = len(holds)
+		return nil
+	})
+	return expired, err
+}
+
+// RunHoldExpirer expires the holds which have not been picked up in time,
+// checking every interval until the context is done.
+func (s *libraryServiceServer) RunHoldExpirer(ctx context.Context,
+	interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			expired, err := s.ExpireHolds(ctx, s.now())
+			if err != nil {
+				s.log.Errorw("failed to expire holds", "error", err)
+				continue
+			}
+			if expired > 0 {
+				s.log.Infow("expired holds", "count", expired)
+			}
+		}
+	}
+}
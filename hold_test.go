@@ -0,0 +1,168 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// placeHold places a hold of the member on the circulation test book, to be
+// picked up at the central branch.
+func placeHold(s *libraryServiceServer, memberID string) (*librarypb.Hold, error) {
+	return s.PlaceHold(context.Background(), &librarypb.PlaceHoldRequest{
+		Parent: "books/" + testCirculationISBN,
+		Hold: &librarypb.Hold{Member: "members/" + memberID,
+			PickupBranch: "central"},
+	})
+}
+
+// newHoldServer creates a circulation server with a central branch, a second
+// member and one copy of the book, which is on loan to the first member.
+func newHoldServer(t *testing.T) (*libraryServiceServer, *time.Time) {
+	ctx := context.Background()
+	s, clock := newCirculationServer(t)
+	require.NoError(t, s.store.CreateBranch(ctx, testBranch("central", "central")))
+	require.NoError(t, s.store.CreateMember(ctx, testMember("00000000000000b2",
+		"leia", "organa", "87654321")))
+	createTestCopies(t, s, "c1")
+	_, err := checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+	return s, clock
+}
+
+func TestPlaceHold(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newCirculationServer(t)
+	require.NoError(t, s.store.CreateBranch(ctx, testBranch("central", "central")))
+
+	_, err := placeHold(s, testMemberID)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "no copies")
+
+	createTestCopies(t, s, "c1")
+	_, err = placeHold(s, testMemberID)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "available")
+
+	_, err = checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+	hold, err := placeHold(s, testMemberID)
+	require.NoError(t, err)
+	require.Equal(t, librarypb.Hold_STATE_WAITING, hold.GetState())
+	_, err = placeHold(s, testMemberID)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestPlaceHoldAtPickupBranch(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newCirculationServer(t)
+	for _, id := range []string{"central", "east"} {
+		require.NoError(t, s.store.CreateBranch(ctx, testBranch(id, id)))
+	}
+
+	// a lost copy can not be held
+	require.NoError(t, s.store.CreateCopy(ctx, testCopy(testCirculationISBN, "c1",
+		"barcodec1", statusLost)))
+	_, err := placeHold(s, testMemberID)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "no copies")
+
+	// a copy available at another branch does not keep the member from
+	// queueing at the pickup branch
+	east := testCopy(testCirculationISBN, "c2", "barcodec2", statusAvailable)
+	east.Branch = "east"
+	require.NoError(t, s.store.CreateCopy(ctx, east))
+	hold, err := placeHold(s, testMemberID)
+	require.NoError(t, err)
+	require.Equal(t, "central", hold.GetPickupBranch())
+
+	// a copy of no branch is available at every branch
+	require.NoError(t, s.store.CreateMember(ctx, testMember("00000000000000b2",
+		"leia", "organa", "87654321")))
+	createTestCopies(t, s, "c3")
+	_, err = placeHold(s, "00000000000000b2")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "available")
+}
+
+func TestHoldTrappedOnReturn(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newHoldServer(t)
+	hold, err := placeHold(s, "00000000000000b2")
+	require.NoError(t, err)
+
+	// the loan can not be renewed while another member waits
+	_, err = s.RenewCopy(ctx, &librarypb.RenewCopyRequest{Name: copyName("c1")})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	*clock = clock.Add(24 * time.Hour)
+	_, err = s.ReturnCopy(ctx, &librarypb.ReturnCopyRequest{Name: copyName("c1")})
+	require.NoError(t, err)
+	got, err := s.GetHold(ctx, &librarypb.GetHoldRequest{Name: hold.GetName()})
+	require.NoError(t, err)
+	require.Equal(t, librarypb.Hold_STATE_READY, got.GetState())
+	require.Equal(t, copyName("c1"), got.GetCopy())
+	require.Equal(t, clock.Add(s.holdPickupPeriod), got.GetPickupExpireTime().AsTime())
+	c, err := s.store.GetCopy(ctx, testCirculationISBN, "c1")
+	require.NoError(t, err)
+	require.Equal(t, statusOnHold, c.Status)
+
+	// only the member of the hold can check out the copy
+	_, err = checkout(s, "c1", testMemberID)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = checkout(s, "c1", "00000000000000b2")
+	require.NoError(t, err)
+	got, err = s.GetHold(ctx, &librarypb.GetHoldRequest{Name: hold.GetName()})
+	require.NoError(t, err)
+	require.Equal(t, librarypb.Hold_STATE_FULFILLED, got.GetState())
+}
+
+func TestRunHoldExpirer(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newHoldServer(t)
+	require.NoError(t, s.store.CreateMember(ctx, testMember("00000000000000b3",
+		"han", "solo", "11223344")))
+	first, err := placeHold(s, "00000000000000b2")
+	require.NoError(t, err)
+	*clock = clock.Add(time.Minute)
+	next, err := placeHold(s, "00000000000000b3")
+	require.NoError(t, err)
+	_, err = s.ReturnCopy(ctx, &librarypb.ReturnCopyRequest{Name: copyName("c1")})
+	require.NoError(t, err)
+
+	runExpirer := func() {
+		expirerCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, s.RunHoldExpirer(expirerCtx, 10*time.Millisecond),
+			context.DeadlineExceeded)
+	}
+	state := func(h *librarypb.Hold) librarypb.Hold_State {
+		got, err := s.GetHold(ctx, &librarypb.GetHoldRequest{Name: h.GetName()})
+		require.NoError(t, err)
+		return got.GetState()
+	}
+
+	// the copy is held until the pickup period has passed
+	*clock = clock.Add(s.holdPickupPeriod - time.Second)
+	runExpirer()
+	require.Equal(t, librarypb.Hold_STATE_READY, state(first))
+
+	// then it is held for the next member
+	*clock = clock.Add(2 * time.Second)
+	runExpirer()
+	require.Equal(t, librarypb.Hold_STATE_EXPIRED, state(first))
+	require.Equal(t, librarypb.Hold_STATE_READY, state(next))
+
+	// and made available when nobody waits
+	*clock = clock.Add(s.holdPickupPeriod + time.Second)
+	runExpirer()
+	require.Equal(t, librarypb.Hold_STATE_EXPIRED, state(next))
+	c, err := s.store.GetCopy(ctx, testCirculationISBN, "c1")
+	require.NoError(t, err)
+	require.Equal(t, statusAvailable, c.Status)
+}
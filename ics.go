@@ -0,0 +1,96 @@
+package library
+
+import (
+	"bytes"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// icsContentType is the media type of the iCalendar files.
+const icsContentType = "text/calendar; charset=utf-8"
+
+// icsEvent is an all-day event of an iCalendar file.
+type icsEvent struct {
+	UID         string // unique among the events of the library
+	Summary     string
+	Description string // May be empty
+	StartDate   string // The first day on the format YYYY-MM-DD
+	EndDate     string // The last day on the format YYYY-MM-DD
+}
+
+// icsDateLayout and icsTimeLayout are the layouts of the dates and the UTC
+// times in an iCalendar file.
+const (
+	icsDateLayout = "20060102"
+	icsTimeLayout = "20060102T150405Z"
+)
+
+// encodeICS encodes the events as an iCalendar file as described in RFC 5545.
+// The events are stamped with now.
+func encodeICS(events []icsEvent, now time.Time) []byte {
+	var buf bytes.Buffer
+	writeICSLine(&buf, "BEGIN:VCALENDAR")
+	writeICSLine(&buf, "VERSION:2.0")
+	writeICSLine(&buf, "PRODID:-//NicolaiMordrup//library//EN")
+	writeICSLine(&buf, "CALSCALE:GREGORIAN")
+	for _, e := range events {
+		start, err := time.Parse(dateLayout, e.StartDate)
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse(dateLayout, e.EndDate)
+		if err != nil {
+			end = start
+		}
+		writeICSLine(&buf, "BEGIN:VEVENT")
+		writeICSLine(&buf, "UID:"+escapeICSText(e.UID)+"@library")
+		writeICSLine(&buf, "DTSTAMP:"+now.UTC().Format(icsTimeLayout))
+		writeICSLine(&buf, "DTSTART;VALUE=DATE:"+start.Format(icsDateLayout))
+		// the end date of an all-day event is the day after the last day
+		writeICSLine(&buf, "DTEND;VALUE=DATE:"+end.AddDate(0, 0, 1).Format(icsDateLayout))
+		writeICSLine(&buf, "SUMMARY:"+escapeICSText(e.Summary))
+		if e.Description != "" {
+			writeICSLine(&buf, "DESCRIPTION:"+escapeICSText(e.Description))
+		}
+		writeICSLine(&buf, "TRANSP:TRANSPARENT")
+		writeICSLine(&buf, "END:VEVENT")
+	}
+	writeICSLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// writeICSLine writes a content line ended by CRLF, folding it so that no
+// line is longer than 75 octets without splitting a character.
+func writeICSLine(buf *bytes.Buffer, line string) {
+	const maxOctets = 75
+	limit := maxOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// the continuation lines start with the folding space
+		limit = maxOctets - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// icsTextEscaper escapes the characters with a special meaning in the text
+// values of an iCalendar file.
+var icsTextEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+)
+
+// escapeICSText escapes a text value of an iCalendar file.
+func escapeICSText(s string) string {
+	return icsTextEscaper.Replace(s)
+}
@@ -0,0 +1,178 @@
+// Package isbn validates, normalizes and hyphenates International Standard
+// Book Numbers.
+//
+// Both ISBN-10 and ISBN-13 are accepted, with or without the hyphens and
+// spaces separating their elements. The canonical form of an ISBN is the 13
+// digits of its ISBN-13, so that '0-306-40615-2', '978-0-306-40615-7' and
+// '9780306406157' are all the same book.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+// The errors returned by Normalize. They are matched with errors.Is.
+var (
+	// ErrLength is returned when an ISBN has neither 10 nor 13 digits.
+	ErrLength = errors.New("an isbn has 10 or 13 digits")
+	// ErrCharacter is returned when an ISBN contains other characters than
+	// digits, hyphens and spaces, or an 'X' which is not the check digit of an
+	// ISBN-10.
+	ErrCharacter = errors.New("an isbn only contains digits, hyphens and spaces," +
+		" and an ISBN-10 may end with 'X'")
+	// ErrCheckDigit is returned when the check digit of an ISBN does not match
+	// its other digits.
+	ErrCheckDigit = errors.New("the check digit of the isbn is wrong")
+	// ErrPrefix is returned when an ISBN-13 does not start with the prefix 978
+	// or 979.
+	ErrPrefix = errors.New("an ISBN-13 starts with 978 or 979")
+)
+
+// Normalize returns the canonical ISBN-13 of an ISBN-10 or ISBN-13. Hyphens
+// and spaces are stripped, the check digit is validated and an ISBN-10 is
+// converted to its ISBN-13 with the prefix 978.
+func Normalize(s string) (string, error) {
+	digits := strip(s)
+	for i, r := range digits {
+		isCheckX := (r == 'X' || r == 'x') && i == 9 && len(digits) == 10
+		if (r < '0' || r > '9') && !isCheckX {
+			return "", ErrCharacter
+		}
+	}
+
+	switch len(digits) {
+	case 10:
+		digits = strings.ToUpper(digits)
+		if checkDigit10(digits[:9]) != digits[9] {
+			return "", ErrCheckDigit
+		}
+		return To13(digits)
+	case 13:
+		if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+			return "", ErrPrefix
+		}
+		if checkDigit13(digits[:12]) != digits[12] {
+			return "", ErrCheckDigit
+		}
+		return digits, nil
+	}
+	return "", ErrLength
+}
+
+// Valid reports whether s is an ISBN-10 or an ISBN-13 with a correct check
+// digit, with or without hyphens and spaces.
+func Valid(s string) bool {
+	_, err := Normalize(s)
+	return err == nil
+}
+
+// To13 converts an ISBN-10 to its ISBN-13 by adding the prefix 978 and
+// recomputing the check digit. The check digit of the ISBN-10 is not
+// validated.
+func To13(isbn10 string) (string, error) {
+	digits := strip(isbn10)
+	if len(digits) != 10 {
+		return "", ErrLength
+	}
+	for _, r := range digits[:9] {
+		if r < '0' || r > '9' {
+			return "", ErrCharacter
+		}
+	}
+	body := "978" + digits[:9]
+	return body + string(checkDigit13(body)), nil
+}
+
+// Hyphenate renders a canonical ISBN-13 for display, separating the prefix,
+// the registration group and the check digit, e.g. '978-0-30640615-7'. The
+// registrant and the publication are not separated, as their ranges are
+// assigned by every registration group. An ISBN-13 of an unassigned group is
+// rendered without a group, and other input is returned as is.
+func Hyphenate(isbn13 string) string {
+	if len(isbn13) != 13 || strings.Trim(isbn13, "0123456789") != "" {
+		return isbn13
+	}
+	prefix, rest, check := isbn13[:3], isbn13[3:12], isbn13[12:]
+	n := groupLength(prefix, rest)
+	if n == 0 {
+		return prefix + "-" + rest + "-" + check
+	}
+	return prefix + "-" + rest[:n] + "-" + rest[n:] + "-" + check
+}
+
+// groupRange is a range of registration groups of the same length, given by
+// the first seven digits after the prefix as in the ISBN range message of the
+// International ISBN Agency.
+type groupRange struct {
+	first, last string
+	length      int
+}
+
+// groupRanges are the assigned registration groups of the prefixes.
+var groupRanges = map[string][]groupRange{
+	"978": {
+		{"0000000", "5999999", 1},
+		{"6000000", "6499999", 3},
+		{"6500000", "6599999", 2},
+		{"7000000", "7999999", 1},
+		{"8000000", "9499999", 2},
+		{"9500000", "9899999", 3},
+		{"9900000", "9989999", 4},
+		{"9990000", "9999999", 5},
+	},
+	"979": {
+		{"1000000", "1399999", 2},
+		{"8000000", "8999999", 1},
+	},
+}
+
+// groupLength returns the number of digits of the registration group of the
+// digits following the prefix, or 0 if the group is not assigned.
+func groupLength(prefix, rest string) int {
+	key := rest[:7]
+	for _, r := range groupRanges[prefix] {
+		if key >= r.first && key <= r.last {
+			return r.length
+		}
+	}
+	return 0
+}
+
+// strip removes the hyphens and spaces of an ISBN.
+func strip(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(s))
+}
+
+// checkDigit10 computes the check digit of the first nine digits of an
+// ISBN-10, which is 'X' for ten.
+func checkDigit10(body string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(body[i]-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// checkDigit13 computes the check digit of the first twelve digits of an
+// ISBN-13.
+func checkDigit13(body string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(body[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
@@ -0,0 +1,65 @@
+package isbn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{in: "9780306406157", want: "9780306406157"},
+		{in: "978-0-306-40615-7", want: "9780306406157"},
+		{in: " 978 0 306 40615 7 ", want: "9780306406157"},
+		{in: "0-306-40615-2", want: "9780306406157"},
+		{in: "0306406152", want: "9780306406157"},
+		{in: "0-8044-2957-X", want: "9780804429573"},
+		{in: "080442957x", want: "9780804429573"},
+		{in: "979-10-90636-07-1", want: "9791090636071"},
+		{in: "9780306406158", wantErr: ErrCheckDigit},
+		{in: "0306406153", wantErr: ErrCheckDigit},
+		{in: "9770306406157", wantErr: ErrPrefix},
+		{in: "97803064061", wantErr: ErrLength},
+		{in: "", wantErr: ErrLength},
+		{in: "978030640615X", wantErr: ErrCharacter},
+		{in: "X306406152", wantErr: ErrCharacter},
+		{in: "books/9780306406157", wantErr: ErrCharacter},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := Normalize(tc.in)
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				require.False(t, Valid(tc.in))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+			require.True(t, Valid(tc.in))
+		})
+	}
+}
+
+func TestHyphenate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{in: "9780306406157", want: "978-0-30640615-7"},
+		{in: "978-0-306-40615-7", want: "978-0-306-40615-7"},
+		{in: "9786001191251", want: "978-600-119125-1"},
+		{in: "9788804429573", want: "978-88-0442957-3"},
+		{in: "9789995501235", want: "978-99955-0123-5"},
+		{in: "9791090636071", want: "979-10-9063607-1"},
+		{in: "9798602405453", want: "979-8-60240545-3"},
+		{in: "9799000000001", want: "979-900000000-1"},
+		{in: "978030640615", want: "978030640615"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			require.Equal(t, tc.want, Hyphenate(tc.in))
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package library
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWTConfig configures the keys and the claims of the JWTs accepted as bearer
+// tokens. The tokens are verified locally, the keys are never fetched.
+type JWTConfig struct {
+	HS256Secrets    [][]byte         // The shared secrets of HS256 tokens
+	RS256PublicKeys []*rsa.PublicKey // The public keys of RS256 tokens
+	JWKS            []byte           // The contents of a JWKS file, may be empty
+	Issuer          string           // The required iss claim, if not empty
+	Audience        string           // The required aud claim, if not empty
+}
+
+// jwtLeeway is the clock skew allowed when checking the exp and nbf claims.
+const jwtLeeway = time.Minute
+
+// jwtKey is a key verifying the signatures of the JWTs of an algorithm.
+type jwtKey struct {
+	id     string // The kid of the key, empty if it has none
+	alg    string // HS256 or RS256
+	secret []byte
+	public *rsa.PublicKey
+}
+
+// jwtVerifier verifies the signature and the claims of JWTs.
+type jwtVerifier struct {
+	keys     []jwtKey
+	issuer   string
+	audience string
+}
+
+// jwtClaims are the registered claims of a JWT which are checked.
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+// jwtAudience is the aud claim, which is either a string or an array of
+// strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("aud must be a string or an array of strings, %w", err)
+	}
+	*a = many
+	return nil
+}
+
+// contains reports whether the audience holds the aud.
+func (a jwtAudience) contains(aud string) bool {
+	for _, candidate := range a {
+		if candidate == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// newJWTVerifier creates the verifier of the configured keys.
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{issuer: cfg.Issuer, audience: cfg.Audience}
+	for _, secret := range cfg.HS256Secrets {
+		v.keys = append(v.keys, jwtKey{alg: "HS256", secret: secret})
+	}
+	for _, public := range cfg.RS256PublicKeys {
+		v.keys = append(v.keys, jwtKey{alg: "RS256", public: public})
+	}
+	if len(cfg.JWKS) != 0 {
+		keys, err := parseJWKS(cfg.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	return v, nil
+}
+
+// verify checks the signature and the claims of the token and returns its
+// claims.
+func (v *jwtVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	if len(v.keys) == 0 {
+		return jwtClaims{}, errors.New("no keys are configured to verify JWTs")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return jwtClaims{}, fmt.Errorf("malformed JWT header, %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, fmt.Errorf("malformed JWT signature, %w", err)
+	}
+	if !v.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature) {
+		return jwtClaims{}, errors.New("invalid JWT signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return jwtClaims{}, fmt.Errorf("malformed JWT claims, %w", err)
+	}
+	switch {
+	case claims.ExpiresAt == nil:
+		return jwtClaims{}, errors.New("the JWT has no exp claim")
+	case now.After(unixTime(*claims.ExpiresAt).Add(jwtLeeway)):
+		return jwtClaims{}, errors.New("the JWT has expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)):
+		return jwtClaims{}, errors.New("the JWT is not valid yet")
+	case claims.Subject == "":
+		return jwtClaims{}, errors.New("the JWT has no sub claim")
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return jwtClaims{}, errors.New("the JWT has another issuer")
+	case v.audience != "" && !claims.Audience.contains(v.audience):
+		return jwtClaims{}, errors.New("the JWT is meant for another audience")
+	}
+	return claims, nil
+}
+
+// verifySignature reports whether a key of the algorithm signed the signed
+// part of a JWT. Only the keys with the key id are tried if both the token
+// and the key have one.
+func (v *jwtVerifier) verifySignature(alg, kid, signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	for _, key := range v.keys {
+		if key.alg != alg || (kid != "" && key.id != "" && key.id != kid) {
+			continue
+		}
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, key.secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case "RS256":
+			if rsa.VerifyPKCS1v15(key.public, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeJWTSegment decodes the base64url encoded JSON of a header or claims
+// segment of a JWT.
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// unixTime converts a NumericDate claim to a time.
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// parseJWKS reads the RSA keys and the symmetric keys of a JWKS file. Keys of
+// other types, and keys which are only used for encryption, are skipped.
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS, %w", err)
+	}
+
+	var keys []jwtKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse n of JWKS key %d, %w", i, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("failed to parse e of JWKS key %d", i)
+			}
+			keys = append(keys, jwtKey{id: k.Kid, alg: "RS256", public: &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}})
+		case k.Kty == "oct" && (k.Alg == "" || k.Alg == "HS256"):
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("failed to parse k of JWKS key %d", i)
+			}
+			keys = append(keys, jwtKey{id: k.Kid, alg: "HS256", secret: secret})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("the JWKS holds no RS256 or HS256 signing keys")
+	}
+	return keys, nil
+}
+
+// ParseRSAPublicKeyPEM parses a PEM encoded RSA public key, either as a
+// PKIX "PUBLIC KEY" or a PKCS #1 "RSA PUBLIC KEY" block.
+func ParseRSAPublicKeyPEM(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key, %w", err)
+		}
+		public, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("the public key is not an RSA key")
+		}
+		return public, nil
+	case "RSA PUBLIC KEY":
+		public, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key, %w", err)
+		}
+		return public, nil
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+}
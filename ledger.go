@@ -0,0 +1,364 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// checks if we have implementat all the different functions
+var _ librarypb.FinesServiceServer = new(libraryServiceServer)
+
+// LedgerEntry is a charge, payment, waiver or refund in the ledger of a
+// member. Amounts are in the minor unit of the currency, e.g. cents.
+type LedgerEntry struct {
+	ID           string    `json:"id"` // The random id in 'members/{member}/ledgerEntries/{id}'
+	MemberID     string    `json:"memberId"`
+	Type         string    `json:"type"`
+	AmountCents  int64     `json:"amountCents"` // Always positive, the type gives the sign
+	CurrencyCode string    `json:"currencyCode"`
+	LoanID       string    `json:"loanId"` // The charged loan, empty for other types
+	Description  string    `json:"description"`
+	BalanceCents int64     `json:"balanceCents"` // The balance after the entry
+	CreateTime   time.Time `json:"createTime"`
+}
+
+// The types of a ledger entry.
+const (
+	entryOverdueFine = "overdue_fine"
+	entryLostItem    = "lost_item"
+	entryPayment     = "payment"
+	entryWaiver      = "waiver"
+	entryRefund      = "refund"
+)
+
+// signedAmount returns the amount of the entry as it adds to the balance.
+// Charges and refunds increase what the member owes, payments and waivers
+// decrease it.
+func (e *LedgerEntry) signedAmount() int64 {
+	if e.Type == entryPayment || e.Type == entryWaiver {
+		return -e.AmountCents
+	}
+	return e.AmountCents
+}
+
+// ledgerTotals are the sums of the amounts of the ledger entries of a member,
+// keyed by their type.
+type ledgerTotals map[string]int64
+
+// balance returns what the member owes. It is negative if the member has a
+// credit.
+func (t ledgerTotals) balance() int64 {
+	return t[entryOverdueFine] + t[entryLostItem] + t[entryRefund] -
+		t[entryPayment] - t[entryWaiver]
+}
+
+// FinePolicy holds the rates of the fines and the balance at which a member
+// can no longer borrow. All amounts are in the minor unit of the currency.
+type FinePolicy struct {
+	CurrencyCode        string // the ISO 4217 code of the currency of the ledgers
+	DailyRateCents      int64  // the fine for each day a copy is returned late
+	MaxFineCents        int64  // the maximum overdue fine of a single loan
+	ReplacementCents    int64  // the charge for a lost copy without a price in the currency
+	BlockThresholdCents int64  // members owing more than this can not borrow
+}
+
+// DefaultFinePolicy is the fine policy used unless configured otherwise.
+var DefaultFinePolicy = FinePolicy{
+	CurrencyCode:        "EUR",
+	DailyRateCents:      25,
+	MaxFineCents:        1000,
+	ReplacementCents:    2500,
+	BlockThresholdCents: 1000,
+}
+
+// The field paths of a LedgerEntry which are validated.
+const (
+	fieldType        = "type"
+	fieldAmountCents = "amount_cents"
+)
+
+// ledgerEntryFromName returns the member id and the id of a ledger entry name
+// on the format 'members/{member}/ledgerEntries/{id}'.
+func ledgerEntryFromName(name string) (string, string) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "members" || parts[2] != "ledgerEntries" {
+		return "", ""
+	}
+	return parts[1], parts[3]
+}
+
+// NewLedgerEntryFromProto converts a *librarypb.LedgerEntry to a LedgerEntry.
+// Only the fields set by the clients are converted.
+func NewLedgerEntryFromProto(e *librarypb.LedgerEntry) LedgerEntry {
+	memberID, id := ledgerEntryFromName(e.GetName())
+	entry := LedgerEntry{
+		ID:           id,
+		MemberID:     memberID,
+		AmountCents:  e.GetAmountCents(),
+		CurrencyCode: e.GetCurrencyCode(),
+		Description:  e.GetDescription(),
+	}
+	if e.GetType() != librarypb.LedgerEntry_TYPE_UNSPECIFIED {
+		entry.Type = strings.ToLower(strings.TrimPrefix(e.GetType().String(), "TYPE_"))
+	}
+	return entry
+}
+
+// AsProto converts the LedgerEntry to a *librarypb.LedgerEntry.
+func (e *LedgerEntry) AsProto() *librarypb.LedgerEntry {
+	entry := &librarypb.LedgerEntry{
+		Name: "members/" + e.MemberID + "/ledgerEntries/" + e.ID,
+		Type: librarypb.LedgerEntry_Type(
+			librarypb.LedgerEntry_Type_value["TYPE_"+strings.ToUpper(e.Type)]),
+		AmountCents:  e.AmountCents,
+		CurrencyCode: e.CurrencyCode,
+		Description:  e.Description,
+		BalanceCents: e.BalanceCents,
+		CreateTime:   timestamppb.New(e.CreateTime),
+	}
+	if e.LoanID != "" {
+		entry.Loan = "loans/" + e.LoanID
+	}
+	return entry
+}
+
+// validatePayment validates a payment, waiver or refund posted by a client and
+// returns a violation for every invalid field.
+func (s *libraryServiceServer) validatePayment(
+	e LedgerEntry) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	if e.Type != entryPayment && e.Type != entryWaiver && e.Type != entryRefund {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       fieldType,
+			Description: "must be a payment, a waiver or a refund",
+		})
+	}
+	if e.AmountCents <= 0 {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       fieldAmountCents,
+			Description: "must be positive",
+		})
+	}
+	if e.CurrencyCode != s.fines.CurrencyCode {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       fieldCurrencyCode,
+			Description: "must be " + s.fines.CurrencyCode,
+		})
+	}
+	return violations
+}
+
+// appendLedgerEntry gives the entry a new id and the balance after it, and
+// stores it in the ledger of its member.
+func appendLedgerEntry(ctx context.Context, tx LedgerStore, e *LedgerEntry) error {
+	id, err := newResourceID()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to create ledger entry id")
+	}
+	totals, err := tx.LedgerTotals(ctx, e.MemberID)
+	if err != nil {
+		return err
+	}
+	e.ID = id
+	e.BalanceCents = totals.balance() + e.signedAmount()
+	return tx.AppendLedgerEntry(ctx, *e)
+}
+
+// fineStore is the storage of the calendars and the ledgers used to charge
+// the overdue fines.
+type fineStore interface {
+	CalendarStore
+	LedgerStore
+}
+
+// chargeOverdueFine charges the member of a returned loan the daily rate for
+// every day the branch of the checkout was open after the due date, up to the
+// maximum fine.
+func (s *libraryServiceServer) chargeOverdueFine(ctx context.Context, tx fineStore,
+	l Loan) error {
+	due, err := time.ParseInLocation(dateLayout, l.DueDate, l.ReturnTime.Location())
+	if err != nil || !l.ReturnTime.After(due) || s.fines.DailyRateCents <= 0 {
+		return nil
+	}
+	cal, err := loadCalendar(ctx, tx, l.Branch, due, l.ReturnTime)
+	if err != nil {
+		return err
+	}
+	days := cal.lateDays(due, l.ReturnTime)
+	if days <= 0 {
+		return nil
+	}
+	amount := int64(days) * s.fines.DailyRateCents
+	if s.fines.MaxFineCents > 0 && amount > s.fines.MaxFineCents {
+		amount = s.fines.MaxFineCents
+	}
+	return appendLedgerEntry(ctx, tx, &LedgerEntry{
+		MemberID:     l.MemberID,
+		Type:         entryOverdueFine,
+		AmountCents:  amount,
+		CurrencyCode: s.fines.CurrencyCode,
+		LoanID:       l.ID,
+		Description:  fmt.Sprintf("returned %d days late", days),
+		CreateTime:   l.ReturnTime,
+	})
+}
+
+// chargeLostItem charges the member of a lost loan the price of the copy, or
+// the replacement charge if the copy has no price in the currency of the
+// ledger.
+func (s *libraryServiceServer) chargeLostItem(ctx context.Context, tx LedgerStore,
+	l Loan, c Copy) error {
+	amount := s.fines.ReplacementCents
+	if c.PriceCents > 0 && c.CurrencyCode == s.fines.CurrencyCode {
+		amount = c.PriceCents
+	}
+	if amount <= 0 {
+		return nil
+	}
+	return appendLedgerEntry(ctx, tx, &LedgerEntry{
+		MemberID:     l.MemberID,
+		Type:         entryLostItem,
+		AmountCents:  amount,
+		CurrencyCode: s.fines.CurrencyCode,
+		LoanID:       l.ID,
+		Description:  "replacement of copy " + c.ID,
+		// listed after the overdue fine of the same loan
+		CreateTime: l.ReturnTime.Add(time.Nanosecond),
+	})
+}
+
+// checkMayBorrow returns a FailedPrecondition status if the member is blocked,
+// the membership has expired or the member owes more than the block threshold
+// of the fine policy.
+func (s *libraryServiceServer) checkMayBorrow(ctx context.Context, tx LedgerStore,
+	m Member, now time.Time) error {
+	if m.Blocked {
+		if m.BlockReason != "" {
+			return status.Errorf(codes.FailedPrecondition,
+				"the member is blocked: %s", m.BlockReason)
+		}
+		return status.Errorf(codes.FailedPrecondition, "the member is blocked")
+	}
+	if m.ExpiryDate < now.Format(dateLayout) {
+		return status.Errorf(codes.FailedPrecondition,
+			"the membership expired on %s", m.ExpiryDate)
+	}
+	totals, err := tx.LedgerTotals(ctx, m.ID)
+	if err != nil {
+		return err
+	}
+	if balance := totals.balance(); balance > s.fines.BlockThresholdCents {
+		return status.Errorf(codes.FailedPrecondition,
+			"the member owes %d %s minor units, more than the limit of %d",
+			balance, s.fines.CurrencyCode, s.fines.BlockThresholdCents)
+	}
+	return nil
+}
+
+// CreateLedgerEntry posts a payment, a waiver or a refund to the ledger of a
+// member. Charges are only posted by the circulation. A payment can not be
+// more than the member owes, a waiver not more than the charges which have
+// not been waived and a refund not more than the credit of the member.
+func (s *libraryServiceServer) CreateLedgerEntry(ctx context.Context,
+	req *librarypb.CreateLedgerEntryRequest) (*librarypb.LedgerEntry, error) {
+
+	entry := NewLedgerEntryFromProto(req.GetLedgerEntry())
+	if violations := s.validatePayment(entry); violations != nil {
+		return nil, invalidFieldsError(inField("ledger_entry", violations))
+	}
+	entry.MemberID = memberIDFromName(req.GetParent())
+	entry.LoanID = ""
+	entry.CreateTime = s.now()
+
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		if _, err := tx.GetMember(ctx, entry.MemberID); err != nil {
+			return err
+		}
+		totals, err := tx.LedgerTotals(ctx, entry.MemberID)
+		if err != nil {
+			return err
+		}
+		balance := totals.balance()
+		switch {
+		case entry.Type == entryPayment && entry.AmountCents > balance:
+			return status.Errorf(codes.FailedPrecondition,
+				"the payment is more than the balance of %d", balance)
+		case entry.Type == entryWaiver && entry.AmountCents >
+			totals[entryOverdueFine]+totals[entryLostItem]-totals[entryWaiver]:
+			return status.Errorf(codes.FailedPrecondition,
+				"the waiver is more than the charges which have not been waived")
+		case entry.Type == entryRefund && entry.AmountCents > -balance:
+			return status.Errorf(codes.FailedPrecondition,
+				"the refund is more than the credit of %d", -balance)
+		}
+		return appendLedgerEntry(ctx, tx, &entry)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return entry.AsProto(), nil
+}
+
+// ListLedgerEntries retreives a page of the ledger entries of a member in the
+// order they were posted.
+func (s *libraryServiceServer) ListLedgerEntries(ctx context.Context,
+	req *librarypb.ListLedgerEntriesRequest) (*librarypb.ListLedgerEntriesResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	memberID := memberIDFromName(req.GetParent())
+	checksum := listChecksum(memberID, "ledgerEntries", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 2)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	if _, err := s.store.GetMember(ctx, memberID); err != nil {
+		return nil, s.toStatus(err)
+	}
+	entries, next, err := s.store.ListLedgerEntries(ctx, memberID, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListLedgerEntriesResponse{}
+	for _, entry := range entries {
+		resp.LedgerEntries = append(resp.LedgerEntries, entry.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// GetBalance retreives what a member owes and whether the member is blocked
+// from borrowing because of it.
+func (s *libraryServiceServer) GetBalance(ctx context.Context,
+	req *librarypb.GetBalanceRequest) (*librarypb.Balance, error) {
+
+	memberID := memberIDFromName(strings.TrimSuffix(req.GetName(), "/balance"))
+	if _, err := s.store.GetMember(ctx, memberID); err != nil {
+		return nil, s.toStatus(err)
+	}
+	totals, err := s.store.LedgerTotals(ctx, memberID)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	balance := totals.balance()
+	return &librarypb.Balance{
+		Name:            "members/" + memberID + "/balance",
+		BalanceCents:    balance,
+		CurrencyCode:    s.fines.CurrencyCode,
+		CheckoutBlocked: balance > s.fines.BlockThresholdCents,
+	}, nil
+}
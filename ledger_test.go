@@ -0,0 +1,106 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOverdueFines(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newCirculationServer(t)
+	s.fines = FinePolicy{
+		CurrencyCode:        "EUR",
+		DailyRateCents:      100,
+		MaxFineCents:        500,
+		ReplacementCents:    2500,
+		BlockThresholdCents: 400,
+	}
+	createTestCopies(t, s, "c1", "c2")
+	checkoutTime := *clock
+
+	// lends the copy on the first day and returns it at the given time
+	lendAndReturn := func(copyID string, returned time.Time) {
+		*clock = checkoutTime
+		loan, err := checkout(s, copyID, testMemberID)
+		require.NoError(t, err)
+		require.Equal(t, "2021-09-22", loan.GetDueDate())
+		*clock = returned
+		_, err = s.ReturnCopy(ctx, &librarypb.ReturnCopyRequest{Name: copyName(copyID)})
+		require.NoError(t, err)
+	}
+	balance := func() int64 {
+		resp, err := s.ListLedgerEntries(ctx, &librarypb.ListLedgerEntriesRequest{
+			Parent: "members/" + testMemberID})
+		require.NoError(t, err)
+		entries := resp.GetLedgerEntries()
+		if len(entries) == 0 {
+			return 0
+		}
+		return entries[len(entries)-1].GetBalanceCents()
+	}
+
+	// a copy returned on its due date is not fined
+	lendAndReturn("c1", time.Date(2021, 9, 22, 18, 0, 0, 0, time.UTC))
+	require.Zero(t, balance())
+
+	// every day after the due date is fined
+	lendAndReturn("c1", time.Date(2021, 9, 25, 12, 0, 0, 0, time.UTC))
+	require.EqualValues(t, 300, balance())
+
+	// the fine of a loan is capped, after which the member owes more than the
+	// block threshold and can not borrow
+	lendAndReturn("c2", time.Date(2021, 10, 22, 12, 0, 0, 0, time.UTC))
+	require.EqualValues(t, 800, balance())
+	_, err := checkout(s, "c1", testMemberID)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "more than the limit of 400")
+
+	pay := func(amount int64) error {
+		*clock = clock.Add(time.Minute)
+		_, err := s.CreateLedgerEntry(ctx, &librarypb.CreateLedgerEntryRequest{
+			Parent: "members/" + testMemberID,
+			LedgerEntry: &librarypb.LedgerEntry{
+				Type:         librarypb.LedgerEntry_TYPE_PAYMENT,
+				AmountCents:  amount,
+				CurrencyCode: "EUR",
+			},
+		})
+		return err
+	}
+	require.Equal(t, codes.FailedPrecondition, status.Code(pay(801)))
+
+	// a member owing the block threshold may borrow again
+	require.NoError(t, pay(400))
+	require.EqualValues(t, 400, balance())
+	_, err = checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+}
+
+func TestLostItemCharge(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newCirculationServer(t)
+	createTestCopies(t, s, "c1")
+	_, err := checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+
+	// a lost copy is charged its price besides the capped overdue fine
+	*clock = time.Date(2021, 12, 1, 12, 0, 0, 0, time.UTC)
+	_, err = s.MarkCopyLost(ctx, &librarypb.MarkCopyLostRequest{Name: copyName("c1")})
+	require.NoError(t, err)
+	resp, err := s.ListLedgerEntries(ctx, &librarypb.ListLedgerEntriesRequest{
+		Parent: "members/" + testMemberID})
+	require.NoError(t, err)
+	entries := resp.GetLedgerEntries()
+	require.Len(t, entries, 2)
+	require.Equal(t, librarypb.LedgerEntry_TYPE_OVERDUE_FINE, entries[0].GetType())
+	require.Equal(t, DefaultFinePolicy.MaxFineCents, entries[0].GetAmountCents())
+	require.Equal(t, librarypb.LedgerEntry_TYPE_LOST_ITEM, entries[1].GetType())
+	require.EqualValues(t, 1999, entries[1].GetAmountCents())
+	require.Equal(t, DefaultFinePolicy.MaxFineCents+1999, entries[1].GetBalanceCents())
+}
@@ -0,0 +1,425 @@
+package library
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The page size limits for listing books.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// listColumn describes a Book field that can be used in a filter or an
+// order_by expression, together with the SQL expression it maps to and the
+// value it is compared by in memory.
+type listColumn struct {
+	expr   string
+	value  func(b Book) string
+	isTime bool
+	isName bool
+	// namePrefix is the prefix of the resource names the column holds the ids
+	// of, which is stripped from the filter values.
+	namePrefix string
+}
+
+// listColumns maps the proto field paths of a Book to the database columns.
+// The author fields are the names of the first credited author, and publisher
+// is the name of the publisher in the format 'publishers/{publisher}'.
+var listColumns = map[string]listColumn{
+	"name": {
+		expr:       "library.isbn",
+		value:      func(b Book) string { return b.ISBN },
+		isName:     true,
+		namePrefix: "books/",
+	},
+	"title": {
+		expr:  "library.title",
+		value: func(b Book) string { return b.Title },
+	},
+	"publisher": {
+		expr:       "COALESCE(library.publisherId, '')",
+		value:      func(b Book) string { return b.Publisher },
+		namePrefix: "publishers/",
+	},
+	"publisher.display_name": {
+		expr: "COALESCE((SELECT publishers.displayName FROM publishers" +
+			" WHERE publishers.id = library.publisherId), '')",
+		value: func(b Book) string { return b.PublisherName },
+	},
+	"author.first_name": {
+		expr:  firstAuthorExpr("firstName"),
+		value: func(b Book) string { return firstAuthor(b).FirstName },
+	},
+	"author.last_name": {
+		expr:  firstAuthorExpr("lastName"),
+		value: func(b Book) string { return firstAuthor(b).LastName },
+	},
+	"create_time": {
+		expr:   "library.createTime",
+		value:  func(b Book) string { return formatTime(b.CreateTime) },
+		isTime: true,
+	},
+	"update_time": {
+		expr:   "library.updateTime",
+		value:  func(b Book) string { return formatTime(b.UpdateTime) },
+		isTime: true,
+	},
+}
+
+// firstAuthorExpr returns the SQL expression of a column of the first
+// credited author of a book.
+func firstAuthorExpr(column string) string {
+	return "COALESCE((SELECT authors." + column + " FROM book_authors" +
+		" INNER JOIN authors ON authors.id = book_authors.authorId" +
+		" WHERE book_authors.isbn = library.isbn AND book_authors.position = 0), '')"
+}
+
+// firstAuthor returns the first credited author of a book.
+func firstAuthor(b Book) BookAuthor {
+	if len(b.Authors) == 0 {
+		return BookAuthor{}
+	}
+	return b.Authors[0]
+}
+
+// filterClause is a single comparison in a filter expression,
+// e.g. 'publisher.display_name = "Penguin"'.
+type filterClause struct {
+	column   listColumn
+	operator string
+	value    string
+}
+
+// matches reports whether the book satisfies the comparison.
+func (c filterClause) matches(b Book) bool {
+	v := c.column.value(b)
+	switch c.operator {
+	case "=":
+		return v == c.value
+	case "!=":
+		return v != c.value
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	case ">":
+		return v > c.value
+	case ">=":
+		return v >= c.value
+	}
+	return false
+}
+
+// orderField is a single field in an order_by expression.
+type orderField struct {
+	column listColumn
+	desc   bool
+}
+
+// listQuery holds a parsed ListBooks request.
+type listQuery struct {
+	pageSize int
+	filter   []filterClause
+	orderBy  []orderField
+	// after holds the ordering values of the last book of the previous page.
+	after       []string
+	showDeleted bool
+	// availableAt is the branch the books must have an available copy at, if
+	// set.
+	availableAt string
+	// checksum ties the page tokens to the parameters of the request.
+	checksum uint32
+}
+
+// pageToken is the content of the opaque page token handed to clients.
+type pageToken struct {
+	Checksum uint32   `json:"c"`
+	After    []string `json:"a"`
+}
+
+// newListQuery validates and parses the paging, filter, ordering and branch
+// parameters of a ListBooks request.
+func newListQuery(pageSize int32, token, filter, orderBy string,
+	showDeleted bool, availableAt string) (listQuery, error) {
+	q := listQuery{
+		showDeleted: showDeleted,
+		availableAt: availableAt,
+		// the branch is appended to the order_by, which never contains a NUL
+		checksum: listChecksum(filter, orderBy+"\x00"+availableAt, showDeleted),
+	}
+	var err error
+
+	if availableAt != "" && !branchPattern.MatchString(availableAt) {
+		return q, &fieldError{"available_at_branch",
+			"must be lowercase letters and digits separated by dashes"}
+	}
+
+	if q.pageSize, err = parsePageSize(pageSize); err != nil {
+		return q, err
+	}
+	if q.filter, err = parseFilter(filter); err != nil {
+		return q, &fieldError{"filter", err.Error()}
+	}
+	if q.orderBy, err = parseOrderBy(orderBy); err != nil {
+		return q, &fieldError{"order_by", err.Error()}
+	}
+
+	if q.after, err = parsePageToken(token, q.checksum, len(q.orderBy)); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// allBooks reads every page of the books matching the filter.
+func allBooks(ctx context.Context, store CatalogueStore, filter string,
+	showDeleted bool) ([]Book, error) {
+	q, err := newListQuery(maxPageSize, "", filter, "", showDeleted, "")
+	if err != nil {
+		return nil, err
+	}
+	var books []Book
+	for {
+		page, next, _, err := store.ListBooks(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, page...)
+		if next == nil {
+			return books, nil
+		}
+		q.after = next
+	}
+}
+
+// parsePageSize applies the default and the maximum to a requested page size.
+func parsePageSize(pageSize int32) (int, error) {
+	switch {
+	case pageSize < 0:
+		return 0, &fieldError{"page_size", "must not be negative"}
+	case pageSize == 0:
+		return defaultPageSize, nil
+	case pageSize > maxPageSize:
+		return maxPageSize, nil
+	}
+	return int(pageSize), nil
+}
+
+// parseOrderBy parses an order_by expression such as 'create_time desc, title'.
+// The name is always appended as the last field so the ordering is total.
+func parseOrderBy(orderBy string) ([]orderField, error) {
+	var fields []orderField
+	hasName := false
+
+	if strings.TrimSpace(orderBy) != "" {
+		for _, part := range strings.Split(orderBy, ",") {
+			words := strings.Fields(part)
+			if len(words) == 0 || len(words) > 2 {
+				return nil, fmt.Errorf("malformed field %q", strings.TrimSpace(part))
+			}
+			column, ok := listColumns[words[0]]
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q", words[0])
+			}
+			desc := false
+			if len(words) == 2 {
+				switch words[1] {
+				case "asc":
+				case "desc":
+					desc = true
+				default:
+					return nil, fmt.Errorf("unknown direction %q", words[1])
+				}
+			}
+			hasName = hasName || column.isName
+			fields = append(fields, orderField{column: column, desc: desc})
+		}
+	}
+	if !hasName {
+		fields = append(fields, orderField{column: listColumns["name"]})
+	}
+	return fields, nil
+}
+
+// parseFilter parses a filter expression made of comparisons joined by AND,
+// e.g. 'publisher.display_name = "Penguin" AND author.last_name = "Lucas"'.
+func parseFilter(filter string) ([]filterClause, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var clauses []filterClause
+	for len(tokens) > 0 {
+		if len(clauses) > 0 {
+			if tokens[0] != "AND" {
+				return nil, fmt.Errorf("expected AND, got %q", tokens[0])
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 3 {
+			return nil, errors.New("incomplete comparison")
+		}
+		column, ok := listColumns[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", tokens[0])
+		}
+		operator := tokens[1]
+		switch operator {
+		case "=", "!=", "<", "<=", ">", ">=":
+		default:
+			return nil, fmt.Errorf("unknown operator %q", operator)
+		}
+		value, err := filterValue(column, tokens[2])
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, filterClause{
+			column:   column,
+			operator: operator,
+			value:    value,
+		})
+		tokens = tokens[3:]
+	}
+	return clauses, nil
+}
+
+// filterValue converts a filter literal to the value stored in the database.
+// Timestamps are parsed as RFC 3339 and formatted as the stored times, in UTC
+// with a fixed width, so comparing the text compares the times.
+func filterValue(column listColumn, literal string) (string, error) {
+	value := literal
+	if strings.HasPrefix(literal, `"`) {
+		value = unquoteFilterLiteral(literal)
+	}
+	switch {
+	case column.isTime:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return "", fmt.Errorf("invalid timestamp %q", value)
+		}
+		return formatTime(t), nil
+	case column.isName:
+		return isbnFromName(value), nil
+	case column.namePrefix != "":
+		return strings.TrimPrefix(value, column.namePrefix), nil
+	}
+	return value, nil
+}
+
+// unquoteFilterLiteral returns the value of a quoted filter literal. A
+// backslash escapes the character following it, the same way tokenizeFilter
+// reads the literal, so `"a\\"` is the value `a\`.
+func unquoteFilterLiteral(literal string) string {
+	var b strings.Builder
+	runes := []rune(strings.TrimSuffix(strings.TrimPrefix(literal, `"`), `"`))
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\\' && i+1 < len(runes) {
+			i++
+		}
+		b.WriteRune(runes[i])
+	}
+	return b.String()
+}
+
+// tokenizeFilter splits a filter expression into field names, operators,
+// keywords and literals. Quoted strings are kept with their quotes.
+func tokenizeFilter(filter string) ([]string, error) {
+	var tokens []string
+	runes := []rune(filter)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"':
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, string(runes[i:j+1]))
+			i = j + 1
+		case strings.ContainsRune("=!<>", r):
+			j := i + 1
+			if j < len(runes) && runes[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) &&
+				!strings.ContainsRune(`=!<>"`, runes[j]) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// listChecksum ties a page token to the parameters it was issued for.
+func listChecksum(filter, orderBy string, showDeleted bool) uint32 {
+	h := fnv.New32a()
+	_, _ = fmt.Fprintf(h, "%s\x00%s\x00%t", filter, orderBy, showDeleted)
+	return h.Sum32()
+}
+
+// encodePageToken creates the opaque page token of the request with the
+// checksum, pointing after the given ordering values.
+func encodePageToken(checksum uint32, after []string) string {
+	b, _ := json.Marshal(pageToken{
+		Checksum: checksum,
+		After:    after,
+	})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageToken decodes a page token created by encodePageToken.
+func decodePageToken(token string) (pageToken, error) {
+	var pt pageToken
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return pt, err
+	}
+	err = json.Unmarshal(b, &pt)
+	return pt, err
+}
+
+// errInvalidPageToken is returned for a page token which was not issued for
+// the same list and parameters.
+var errInvalidPageToken = &fieldError{"page_token",
+	"must be the next_page_token of a call with the same parameters"}
+
+// parsePageToken returns the ordering values a page token points after, or
+// nil if the token is empty. The token must have been issued for the checksum
+// and hold n ordering values.
+//
+// The lists of the other collections pass the name of the collection, such as
+// "authors", as the order_by of listChecksum. ListBooks never accepts such an
+// order_by, so a page token issued by one list is never valid for another.
+func parsePageToken(token string, checksum uint32, n int) ([]string, error) {
+	if token == "" {
+		return nil, nil
+	}
+	pt, err := decodePageToken(token)
+	if err != nil || pt.Checksum != checksum || len(pt.After) != n {
+		return nil, errInvalidPageToken
+	}
+	return pt.After, nil
+}
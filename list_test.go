@@ -0,0 +1,169 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		want   []string // the operator and value of every clause
+		err    bool
+	}{
+		{filter: ``, want: nil},
+		{filter: `title = "star wars"`, want: []string{"=", "star wars"}},
+		{filter: `title="star wars"`, want: []string{"=", "star wars"}},
+		{filter: `title != abc`, want: []string{"!=", "abc"}},
+		{filter: `title = "say \"hi\""`, want: []string{"=", `say "hi"`}},
+		{filter: `title = "back\\slash"`, want: []string{"=", `back\slash`}},
+		{filter: `title = "a\\"`, want: []string{"=", `a\`}},
+		{filter: `title = "\\\"a\\\""`, want: []string{"=", `\"a\"`}},
+		{filter: `title >= "a" AND title < "m"`, want: []string{">=", "a", "<", "m"}},
+		{filter: `name = "books/978-0-00-000000-2"`, want: []string{"=", "9780000000002"}},
+		{filter: `publisher = "publishers/00000000000000e5"`,
+			want: []string{"=", "00000000000000e5"}},
+		{filter: `author.last_name = "Lucas"`, want: []string{"=", "Lucas"}},
+		// timestamps are converted to the stored format, in UTC
+		{filter: `create_time > "2021-09-01T14:00:00+02:00"`,
+			want: []string{">", formatTime(time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC))}},
+		{filter: `create_time > "yesterday"`, err: true},
+		{filter: `isbn = "9780000000002"`, err: true},
+		{filter: `title ~ "star"`, err: true},
+		{filter: `title =`, err: true},
+		{filter: `title = "star wars`, err: true},
+		{filter: `title = "a" OR title = "b"`, err: true},
+		{filter: `title = "a" title = "b"`, err: true},
+		{filter: `(title = "a")`, err: true},
+		{filter: `title = "a" AND (title = "b"`, err: true},
+		{filter: `title = "a" AND`, err: true},
+	} {
+		t.Run(tc.filter, func(t *testing.T) {
+			clauses, err := parseFilter(tc.filter)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var got []string
+			for _, c := range clauses {
+				got = append(got, c.operator, c.value)
+			}
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	for _, tc := range []struct {
+		orderBy string
+		want    []string // the expression of every field, prefixed by - if descending
+		err     bool
+	}{
+		{orderBy: "", want: []string{"library.isbn"}},
+		{orderBy: "title", want: []string{"library.title", "library.isbn"}},
+		{orderBy: "create_time desc, title asc",
+			want: []string{"-library.createTime", "library.title", "library.isbn"}},
+		{orderBy: "name desc", want: []string{"-library.isbn"}},
+		{orderBy: "isbn", err: true},
+		{orderBy: "title descending", err: true},
+		{orderBy: "title desc asc", err: true},
+		{orderBy: "title,,name", err: true},
+	} {
+		t.Run(tc.orderBy, func(t *testing.T) {
+			fields, err := parseOrderBy(tc.orderBy)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var got []string
+			for _, f := range fields {
+				expr := f.column.expr
+				if f.desc {
+					expr = "-" + expr
+				}
+				got = append(got, expr)
+			}
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestNewListQuery(t *testing.T) {
+	q, err := newListQuery(0, "", "", "", false, "")
+	require.NoError(t, err)
+	require.Equal(t, defaultPageSize, q.pageSize)
+	q, err = newListQuery(maxPageSize+1, "", "", "", false, "")
+	require.NoError(t, err)
+	require.Equal(t, maxPageSize, q.pageSize)
+	_, err = newListQuery(-1, "", "", "", false, "")
+	require.Error(t, err)
+	_, err = newListQuery(10, "", "", "", false, "Central Branch")
+	require.Error(t, err)
+
+	filter, orderBy := `title = "star wars"`, "title desc"
+	token := encodePageToken(listChecksum(filter, orderBy+"\x00", false),
+		[]string{"star wars", "9780000000001"})
+	q, err = newListQuery(10, token, filter, orderBy, false, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"star wars", "9780000000001"}, q.after)
+
+	for name, tc := range map[string]struct {
+		token, filter, orderBy string
+		showDeleted            bool
+	}{
+		"other filter":       {token, `title = "empire"`, orderBy, false},
+		"other order_by":     {token, filter, "title", false},
+		"other show_deleted": {token, filter, orderBy, true},
+		"garbage":            {"not a token", filter, orderBy, false},
+		"not json":           {"bm90IGpzb24", filter, orderBy, false},
+		"tampered": {encodePageToken(listChecksum(filter, orderBy+"\x00", false),
+			[]string{"star wars"}), filter, orderBy, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newListQuery(10, tc.token, tc.filter, tc.orderBy,
+				tc.showDeleted, "")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestListBooksPageToken(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, testStores["memory"])
+	for _, isbn := range []string{"9780000000001", "9780000000002", "9780000000003"} {
+		require.NoError(t, s.store.InsertIntoDatabase(ctx, testBook(isbn, "star wars")))
+	}
+
+	resp, err := s.ListBooks(ctx, &librarypb.ListBooksRequest{
+		PageSize: 2, Filter: `title = "star wars"`})
+	require.NoError(t, err)
+	require.Len(t, resp.GetBook(), 2)
+	require.NotEmpty(t, resp.GetNextPageToken())
+
+	// a page token is only valid with the filter and order_by it was issued for
+	_, err = s.ListBooks(ctx, &librarypb.ListBooksRequest{PageSize: 2,
+		PageToken: resp.GetNextPageToken(), Filter: `title = "empire"`})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.ListBooks(ctx, &librarypb.ListBooksRequest{PageSize: 2,
+		PageToken: resp.GetNextPageToken(), Filter: `title = "star wars"`,
+		OrderBy: "title"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.ListBooks(ctx, &librarypb.ListBooksRequest{PageSize: 2,
+		PageToken: resp.GetNextPageToken() + "x", Filter: `title = "star wars"`})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	resp, err = s.ListBooks(ctx, &librarypb.ListBooksRequest{PageSize: 2,
+		PageToken: resp.GetNextPageToken(), Filter: `title = "star wars"`})
+	require.NoError(t, err)
+	require.Len(t, resp.GetBook(), 1)
+	require.Equal(t, "9780000000003", resp.GetBook()[0].GetName())
+	require.Empty(t, resp.GetNextPageToken())
+}
@@ -0,0 +1,324 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// checks if we have implementat all the different functions
+var _ librarypb.CirculationServiceServer = new(libraryServiceServer)
+
+// Loan is a loan of a copy of a book to a member.
+type Loan struct {
+	ID           string    `json:"id"` // The random id in 'loans/{id}'
+	ISBN         string    `json:"isbn"`
+	CopyID       string    `json:"copyId"`
+	MemberID     string    `json:"memberId"`
+	Branch       string    `json:"branch"` // The branch of the checkout, may be empty
+	CheckoutTime time.Time `json:"checkoutTime"`
+	DueDate      string    `json:"dueDate"` // On the format YYYY-MM-DD
+	Renewals     int       `json:"renewals"`
+	ReturnTime   time.Time `json:"returnTime"` // Zero while the copy is on loan
+	Lost         bool      `json:"lost"`       // Set if the copy was lost instead of returned
+}
+
+// IsActive reports whether the copy of the loan has not been returned.
+func (l *Loan) IsActive() bool {
+	return l.ReturnTime.IsZero()
+}
+
+// loanPolicy holds the lending rules of a membership tier.
+type loanPolicy struct {
+	LoanDays    int // the number of days until a loan is due
+	MaxLoans    int // the maximum number of active loans of a member
+	MaxRenewals int // the maximum number of renewals of a loan
+}
+
+// defaultLoanPolicies are the lending rules of each membership tier.
+var defaultLoanPolicies = map[string]loanPolicy{
+	tierStandard: {LoanDays: 21, MaxLoans: 10, MaxRenewals: 2},
+	tierStudent:  {LoanDays: 28, MaxLoans: 15, MaxRenewals: 3},
+	tierSenior:   {LoanDays: 28, MaxLoans: 10, MaxRenewals: 3},
+	tierStaff:    {LoanDays: 42, MaxLoans: 30, MaxRenewals: 5},
+}
+
+// loanPolicy returns the lending rules of the member. Members of an unknown
+// tier get the rules of the standard tier.
+func (s *libraryServiceServer) loanPolicy(m Member) loanPolicy {
+	if policy, ok := s.loanPolicies[m.Tier]; ok {
+		return policy
+	}
+	return s.loanPolicies[tierStandard]
+}
+
+// loanIDFromName returns the id of a loan name on the format 'loans/{id}'.
+func loanIDFromName(name string) string {
+	return strings.TrimPrefix(name, "loans/")
+}
+
+// AsProto converts the Loan to a *librarypb.Loan.
+func (l *Loan) AsProto() *librarypb.Loan {
+	loan := &librarypb.Loan{
+		Name:         "loans/" + l.ID,
+		Copy:         "books/" + l.ISBN + "/copies/" + l.CopyID,
+		Member:       "members/" + l.MemberID,
+		CheckoutTime: timestamppb.New(l.CheckoutTime),
+		DueDate:      l.DueDate,
+		Renewals:     int32(l.Renewals),
+		Lost:         l.Lost,
+		Branch:       l.Branch,
+	}
+	if !l.IsActive() {
+		loan.ReturnTime = timestamppb.New(l.ReturnTime)
+	}
+	return loan
+}
+
+// CheckoutCopy lends an available copy, or a copy held for the member, to a
+// member who is not blocked, does not owe too much and has not reached the
+// limit of loans of the membership tier. A copy owned by a branch is checked
+// out at that branch. The due date is set by the loan policy of the tier and
+// moved to the next day the branch of the checkout is open.
+func (s *libraryServiceServer) CheckoutCopy(ctx context.Context,
+	req *librarypb.CheckoutCopyRequest) (*librarypb.Loan, error) {
+
+	isbn, copyID := copyFromName(req.GetName())
+	id, err := newResourceID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create loan id")
+	}
+	loan := Loan{
+		ID:           id,
+		ISBN:         isbn,
+		CopyID:       copyID,
+		MemberID:     memberIDFromName(req.GetMember()),
+		Branch:       req.GetBranch(),
+		CheckoutTime: s.now(),
+	}
+	if loan.Branch != "" && !branchPattern.MatchString(loan.Branch) {
+		return nil, invalidFieldsError([]*errdetails.BadRequest_FieldViolation{{
+			Field:       fieldBranch,
+			Description: "must be lowercase letters and digits separated by dashes",
+		}})
+	}
+
+	err = s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		book, err := tx.FindSpecificBook(ctx, loan.ISBN)
+		if err != nil {
+			return err
+		}
+		if book.IsDeleted() {
+			return ErrNotFound
+		}
+		member, err := tx.GetMember(ctx, loan.MemberID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkMayBorrow(ctx, tx, member, loan.CheckoutTime); err != nil {
+			return err
+		}
+		policy := s.loanPolicy(member)
+		active, err := tx.CountActiveLoans(ctx, member.ID)
+		if err != nil {
+			return err
+		}
+		if active >= policy.MaxLoans {
+			return status.Errorf(codes.FailedPrecondition,
+				"the member has reached the limit of %d loans", policy.MaxLoans)
+		}
+		c, err := tx.GetCopy(ctx, loan.ISBN, loan.CopyID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case c.Branch == "":
+		case loan.Branch == "":
+			loan.Branch = c.Branch
+		case loan.Branch != c.Branch:
+			return status.Errorf(codes.FailedPrecondition,
+				"the copy belongs to the branch %q", c.Branch)
+		}
+		if c.Status == statusOnHold {
+			if err := fulfillHold(ctx, tx, c, member.ID, loan.CheckoutTime); err != nil {
+				return err
+			}
+		}
+		if loan.DueDate, err = dueDate(ctx, tx, loan.Branch, loan.CheckoutTime,
+			policy.LoanDays); err != nil {
+			return err
+		}
+		return tx.CreateLoan(ctx, loan)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return loan.AsProto(), nil
+}
+
+// ReturnCopy closes the loan of a copy and makes the copy available again, or
+// holds it for the first waiting hold on the book. A copy returned after its
+// due date is charged an overdue fine.
+func (s *libraryServiceServer) ReturnCopy(ctx context.Context,
+	req *librarypb.ReturnCopyRequest) (*librarypb.Loan, error) {
+
+	isbn, copyID := copyFromName(req.GetName())
+	var loan Loan
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if loan, err = tx.GetActiveLoan(ctx, isbn, copyID); err != nil {
+			return err
+		}
+		loan.ReturnTime = s.now()
+		if err := tx.ReturnLoan(ctx, loan); err != nil {
+			return err
+		}
+		if err := s.chargeOverdueFine(ctx, tx, loan); err != nil {
+			return err
+		}
+		return s.releaseCopy(ctx, tx, loan.ISBN, loan.CopyID, loan.ReturnTime)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return loan.AsProto(), nil
+}
+
+// MarkCopyLost closes the loan of a copy which the member has lost and marks
+// the copy as lost. The member is charged the price of the copy and the
+// overdue fine if the loan was overdue.
+func (s *libraryServiceServer) MarkCopyLost(ctx context.Context,
+	req *librarypb.MarkCopyLostRequest) (*librarypb.Loan, error) {
+
+	isbn, copyID := copyFromName(req.GetName())
+	var loan Loan
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if loan, err = tx.GetActiveLoan(ctx, isbn, copyID); err != nil {
+			return err
+		}
+		loan.ReturnTime = s.now()
+		loan.Lost = true
+		if err := tx.ReturnLoan(ctx, loan); err != nil {
+			return err
+		}
+		if err := s.chargeOverdueFine(ctx, tx, loan); err != nil {
+			return err
+		}
+		c, err := tx.GetCopy(ctx, loan.ISBN, loan.CopyID)
+		if err != nil {
+			return err
+		}
+		return s.chargeLostItem(ctx, tx, loan, c)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return loan.AsProto(), nil
+}
+
+// RenewCopy extends the loan of a copy by the loan period of the member's
+// tier, counted from the current due date or from today if the loan is
+// overdue, to a day the branch of the checkout is open. A loan can only be
+// renewed a limited number of times, not by a blocked member and not while
+// other members wait for the book without a copy sent to them.
+func (s *libraryServiceServer) RenewCopy(ctx context.Context,
+	req *librarypb.RenewCopyRequest) (*librarypb.Loan, error) {
+
+	isbn, copyID := copyFromName(req.GetName())
+	now := s.now()
+	var loan Loan
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if loan, err = tx.GetActiveLoan(ctx, isbn, copyID); err != nil {
+			return err
+		}
+		member, err := tx.GetMember(ctx, loan.MemberID)
+		if err != nil {
+			return err
+		}
+		if err := s.checkMayBorrow(ctx, tx, member, now); err != nil {
+			return err
+		}
+		_, err = tx.NextWaitingHold(ctx, loan.ISBN)
+		switch {
+		case err == nil:
+			return status.Errorf(codes.FailedPrecondition,
+				"other members are waiting for the book")
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+		policy := s.loanPolicy(member)
+		if loan.Renewals >= policy.MaxRenewals {
+			return status.Errorf(codes.FailedPrecondition,
+				"the loan has already been renewed %d times", policy.MaxRenewals)
+		}
+
+		from := now
+		if due, err := time.ParseInLocation(dateLayout, loan.DueDate,
+			now.Location()); err == nil && due.After(now) {
+			from = due
+		}
+		if loan.DueDate, err = dueDate(ctx, tx, loan.Branch, from,
+			policy.LoanDays); err != nil {
+			return err
+		}
+		loan.Renewals++
+		return tx.RenewLoan(ctx, loan)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return loan.AsProto(), nil
+}
+
+// GetLoan retreives a specific loan.
+func (s *libraryServiceServer) GetLoan(ctx context.Context,
+	req *librarypb.GetLoanRequest) (*librarypb.Loan, error) {
+
+	loan, err := s.store.GetLoan(ctx, loanIDFromName(req.GetName()))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return loan.AsProto(), nil
+}
+
+// ListLoans retreives a page of the loans ordered by their checkout times,
+// optionally only those of one member. Returned loans are only listed if
+// show_returned is set.
+func (s *libraryServiceServer) ListLoans(ctx context.Context,
+	req *librarypb.ListLoansRequest) (*librarypb.ListLoansResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	memberID := memberIDFromName(req.GetMember())
+	checksum := listChecksum(memberID, "loans", req.GetShowReturned())
+	after, err := parsePageToken(req.GetPageToken(), checksum, 2)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	loans, next, err := s.store.ListLoans(ctx, memberID, req.GetShowReturned(),
+		pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListLoansResponse{}
+	for _, loan := range loans {
+		resp.Loans = append(resp.Loans, loan.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
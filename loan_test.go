@@ -0,0 +1,142 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The book and the member of the circulation tests.
+const (
+	testCirculationISBN = "9780000000019"
+	testMemberID        = "00000000000000b1"
+)
+
+// newCirculationServer creates a server on a memory store holding a book and
+// a member, whose clock is fixed at the returned time until it is changed.
+func newCirculationServer(t *testing.T) (*libraryServiceServer, *time.Time) {
+	ctx := context.Background()
+	s := newTestServer(t, testStores["memory"])
+	clock := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC) // a Wednesday
+	s.now = func() time.Time { return clock }
+	require.NoError(t, s.store.InsertIntoDatabase(ctx,
+		testBook(testCirculationISBN, "star wars")))
+	require.NoError(t, s.store.CreateMember(ctx, testMember(testMemberID, "luke",
+		"skywalker", "12345678")))
+	return s, &clock
+}
+
+// copyName returns the name of a copy of the circulation test book.
+func copyName(id string) string {
+	return "books/" + testCirculationISBN + "/copies/" + id
+}
+
+// createTestCopies stores available copies of the circulation test book.
+func createTestCopies(t *testing.T, s *libraryServiceServer, ids ...string) {
+	for _, id := range ids {
+		require.NoError(t, s.store.CreateCopy(context.Background(),
+			testCopy(testCirculationISBN, id, "barcode"+id, statusAvailable)))
+	}
+}
+
+// checkout checks out a copy of the circulation test book to the member.
+func checkout(s *libraryServiceServer, copyID, memberID string) (*librarypb.Loan, error) {
+	return s.CheckoutCopy(context.Background(), &librarypb.CheckoutCopyRequest{
+		Name: copyName(copyID), Member: "members/" + memberID})
+}
+
+func TestCheckoutCopy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("due date", func(t *testing.T) {
+		s, _ := newCirculationServer(t)
+		createTestCopies(t, s, "c1")
+		loan, err := checkout(s, "c1", testMemberID)
+		require.NoError(t, err)
+		require.Equal(t, "2021-09-22", loan.GetDueDate())
+		c, err := s.store.GetCopy(ctx, testCirculationISBN, "c1")
+		require.NoError(t, err)
+		require.Equal(t, statusOnLoan, c.Status)
+
+		_, err = checkout(s, "c1", testMemberID)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+
+	t.Run("max loans", func(t *testing.T) {
+		s, _ := newCirculationServer(t)
+		s.loanPolicies = map[string]loanPolicy{
+			tierStandard: {LoanDays: 21, MaxLoans: 2, MaxRenewals: 1},
+		}
+		createTestCopies(t, s, "c1", "c2", "c3")
+		for _, id := range []string{"c1", "c2"} {
+			_, err := checkout(s, id, testMemberID)
+			require.NoError(t, err)
+		}
+		_, err := checkout(s, "c3", testMemberID)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "limit of 2 loans")
+
+		// a returned loan no longer counts
+		_, err = s.ReturnCopy(ctx, &librarypb.ReturnCopyRequest{Name: copyName("c1")})
+		require.NoError(t, err)
+		_, err = checkout(s, "c3", testMemberID)
+		require.NoError(t, err)
+	})
+
+	t.Run("blocked member", func(t *testing.T) {
+		s, _ := newCirculationServer(t)
+		createTestCopies(t, s, "c1")
+		blocked := testMember("00000000000000b2", "han", "solo", "87654321")
+		blocked.Blocked = true
+		blocked.BlockReason = "owes jabba"
+		require.NoError(t, s.store.CreateMember(ctx, blocked))
+		_, err := checkout(s, "c1", blocked.ID)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "owes jabba")
+	})
+
+	t.Run("expired membership", func(t *testing.T) {
+		s, clock := newCirculationServer(t)
+		createTestCopies(t, s, "c1")
+		*clock = time.Date(2022, 9, 2, 12, 0, 0, 0, time.UTC)
+		_, err := checkout(s, "c1", testMemberID)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+		require.Contains(t, status.Convert(err).Message(), "2022-09-01")
+	})
+}
+
+func TestRenewCopy(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newCirculationServer(t)
+	s.loanPolicies = map[string]loanPolicy{
+		tierStandard: {LoanDays: 21, MaxLoans: 10, MaxRenewals: 2},
+	}
+	createTestCopies(t, s, "c1")
+	_, err := checkout(s, "c1", testMemberID)
+	require.NoError(t, err)
+	renew := func() (*librarypb.Loan, error) {
+		return s.RenewCopy(ctx, &librarypb.RenewCopyRequest{Name: copyName("c1")})
+	}
+
+	// a renewal before the due date extends the loan from the due date
+	loan, err := renew()
+	require.NoError(t, err)
+	require.Equal(t, "2021-10-13", loan.GetDueDate())
+	require.EqualValues(t, 1, loan.GetRenewals())
+
+	// an overdue loan is extended from today
+	*clock = time.Date(2021, 10, 20, 12, 0, 0, 0, time.UTC)
+	loan, err = renew()
+	require.NoError(t, err)
+	require.Equal(t, "2021-11-10", loan.GetDueDate())
+	require.EqualValues(t, 2, loan.GetRenewals())
+
+	_, err = renew()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "renewed 2 times")
+}
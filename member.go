@@ -0,0 +1,344 @@
+package library
+
+import (
+	"context"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// checks if we have implementat all the different functions
+var _ librarypb.MemberServiceServer = new(libraryServiceServer)
+
+// Member is a patron of the library.
+type Member struct {
+	ID            string    `json:"id"` // The random id in 'members/{id}'
+	FirstName     string    `json:"firstName"`
+	LastName      string    `json:"lastName"`
+	Email         string    `json:"email"`
+	PhoneNumber   string    `json:"phoneNumber"`   // May be empty
+	PostalAddress string    `json:"postalAddress"` // May be empty
+	Tier          string    `json:"tier"`
+	CardNumber    string    `json:"cardNumber"`
+	ExpiryDate    string    `json:"expiryDate"` // On the format YYYY-MM-DD
+	Blocked       bool      `json:"blocked"`
+	BlockReason   string    `json:"blockReason"`
+	CreateTime    time.Time `json:"createTime"`
+	UpdateTime    time.Time `json:"updateTime"`
+}
+
+// The membership tiers.
+const (
+	tierStandard = "standard"
+	tierStudent  = "student"
+	tierSenior   = "senior"
+	tierStaff    = "staff"
+)
+
+// validTiers are the tiers which can be stored.
+var validTiers = map[string]bool{
+	tierStandard: true,
+	tierStudent:  true,
+	tierSenior:   true,
+	tierStaff:    true,
+}
+
+// The field paths of a Member which can be validated and updated, besides
+// fieldFirstName and fieldLastName.
+const (
+	fieldEmail         = "email"
+	fieldPhoneNumber   = "phone_number"
+	fieldPostalAddress = "postal_address"
+	fieldTier          = "tier"
+	fieldCardNumber    = "card_number"
+	fieldExpiryDate    = "expiry_date"
+	fieldBlocked       = "blocked"
+	fieldBlockReason   = "block_reason"
+)
+
+// updatableMemberFields are the field paths which are allowed in the update
+// mask of a member.
+var updatableMemberFields = []string{
+	fieldFirstName,
+	fieldLastName,
+	fieldEmail,
+	fieldPhoneNumber,
+	fieldPostalAddress,
+	fieldTier,
+	fieldCardNumber,
+	fieldExpiryDate,
+	fieldBlocked,
+	fieldBlockReason,
+}
+
+// The regex patterns for validating a member.
+var (
+	phoneNumberPattern = regexp.MustCompile(`^\+?[0-9]+(?:[ -][0-9]+)*$`)
+	cardNumberPattern  = regexp.MustCompile(`^\d{8,16}$`)
+)
+
+// validateMemberFields validates the given field paths of the member and
+// returns a violation for every invalid field.
+func validateMemberFields(m Member,
+	paths []string) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	for _, path := range paths {
+		switch path {
+		case fieldFirstName, fieldLastName:
+			name := m.FirstName
+			if path == fieldLastName {
+				name = m.LastName
+			}
+			if description, ok := checkText("members", path, name); !ok {
+				violation(path, description)
+			}
+		case fieldEmail:
+			if addr, err := mail.ParseAddress(m.Email); err != nil || addr.Address != m.Email {
+				violation(path, "must be an email address such as 'name@example.com'")
+			}
+		case fieldPhoneNumber:
+			if m.PhoneNumber != "" && !phoneNumberPattern.MatchString(m.PhoneNumber) {
+				violation(path, "must be digits separated by spaces or dashes,"+
+					" optionally starting with '+'")
+			}
+		case fieldTier:
+			if !validTiers[m.Tier] {
+				violation(path, "must be a membership tier")
+			}
+		case fieldCardNumber:
+			if !cardNumberPattern.MatchString(m.CardNumber) {
+				violation(path, "must be 8 to 16 digits")
+			}
+		case fieldExpiryDate:
+			if _, err := time.Parse(dateLayout, m.ExpiryDate); err != nil {
+				violation(path, "must be a date in the format 'YYYY-MM-DD'")
+			}
+		}
+	}
+	return violations
+}
+
+// memberUpdatePaths resolves the paths of the update mask of a member. An
+// empty mask or the '*' path selects all updatable fields.
+func memberUpdatePaths(maskPaths []string) ([]string,
+	[]*errdetails.BadRequest_FieldViolation) {
+	if len(maskPaths) == 0 {
+		return updatableMemberFields, nil
+	}
+
+	var paths []string
+	for _, path := range maskPaths {
+		switch path {
+		case "*":
+			return updatableMemberFields, nil
+		case fieldFirstName, fieldLastName, fieldEmail, fieldPhoneNumber,
+			fieldPostalAddress, fieldTier, fieldCardNumber, fieldExpiryDate,
+			fieldBlocked, fieldBlockReason:
+			paths = append(paths, path)
+		case fieldName, fieldCreateTime, fieldUpdateTime:
+			return nil, updateMaskViolation("field %q is immutable", path)
+		default:
+			return nil, updateMaskViolation("unknown field %q", path)
+		}
+	}
+	return paths, nil
+}
+
+// applyMemberUpdate copies the given field paths from update to the existing
+// member.
+func applyMemberUpdate(existing, update Member, paths []string) Member {
+	for _, path := range paths {
+		switch path {
+		case fieldFirstName:
+			existing.FirstName = update.FirstName
+		case fieldLastName:
+			existing.LastName = update.LastName
+		case fieldEmail:
+			existing.Email = update.Email
+		case fieldPhoneNumber:
+			existing.PhoneNumber = update.PhoneNumber
+		case fieldPostalAddress:
+			existing.PostalAddress = update.PostalAddress
+		case fieldTier:
+			existing.Tier = update.Tier
+		case fieldCardNumber:
+			existing.CardNumber = update.CardNumber
+		case fieldExpiryDate:
+			existing.ExpiryDate = update.ExpiryDate
+		case fieldBlocked:
+			existing.Blocked = update.Blocked
+		case fieldBlockReason:
+			existing.BlockReason = update.BlockReason
+		}
+	}
+	return existing
+}
+
+// memberIDFromName returns the id of a member name on the format
+// 'members/{id}'.
+func memberIDFromName(name string) string {
+	return strings.TrimPrefix(name, "members/")
+}
+
+// NewMemberFromProto converts a *librarypb.Member to a Member. An unspecified
+// tier is left empty.
+func NewMemberFromProto(m *librarypb.Member) Member {
+	member := Member{
+		ID:            memberIDFromName(m.GetName()),
+		FirstName:     normalizeText(m.GetFirstName()),
+		LastName:      normalizeText(m.GetLastName()),
+		Email:         m.GetEmail(),
+		PhoneNumber:   m.GetPhoneNumber(),
+		PostalAddress: m.GetPostalAddress(),
+		CardNumber:    m.GetCardNumber(),
+		ExpiryDate:    m.GetExpiryDate(),
+		Blocked:       m.GetBlocked(),
+		BlockReason:   m.GetBlockReason(),
+	}
+	if m.GetTier() != librarypb.Member_TIER_UNSPECIFIED {
+		member.Tier = strings.ToLower(strings.TrimPrefix(m.GetTier().String(), "TIER_"))
+	}
+	return member
+}
+
+// AsProto converts the Member to a *librarypb.Member.
+func (m *Member) AsProto() *librarypb.Member {
+	return &librarypb.Member{
+		Name:          "members/" + m.ID,
+		FirstName:     m.FirstName,
+		LastName:      m.LastName,
+		Email:         m.Email,
+		PhoneNumber:   m.PhoneNumber,
+		PostalAddress: m.PostalAddress,
+		Tier: librarypb.Member_Tier(
+			librarypb.Member_Tier_value["TIER_"+strings.ToUpper(m.Tier)]),
+		CardNumber:  m.CardNumber,
+		ExpiryDate:  m.ExpiryDate,
+		Blocked:     m.Blocked,
+		BlockReason: m.BlockReason,
+		CreateTime:  timestamppb.New(m.CreateTime),
+		UpdateTime:  timestamppb.New(m.UpdateTime),
+	}
+}
+
+// CreateMember creates a member with a new random id. A member without a tier
+// gets the standard tier.
+func (s *libraryServiceServer) CreateMember(ctx context.Context,
+	req *librarypb.CreateMemberRequest) (*librarypb.Member, error) {
+
+	member := NewMemberFromProto(req.GetMember())
+	if member.Tier == "" {
+		member.Tier = tierStandard
+	}
+	if violations := validateMemberFields(member, updatableMemberFields); violations != nil {
+		return nil, invalidFieldsError(inField("member", violations))
+	}
+
+	id, err := newResourceID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create member id")
+	}
+	member.ID = id
+	member.CreateTime = time.Now()
+	member.UpdateTime = member.CreateTime
+
+	if err := s.store.CreateMember(ctx, member); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return member.AsProto(), nil
+}
+
+// GetMember retreives a specific member.
+func (s *libraryServiceServer) GetMember(ctx context.Context,
+	req *librarypb.GetMemberRequest) (*librarypb.Member, error) {
+
+	member, err := s.store.GetMember(ctx, memberIDFromName(req.GetName()))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return member.AsProto(), nil
+}
+
+// ListMembers retreives a page of the members ordered by their names.
+func (s *libraryServiceServer) ListMembers(ctx context.Context,
+	req *librarypb.ListMembersRequest) (*librarypb.ListMembersResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	checksum := listChecksum("", "members", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 3)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	members, next, err := s.store.ListMembers(ctx, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListMembersResponse{}
+	for _, member := range members {
+		resp.Members = append(resp.Members, member.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// UpdateMember updates a member. Only the fields in the update mask are
+// written, or all the fields if the mask is empty.
+func (s *libraryServiceServer) UpdateMember(ctx context.Context,
+	req *librarypb.UpdateMemberRequest) (*librarypb.Member, error) {
+
+	paths, violations := memberUpdatePaths(req.GetUpdateMask().GetPaths())
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
+	}
+	update := NewMemberFromProto(req.GetMember())
+	if violations := validateMemberFields(update, paths); violations != nil {
+		return nil, invalidFieldsError(inField("member", violations))
+	}
+
+	var member Member
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if member, err = tx.GetMember(ctx, update.ID); err != nil {
+			return err
+		}
+		member = applyMemberUpdate(member, update, paths)
+		member.UpdateTime = time.Now()
+		return tx.UpdateMember(ctx, member)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return member.AsProto(), nil
+}
+
+// DeleteMember deletes a member.
+func (s *libraryServiceServer) DeleteMember(ctx context.Context,
+	req *librarypb.DeleteMemberRequest) (*emptypb.Empty, error) {
+
+	if err := s.store.DeleteMember(ctx, memberIDFromName(req.GetName())); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &emptypb.Empty{}, nil
+}
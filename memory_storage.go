@@ -0,0 +1,1744 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checks if we have implementat all the different functions
+var _ BookStore = new(MemoryStorage)
+
+// MemoryStorage keeps the books, the members and their loans, holds and
+// ledgers, the branches and their calendars, the audit log and the book
+// changes in memory. It is safe for concurrent use. A transaction copies the
+// whole store, so it is meant for tests and for trying out the server without
+// a database, not for a large catalogue.
+type MemoryStorage struct {
+	mu         *sync.RWMutex
+	books      map[string]Book   // stored without the derived fields
+	revisions  map[string][]Book // keyed by isbn, the oldest first
+	authors    map[string]Author
+	publishers map[string]Publisher
+	copies     map[string]map[string]Copy // keyed by isbn and id
+	members    map[string]Member
+	loans      map[string]Loan
+	holds      map[string]map[string]Hold    // keyed by isbn and id
+	ledgers    map[string][]LedgerEntry      // keyed by member id
+	branches   map[string]Branch             // keyed by id
+	hours      map[string]OpeningHours       // keyed by branch
+	closures   map[string]map[string]Closure // keyed by branch and id
+	apiKeys    map[string]APIKey             // keyed by id
+	roles      map[string]RoleBinding        // keyed by principal
+	audit      []AuditEvent                  // in the order they were appended
+	changes    []BookChange                  // in the order of their seq
+	inTx       bool                          // set while running in a transaction, which holds the lock
+}
+
+// NewMemoryStorage creates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		mu:         &sync.RWMutex{},
+		books:      map[string]Book{},
+		revisions:  map[string][]Book{},
+		authors:    map[string]Author{},
+		publishers: map[string]Publisher{},
+		copies:     map[string]map[string]Copy{},
+		members:    map[string]Member{},
+		loans:      map[string]Loan{},
+		holds:      map[string]map[string]Hold{},
+		ledgers:    map[string][]LedgerEntry{},
+		branches:   map[string]Branch{},
+		hours:      map[string]OpeningHours{},
+		closures:   map[string]map[string]Closure{},
+		apiKeys:    map[string]APIKey{},
+		roles:      map[string]RoleBinding{},
+	}
+}
+
+// lock acquires the write lock unless running in a transaction, and returns
+// the function releasing it.
+func (storage *MemoryStorage) lock() func() {
+	if storage.inTx {
+		return func() {}
+	}
+	storage.mu.Lock()
+	return storage.mu.Unlock
+}
+
+// rlock acquires the read lock unless running in a transaction, and returns
+// the function releasing it.
+func (storage *MemoryStorage) rlock() func() {
+	if storage.inTx {
+		return func() {}
+	}
+	storage.mu.RLock()
+	return storage.mu.RUnlock
+}
+
+// RunInTransaction runs fn on a copy of the stored resources which replaces
+// them if fn returns nil. Other callers are blocked until fn returns. Every
+// transaction, even one which only reads, copies all the maps, so it takes
+// time in proportion to the size of the store.
+func (storage *MemoryStorage) RunInTransaction(ctx context.Context,
+	fn func(tx BookStore) error) error {
+	if storage.inTx {
+		return fn(storage)
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tx := &MemoryStorage{
+		mu:         storage.mu,
+		books:      make(map[string]Book, len(storage.books)),
+		revisions:  make(map[string][]Book, len(storage.revisions)),
+		authors:    make(map[string]Author, len(storage.authors)),
+		publishers: make(map[string]Publisher, len(storage.publishers)),
+		copies:     make(map[string]map[string]Copy, len(storage.copies)),
+		members:    make(map[string]Member, len(storage.members)),
+		loans:      make(map[string]Loan, len(storage.loans)),
+		holds:      make(map[string]map[string]Hold, len(storage.holds)),
+		ledgers:    make(map[string][]LedgerEntry, len(storage.ledgers)),
+		branches:   make(map[string]Branch, len(storage.branches)),
+		hours:      make(map[string]OpeningHours, len(storage.hours)),
+		closures:   make(map[string]map[string]Closure, len(storage.closures)),
+		apiKeys:    make(map[string]APIKey, len(storage.apiKeys)),
+		roles:      make(map[string]RoleBinding, len(storage.roles)),
+		inTx:       true,
+	}
+	for isbn, b := range storage.books {
+		tx.books[isbn] = b
+	}
+	for isbn, revisions := range storage.revisions {
+		// the revisions are only appended, so the copy can share them
+		tx.revisions[isbn] = revisions[:len(revisions):len(revisions)]
+	}
+	for id, a := range storage.authors {
+		tx.authors[id] = a
+	}
+	for id, p := range storage.publishers {
+		tx.publishers[id] = p
+	}
+	for isbn, copies := range storage.copies {
+		tx.copies[isbn] = make(map[string]Copy, len(copies))
+		for id, c := range copies {
+			tx.copies[isbn][id] = c
+		}
+	}
+	for id, m := range storage.members {
+		tx.members[id] = m
+	}
+	for id, l := range storage.loans {
+		tx.loans[id] = l
+	}
+	for id, entries := range storage.ledgers {
+		// the entries are only appended, so the copy can share them
+		tx.ledgers[id] = entries[:len(entries):len(entries)]
+	}
+	for isbn, holds := range storage.holds {
+		tx.holds[isbn] = make(map[string]Hold, len(holds))
+		for id, h := range holds {
+			tx.holds[isbn][id] = h
+		}
+	}
+	for id, b := range storage.branches {
+		tx.branches[id] = b
+	}
+	for branch, h := range storage.hours {
+		// the periods are replaced and never changed, so the copy can share them
+		tx.hours[branch] = h
+	}
+	for branch, closures := range storage.closures {
+		tx.closures[branch] = make(map[string]Closure, len(closures))
+		for id, c := range closures {
+			tx.closures[branch][id] = c
+		}
+	}
+	for id, k := range storage.apiKeys {
+		tx.apiKeys[id] = k
+	}
+	for principal, b := range storage.roles {
+		tx.roles[principal] = b
+	}
+	// the events are only appended, so the copy can share them
+	tx.audit = storage.audit[:len(storage.audit):len(storage.audit)]
+	tx.changes = storage.changes[:len(storage.changes):len(storage.changes)]
+	if err := fn(tx); err != nil {
+		return err
+	}
+	storage.books = tx.books
+	storage.revisions = tx.revisions
+	storage.authors = tx.authors
+	storage.publishers = tx.publishers
+	storage.copies = tx.copies
+	storage.members = tx.members
+	storage.loans = tx.loans
+	storage.holds = tx.holds
+	storage.ledgers = tx.ledgers
+	storage.branches = tx.branches
+	storage.hours = tx.hours
+	storage.closures = tx.closures
+	storage.apiKeys = tx.apiKeys
+	storage.roles = tx.roles
+	storage.audit = tx.audit
+	storage.changes = tx.changes
+	return nil
+}
+
+// withDerivedFields returns a copy of the stored book with the names of its
+// publisher and authors and its copy counts filled in.
+func (storage *MemoryStorage) withDerivedFields(b Book) Book {
+	b.PublisherName = storage.publishers[b.Publisher].DisplayName
+	b.TotalCopies, b.AvailableCopies = 0, 0
+	for _, c := range storage.copies[b.ISBN] {
+		if c.Status != statusWithdrawn {
+			b.TotalCopies++
+		}
+		if c.Status == statusAvailable {
+			b.AvailableCopies++
+		}
+	}
+	authors := make([]BookAuthor, len(b.Authors))
+	for i, a := range b.Authors {
+		author := storage.authors[a.AuthorID]
+		a.FirstName = author.FirstName
+		a.LastName = author.LastName
+		authors[i] = a
+	}
+	b.Authors = authors
+	if revisions := storage.revisions[b.ISBN]; len(revisions) > 0 {
+		latest := revisions[len(revisions)-1]
+		b.RevisionID = latest.RevisionID
+		b.RevisionCreateTime = latest.RevisionCreateTime
+	}
+	return b
+}
+
+// recordRevision stores the book with the isbn as a new revision, and
+// appends the change of the given type which wrote it.
+func (storage *MemoryStorage) recordRevision(isbn, changeType string) error {
+	id, err := newResourceID()
+	if err != nil {
+		return fmt.Errorf("failed to create revision id, %w", err)
+	}
+	b := storage.books[isbn]
+	b.RevisionID = id
+	b.RevisionCreateTime = time.Now()
+	storage.revisions[isbn] = append(storage.revisions[isbn], b)
+	storage.changes = append(storage.changes, BookChange{
+		Seq:        int64(len(storage.changes) + 1),
+		ISBN:       isbn,
+		Type:       changeType,
+		RevisionID: id,
+		ChangeTime: b.RevisionCreateTime,
+	})
+	return nil
+}
+
+// setAuthors stores the authors of the book without their names. It returns
+// an error matching ErrNotFound if any of the authors did not exist.
+func (storage *MemoryStorage) setAuthors(b *Book, authors []BookAuthor) error {
+	b.Authors = make([]BookAuthor, len(authors))
+	for i, a := range authors {
+		if _, ok := storage.authors[a.AuthorID]; !ok {
+			return unknownAuthorError(a.AuthorID)
+		}
+		b.Authors[i] = BookAuthor{AuthorID: a.AuthorID, Role: a.Role}
+	}
+	return nil
+}
+
+// InsertIntoDatabase stores a new book. It returns ErrAlreadyExists if a book
+// with the same isbn is already stored.
+func (storage *MemoryStorage) InsertIntoDatabase(ctx context.Context, b Book) error {
+	defer storage.lock()()
+
+	if _, ok := storage.books[b.ISBN]; ok {
+		return ErrAlreadyExists
+	}
+	if _, ok := storage.publishers[b.Publisher]; !ok {
+		return unknownPublisherError(b.Publisher)
+	}
+	if err := storage.setAuthors(&b, b.Authors); err != nil {
+		return err
+	}
+	b.PublisherName = ""
+	b.TotalCopies, b.AvailableCopies = 0, 0
+	b.RevisionID, b.RevisionCreateTime = "", time.Time{}
+	storage.books[b.ISBN] = b
+	return storage.recordRevision(b.ISBN, changeCreated)
+}
+
+// FindSpecificBook returns the book with the isbn, or ErrNotFound if it did
+// not exist.
+func (storage *MemoryStorage) FindSpecificBook(ctx context.Context,
+	isbn string) (Book, error) {
+	defer storage.rlock()()
+
+	b, ok := storage.books[isbn]
+	if !ok {
+		return Book{}, ErrNotFound
+	}
+	return storage.withDerivedFields(b), nil
+}
+
+// FindBooks returns the books with the given isbns keyed by their isbn. Books
+// which do not exist are left out.
+func (storage *MemoryStorage) FindBooks(ctx context.Context,
+	isbns []string) (map[string]Book, error) {
+	defer storage.rlock()()
+
+	books := map[string]Book{}
+	for _, isbn := range isbns {
+		if b, ok := storage.books[isbn]; ok {
+			books[isbn] = storage.withDerivedFields(b)
+		}
+	}
+	return books, nil
+}
+
+// ListBooks returns one page of the books matching the query, the ordering
+// values of the last book when more books follow, and the total number of
+// books matching the filter.
+func (storage *MemoryStorage) ListBooks(ctx context.Context,
+	q listQuery) ([]Book, []string, int, error) {
+	defer storage.rlock()()
+
+	var matching []Book
+	for _, b := range storage.books {
+		if b.IsDeleted() && !q.showDeleted {
+			continue
+		}
+		if q.availableAt != "" && !storage.availableAt(b.ISBN, q.availableAt) {
+			continue
+		}
+		b = storage.withDerivedFields(b)
+		ok := true
+		for _, c := range q.filter {
+			ok = ok && c.matches(b)
+		}
+		if ok {
+			matching = append(matching, b)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return compareOrder(q.orderBy, orderKey(q.orderBy, matching[i]),
+			orderKey(q.orderBy, matching[j])) < 0
+	})
+
+	var books []Book
+	var next, last []string
+	for _, b := range matching {
+		key := orderKey(q.orderBy, b)
+		if q.after != nil && compareOrder(q.orderBy, key, q.after) <= 0 {
+			continue
+		}
+		if len(books) == q.pageSize {
+			next = last // one more book than requested, so a next page exists
+			break
+		}
+		books = append(books, b)
+		last = key
+	}
+	return books, next, len(matching), nil
+}
+
+// availableAt reports whether the book has an available copy at the branch.
+func (storage *MemoryStorage) availableAt(isbn, branch string) bool {
+	for _, c := range storage.copies[isbn] {
+		if c.Branch == branch && c.Status == statusAvailable {
+			return true
+		}
+	}
+	return false
+}
+
+// orderKey returns the ordering values of the book.
+func orderKey(orderBy []orderField, b Book) []string {
+	key := make([]string, len(orderBy))
+	for i, field := range orderBy {
+		key[i] = field.column.value(b)
+	}
+	return key
+}
+
+// compareOrder compares two ordering keys, returning a negative number if a
+// is ordered before b, zero if they are equal and a positive number otherwise.
+func compareOrder(orderBy []orderField, a, b []string) int {
+	for i, field := range orderBy {
+		if a[i] == b[i] {
+			continue
+		}
+		less := a[i] < b[i]
+		if less != field.desc {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// UpdateBookInDB writes the given field paths and the update time of the book.
+// It returns ErrNotFound if the book did not exist.
+func (storage *MemoryStorage) UpdateBookInDB(ctx context.Context, b Book,
+	paths []string) error {
+	defer storage.lock()()
+
+	existing, ok := storage.books[b.ISBN]
+	if !ok {
+		return ErrNotFound
+	}
+	existing = applyUpdate(existing, b, paths)
+	existing.UpdateTime = b.UpdateTime
+	if _, ok := storage.publishers[existing.Publisher]; !ok &&
+		existing.Publisher != storage.books[b.ISBN].Publisher {
+		return unknownPublisherError(existing.Publisher)
+	}
+	if err := storage.setAuthors(&existing, existing.Authors); err != nil {
+		return err
+	}
+	storage.books[b.ISBN] = existing
+	return storage.recordRevision(b.ISBN, changeUpdated)
+}
+
+// SoftDeleteBook marks a book as deleted until the expire time. It returns
+// ErrNotFound if the book did not exist, ErrConflict if it was already deleted
+// and an error matching ErrInUse if any of its copies is on loan or on hold.
+func (storage *MemoryStorage) SoftDeleteBook(ctx context.Context, isbn string,
+	deleteTime, expireTime time.Time) error {
+	defer storage.lock()()
+
+	for _, c := range storage.copies[isbn] {
+		if c.Status == statusOnLoan || c.Status == statusOnHold {
+			return errBookHasLoans
+		}
+	}
+
+	b, ok := storage.books[isbn]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case b.IsDeleted():
+		return ErrConflict
+	}
+	b.DeleteTime = deleteTime
+	b.ExpireTime = expireTime
+	storage.books[isbn] = b
+	return storage.recordRevision(isbn, changeDeleted)
+}
+
+// UndeleteBookInDB restores a deleted book which has not yet been purged. It
+// returns ErrNotFound if the book did not exist and ErrConflict if it was not
+// deleted.
+func (storage *MemoryStorage) UndeleteBookInDB(ctx context.Context,
+	isbn string) error {
+	defer storage.lock()()
+
+	b, ok := storage.books[isbn]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case !b.IsDeleted():
+		return ErrConflict
+	}
+	b.DeleteTime = time.Time{}
+	b.ExpireTime = time.Time{}
+	storage.books[isbn] = b
+	return storage.recordRevision(isbn, changeUpdated)
+}
+
+// ListExpiredBooks returns the deleted books whose expire time is before now,
+// ordered by isbn.
+func (storage *MemoryStorage) ListExpiredBooks(ctx context.Context,
+	now time.Time) ([]Book, error) {
+	defer storage.rlock()()
+
+	var expired []Book
+	for _, b := range storage.books {
+		if !b.ExpireTime.IsZero() && !b.ExpireTime.After(now) {
+			expired = append(expired, storage.withDerivedFields(b))
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].ISBN < expired[j].ISBN
+	})
+	return expired, nil
+}
+
+// PurgeExpiredBooks permanently removes the deleted books whose expire time is
+// before now, their copies and their revisions, and returns the number of
+// purged books.
+func (storage *MemoryStorage) PurgeExpiredBooks(ctx context.Context,
+	now time.Time) (int64, error) {
+	defer storage.lock()()
+
+	var purged int64
+	for isbn, b := range storage.books {
+		if !b.ExpireTime.IsZero() && !b.ExpireTime.After(now) {
+			delete(storage.books, isbn)
+			delete(storage.copies, isbn)
+			delete(storage.holds, isbn)
+			delete(storage.revisions, isbn)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// ListBookRevisions returns one page of the revisions of the book, the latest
+// first.
+func (storage *MemoryStorage) ListBookRevisions(ctx context.Context, isbn string,
+	pageSize int, after []string) ([]Book, []string, error) {
+	defer storage.rlock()()
+
+	all := storage.revisions[isbn]
+	start := len(all) - 1
+	if after != nil {
+		i, err := strconv.Atoi(after[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid revision ordering value, %w", err)
+		}
+		start = i - 1
+	}
+
+	var revisions []Book
+	var next []string
+	for i := start; i >= 0; i-- {
+		if len(revisions) == pageSize {
+			next = []string{strconv.Itoa(i + 1)}
+			break
+		}
+		revisions = append(revisions, all[i])
+	}
+	return revisions, next, nil
+}
+
+// GetBookRevision returns the revision of the book, or an error matching
+// ErrNotFound if it did not exist.
+func (storage *MemoryStorage) GetBookRevision(ctx context.Context, isbn,
+	revisionID string) (Book, error) {
+	defer storage.rlock()()
+
+	for _, b := range storage.revisions[isbn] {
+		if b.RevisionID == revisionID {
+			return b, nil
+		}
+	}
+	return Book{}, errRevisionNotFound
+}
+
+// ListBookChanges returns up to limit of the book changes after the seq, in
+// the order they were made.
+func (storage *MemoryStorage) ListBookChanges(ctx context.Context,
+	afterSeq int64, limit int) ([]BookChange, error) {
+	defer storage.rlock()()
+
+	if afterSeq < 0 || afterSeq >= int64(len(storage.changes)) {
+		return nil, nil
+	}
+	changes := storage.changes[afterSeq:]
+	if len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return append([]BookChange(nil), changes...), nil
+}
+
+// LastBookChange returns the seq of the latest book change, or 0 if no book
+// has been changed.
+func (storage *MemoryStorage) LastBookChange(ctx context.Context) (int64, error) {
+	defer storage.rlock()()
+
+	return int64(len(storage.changes)), nil
+}
+
+// SearchBooks finds one page of the books whose title, author or publisher
+// contain all the terms of the query. The rank is the negated number of
+// matched terms, so books matching more often are ordered first.
+func (storage *MemoryStorage) SearchBooks(ctx context.Context,
+	q searchQuery) ([]SearchResult, []string, int, error) {
+	defer storage.rlock()()
+
+	var matching []SearchResult
+	for _, b := range storage.books {
+		if b.IsDeleted() {
+			continue
+		}
+		if r, ok := searchBook(storage.withDerivedFields(b), q.terms); ok {
+			matching = append(matching, r)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Rank != matching[j].Rank {
+			return matching[i].Rank < matching[j].Rank
+		}
+		return matching[i].Book.ISBN < matching[j].Book.ISBN
+	})
+
+	var after float64
+	if q.after != nil {
+		after, _ = strconv.ParseFloat(q.after[0], 64)
+	}
+
+	var results []SearchResult
+	var next []string
+	for _, r := range matching {
+		if q.after != nil && (r.Rank < after ||
+			(r.Rank == after && r.Book.ISBN <= q.after[1])) {
+			continue
+		}
+		if len(results) == q.pageSize {
+			last := results[len(results)-1]
+			next = []string{strconv.FormatFloat(last.Rank, 'g', -1, 64), last.Book.ISBN}
+			break
+		}
+		results = append(results, r)
+	}
+	return results, next, len(matching), nil
+}
+
+// searchBook matches the terms against the title, author and publisher of the
+// book. The snippet is the field with the most matches.
+func searchBook(b Book, terms []searchTerm) (SearchResult, bool) {
+	var names []string
+	for _, a := range b.Authors {
+		names = append(names, a.FirstName+" "+a.LastName)
+	}
+	fields := []string{b.Title, strings.Join(names, " "), b.PublisherName}
+	spans := make([][][2]int, len(fields))
+	matches := 0
+
+	for _, term := range terms {
+		found := false
+		for i, field := range fields {
+			termSpans := matchTerm(searchWords(field), term)
+			spans[i] = append(spans[i], termSpans...)
+			matches += len(termSpans)
+			found = found || len(termSpans) != 0
+		}
+		if !found {
+			return SearchResult{}, false
+		}
+	}
+
+	best := 0
+	for i := range fields {
+		if len(spans[i]) > len(spans[best]) {
+			best = i
+		}
+	}
+	return SearchResult{
+		Book:    b,
+		Rank:    -float64(matches),
+		Snippet: highlight(fields[best], spans[best]),
+	}, true
+}
+
+// matchTerm returns the byte offsets of the occurrences of the term in the
+// words of a text.
+func matchTerm(words []searchWord, term searchTerm) [][2]int {
+	var spans [][2]int
+	n := len(term.words)
+	for i := 0; i+n <= len(words); i++ {
+		matched := true
+		for k, w := range term.words {
+			if term.prefix && k == n-1 {
+				matched = matched && strings.HasPrefix(words[i+k].text, w)
+			} else {
+				matched = matched && words[i+k].text == w
+			}
+		}
+		if matched {
+			spans = append(spans, [2]int{words[i].start, words[i+n-1].end})
+		}
+	}
+	return spans
+}
+
+// highlight encloses the given byte offsets of the text in snippetStart and
+// snippetEnd. Overlapping offsets are merged.
+func highlight(text string, spans [][2]int) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+	var sb strings.Builder
+	pos := 0
+	for i := 0; i < len(spans); i++ {
+		start, end := spans[i][0], spans[i][1]
+		for i+1 < len(spans) && spans[i+1][0] <= end {
+			i++
+			if spans[i][1] > end {
+				end = spans[i][1]
+			}
+		}
+		sb.WriteString(text[pos:start])
+		sb.WriteString(snippetStart + text[start:end] + snippetEnd)
+		pos = end
+	}
+	sb.WriteString(text[pos:])
+	return sb.String()
+}
+
+// CreateAuthor stores a new author.
+func (storage *MemoryStorage) CreateAuthor(ctx context.Context, a Author) error {
+	defer storage.lock()()
+
+	if _, ok := storage.authors[a.ID]; ok {
+		return ErrAlreadyExists
+	}
+	storage.authors[a.ID] = a
+	return nil
+}
+
+// GetAuthor returns the author with the id.
+func (storage *MemoryStorage) GetAuthor(ctx context.Context, id string) (Author, error) {
+	defer storage.rlock()()
+
+	a, ok := storage.authors[id]
+	if !ok {
+		return Author{}, errAuthorNotFound
+	}
+	return a, nil
+}
+
+// ListAuthors returns one page of the authors ordered by last name, first
+// name and id.
+func (storage *MemoryStorage) ListAuthors(ctx context.Context, pageSize int,
+	after []string) ([]Author, []string, error) {
+	defer storage.rlock()()
+
+	var all []Author
+	for _, a := range storage.authors {
+		all = append(all, a)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(authorKey(all[i]), authorKey(all[j])) < 0
+	})
+
+	var authors []Author
+	var next []string
+	for _, a := range all {
+		if after != nil && compareKeys(authorKey(a), after) <= 0 {
+			continue
+		}
+		if len(authors) == pageSize {
+			next = authorKey(authors[len(authors)-1])
+			break
+		}
+		authors = append(authors, a)
+	}
+	return authors, next, nil
+}
+
+// compareKeys compares two ascending ordering keys like compareOrder.
+func compareKeys(a, b []string) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return strings.Compare(a[i], b[i])
+		}
+	}
+	return 0
+}
+
+// UpdateAuthor writes the names and the update time of the author.
+func (storage *MemoryStorage) UpdateAuthor(ctx context.Context, a Author) error {
+	defer storage.lock()()
+
+	existing, ok := storage.authors[a.ID]
+	if !ok {
+		return errAuthorNotFound
+	}
+	existing.FirstName = a.FirstName
+	existing.LastName = a.LastName
+	existing.UpdateTime = a.UpdateTime
+	storage.authors[a.ID] = existing
+	return nil
+}
+
+// DeleteAuthor removes an author which no book credits.
+func (storage *MemoryStorage) DeleteAuthor(ctx context.Context, id string) error {
+	defer storage.lock()()
+
+	if _, ok := storage.authors[id]; !ok {
+		return errAuthorNotFound
+	}
+	for _, b := range storage.books {
+		for _, a := range b.Authors {
+			if a.AuthorID == id {
+				return errAuthorInUse
+			}
+		}
+	}
+	delete(storage.authors, id)
+	return nil
+}
+
+// CreatePublisher stores a new publisher.
+func (storage *MemoryStorage) CreatePublisher(ctx context.Context, p Publisher) error {
+	defer storage.lock()()
+
+	if _, ok := storage.publishers[p.ID]; ok {
+		return ErrAlreadyExists
+	}
+	storage.publishers[p.ID] = p
+	return nil
+}
+
+// GetPublisher returns the publisher with the id.
+func (storage *MemoryStorage) GetPublisher(ctx context.Context,
+	id string) (Publisher, error) {
+	defer storage.rlock()()
+
+	p, ok := storage.publishers[id]
+	if !ok {
+		return Publisher{}, errPublisherNotFound
+	}
+	return p, nil
+}
+
+// ListPublishers returns one page of the publishers ordered by display name
+// and id.
+func (storage *MemoryStorage) ListPublishers(ctx context.Context, pageSize int,
+	after []string) ([]Publisher, []string, error) {
+	defer storage.rlock()()
+
+	var all []Publisher
+	for _, p := range storage.publishers {
+		all = append(all, p)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(publisherKey(all[i]), publisherKey(all[j])) < 0
+	})
+
+	var publishers []Publisher
+	var next []string
+	for _, p := range all {
+		if after != nil && compareKeys(publisherKey(p), after) <= 0 {
+			continue
+		}
+		if len(publishers) == pageSize {
+			next = publisherKey(publishers[len(publishers)-1])
+			break
+		}
+		publishers = append(publishers, p)
+	}
+	return publishers, next, nil
+}
+
+// UpdatePublisher writes the fields and the update time of the publisher.
+func (storage *MemoryStorage) UpdatePublisher(ctx context.Context, p Publisher) error {
+	defer storage.lock()()
+
+	existing, ok := storage.publishers[p.ID]
+	if !ok {
+		return errPublisherNotFound
+	}
+	existing.DisplayName = p.DisplayName
+	existing.Country = p.Country
+	existing.Website = p.Website
+	existing.UpdateTime = p.UpdateTime
+	storage.publishers[p.ID] = existing
+	return nil
+}
+
+// DeletePublisher removes a publisher. If force is set the publisher of its
+// books is cleared, otherwise a publisher with books is kept.
+func (storage *MemoryStorage) DeletePublisher(ctx context.Context, id string,
+	force bool) error {
+	defer storage.lock()()
+
+	if _, ok := storage.publishers[id]; !ok {
+		return errPublisherNotFound
+	}
+	for isbn, b := range storage.books {
+		if b.Publisher != id {
+			continue
+		}
+		if !force {
+			return errPublisherInUse
+		}
+		b.Publisher = ""
+		storage.books[isbn] = b
+		if err := storage.recordRevision(isbn, changeUpdated); err != nil {
+			return err
+		}
+	}
+	delete(storage.publishers, id)
+	return nil
+}
+
+// CreateCopy stores a new copy of an existing book.
+func (storage *MemoryStorage) CreateCopy(ctx context.Context, c Copy) error {
+	defer storage.lock()()
+
+	if _, ok := storage.books[c.ISBN]; !ok {
+		return ErrNotFound
+	}
+	if storage.barcodeTaken(c) {
+		return errBarcodeExists
+	}
+	if storage.copies[c.ISBN] == nil {
+		storage.copies[c.ISBN] = map[string]Copy{}
+	}
+	storage.copies[c.ISBN][c.ID] = c
+	return nil
+}
+
+// barcodeTaken reports whether another copy has the barcode of the copy.
+func (storage *MemoryStorage) barcodeTaken(c Copy) bool {
+	for _, copies := range storage.copies {
+		for _, other := range copies {
+			if other.Barcode == c.Barcode && other.ID != c.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetCopy returns the copy of the book with the isbn.
+func (storage *MemoryStorage) GetCopy(ctx context.Context, isbn, id string) (Copy, error) {
+	defer storage.rlock()()
+
+	c, ok := storage.copies[isbn][id]
+	if !ok {
+		return Copy{}, errCopyNotFound
+	}
+	return c, nil
+}
+
+// ListCopies returns one page of the copies of the book ordered by barcode and
+// id.
+func (storage *MemoryStorage) ListCopies(ctx context.Context, isbn string,
+	pageSize int, after []string) ([]Copy, []string, error) {
+	defer storage.rlock()()
+
+	var all []Copy
+	for _, c := range storage.copies[isbn] {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(copyKey(all[i]), copyKey(all[j])) < 0
+	})
+
+	var copies []Copy
+	var next []string
+	for _, c := range all {
+		if after != nil && compareKeys(copyKey(c), after) <= 0 {
+			continue
+		}
+		if len(copies) == pageSize {
+			next = copyKey(copies[len(copies)-1])
+			break
+		}
+		copies = append(copies, c)
+	}
+	return copies, next, nil
+}
+
+// UpdateCopy writes the fields and the update time of the copy.
+func (storage *MemoryStorage) UpdateCopy(ctx context.Context, c Copy) error {
+	defer storage.lock()()
+
+	existing, ok := storage.copies[c.ISBN][c.ID]
+	if !ok {
+		return errCopyNotFound
+	}
+	if storage.barcodeTaken(c) {
+		return errBarcodeExists
+	}
+	c.CreateTime = existing.CreateTime
+	storage.copies[c.ISBN][c.ID] = c
+	return nil
+}
+
+// DeleteCopy removes a copy which is neither on loan, on hold nor in transit.
+func (storage *MemoryStorage) DeleteCopy(ctx context.Context, isbn, id string) error {
+	defer storage.lock()()
+
+	c, ok := storage.copies[isbn][id]
+	switch {
+	case !ok:
+		return errCopyNotFound
+	case c.Status == statusOnLoan:
+		return errCopyOnLoan
+	case c.Status == statusOnHold:
+		return errCopyOnHold
+	case c.Status == statusInTransit:
+		return errCopyInTransit
+	}
+	delete(storage.copies[isbn], id)
+	return nil
+}
+
+// CreateMember stores a new member.
+func (storage *MemoryStorage) CreateMember(ctx context.Context, m Member) error {
+	defer storage.lock()()
+
+	if _, ok := storage.members[m.ID]; ok {
+		return ErrAlreadyExists
+	}
+	if storage.cardNumberTaken(m) {
+		return errCardNumberExists
+	}
+	storage.members[m.ID] = m
+	return nil
+}
+
+// cardNumberTaken reports whether another member has the card number of the
+// member.
+func (storage *MemoryStorage) cardNumberTaken(m Member) bool {
+	for _, other := range storage.members {
+		if other.CardNumber == m.CardNumber && other.ID != m.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMember returns the member with the id.
+func (storage *MemoryStorage) GetMember(ctx context.Context, id string) (Member, error) {
+	defer storage.rlock()()
+
+	m, ok := storage.members[id]
+	if !ok {
+		return Member{}, errMemberNotFound
+	}
+	return m, nil
+}
+
+// ListMembers returns one page of the members ordered by last name, first
+// name and id.
+func (storage *MemoryStorage) ListMembers(ctx context.Context, pageSize int,
+	after []string) ([]Member, []string, error) {
+	defer storage.rlock()()
+
+	var all []Member
+	for _, m := range storage.members {
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(memberKey(all[i]), memberKey(all[j])) < 0
+	})
+
+	var members []Member
+	var next []string
+	for _, m := range all {
+		if after != nil && compareKeys(memberKey(m), after) <= 0 {
+			continue
+		}
+		if len(members) == pageSize {
+			next = memberKey(members[len(members)-1])
+			break
+		}
+		members = append(members, m)
+	}
+	return members, next, nil
+}
+
+// UpdateMember writes the fields and the update time of the member.
+func (storage *MemoryStorage) UpdateMember(ctx context.Context, m Member) error {
+	defer storage.lock()()
+
+	existing, ok := storage.members[m.ID]
+	if !ok {
+		return errMemberNotFound
+	}
+	if storage.cardNumberTaken(m) {
+		return errCardNumberExists
+	}
+	m.CreateTime = existing.CreateTime
+	storage.members[m.ID] = m
+	return nil
+}
+
+// DeleteMember removes a member without copies on loan or a balance. The
+// ledger of the member is kept.
+func (storage *MemoryStorage) DeleteMember(ctx context.Context, id string) error {
+	defer storage.lock()()
+
+	if _, ok := storage.members[id]; !ok {
+		return errMemberNotFound
+	}
+	if storage.countActiveLoans(id) > 0 {
+		return errMemberHasLoans
+	}
+	if storage.ledgerTotals(id).balance() != 0 {
+		return errMemberHasBalance
+	}
+	delete(storage.members, id)
+	return nil
+}
+
+// CreateLoan stores a new loan and marks its copy as on loan.
+func (storage *MemoryStorage) CreateLoan(ctx context.Context, l Loan) error {
+	defer storage.lock()()
+
+	c, ok := storage.copies[l.ISBN][l.CopyID]
+	switch {
+	case !ok:
+		return errCopyNotFound
+	case c.Status != statusAvailable:
+		return errCopyNotAvailable
+	}
+	c.Status = statusOnLoan
+	c.UpdateTime = l.CheckoutTime
+	storage.copies[l.ISBN][l.CopyID] = c
+	storage.loans[l.ID] = l
+	return nil
+}
+
+// GetLoan returns the loan with the id.
+func (storage *MemoryStorage) GetLoan(ctx context.Context, id string) (Loan, error) {
+	defer storage.rlock()()
+
+	l, ok := storage.loans[id]
+	if !ok {
+		return Loan{}, errLoanNotFound
+	}
+	return l, nil
+}
+
+// GetActiveLoan returns the loan of the copy which has not been returned.
+func (storage *MemoryStorage) GetActiveLoan(ctx context.Context, isbn,
+	copyID string) (Loan, error) {
+	defer storage.rlock()()
+
+	for _, l := range storage.loans {
+		if l.ISBN == isbn && l.CopyID == copyID && l.IsActive() {
+			return l, nil
+		}
+	}
+	return Loan{}, errCopyNotOnLoan
+}
+
+// CountActiveLoans counts the loans of the member which have not been
+// returned.
+func (storage *MemoryStorage) CountActiveLoans(ctx context.Context,
+	memberID string) (int, error) {
+	defer storage.rlock()()
+
+	return storage.countActiveLoans(memberID), nil
+}
+
+// countActiveLoans counts the loans of the member which have not been
+// returned.
+func (storage *MemoryStorage) countActiveLoans(memberID string) int {
+	count := 0
+	for _, l := range storage.loans {
+		if l.MemberID == memberID && l.IsActive() {
+			count++
+		}
+	}
+	return count
+}
+
+// ListLoans returns one page of the loans ordered by checkout time and id.
+func (storage *MemoryStorage) ListLoans(ctx context.Context, memberID string,
+	showReturned bool, pageSize int, after []string) ([]Loan, []string, error) {
+	defer storage.rlock()()
+
+	var all []Loan
+	for _, l := range storage.loans {
+		if (memberID == "" || l.MemberID == memberID) && (showReturned || l.IsActive()) {
+			all = append(all, l)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(loanKey(all[i]), loanKey(all[j])) < 0
+	})
+
+	var loans []Loan
+	var next []string
+	for _, l := range all {
+		if after != nil && compareKeys(loanKey(l), after) <= 0 {
+			continue
+		}
+		if len(loans) == pageSize {
+			next = loanKey(loans[len(loans)-1])
+			break
+		}
+		loans = append(loans, l)
+	}
+	return loans, next, nil
+}
+
+// RenewLoan writes the due date and the renewals of an active loan.
+func (storage *MemoryStorage) RenewLoan(ctx context.Context, l Loan) error {
+	defer storage.lock()()
+
+	existing, ok := storage.loans[l.ID]
+	switch {
+	case !ok:
+		return errLoanNotFound
+	case !existing.IsActive():
+		return errLoanReturned
+	}
+	existing.DueDate = l.DueDate
+	existing.Renewals = l.Renewals
+	storage.loans[l.ID] = existing
+	return nil
+}
+
+// ReturnLoan writes the return time of an active loan and marks its copy as
+// available, or as lost if the loan is lost.
+func (storage *MemoryStorage) ReturnLoan(ctx context.Context, l Loan) error {
+	defer storage.lock()()
+
+	existing, ok := storage.loans[l.ID]
+	switch {
+	case !ok:
+		return errLoanNotFound
+	case !existing.IsActive():
+		return errLoanReturned
+	}
+	existing.ReturnTime = l.ReturnTime
+	existing.Lost = l.Lost
+	storage.loans[l.ID] = existing
+	if c, ok := storage.copies[existing.ISBN][existing.CopyID]; ok {
+		c.Status = statusAvailable
+		if l.Lost {
+			c.Status = statusLost
+		}
+		c.UpdateTime = l.ReturnTime
+		storage.copies[existing.ISBN][existing.CopyID] = c
+	}
+	return nil
+}
+
+// CreateHold stores a new hold.
+func (storage *MemoryStorage) CreateHold(ctx context.Context, h Hold) error {
+	defer storage.lock()()
+
+	for _, other := range storage.holds[h.ISBN] {
+		if other.MemberID == h.MemberID && other.IsActive() {
+			return errHoldExists
+		}
+	}
+	if storage.holds[h.ISBN] == nil {
+		storage.holds[h.ISBN] = map[string]Hold{}
+	}
+	storage.holds[h.ISBN][h.ID] = h
+	return nil
+}
+
+// GetHold returns the hold on the book with the isbn.
+func (storage *MemoryStorage) GetHold(ctx context.Context, isbn, id string) (Hold, error) {
+	defer storage.rlock()()
+
+	h, ok := storage.holds[isbn][id]
+	if !ok {
+		return Hold{}, errHoldNotFound
+	}
+	return h, nil
+}
+
+// sortedHolds returns the holds on the book matching the condition, ordered
+// by place time and id.
+func (storage *MemoryStorage) sortedHolds(isbn string, match func(h Hold) bool) []Hold {
+	var holds []Hold
+	for _, h := range storage.holds[isbn] {
+		if match(h) {
+			holds = append(holds, h)
+		}
+	}
+	sort.Slice(holds, func(i, j int) bool {
+		return compareKeys(holdKey(holds[i]), holdKey(holds[j])) < 0
+	})
+	return holds
+}
+
+// ListHolds returns one page of the holds on the book ordered by place time
+// and id.
+func (storage *MemoryStorage) ListHolds(ctx context.Context, isbn string,
+	showClosed bool, pageSize int, after []string) ([]Hold, []string, error) {
+	defer storage.rlock()()
+
+	var holds []Hold
+	var next []string
+	for _, h := range storage.sortedHolds(isbn, func(h Hold) bool {
+		return showClosed || h.IsActive()
+	}) {
+		if after != nil && compareKeys(holdKey(h), after) <= 0 {
+			continue
+		}
+		if len(holds) == pageSize {
+			next = holdKey(holds[len(holds)-1])
+			break
+		}
+		holds = append(holds, h)
+	}
+	return holds, next, nil
+}
+
+// NextWaitingHold returns the waiting hold on the book which was placed
+// first and has no copy sent to it.
+func (storage *MemoryStorage) NextWaitingHold(ctx context.Context, isbn string) (Hold, error) {
+	defer storage.rlock()()
+
+	waiting := storage.sortedHolds(isbn, func(h Hold) bool {
+		return h.State == holdWaiting && h.CopyID == ""
+	})
+	if len(waiting) == 0 {
+		return Hold{}, errNoWaitingHold
+	}
+	return waiting[0], nil
+}
+
+// GetHoldOfCopy returns the ready hold the copy is held for, or the waiting
+// hold the copy is sent for.
+func (storage *MemoryStorage) GetHoldOfCopy(ctx context.Context, isbn,
+	copyID string) (Hold, error) {
+	defer storage.rlock()()
+
+	for _, h := range storage.holds[isbn] {
+		if h.IsActive() && h.CopyID == copyID {
+			return h, nil
+		}
+	}
+	return Hold{}, errCopyNotOnHold
+}
+
+// ListExpiredHolds returns the ready holds whose pickup expire time is before
+// now.
+func (storage *MemoryStorage) ListExpiredHolds(ctx context.Context,
+	now time.Time) ([]Hold, error) {
+	defer storage.rlock()()
+
+	var expired []Hold
+	for isbn := range storage.holds {
+		expired = append(expired, storage.sortedHolds(isbn, func(h Hold) bool {
+			return h.State == holdReady && !h.PickupExpireTime.After(now)
+		})...)
+	}
+	return expired, nil
+}
+
+// UpdateHold writes the state, the held copy, the pickup expire time and the
+// update time of the hold.
+func (storage *MemoryStorage) UpdateHold(ctx context.Context, h Hold) error {
+	defer storage.lock()()
+
+	existing, ok := storage.holds[h.ISBN][h.ID]
+	if !ok {
+		return errHoldNotFound
+	}
+	existing.State = h.State
+	existing.CopyID = h.CopyID
+	existing.PickupExpireTime = h.PickupExpireTime
+	existing.UpdateTime = h.UpdateTime
+	storage.holds[h.ISBN][h.ID] = existing
+	return nil
+}
+
+// AppendLedgerEntry stores a new entry in the ledger of a member.
+func (storage *MemoryStorage) AppendLedgerEntry(ctx context.Context, e LedgerEntry) error {
+	defer storage.lock()()
+
+	storage.ledgers[e.MemberID] = append(storage.ledgers[e.MemberID], e)
+	return nil
+}
+
+// ListLedgerEntries returns one page of the ledger entries of the member
+// ordered by create time and id.
+func (storage *MemoryStorage) ListLedgerEntries(ctx context.Context, memberID string,
+	pageSize int, after []string) ([]LedgerEntry, []string, error) {
+	defer storage.rlock()()
+
+	all := append([]LedgerEntry(nil), storage.ledgers[memberID]...)
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(ledgerEntryKey(all[i]), ledgerEntryKey(all[j])) < 0
+	})
+
+	var entries []LedgerEntry
+	var next []string
+	for _, e := range all {
+		if after != nil && compareKeys(ledgerEntryKey(e), after) <= 0 {
+			continue
+		}
+		if len(entries) == pageSize {
+			next = ledgerEntryKey(entries[len(entries)-1])
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, next, nil
+}
+
+// LedgerTotals sums the amounts of the ledger entries of the member by their
+// type.
+func (storage *MemoryStorage) LedgerTotals(ctx context.Context,
+	memberID string) (ledgerTotals, error) {
+	defer storage.rlock()()
+
+	return storage.ledgerTotals(memberID), nil
+}
+
+// ledgerTotals sums the amounts of the ledger entries of the member by their
+// type.
+func (storage *MemoryStorage) ledgerTotals(memberID string) ledgerTotals {
+	totals := ledgerTotals{}
+	for _, e := range storage.ledgers[memberID] {
+		totals[e.Type] += e.AmountCents
+	}
+	return totals
+}
+
+// CreateBranch stores a new branch.
+func (storage *MemoryStorage) CreateBranch(ctx context.Context, b Branch) error {
+	defer storage.lock()()
+
+	if _, ok := storage.branches[b.ID]; ok {
+		return errBranchExists
+	}
+	storage.branches[b.ID] = b
+	return nil
+}
+
+// GetBranch returns the branch with the id.
+func (storage *MemoryStorage) GetBranch(ctx context.Context, id string) (Branch, error) {
+	defer storage.rlock()()
+
+	b, ok := storage.branches[id]
+	if !ok {
+		return Branch{}, errBranchNotFound
+	}
+	return b, nil
+}
+
+// ListBranches returns one page of the branches ordered by id.
+func (storage *MemoryStorage) ListBranches(ctx context.Context, pageSize int,
+	after []string) ([]Branch, []string, error) {
+	defer storage.rlock()()
+
+	var all []Branch
+	for _, b := range storage.branches {
+		all = append(all, b)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(branchKey(all[i]), branchKey(all[j])) < 0
+	})
+
+	var branches []Branch
+	var next []string
+	for _, b := range all {
+		if after != nil && compareKeys(branchKey(b), after) <= 0 {
+			continue
+		}
+		if len(branches) == pageSize {
+			next = branchKey(branches[len(branches)-1])
+			break
+		}
+		branches = append(branches, b)
+	}
+	return branches, next, nil
+}
+
+// UpdateBranch writes the fields and the update time of the branch.
+func (storage *MemoryStorage) UpdateBranch(ctx context.Context, b Branch) error {
+	defer storage.lock()()
+
+	existing, ok := storage.branches[b.ID]
+	if !ok {
+		return errBranchNotFound
+	}
+	b.CreateTime = existing.CreateTime
+	storage.branches[b.ID] = b
+	return nil
+}
+
+// DeleteBranch removes a branch which owns no copies, and its calendar.
+func (storage *MemoryStorage) DeleteBranch(ctx context.Context, id string) error {
+	defer storage.lock()()
+
+	if _, ok := storage.branches[id]; !ok {
+		return errBranchNotFound
+	}
+	for _, copies := range storage.copies {
+		for _, c := range copies {
+			if c.Branch == id || c.TransferBranch == id {
+				return errBranchInUse
+			}
+		}
+	}
+	delete(storage.branches, id)
+	delete(storage.hours, id)
+	delete(storage.closures, id)
+	return nil
+}
+
+// GetOpeningHours returns the opening hours of the branch.
+func (storage *MemoryStorage) GetOpeningHours(ctx context.Context,
+	branch string) (OpeningHours, error) {
+	defer storage.rlock()()
+
+	h, ok := storage.hours[branch]
+	if !ok {
+		return OpeningHours{Branch: branch}, nil
+	}
+	return h, nil
+}
+
+// SetOpeningHours replaces the opening periods of the branch.
+func (storage *MemoryStorage) SetOpeningHours(ctx context.Context, h OpeningHours) error {
+	defer storage.lock()()
+
+	periods := append([]OpeningPeriod(nil), h.Periods...)
+	sort.Slice(periods, func(i, j int) bool {
+		if periods[i].Day != periods[j].Day {
+			return periods[i].Day < periods[j].Day
+		}
+		return periods[i].OpenTime < periods[j].OpenTime
+	})
+	h.Periods = periods
+	storage.hours[h.Branch] = h
+	return nil
+}
+
+// CreateClosure stores a new closure of a branch.
+func (storage *MemoryStorage) CreateClosure(ctx context.Context, c Closure) error {
+	defer storage.lock()()
+
+	if storage.closures[c.Branch] == nil {
+		storage.closures[c.Branch] = map[string]Closure{}
+	}
+	if _, ok := storage.closures[c.Branch][c.ID]; ok {
+		return ErrAlreadyExists
+	}
+	storage.closures[c.Branch][c.ID] = c
+	return nil
+}
+
+// GetClosure returns the closure of the branch.
+func (storage *MemoryStorage) GetClosure(ctx context.Context, branch,
+	id string) (Closure, error) {
+	defer storage.rlock()()
+
+	c, ok := storage.closures[branch][id]
+	if !ok {
+		return Closure{}, errClosureNotFound
+	}
+	return c, nil
+}
+
+// ListClosures returns one page of the closures of the branch ordered by start
+// date and id.
+func (storage *MemoryStorage) ListClosures(ctx context.Context, branch string,
+	pageSize int, after []string) ([]Closure, []string, error) {
+	defer storage.rlock()()
+
+	var closures []Closure
+	var next []string
+	for _, c := range storage.sortedClosures(branch) {
+		if after != nil && compareKeys(closureKey(c), after) <= 0 {
+			continue
+		}
+		if len(closures) == pageSize {
+			next = closureKey(closures[len(closures)-1])
+			break
+		}
+		closures = append(closures, c)
+	}
+	return closures, next, nil
+}
+
+// ListClosuresBetween returns the closures of the branch which include a day
+// from the from date to the to date.
+func (storage *MemoryStorage) ListClosuresBetween(ctx context.Context, branch, from,
+	to string) ([]Closure, error) {
+	defer storage.rlock()()
+
+	var closures []Closure
+	for _, c := range storage.sortedClosures(branch) {
+		if c.StartDate <= to && c.EndDate >= from {
+			closures = append(closures, c)
+		}
+	}
+	return closures, nil
+}
+
+// sortedClosures returns the closures of the branch ordered by start date and
+// id.
+func (storage *MemoryStorage) sortedClosures(branch string) []Closure {
+	var all []Closure
+	for _, c := range storage.closures[branch] {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(closureKey(all[i]), closureKey(all[j])) < 0
+	})
+	return all
+}
+
+// UpdateClosure writes the fields and the update time of the closure.
+func (storage *MemoryStorage) UpdateClosure(ctx context.Context, c Closure) error {
+	defer storage.lock()()
+
+	existing, ok := storage.closures[c.Branch][c.ID]
+	if !ok {
+		return errClosureNotFound
+	}
+	c.CreateTime = existing.CreateTime
+	storage.closures[c.Branch][c.ID] = c
+	return nil
+}
+
+// DeleteClosure removes the closure of the branch.
+func (storage *MemoryStorage) DeleteClosure(ctx context.Context, branch, id string) error {
+	defer storage.lock()()
+
+	if _, ok := storage.closures[branch][id]; !ok {
+		return errClosureNotFound
+	}
+	delete(storage.closures[branch], id)
+	return nil
+}
+
+// CreateAPIKey stores a new API key.
+func (storage *MemoryStorage) CreateAPIKey(ctx context.Context, k APIKey) error {
+	defer storage.lock()()
+
+	storage.apiKeys[k.ID] = k
+	return nil
+}
+
+// GetAPIKeyByHash returns the API key with the key hash.
+func (storage *MemoryStorage) GetAPIKeyByHash(ctx context.Context,
+	keyHash string) (APIKey, error) {
+	defer storage.rlock()()
+
+	for _, k := range storage.apiKeys {
+		if k.KeyHash == keyHash {
+			return k, nil
+		}
+	}
+	return APIKey{}, errAPIKeyNotFound
+}
+
+// ListAPIKeys returns all the API keys ordered by create time and id.
+func (storage *MemoryStorage) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	defer storage.rlock()()
+
+	var keys []APIKey
+	for _, k := range storage.apiKeys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(apiKeyKey(keys[i]), apiKeyKey(keys[j])) < 0
+	})
+	return keys, nil
+}
+
+// DeleteAPIKey removes the API key.
+func (storage *MemoryStorage) DeleteAPIKey(ctx context.Context, id string) error {
+	defer storage.lock()()
+
+	if _, ok := storage.apiKeys[id]; !ok {
+		return errAPIKeyNotFound
+	}
+	delete(storage.apiKeys, id)
+	return nil
+}
+
+// SetRoleBinding stores the role binding of the principal.
+func (storage *MemoryStorage) SetRoleBinding(ctx context.Context, b RoleBinding) error {
+	defer storage.lock()()
+
+	storage.roles[b.Principal] = b
+	return nil
+}
+
+// GetRoleBinding returns the role binding of the principal.
+func (storage *MemoryStorage) GetRoleBinding(ctx context.Context,
+	principal string) (RoleBinding, error) {
+	defer storage.rlock()()
+
+	b, ok := storage.roles[principal]
+	if !ok {
+		return RoleBinding{}, errRoleBindingNotFound
+	}
+	return b, nil
+}
+
+// ListRoleBindings returns one page of the role bindings ordered by principal.
+func (storage *MemoryStorage) ListRoleBindings(ctx context.Context, pageSize int,
+	after []string) ([]RoleBinding, []string, error) {
+	defer storage.rlock()()
+
+	var all []RoleBinding
+	for _, b := range storage.roles {
+		all = append(all, b)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(roleBindingKey(all[i]), roleBindingKey(all[j])) < 0
+	})
+
+	var bindings []RoleBinding
+	var next []string
+	for _, b := range all {
+		if after != nil && compareKeys(roleBindingKey(b), after) <= 0 {
+			continue
+		}
+		if len(bindings) == pageSize {
+			next = roleBindingKey(bindings[len(bindings)-1])
+			break
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, next, nil
+}
+
+// DeleteRoleBinding removes the role binding of the principal.
+func (storage *MemoryStorage) DeleteRoleBinding(ctx context.Context,
+	principal string) error {
+	defer storage.lock()()
+
+	if _, ok := storage.roles[principal]; !ok {
+		return errRoleBindingNotFound
+	}
+	delete(storage.roles, principal)
+	return nil
+}
+
+// AppendAuditEvent stores a new audit event.
+func (storage *MemoryStorage) AppendAuditEvent(ctx context.Context, e AuditEvent) error {
+	defer storage.lock()()
+
+	storage.audit = append(storage.audit, e)
+	return nil
+}
+
+// ListAuditEvents returns one page of the audit events selected by the query
+// ordered by event time and id.
+func (storage *MemoryStorage) ListAuditEvents(ctx context.Context,
+	q auditQuery) ([]AuditEvent, []string, error) {
+	defer storage.rlock()()
+
+	all := append([]AuditEvent(nil), storage.audit...)
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(auditEventKey(all[i]), auditEventKey(all[j])) < 0
+	})
+
+	var events []AuditEvent
+	var next []string
+	for _, e := range all {
+		switch {
+		case q.resource != "" && e.Resource != q.resource,
+			!q.startTime.IsZero() && e.EventTime.Before(q.startTime),
+			!q.endTime.IsZero() && !e.EventTime.Before(q.endTime),
+			q.after != nil && compareKeys(auditEventKey(e), q.after) <= 0:
+			continue
+		}
+		if len(events) == q.pageSize {
+			next = auditEventKey(events[len(events)-1])
+			break
+		}
+		events = append(events, e)
+	}
+	return events, next, nil
+}
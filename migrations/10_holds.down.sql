@@ -0,0 +1,3 @@
+DROP INDEX holds_active_member;
+DROP INDEX holds_queue;
+DROP TABLE holds;
@@ -0,0 +1,18 @@
+-- The holds of the members on the books. The waiting holds of a book are
+-- served in the order they were placed, and a member has at most one waiting
+-- or ready hold on a book.
+CREATE TABLE holds(
+    id TEXT PRIMARY KEY,
+    isbn TEXT NOT NULL,
+    memberId TEXT NOT NULL,
+    pickupBranch TEXT NOT NULL,
+    state TEXT NOT NULL,
+    copyId TEXT NOT NULL DEFAULT '',
+    placeTime timestamp NOT NULL,
+    pickupExpireTime timestamp,
+    updateTime timestamp NOT NULL
+);
+
+CREATE INDEX holds_queue ON holds(isbn, state, placeTime, id);
+CREATE UNIQUE INDEX holds_active_member ON holds(isbn, memberId)
+    WHERE state IN ('waiting', 'ready');
@@ -0,0 +1,4 @@
+ALTER TABLE loans DROP COLUMN lost;
+
+DROP INDEX ledger_entries_member;
+DROP TABLE ledger_entries;
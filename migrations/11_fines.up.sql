@@ -0,0 +1,17 @@
+-- The append-only ledger of the fines and payments of the members. The
+-- amounts are positive in the smallest unit of the currency.
+CREATE TABLE ledger_entries(
+    id TEXT PRIMARY KEY,
+    memberId TEXT NOT NULL,
+    type TEXT NOT NULL,
+    amountCents INTEGER NOT NULL,
+    currencyCode TEXT NOT NULL,
+    loanId TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    balanceCents INTEGER NOT NULL,
+    createTime timestamp NOT NULL
+);
+
+CREATE INDEX ledger_entries_member ON ledger_entries(memberId, createTime, id);
+
+ALTER TABLE loans ADD COLUMN lost INTEGER NOT NULL DEFAULT 0;
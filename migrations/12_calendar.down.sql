@@ -0,0 +1,5 @@
+ALTER TABLE loans DROP COLUMN branch;
+
+DROP INDEX closures_branch;
+DROP TABLE closures;
+DROP TABLE opening_periods;
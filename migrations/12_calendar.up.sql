@@ -0,0 +1,26 @@
+-- The weekly opening hours of the branches. The days are numbered from 1 for
+-- Monday to 7 for Sunday, and a branch without periods is open every day.
+CREATE TABLE opening_periods(
+    branch TEXT NOT NULL,
+    day INTEGER NOT NULL,
+    openTime TEXT NOT NULL,
+    closeTime TEXT NOT NULL,
+    PRIMARY KEY (branch, day, openTime)
+);
+
+-- The holidays and ad-hoc closures of the branches. The end date is the last
+-- closed day.
+CREATE TABLE closures(
+    id TEXT PRIMARY KEY,
+    branch TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    startDate TEXT NOT NULL,
+    endDate TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    createTime timestamp NOT NULL,
+    updateTime timestamp NOT NULL
+);
+
+CREATE INDEX closures_branch ON closures(branch, startDate, id);
+
+ALTER TABLE loans ADD COLUMN branch TEXT NOT NULL DEFAULT '';
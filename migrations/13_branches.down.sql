@@ -0,0 +1,6 @@
+DROP INDEX copies_branch;
+
+ALTER TABLE copies DROP COLUMN transferBranch;
+ALTER TABLE copies DROP COLUMN branch;
+
+DROP TABLE branches;
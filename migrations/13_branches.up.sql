@@ -0,0 +1,15 @@
+-- The branches of the library. The copies belong to a branch, or to no branch
+-- if they were added before the branches, and are sent to the transfer branch
+-- while they are in transit.
+CREATE TABLE branches(
+    id TEXT PRIMARY KEY,
+    displayName TEXT NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    createTime timestamp NOT NULL,
+    updateTime timestamp NOT NULL
+);
+
+ALTER TABLE copies ADD COLUMN branch TEXT NOT NULL DEFAULT '';
+ALTER TABLE copies ADD COLUMN transferBranch TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX copies_branch ON copies(branch, status);
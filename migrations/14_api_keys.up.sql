@@ -0,0 +1,8 @@
+-- The API keys authenticating the clients. Only the SHA-256 of a key is
+-- stored, which the key is looked up by.
+CREATE TABLE api_keys(
+    id TEXT PRIMARY KEY,
+    displayName TEXT NOT NULL,
+    keyHash TEXT NOT NULL UNIQUE,
+    createTime timestamp NOT NULL
+);
@@ -0,0 +1,7 @@
+-- The roles bound to the authenticated principals. Principals without a role
+-- binding are denied every call.
+CREATE TABLE role_bindings(
+    principal TEXT PRIMARY KEY,
+    role TEXT NOT NULL,
+    updateTime timestamp NOT NULL
+);
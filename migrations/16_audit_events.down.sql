@@ -0,0 +1,5 @@
+DROP TRIGGER audit_events_no_delete;
+DROP TRIGGER audit_events_no_update;
+DROP INDEX audit_events_resource;
+DROP INDEX audit_events_time;
+DROP TABLE audit_events;
@@ -0,0 +1,25 @@
+-- The append-only audit log of the changes of the books, with the JSON of a
+-- book before and after each change. The before snapshot is empty when the
+-- book was created.
+CREATE TABLE audit_events(
+    id TEXT PRIMARY KEY,
+    principal TEXT NOT NULL DEFAULT '',
+    method TEXT NOT NULL,
+    resource TEXT NOT NULL,
+    beforeJson TEXT NOT NULL DEFAULT '',
+    afterJson TEXT NOT NULL,
+    eventTime timestamp NOT NULL
+);
+
+CREATE INDEX audit_events_time ON audit_events(eventTime, id);
+CREATE INDEX audit_events_resource ON audit_events(resource, eventTime, id);
+
+CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events can not be changed');
+END;
+
+CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events can not be removed');
+END;
@@ -0,0 +1,2 @@
+DROP INDEX book_revisions_isbn;
+DROP TABLE book_revisions;
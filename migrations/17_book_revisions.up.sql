@@ -0,0 +1,30 @@
+-- The revisions of the books. Every write of a book stores the written book
+-- as a new revision, whose authors are a JSON array of their ids and roles in
+-- the order they are credited. The seq orders the revisions of a book.
+CREATE TABLE book_revisions(
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    isbn TEXT NOT NULL,
+    revisionId TEXT NOT NULL,
+    revisionCreateTime timestamp NOT NULL,
+    title TEXT NOT NULL,
+    publisherId TEXT NOT NULL DEFAULT '',
+    authors TEXT NOT NULL DEFAULT '[]',
+    createTime timestamp NOT NULL,
+    updateTime timestamp NOT NULL,
+    deleteTime timestamp,
+    expireTime timestamp,
+    UNIQUE (isbn, revisionId)
+);
+
+CREATE INDEX book_revisions_isbn ON book_revisions(isbn, seq);
+
+-- The books stored before the revisions were kept start with one revision.
+INSERT INTO book_revisions (isbn, revisionId, revisionCreateTime, title,
+    publisherId, authors, createTime, updateTime, deleteTime, expireTime)
+SELECT isbn, lower(hex(randomblob(8))), updateTime, title,
+    COALESCE(publisherId, ''),
+    (SELECT json_group_array(json_object('authorId', authorId, 'role', role))
+        FROM (SELECT authorId, role FROM book_authors
+            WHERE book_authors.isbn = library.isbn ORDER BY position)),
+    createTime, updateTime, deleteTime, expireTime
+FROM library;
@@ -0,0 +1,11 @@
+-- The changes of the books in the order they were made, which WatchBooks
+-- streams and resumes from. Every stored revision of a book appends a change,
+-- and the changes are kept when the book is purged, so the seq of a change
+-- stays valid as a resume token.
+CREATE TABLE book_changes(
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    isbn TEXT NOT NULL,
+    changeType TEXT NOT NULL,
+    revisionId TEXT NOT NULL,
+    changeTime timestamp NOT NULL
+);
@@ -0,0 +1,2 @@
+UPDATE role_bindings SET principal = substr(principal, length('users/') + 1)
+    WHERE principal LIKE 'users/%';
@@ -0,0 +1,4 @@
+-- The principals of the JWTs are namespaced as 'users/{sub}', so that a sub
+-- claim can never be taken for an API key.
+UPDATE role_bindings SET principal = 'users/' || principal
+    WHERE principal NOT LIKE 'apiKeys/%';
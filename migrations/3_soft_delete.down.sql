@@ -0,0 +1,5 @@
+ALTER TABLE library
+DROP COLUMN expireTime;
+
+ALTER TABLE library
+DROP COLUMN deleteTime;
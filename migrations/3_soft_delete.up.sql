@@ -0,0 +1,6 @@
+-- Deleted books are kept until their expire time has passed
+ALTER TABLE library
+ADD deleteTime timestamp;
+
+ALTER TABLE library
+ADD expireTime timestamp;
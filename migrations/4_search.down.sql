@@ -0,0 +1,7 @@
+DROP TRIGGER author_search_update;
+DROP TRIGGER author_search_insert;
+DROP TRIGGER library_search_delete;
+DROP TRIGGER library_search_update;
+DROP TRIGGER library_search_insert;
+
+DROP TABLE book_search;
@@ -0,0 +1,38 @@
+-- Full-text index of the books, kept in sync with the library and author
+-- tables by the triggers below
+CREATE VIRTUAL TABLE book_search USING fts5(
+    isbn UNINDEXED,
+    title,
+    author,
+    publisher
+);
+
+INSERT INTO book_search (isbn, title, author, publisher)
+SELECT library.isbn, library.title,
+    author.firstName || ' ' || author.lastName,
+    COALESCE(library.publisher, '')
+FROM library INNER JOIN author ON library.isbn = author.isbn;
+
+CREATE TRIGGER library_search_insert AFTER INSERT ON library BEGIN
+    INSERT INTO book_search (isbn, title, author, publisher)
+    VALUES (NEW.isbn, NEW.title, '', COALESCE(NEW.publisher, ''));
+END;
+
+CREATE TRIGGER library_search_update AFTER UPDATE OF title, publisher ON library BEGIN
+    UPDATE book_search SET title = NEW.title, publisher = COALESCE(NEW.publisher, '')
+    WHERE isbn = NEW.isbn;
+END;
+
+CREATE TRIGGER library_search_delete AFTER DELETE ON library BEGIN
+    DELETE FROM book_search WHERE isbn = OLD.isbn;
+END;
+
+CREATE TRIGGER author_search_insert AFTER INSERT ON author BEGIN
+    UPDATE book_search SET author = NEW.firstName || ' ' || NEW.lastName
+    WHERE isbn = NEW.isbn;
+END;
+
+CREATE TRIGGER author_search_update AFTER UPDATE ON author BEGIN
+    UPDATE book_search SET author = NEW.firstName || ' ' || NEW.lastName
+    WHERE isbn = NEW.isbn;
+END;
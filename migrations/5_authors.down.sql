@@ -0,0 +1,29 @@
+DROP TRIGGER authors_search_update;
+DROP TRIGGER book_authors_search_delete;
+DROP TRIGGER book_authors_search_insert;
+
+-- Only the first author of every book is kept
+CREATE TABLE author(
+    isbn TEXT PRIMARY KEY,
+    firstName TEXT NOT NULL,
+    lastName TEXT NOT NULL
+);
+
+INSERT INTO author (isbn, firstName, lastName)
+SELECT book_authors.isbn, authors.firstName, authors.lastName
+FROM book_authors INNER JOIN authors ON authors.id = book_authors.authorId
+WHERE book_authors.position = 0;
+
+CREATE TRIGGER author_search_insert AFTER INSERT ON author BEGIN
+    UPDATE book_search SET author = NEW.firstName || ' ' || NEW.lastName
+    WHERE isbn = NEW.isbn;
+END;
+
+CREATE TRIGGER author_search_update AFTER UPDATE ON author BEGIN
+    UPDATE book_search SET author = NEW.firstName || ' ' || NEW.lastName
+    WHERE isbn = NEW.isbn;
+END;
+
+DROP INDEX book_authors_author;
+DROP TABLE book_authors;
+DROP TABLE authors;
@@ -0,0 +1,62 @@
+-- Authors become a resource of their own, referenced by any number of books
+CREATE TABLE authors(
+    id TEXT PRIMARY KEY,
+    firstName TEXT NOT NULL,
+    lastName TEXT NOT NULL,
+    createTime timestamp NOT NULL,
+    updateTime timestamp NOT NULL
+);
+
+CREATE TABLE book_authors(
+    isbn TEXT NOT NULL,
+    authorId TEXT NOT NULL,
+    role TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    PRIMARY KEY (isbn, position)
+);
+
+CREATE INDEX book_authors_author ON book_authors(authorId);
+
+-- Every distinct name of the old author table becomes one author
+INSERT INTO authors (id, firstName, lastName, createTime, updateTime)
+SELECT lower(hex(randomblob(8))), author.firstName, author.lastName,
+    MIN(library.createTime), MIN(library.createTime)
+FROM author INNER JOIN library ON library.isbn = author.isbn
+GROUP BY author.firstName, author.lastName;
+
+INSERT INTO book_authors (isbn, authorId, role, position)
+SELECT author.isbn, authors.id, 'author', 0
+FROM author INNER JOIN authors
+    ON authors.firstName = author.firstName AND authors.lastName = author.lastName;
+
+DROP TRIGGER author_search_insert;
+DROP TRIGGER author_search_update;
+DROP TABLE author;
+
+-- The author column of the search index holds the names of all the authors
+CREATE TRIGGER book_authors_search_insert AFTER INSERT ON book_authors BEGIN
+    UPDATE book_search SET author = (
+        SELECT COALESCE(group_concat(authors.firstName || ' ' || authors.lastName, ' '), '')
+        FROM book_authors INNER JOIN authors ON authors.id = book_authors.authorId
+        WHERE book_authors.isbn = NEW.isbn
+    )
+    WHERE isbn = NEW.isbn;
+END;
+
+CREATE TRIGGER book_authors_search_delete AFTER DELETE ON book_authors BEGIN
+    UPDATE book_search SET author = (
+        SELECT COALESCE(group_concat(authors.firstName || ' ' || authors.lastName, ' '), '')
+        FROM book_authors INNER JOIN authors ON authors.id = book_authors.authorId
+        WHERE book_authors.isbn = OLD.isbn
+    )
+    WHERE isbn = OLD.isbn;
+END;
+
+CREATE TRIGGER authors_search_update AFTER UPDATE OF firstName, lastName ON authors BEGIN
+    UPDATE book_search SET author = (
+        SELECT COALESCE(group_concat(authors.firstName || ' ' || authors.lastName, ' '), '')
+        FROM book_authors INNER JOIN authors ON authors.id = book_authors.authorId
+        WHERE book_authors.isbn = book_search.isbn
+    )
+    WHERE isbn IN (SELECT isbn FROM book_authors WHERE authorId = NEW.id);
+END;
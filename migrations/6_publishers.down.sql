@@ -0,0 +1,23 @@
+DROP TRIGGER publishers_search_update;
+DROP TRIGGER library_search_update;
+DROP TRIGGER library_search_insert;
+DROP INDEX library_publisher;
+
+-- The books keep the display name of their publisher
+ALTER TABLE library RENAME COLUMN publisherId TO publisher;
+
+UPDATE library SET publisher = (
+    SELECT displayName FROM publishers WHERE publishers.id = library.publisher
+);
+
+CREATE TRIGGER library_search_insert AFTER INSERT ON library BEGIN
+    INSERT INTO book_search (isbn, title, author, publisher)
+    VALUES (NEW.isbn, NEW.title, '', COALESCE(NEW.publisher, ''));
+END;
+
+CREATE TRIGGER library_search_update AFTER UPDATE OF title, publisher ON library BEGIN
+    UPDATE book_search SET title = NEW.title, publisher = COALESCE(NEW.publisher, '')
+    WHERE isbn = NEW.isbn;
+END;
+
+DROP TABLE publishers;
@@ -0,0 +1,54 @@
+-- Publishers become a resource of their own, referenced by the books
+CREATE TABLE publishers(
+    id TEXT PRIMARY KEY,
+    displayName TEXT NOT NULL,
+    country TEXT NOT NULL DEFAULT '',
+    website TEXT NOT NULL DEFAULT '',
+    createTime timestamp NOT NULL,
+    updateTime timestamp NOT NULL
+);
+
+-- Publisher names which only differ in case or surrounding spaces become one
+-- publisher
+INSERT INTO publishers (id, displayName, createTime, updateTime)
+SELECT lower(hex(randomblob(8))), MIN(trim(publisher)),
+    MIN(createTime), MIN(createTime)
+FROM library
+WHERE trim(COALESCE(publisher, '')) != ''
+GROUP BY lower(trim(publisher));
+
+DROP TRIGGER library_search_insert;
+DROP TRIGGER library_search_update;
+
+UPDATE library SET publisher = (
+    SELECT id FROM publishers
+    WHERE lower(publishers.displayName) = lower(trim(library.publisher))
+);
+
+ALTER TABLE library RENAME COLUMN publisher TO publisherId;
+
+CREATE INDEX library_publisher ON library(publisherId);
+
+-- The publisher column of the search index holds the display name
+UPDATE book_search SET publisher = COALESCE((
+    SELECT publishers.displayName FROM library
+    INNER JOIN publishers ON publishers.id = library.publisherId
+    WHERE library.isbn = book_search.isbn
+), '');
+
+CREATE TRIGGER library_search_insert AFTER INSERT ON library BEGIN
+    INSERT INTO book_search (isbn, title, author, publisher)
+    VALUES (NEW.isbn, NEW.title, '', COALESCE(
+        (SELECT displayName FROM publishers WHERE id = NEW.publisherId), ''));
+END;
+
+CREATE TRIGGER library_search_update AFTER UPDATE OF title, publisherId ON library BEGIN
+    UPDATE book_search SET title = NEW.title, publisher = COALESCE(
+        (SELECT displayName FROM publishers WHERE id = NEW.publisherId), '')
+    WHERE isbn = NEW.isbn;
+END;
+
+CREATE TRIGGER publishers_search_update AFTER UPDATE OF displayName ON publishers BEGIN
+    UPDATE book_search SET publisher = NEW.displayName
+    WHERE isbn IN (SELECT isbn FROM library WHERE publisherId = NEW.id);
+END;
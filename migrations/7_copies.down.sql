@@ -0,0 +1,2 @@
+DROP INDEX copies_isbn;
+DROP TABLE copies;
@@ -0,0 +1,16 @@
+-- The physical copies of the books
+CREATE TABLE copies(
+    id TEXT PRIMARY KEY,
+    isbn TEXT NOT NULL,
+    barcode TEXT NOT NULL UNIQUE,
+    acquisitionDate TEXT NOT NULL DEFAULT '',
+    priceCents INTEGER NOT NULL DEFAULT 0,
+    currencyCode TEXT NOT NULL DEFAULT '',
+    condition TEXT NOT NULL DEFAULT '',
+    shelfLocation TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    createTime timestamp NOT NULL,
+    updateTime timestamp NOT NULL
+);
+
+CREATE INDEX copies_isbn ON copies(isbn, status);
@@ -0,0 +1,2 @@
+DROP INDEX members_name;
+DROP TABLE members;
@@ -0,0 +1,18 @@
+-- The members of the library, who borrow its books
+CREATE TABLE members(
+    id TEXT PRIMARY KEY,
+    firstName TEXT NOT NULL,
+    lastName TEXT NOT NULL,
+    email TEXT NOT NULL,
+    phoneNumber TEXT NOT NULL DEFAULT '',
+    postalAddress TEXT NOT NULL DEFAULT '',
+    tier TEXT NOT NULL,
+    cardNumber TEXT NOT NULL UNIQUE,
+    expiryDate TEXT NOT NULL,
+    blocked INTEGER NOT NULL DEFAULT 0,
+    blockReason TEXT NOT NULL DEFAULT '',
+    createTime timestamp NOT NULL,
+    updateTime timestamp NOT NULL
+);
+
+CREATE INDEX members_name ON members(lastName, firstName, id);
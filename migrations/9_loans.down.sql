@@ -0,0 +1,3 @@
+DROP INDEX loans_member;
+DROP INDEX loans_active_copy;
+DROP TABLE loans;
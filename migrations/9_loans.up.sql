@@ -0,0 +1,15 @@
+-- The loans of the copies to the members. A loan is active until its
+-- returnTime is set, and a copy has at most one active loan.
+CREATE TABLE loans(
+    id TEXT PRIMARY KEY,
+    isbn TEXT NOT NULL,
+    copyId TEXT NOT NULL,
+    memberId TEXT NOT NULL,
+    checkoutTime timestamp NOT NULL,
+    dueDate TEXT NOT NULL,
+    renewals INTEGER NOT NULL DEFAULT 0,
+    returnTime timestamp
+);
+
+CREATE UNIQUE INDEX loans_active_copy ON loans(copyId) WHERE returnTime IS NULL;
+CREATE INDEX loans_member ON loans(memberId, checkoutTime, id);
@@ -0,0 +1,224 @@
+package library
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The roles of the principals, from the least to the most permitted. Every
+// role grants the permissions of the roles before it as well.
+const (
+	rolePatron    = "patron"
+	roleLibrarian = "librarian"
+	roleAdmin     = "admin"
+)
+
+// roleRanks orders the roles, a role includes the roles of a lower rank.
+var roleRanks = map[string]int{
+	rolePatron:    1,
+	roleLibrarian: 2,
+	roleAdmin:     3,
+}
+
+// rolePermissions are the permissions a role grants besides the permissions
+// of the roles it includes.
+var rolePermissions = map[string][]string{
+	rolePatron: {
+		"books.get", "books.list", "books.search", "books.watch",
+		"authors.get", "authors.list",
+		"publishers.get", "publishers.list",
+		"copies.get", "copies.list",
+		"branches.get", "branches.list",
+		"calendars.get",
+	},
+	roleLibrarian: {
+		"books.create", "books.update", "books.listRevisions",
+		"authors.create", "authors.update",
+		"publishers.create", "publishers.update",
+		"copies.create", "copies.update", "copies.transfer",
+		"members.create", "members.get", "members.list", "members.update",
+		"loans.create", "loans.get", "loans.list", "loans.update",
+		"holds.create", "holds.get", "holds.list", "holds.update",
+		"ledgers.create", "ledgers.get", "ledgers.list",
+		"branches.update",
+		"calendars.update",
+	},
+	roleAdmin: {
+		"books.delete", "books.undelete",
+		"authors.delete",
+		"publishers.delete",
+		"copies.delete",
+		"members.delete",
+		"branches.create", "branches.delete",
+		"roleBindings.set", "roleBindings.list", "roleBindings.delete",
+		"auditEvents.list",
+	},
+}
+
+// methodPermissions is the access policy, the permission every method of the
+// services requires. A method which is not in the policy can not be called.
+var methodPermissions = map[string]string{
+	"/librarypb.v1.LibraryService/CreateBook":        "books.create",
+	"/librarypb.v1.LibraryService/GetBook":           "books.get",
+	"/librarypb.v1.LibraryService/UpdateBook":        "books.update",
+	"/librarypb.v1.LibraryService/DeleteBook":        "books.delete",
+	"/librarypb.v1.LibraryService/UndeleteBook":      "books.undelete",
+	"/librarypb.v1.LibraryService/ListBooks":         "books.list",
+	"/librarypb.v1.LibraryService/BatchCreateBooks":  "books.create",
+	"/librarypb.v1.LibraryService/BatchGetBooks":     "books.get",
+	"/librarypb.v1.LibraryService/BatchDeleteBooks":  "books.delete",
+	"/librarypb.v1.LibraryService/SearchBooks":       "books.search",
+	"/librarypb.v1.LibraryService/WatchBooks":        "books.watch",
+	"/librarypb.v1.LibraryService/ListBookRevisions": "books.listRevisions",
+	"/librarypb.v1.LibraryService/RollbackBook":      "books.update",
+	"/librarypb.v1.LibraryService/CreateAuthor":      "authors.create",
+	"/librarypb.v1.LibraryService/GetAuthor":         "authors.get",
+	"/librarypb.v1.LibraryService/ListAuthors":       "authors.list",
+	"/librarypb.v1.LibraryService/UpdateAuthor":      "authors.update",
+	"/librarypb.v1.LibraryService/DeleteAuthor":      "authors.delete",
+	"/librarypb.v1.LibraryService/CreatePublisher":   "publishers.create",
+	"/librarypb.v1.LibraryService/GetPublisher":      "publishers.get",
+	"/librarypb.v1.LibraryService/ListPublishers":    "publishers.list",
+	"/librarypb.v1.LibraryService/UpdatePublisher":   "publishers.update",
+	"/librarypb.v1.LibraryService/DeletePublisher":   "publishers.delete",
+	"/librarypb.v1.LibraryService/CreateCopy":        "copies.create",
+	"/librarypb.v1.LibraryService/GetCopy":           "copies.get",
+	"/librarypb.v1.LibraryService/ListCopies":        "copies.list",
+	"/librarypb.v1.LibraryService/UpdateCopy":        "copies.update",
+	"/librarypb.v1.LibraryService/DeleteCopy":        "copies.delete",
+
+	"/librarypb.v1.MemberService/CreateMember": "members.create",
+	"/librarypb.v1.MemberService/GetMember":    "members.get",
+	"/librarypb.v1.MemberService/ListMembers":  "members.list",
+	"/librarypb.v1.MemberService/UpdateMember": "members.update",
+	"/librarypb.v1.MemberService/DeleteMember": "members.delete",
+
+	"/librarypb.v1.BranchService/CreateBranch": "branches.create",
+	"/librarypb.v1.BranchService/GetBranch":    "branches.get",
+	"/librarypb.v1.BranchService/ListBranches": "branches.list",
+	"/librarypb.v1.BranchService/UpdateBranch": "branches.update",
+	"/librarypb.v1.BranchService/DeleteBranch": "branches.delete",
+	"/librarypb.v1.BranchService/TransferCopy": "copies.transfer",
+	"/librarypb.v1.BranchService/ReceiveCopy":  "copies.transfer",
+
+	"/librarypb.v1.CirculationService/CheckoutCopy": "loans.create",
+	"/librarypb.v1.CirculationService/ReturnCopy":   "loans.update",
+	"/librarypb.v1.CirculationService/RenewCopy":    "loans.update",
+	"/librarypb.v1.CirculationService/GetLoan":      "loans.get",
+	"/librarypb.v1.CirculationService/ListLoans":    "loans.list",
+	"/librarypb.v1.CirculationService/MarkCopyLost": "loans.update",
+	"/librarypb.v1.CirculationService/PlaceHold":    "holds.create",
+	"/librarypb.v1.CirculationService/GetHold":      "holds.get",
+	"/librarypb.v1.CirculationService/CancelHold":   "holds.update",
+	"/librarypb.v1.CirculationService/ListHolds":    "holds.list",
+
+	"/librarypb.v1.FinesService/CreateLedgerEntry": "ledgers.create",
+	"/librarypb.v1.FinesService/ListLedgerEntries": "ledgers.list",
+	"/librarypb.v1.FinesService/GetBalance":        "ledgers.get",
+
+	"/librarypb.v1.CalendarService/GetOpeningHours":    "calendars.get",
+	"/librarypb.v1.CalendarService/UpdateOpeningHours": "calendars.update",
+	"/librarypb.v1.CalendarService/CreateClosure":      "calendars.update",
+	"/librarypb.v1.CalendarService/GetClosure":         "calendars.get",
+	"/librarypb.v1.CalendarService/ListClosures":       "calendars.get",
+	"/librarypb.v1.CalendarService/UpdateClosure":      "calendars.update",
+	"/librarypb.v1.CalendarService/DeleteClosure":      "calendars.update",
+	"/librarypb.v1.CalendarService/ExportClosures":     "calendars.get",
+	"/librarypb.v1.CalendarService/ExportDueDates":     "loans.list",
+
+	"/librarypb.v1.AccessService/SetRoleBinding":    "roleBindings.set",
+	"/librarypb.v1.AccessService/ListRoleBindings":  "roleBindings.list",
+	"/librarypb.v1.AccessService/DeleteRoleBinding": "roleBindings.delete",
+
+	"/librarypb.v1.AuditService/ListAuditEvents": "auditEvents.list",
+}
+
+// grants reports whether the role grants the permission, by itself or by a
+// role it includes.
+func grants(role, permission string) bool {
+	for r, permissions := range rolePermissions {
+		if roleRanks[r] > roleRanks[role] {
+			continue
+		}
+		for _, p := range permissions {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorizer enforces the access policy on the calls authenticated by an
+// Authenticator, by the roles bound to their principals in the store.
+type Authorizer struct {
+	store RoleBindingStore
+	log   *zap.SugaredLogger
+}
+
+// NewAuthorizer creates an Authorizer looking up the role bindings in the
+// store.
+func NewAuthorizer(store RoleBindingStore, logger *zap.SugaredLogger) *Authorizer {
+	return &Authorizer{store: store, log: logger}
+}
+
+// UnaryInterceptor rejects the calls whose principal has no role granting the
+// permission of the method with PermissionDenied. It must run after the
+// interceptor of the Authenticator.
+func (a *Authorizer) UnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor rejects the streaming calls like UnaryInterceptor. It
+// must run after the stream interceptor of the Authenticator.
+func (a *Authorizer) StreamInterceptor(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &principalStream{ServerStream: ss, ctx: ctx})
+}
+
+// authorize checks that the principal of the call may call the method, and
+// returns the context holding the principal with its role.
+func (a *Authorizer) authorize(ctx context.Context,
+	method string) (context.Context, error) {
+	permission, ok := methodPermissions[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied,
+			"the method %s is not in the access policy", method)
+	}
+	p, ok := principalFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "the call is not authenticated")
+	}
+
+	// a principal without a role binding may call nothing, as anyone holding
+	// a JWT of the issuer is authenticated
+	binding, err := a.store.GetRoleBinding(ctx, p.Subject)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return nil, status.Errorf(codes.PermissionDenied,
+			"the principal %s has no role", p.Subject)
+	case err != nil:
+		a.log.Errorw("failed to look up role binding", "error", err)
+		return nil, status.Errorf(codes.Internal, "internal storage error")
+	}
+	p.Role = binding.Role
+	if !grants(p.Role, permission) {
+		return nil, status.Errorf(codes.PermissionDenied,
+			"the role %s does not grant the permission %s", p.Role, permission)
+	}
+	return withPrincipal(ctx, p), nil
+}
@@ -0,0 +1,210 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// minimumRoles is the least role which may call every method.
+var minimumRoles = map[string]string{
+	"/librarypb.v1.LibraryService/CreateBook":        roleLibrarian,
+	"/librarypb.v1.LibraryService/GetBook":           rolePatron,
+	"/librarypb.v1.LibraryService/UpdateBook":        roleLibrarian,
+	"/librarypb.v1.LibraryService/DeleteBook":        roleAdmin,
+	"/librarypb.v1.LibraryService/UndeleteBook":      roleAdmin,
+	"/librarypb.v1.LibraryService/ListBooks":         rolePatron,
+	"/librarypb.v1.LibraryService/BatchCreateBooks":  roleLibrarian,
+	"/librarypb.v1.LibraryService/BatchGetBooks":     rolePatron,
+	"/librarypb.v1.LibraryService/BatchDeleteBooks":  roleAdmin,
+	"/librarypb.v1.LibraryService/SearchBooks":       rolePatron,
+	"/librarypb.v1.LibraryService/WatchBooks":        rolePatron,
+	"/librarypb.v1.LibraryService/ListBookRevisions": roleLibrarian,
+	"/librarypb.v1.LibraryService/RollbackBook":      roleLibrarian,
+	"/librarypb.v1.LibraryService/CreateAuthor":      roleLibrarian,
+	"/librarypb.v1.LibraryService/GetAuthor":         rolePatron,
+	"/librarypb.v1.LibraryService/ListAuthors":       rolePatron,
+	"/librarypb.v1.LibraryService/UpdateAuthor":      roleLibrarian,
+	"/librarypb.v1.LibraryService/DeleteAuthor":      roleAdmin,
+	"/librarypb.v1.LibraryService/CreatePublisher":   roleLibrarian,
+	"/librarypb.v1.LibraryService/GetPublisher":      rolePatron,
+	"/librarypb.v1.LibraryService/ListPublishers":    rolePatron,
+	"/librarypb.v1.LibraryService/UpdatePublisher":   roleLibrarian,
+	"/librarypb.v1.LibraryService/DeletePublisher":   roleAdmin,
+	"/librarypb.v1.LibraryService/CreateCopy":        roleLibrarian,
+	"/librarypb.v1.LibraryService/GetCopy":           rolePatron,
+	"/librarypb.v1.LibraryService/ListCopies":        rolePatron,
+	"/librarypb.v1.LibraryService/UpdateCopy":        roleLibrarian,
+	"/librarypb.v1.LibraryService/DeleteCopy":        roleAdmin,
+
+	"/librarypb.v1.MemberService/CreateMember": roleLibrarian,
+	"/librarypb.v1.MemberService/GetMember":    roleLibrarian,
+	"/librarypb.v1.MemberService/ListMembers":  roleLibrarian,
+	"/librarypb.v1.MemberService/UpdateMember": roleLibrarian,
+	"/librarypb.v1.MemberService/DeleteMember": roleAdmin,
+
+	"/librarypb.v1.BranchService/CreateBranch": roleAdmin,
+	"/librarypb.v1.BranchService/GetBranch":    rolePatron,
+	"/librarypb.v1.BranchService/ListBranches": rolePatron,
+	"/librarypb.v1.BranchService/UpdateBranch": roleLibrarian,
+	"/librarypb.v1.BranchService/DeleteBranch": roleAdmin,
+	"/librarypb.v1.BranchService/TransferCopy": roleLibrarian,
+	"/librarypb.v1.BranchService/ReceiveCopy":  roleLibrarian,
+
+	"/librarypb.v1.CirculationService/CheckoutCopy": roleLibrarian,
+	"/librarypb.v1.CirculationService/ReturnCopy":   roleLibrarian,
+	"/librarypb.v1.CirculationService/RenewCopy":    roleLibrarian,
+	"/librarypb.v1.CirculationService/GetLoan":      roleLibrarian,
+	"/librarypb.v1.CirculationService/ListLoans":    roleLibrarian,
+	"/librarypb.v1.CirculationService/MarkCopyLost": roleLibrarian,
+	"/librarypb.v1.CirculationService/PlaceHold":    roleLibrarian,
+	"/librarypb.v1.CirculationService/GetHold":      roleLibrarian,
+	"/librarypb.v1.CirculationService/CancelHold":   roleLibrarian,
+	"/librarypb.v1.CirculationService/ListHolds":    roleLibrarian,
+
+	"/librarypb.v1.FinesService/CreateLedgerEntry": roleLibrarian,
+	"/librarypb.v1.FinesService/ListLedgerEntries": roleLibrarian,
+	"/librarypb.v1.FinesService/GetBalance":        roleLibrarian,
+
+	"/librarypb.v1.CalendarService/GetOpeningHours":    rolePatron,
+	"/librarypb.v1.CalendarService/UpdateOpeningHours": roleLibrarian,
+	"/librarypb.v1.CalendarService/CreateClosure":      roleLibrarian,
+	"/librarypb.v1.CalendarService/GetClosure":         rolePatron,
+	"/librarypb.v1.CalendarService/ListClosures":       rolePatron,
+	"/librarypb.v1.CalendarService/UpdateClosure":      roleLibrarian,
+	"/librarypb.v1.CalendarService/DeleteClosure":      roleLibrarian,
+	"/librarypb.v1.CalendarService/ExportClosures":     rolePatron,
+	"/librarypb.v1.CalendarService/ExportDueDates":     roleLibrarian,
+
+	"/librarypb.v1.AccessService/SetRoleBinding":    roleAdmin,
+	"/librarypb.v1.AccessService/ListRoleBindings":  roleAdmin,
+	"/librarypb.v1.AccessService/DeleteRoleBinding": roleAdmin,
+
+	"/librarypb.v1.AuditService/ListAuditEvents": roleAdmin,
+}
+
+func TestPolicyCoversEveryMethod(t *testing.T) {
+	services := librarypb.File_librarypb_library_proto.Services()
+	methods := map[string]bool{}
+	for i := 0; i < services.Len(); i++ {
+		service := services.Get(i)
+		for j := 0; j < service.Methods().Len(); j++ {
+			method := fmt.Sprintf("/%s/%s", service.FullName(), service.Methods().Get(j).Name())
+			methods[method] = true
+			require.Contains(t, methodPermissions, method)
+			require.Contains(t, minimumRoles, method)
+		}
+	}
+	for method, permission := range methodPermissions {
+		require.True(t, methods[method], "%s is not a method of the services", method)
+		require.True(t, grants(roleAdmin, permission),
+			"no role grants the permission %s of %s", permission, method)
+	}
+	require.Len(t, minimumRoles, len(methods))
+}
+
+func TestAuthorizer(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage()
+	now := time.Now()
+	for _, role := range []string{rolePatron, roleLibrarian, roleAdmin} {
+		binding, err := NewRoleBinding("users/"+role+"@example.com", role, now)
+		require.NoError(t, err)
+		require.NoError(t, store.SetRoleBinding(ctx, binding))
+	}
+	authorizer := NewAuthorizer(store, zap.NewNop().Sugar())
+
+	call := func(subject, method string) (principal, error) {
+		var got principal
+		_, err := authorizer.UnaryInterceptor(
+			withPrincipal(ctx, principal{Subject: subject}), nil,
+			&grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				got, _ = principalFromContext(ctx)
+				return nil, nil
+			})
+		return got, err
+	}
+
+	for method, minimum := range minimumRoles {
+		t.Run(method, func(t *testing.T) {
+			subjects := map[string]string{
+				"users/patron@example.com":    rolePatron,
+				"users/librarian@example.com": roleLibrarian,
+				"users/admin@example.com":     roleAdmin,
+			}
+			for subject, role := range subjects {
+				got, err := call(subject, method)
+				if roleRanks[role] < roleRanks[minimum] {
+					require.Equal(t, codes.PermissionDenied, status.Code(err),
+						"%s as %s", method, role)
+					continue
+				}
+				require.NoError(t, err, "%s as %s", method, role)
+				require.Equal(t, role, got.Role)
+			}
+
+			// a principal without a role binding may call nothing
+			_, err := call("users/unbound@example.com", method)
+			require.Equal(t, codes.PermissionDenied, status.Code(err), method)
+		})
+	}
+
+	t.Run("principals", func(t *testing.T) {
+		for principal, valid := range map[string]bool{
+			"apiKeys/0123456789abcdef": true,
+			"users/alice":              true,
+			"alice":                    false,
+			"users/":                   false,
+			"apiKeys/":                 false,
+			"":                         false,
+		} {
+			_, err := NewRoleBinding(principal, roleAdmin, now)
+			require.Equal(t, valid, err == nil, principal)
+		}
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		_, err := call("users/admin@example.com", "/librarypb.v1.LibraryService/DropDatabase")
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		_, err := authorizer.UnaryInterceptor(ctx, nil,
+			&grpc.UnaryServerInfo{FullMethod: "/librarypb.v1.LibraryService/GetBook"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var got principal
+		stream := &principalStream{
+			ctx: withPrincipal(ctx, principal{Subject: "users/patron@example.com"})}
+		err := authorizer.StreamInterceptor(nil, stream,
+			&grpc.StreamServerInfo{FullMethod: "/librarypb.v1.LibraryService/WatchBooks"},
+			func(srv interface{}, ss grpc.ServerStream) error {
+				got, _ = principalFromContext(ss.Context())
+				return nil
+			})
+		require.NoError(t, err)
+		require.Equal(t, rolePatron, got.Role)
+
+		stream.ctx = ctx
+		err = authorizer.StreamInterceptor(nil, stream,
+			&grpc.StreamServerInfo{FullMethod: "/librarypb.v1.LibraryService/WatchBooks"},
+			func(srv interface{}, ss grpc.ServerStream) error {
+				return nil
+			})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+}
@@ -0,0 +1,277 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Publisher is a publishing house referenced by the books it has published.
+type Publisher struct {
+	ID          string    `json:"id"` // The random id in 'publishers/{id}'
+	DisplayName string    `json:"displayName"`
+	Country     string    `json:"country"` // ISO 3166-1 alpha-2 code, may be empty
+	Website     string    `json:"website"` // May be empty
+	CreateTime  time.Time `json:"createTime"`
+	UpdateTime  time.Time `json:"updateTime"`
+}
+
+// The field paths of a Publisher which can be validated and updated.
+const (
+	fieldDisplayName = "display_name"
+	fieldCountry     = "country"
+	fieldWebsite     = "website"
+)
+
+// updatablePublisherFields are the field paths which are allowed in the
+// update mask of a publisher.
+var updatablePublisherFields = []string{
+	fieldDisplayName,
+	fieldCountry,
+	fieldWebsite,
+}
+
+// countryPattern matches an ISO 3166-1 alpha-2 country code.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// validatePublisherFields validates the given field paths of the publisher.
+// The country and the website are optional. It returns a violation for every
+// invalid field.
+func validatePublisherFields(p Publisher,
+	paths []string) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	for _, path := range paths {
+		switch path {
+		case fieldDisplayName:
+			if description, ok := checkText("publishers", path, p.DisplayName); !ok {
+				violation(path, description)
+			}
+		case fieldCountry:
+			if p.Country != "" && !countryPattern.MatchString(p.Country) {
+				violation(path, "must be an ISO 3166-1 alpha-2 country code such as 'DK'")
+			}
+		case fieldWebsite:
+			if p.Website != "" && !validWebsite(p.Website) {
+				violation(path, "must be an http or https URL")
+			}
+		}
+	}
+	return violations
+}
+
+// validWebsite reports whether the website is an absolute http or https url.
+func validWebsite(website string) bool {
+	u, err := url.Parse(website)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// publisherUpdatePaths resolves the paths of the update mask of a publisher.
+// An empty mask or the '*' path selects all updatable fields.
+func publisherUpdatePaths(maskPaths []string) ([]string,
+	[]*errdetails.BadRequest_FieldViolation) {
+	if len(maskPaths) == 0 {
+		return updatablePublisherFields, nil
+	}
+
+	var paths []string
+	for _, path := range maskPaths {
+		switch path {
+		case "*":
+			return updatablePublisherFields, nil
+		case fieldDisplayName, fieldCountry, fieldWebsite:
+			paths = append(paths, path)
+		case fieldName, fieldCreateTime, fieldUpdateTime:
+			return nil, updateMaskViolation("field %q is immutable", path)
+		default:
+			return nil, updateMaskViolation("unknown field %q", path)
+		}
+	}
+	return paths, nil
+}
+
+// publisherIDFromName returns the id of a publisher name on the format
+// 'publishers/{id}'.
+func publisherIDFromName(name string) string {
+	return strings.TrimPrefix(name, "publishers/")
+}
+
+// NewPublisherFromProto converts a *librarypb.Publisher to a Publisher.
+func NewPublisherFromProto(p *librarypb.Publisher) Publisher {
+	return Publisher{
+		ID:          publisherIDFromName(p.GetName()),
+		DisplayName: normalizeText(p.GetDisplayName()),
+		Country:     p.GetCountry(),
+		Website:     p.GetWebsite(),
+	}
+}
+
+// AsProto converts the Publisher to a *librarypb.Publisher.
+func (p *Publisher) AsProto() *librarypb.Publisher {
+	return &librarypb.Publisher{
+		Name:        "publishers/" + p.ID,
+		DisplayName: p.DisplayName,
+		Country:     p.Country,
+		Website:     p.Website,
+		CreateTime:  timestamppb.New(p.CreateTime),
+		UpdateTime:  timestamppb.New(p.UpdateTime),
+	}
+}
+
+// CreatePublisher creates a publisher with a new random id.
+func (s *libraryServiceServer) CreatePublisher(ctx context.Context,
+	req *librarypb.CreatePublisherRequest) (*librarypb.Publisher, error) {
+
+	publisher := NewPublisherFromProto(req.GetPublisher())
+	if violations := validatePublisherFields(publisher, updatablePublisherFields); violations != nil {
+		return nil, invalidFieldsError(inField("publisher", violations))
+	}
+
+	id, err := newResourceID()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create publisher id")
+	}
+	publisher.ID = id
+	publisher.CreateTime = time.Now()
+	publisher.UpdateTime = publisher.CreateTime
+
+	if err := s.store.CreatePublisher(ctx, publisher); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return publisher.AsProto(), nil
+}
+
+// GetPublisher retreives a specific publisher.
+func (s *libraryServiceServer) GetPublisher(ctx context.Context,
+	req *librarypb.GetPublisherRequest) (*librarypb.Publisher, error) {
+
+	publisher, err := s.store.GetPublisher(ctx, publisherIDFromName(req.GetName()))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return publisher.AsProto(), nil
+}
+
+// ListPublishers retreives a page of the publishers ordered by their display
+// names.
+func (s *libraryServiceServer) ListPublishers(ctx context.Context,
+	req *librarypb.ListPublishersRequest) (*librarypb.ListPublishersResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	checksum := listChecksum("", "publishers", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 2)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	publishers, next, err := s.store.ListPublishers(ctx, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListPublishersResponse{}
+	for _, publisher := range publishers {
+		resp.Publishers = append(resp.Publishers, publisher.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// UpdatePublisher updates a publisher. Only the fields in the update mask are
+// written, or all the fields if the mask is empty.
+func (s *libraryServiceServer) UpdatePublisher(ctx context.Context,
+	req *librarypb.UpdatePublisherRequest) (*librarypb.Publisher, error) {
+
+	paths, violations := publisherUpdatePaths(req.GetUpdateMask().GetPaths())
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
+	}
+	update := NewPublisherFromProto(req.GetPublisher())
+	if violations := validatePublisherFields(update, paths); violations != nil {
+		return nil, invalidFieldsError(inField("publisher", violations))
+	}
+
+	var publisher Publisher
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if publisher, err = tx.GetPublisher(ctx, update.ID); err != nil {
+			return err
+		}
+		for _, path := range paths {
+			switch path {
+			case fieldDisplayName:
+				publisher.DisplayName = update.DisplayName
+			case fieldCountry:
+				publisher.Country = update.Country
+			case fieldWebsite:
+				publisher.Website = update.Website
+			}
+		}
+		publisher.UpdateTime = time.Now()
+		return tx.UpdatePublisher(ctx, publisher)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return publisher.AsProto(), nil
+}
+
+// DeletePublisher deletes a publisher. A publisher of any book, including the
+// deleted books which are not yet purged, is only deleted if force is set, in
+// which case the publisher of those books is cleared and the change of each
+// book is audited.
+func (s *libraryServiceServer) DeletePublisher(ctx context.Context,
+	req *librarypb.DeletePublisherRequest) (*emptypb.Empty, error) {
+
+	id := publisherIDFromName(req.GetName())
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		books, err := allBooks(ctx, tx,
+			fmt.Sprintf("publisher = %q", "publishers/"+id), true)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeletePublisher(ctx, id, req.GetForce()); err != nil {
+			return err
+		}
+		for i := range books {
+			cleared, err := tx.FindSpecificBook(ctx, books[i].ISBN)
+			if err != nil {
+				return err
+			}
+			if err := auditBook(ctx, tx, "DeletePublisher", &books[i],
+				&cleared); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	s.changes.notify()
+	return &emptypb.Empty{}, nil
+}
@@ -0,0 +1,174 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// revisionAuthor is an author of a book as stored in a revision of the book.
+type revisionAuthor struct {
+	AuthorID string `json:"authorId"`
+	Role     string `json:"role"`
+}
+
+// bookRevisionFromName returns the isbn and the revision id of a book name on
+// the format 'books/{isbn}@{revision}'. The revision id is empty if the name
+// has no revision.
+func bookRevisionFromName(name string) (string, string) {
+	name, revisionID := name, ""
+	if i := strings.LastIndexByte(name, '@'); i >= 0 {
+		name, revisionID = name[:i], name[i+1:]
+	}
+	return isbnFromName(name), revisionID
+}
+
+// getBookRevision retreives a past revision of a book for GetBook. The
+// revisions of a deleted book are only returned if showDeleted is set.
+func (s *libraryServiceServer) getBookRevision(ctx context.Context, isbn,
+	revisionID string, showDeleted bool) (*librarypb.Book, error) {
+	book, err := s.store.FindSpecificBook(ctx, isbn)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	if book.IsDeleted() && !showDeleted {
+		return nil, status.Errorf(codes.NotFound,
+			"the book has been deleted from the library")
+	}
+	revision, err := s.store.GetBookRevision(ctx, isbn, revisionID)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return revision.AsProto(), nil
+}
+
+// ListBookRevisions retreives a page of the revisions of a book, the latest
+// first.
+func (s *libraryServiceServer) ListBookRevisions(ctx context.Context,
+	req *librarypb.ListBookRevisionsRequest) (*librarypb.ListBookRevisionsResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	bookIsbn := isbnFromName(req.GetName())
+	checksum := listChecksum(bookIsbn, "revisions", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 1)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	if _, err := s.store.FindSpecificBook(ctx, bookIsbn); err != nil {
+		return nil, s.toStatus(err)
+	}
+	revisions, next, err := s.store.ListBookRevisions(ctx, bookIsbn, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListBookRevisionsResponse{}
+	for _, revision := range revisions {
+		resp.Books = append(resp.Books, revision.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// RollbackBook restores the title, the publisher and the authors of a past
+// revision of a book, which creates a new revision of the book. A revision
+// whose publisher or authors have since been deleted can not be restored. If
+// successful it sends back the restored book as response
+func (s *libraryServiceServer) RollbackBook(ctx context.Context,
+	req *librarypb.RollbackBookRequest) (*librarypb.Book, error) {
+
+	bookIsbn := isbnFromName(req.GetName())
+	if req.GetRevisionId() == "" {
+		return nil, invalidFieldsError([]*errdetails.BadRequest_FieldViolation{{
+			Field:       "revision_id",
+			Description: "must be the id of a revision of the book",
+		}})
+	}
+
+	var written Book
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		book, err := tx.FindSpecificBook(ctx, bookIsbn)
+		if err != nil {
+			return err
+		}
+		if book.IsDeleted() {
+			return ErrNotFound
+		}
+		if err := checkEtag(ctx, req.GetEtag(), book); err != nil {
+			return err
+		}
+		revision, err := tx.GetBookRevision(ctx, bookIsbn, req.GetRevisionId())
+		if err != nil {
+			return err
+		}
+		if err := checkRevisionReferences(ctx, tx, revision); err != nil {
+			return err
+		}
+
+		paths := []string{fieldTitle, fieldPublisher, fieldAuthors}
+		restored := applyUpdate(book, revision, paths)
+		restored.UpdateTime = time.Now()
+		if err := tx.UpdateBookInDB(ctx, restored, paths); err != nil {
+			return err
+		}
+		if written, err = tx.FindSpecificBook(ctx, bookIsbn); err != nil {
+			return err
+		}
+		return auditBook(ctx, tx, "RollbackBook", &book, &written)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	s.changes.notify()
+	return written.AsProto(), nil
+}
+
+// referenceStore is the storage of the publishers and the authors a book
+// refers to.
+type referenceStore interface {
+	PublisherStore
+	AuthorStore
+}
+
+// checkRevisionReferences returns a FailedPrecondition error naming the
+// publisher or the author of the revision which has since been deleted. The
+// publisher of a revision is empty if it was cleared by deleting it.
+func checkRevisionReferences(ctx context.Context, tx referenceStore, revision Book) error {
+	if revision.Publisher == "" {
+		return status.Errorf(codes.FailedPrecondition,
+			"the publisher of the revision has been deleted")
+	}
+	_, err := tx.GetPublisher(ctx, revision.Publisher)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Errorf(codes.FailedPrecondition,
+			"the publisher %q of the revision has been deleted",
+			"publishers/"+revision.Publisher)
+	case err != nil:
+		return err
+	}
+	for _, a := range revision.Authors {
+		_, err := tx.GetAuthor(ctx, a.AuthorID)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			return status.Errorf(codes.FailedPrecondition,
+				"the author %q of the revision has been deleted",
+				"authors/"+a.AuthorID)
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
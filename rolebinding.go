@@ -0,0 +1,150 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// checks if we have implementat all the different functions
+var _ librarypb.AccessServiceServer = new(libraryServiceServer)
+
+// RoleBinding binds a role to an authenticated principal.
+type RoleBinding struct {
+	Principal  string    `json:"principal"` // The subject of the principal
+	Role       string    `json:"role"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// The field paths of a RoleBinding which are validated.
+const (
+	fieldPrincipal = "principal"
+	fieldRole      = "role"
+)
+
+// validateRoleBinding validates the fields of the role binding and returns a
+// violation for every invalid field.
+func validateRoleBinding(b RoleBinding) []*errdetails.BadRequest_FieldViolation {
+	var violations []*errdetails.BadRequest_FieldViolation
+	violation := func(field, description string) {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	if !validPrincipal(b.Principal) || len(b.Principal) > 200 {
+		violation(fieldPrincipal, "must be the subject of a principal,"+
+			" 'apiKeys/{id}' or 'users/{sub}', of at most 200 characters")
+	}
+	if _, ok := roleRanks[b.Role]; !ok {
+		violation(fieldRole, "must be a role")
+	}
+	return violations
+}
+
+// validPrincipal reports whether the subject is that of an API key or of the
+// user of a JWT.
+func validPrincipal(subject string) bool {
+	for _, prefix := range []string{apiKeySubjectPrefix, userSubjectPrefix} {
+		if strings.HasPrefix(subject, prefix) &&
+			strings.TrimSpace(subject[len(prefix):]) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRoleBinding creates the role binding of a principal, such as the first
+// admin, outside of the AccessService. It returns an error if the principal
+// or the role is invalid.
+func NewRoleBinding(principal, role string, now time.Time) (RoleBinding, error) {
+	b := RoleBinding{Principal: principal, Role: role, UpdateTime: now}
+	if violations := validateRoleBinding(b); violations != nil {
+		return RoleBinding{}, fmt.Errorf("%s %s", violations[0].GetField(),
+			violations[0].GetDescription())
+	}
+	return b, nil
+}
+
+// NewRoleBindingFromProto converts a *librarypb.RoleBinding to a RoleBinding.
+func NewRoleBindingFromProto(b *librarypb.RoleBinding) RoleBinding {
+	binding := RoleBinding{Principal: b.GetPrincipal()}
+	if b.GetRole() != librarypb.RoleBinding_ROLE_UNSPECIFIED {
+		binding.Role = strings.ToLower(strings.TrimPrefix(b.GetRole().String(), "ROLE_"))
+	}
+	return binding
+}
+
+// AsProto converts the RoleBinding to a *librarypb.RoleBinding.
+func (b *RoleBinding) AsProto() *librarypb.RoleBinding {
+	return &librarypb.RoleBinding{
+		Principal: b.Principal,
+		Role: librarypb.RoleBinding_Role(
+			librarypb.RoleBinding_Role_value["ROLE_"+strings.ToUpper(b.Role)]),
+		UpdateTime: timestamppb.New(b.UpdateTime),
+	}
+}
+
+// SetRoleBinding binds a role to a principal, replacing its former role.
+func (s *libraryServiceServer) SetRoleBinding(ctx context.Context,
+	req *librarypb.SetRoleBindingRequest) (*librarypb.RoleBinding, error) {
+
+	binding := NewRoleBindingFromProto(req.GetRoleBinding())
+	if violations := validateRoleBinding(binding); violations != nil {
+		return nil, invalidFieldsError(inField("role_binding", violations))
+	}
+	binding.UpdateTime = time.Now()
+
+	if err := s.store.SetRoleBinding(ctx, binding); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return binding.AsProto(), nil
+}
+
+// ListRoleBindings retreives a page of the role bindings ordered by their
+// principals.
+func (s *libraryServiceServer) ListRoleBindings(ctx context.Context,
+	req *librarypb.ListRoleBindingsRequest) (*librarypb.ListRoleBindingsResponse, error) {
+
+	pageSize, err := parsePageSize(req.GetPageSize())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+	checksum := listChecksum("", "roleBindings", false)
+	after, err := parsePageToken(req.GetPageToken(), checksum, 1)
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	bindings, next, err := s.store.ListRoleBindings(ctx, pageSize, after)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.ListRoleBindingsResponse{}
+	for _, binding := range bindings {
+		resp.RoleBindings = append(resp.RoleBindings, binding.AsProto())
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(checksum, next)
+	}
+	return resp, nil
+}
+
+// DeleteRoleBinding deletes the role binding of a principal, after which the
+// principal may call no method.
+func (s *libraryServiceServer) DeleteRoleBinding(ctx context.Context,
+	req *librarypb.DeleteRoleBindingRequest) (*emptypb.Empty, error) {
+
+	if err := s.store.DeleteRoleBinding(ctx, req.GetPrincipal()); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &emptypb.Empty{}, nil
+}
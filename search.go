@@ -0,0 +1,192 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+)
+
+// The markers enclosing the matched words in a search snippet.
+const (
+	snippetStart = "<b>"
+	snippetEnd   = "</b>"
+)
+
+// SearchResult is a book matching a search query.
+type SearchResult struct {
+	Book Book
+	// Rank orders the results, the most relevant result has the lowest rank.
+	Rank float64
+	// Snippet is an excerpt of the matching field with the matched words
+	// enclosed in snippetStart and snippetEnd.
+	Snippet string
+}
+
+// searchTerm is a single word or a quoted phrase of a search query.
+type searchTerm struct {
+	words []string
+	// prefix is set if the last word matches any word with that prefix.
+	prefix bool
+}
+
+// searchQuery holds a parsed SearchBooks request.
+type searchQuery struct {
+	terms    []searchTerm
+	pageSize int
+	// after holds the rank and the isbn of the last result of the previous
+	// page.
+	after []string
+	// checksum ties the page tokens to the query.
+	checksum uint32
+}
+
+// newSearchQuery validates and parses the query and the paging parameters of
+// a SearchBooks request.
+func newSearchQuery(query string, pageSize int32,
+	token string) (searchQuery, error) {
+	q := searchQuery{checksum: listChecksum(query, "rank", false)}
+	var err error
+
+	if q.pageSize, err = parsePageSize(pageSize); err != nil {
+		return q, err
+	}
+	if q.terms, err = parseSearchQuery(query); err != nil {
+		return q, &fieldError{"query", err.Error()}
+	}
+
+	if q.after, err = parsePageToken(token, q.checksum, 2); err != nil {
+		return q, err
+	}
+	if q.after != nil {
+		if _, err := strconv.ParseFloat(q.after[0], 64); err != nil {
+			return q, errInvalidPageToken
+		}
+	}
+	return q, nil
+}
+
+// parseSearchQuery splits a search query into its words and quoted phrases.
+// A word or phrase followed by '*' is matched as a prefix.
+func parseSearchQuery(query string) ([]searchTerm, error) {
+	var terms []searchTerm
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		var text string
+		switch {
+		case unicode.IsSpace(runes[i]):
+			i++
+			continue
+		case runes[i] == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated phrase")
+			}
+			text = string(runes[i+1 : j])
+			i = j + 1
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) &&
+				runes[j] != '"' && runes[j] != '*' {
+				j++
+			}
+			text = string(runes[i:j])
+			i = j
+		}
+
+		term := searchTerm{}
+		if i < len(runes) && runes[i] == '*' {
+			term.prefix = true
+			i++
+		}
+		for _, w := range searchWords(text) {
+			term.words = append(term.words, w.text)
+		}
+		if len(term.words) != 0 {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, errors.New("no words to search for")
+	}
+	return terms, nil
+}
+
+// searchWord is a word of a searched text and its position in the text.
+type searchWord struct {
+	text       string // in lower case
+	start, end int    // byte offsets in the text
+}
+
+// searchWords splits a text into its words, which are the runs of letters
+// and digits, the same way the full-text index does.
+func searchWords(text string) []searchWord {
+	var words []searchWord
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWordRune && start < 0:
+			start = i
+		case !isWordRune && start >= 0:
+			words = append(words, searchWord{
+				text: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, searchWord{
+			text: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return words
+}
+
+// ftsExpression returns the terms as an FTS5 query expression. The words are
+// quoted so that no FTS5 syntax can be injected.
+func (q searchQuery) ftsExpression() string {
+	parts := make([]string, len(q.terms))
+	for i, term := range q.terms {
+		parts[i] = `"` + strings.Join(term.words, " ") + `"`
+		if term.prefix {
+			parts[i] += "*"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// SearchBooks finds the books whose title, author or publisher match the
+// query, the most relevant first. Deleted books are not included.
+func (s *libraryServiceServer) SearchBooks(ctx context.Context,
+	req *librarypb.SearchBooksRequest) (*librarypb.SearchBooksResponse, error) {
+
+	query, err := newSearchQuery(req.GetQuery(), req.GetPageSize(),
+		req.GetPageToken())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	results, next, total, err := s.store.SearchBooks(ctx, query)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &librarypb.SearchBooksResponse{TotalSize: int32(total)}
+	for _, r := range results {
+		resp.Results = append(resp.Results, &librarypb.SearchResult{
+			Book:      r.Book.AsProto(),
+			Relevance: -r.Rank,
+			Snippet:   r.Snippet,
+		})
+	}
+	if next != nil {
+		resp.NextPageToken = encodePageToken(query.checksum, next)
+	}
+	return resp, nil
+}
@@ -2,10 +2,8 @@ package library
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"net"
-	"strings"
 	"time"
 
 	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
@@ -18,40 +16,78 @@ import (
 // checks if we have implementat all the different functions
 var _ librarypb.LibraryServiceServer = new(libraryServiceServer)
 
-// libraryServiceServer for the grpc server struct
+// libraryServiceServer for the grpc server struct. It serves the
+// LibraryService, the MemberService, the CirculationService, the FinesService,
+// the CalendarService, the BranchService, the AccessService and the
+// AuditService.
 type libraryServiceServer struct {
 	librarypb.UnsafeLibraryServiceServer
-	store                     DBStorage
+	librarypb.UnsafeMemberServiceServer
+	librarypb.UnsafeCirculationServiceServer
+	librarypb.UnsafeFinesServiceServer
+	librarypb.UnsafeCalendarServiceServer
+	librarypb.UnsafeBranchServiceServer
+	librarypb.UnsafeAccessServiceServer
+	librarypb.UnsafeAuditServiceServer
+	store                     BookStore
 	minDurationBetweenUpdates time.Duration
+	deletedBookRetention      time.Duration
+	loanPolicies              map[string]loanPolicy // keyed by membership tier
+	holdPickupPeriod          time.Duration
+	fines                     FinePolicy
+	changes                   changeNotifier   // wakes up WatchBooks
+	now                       func() time.Time // the clock of the circulation
 	log                       *zap.SugaredLogger
 }
 
-// NewServer creates a new GRPC server instance.
+// NewServer creates a new GRPC server instance storing the books in the given
+// store. Deleted books are kept for the deletedBookRetention duration before
+// they are purged, held copies can be picked up during the holdPickupPeriod
+// and late and lost copies are charged by the fine policy.
 func NewServer(
-	dataBase *sql.DB,
+	store BookStore,
 	logger *zap.SugaredLogger,
 	minDurationTimeBetweenUpdates time.Duration,
+	deletedBookRetention time.Duration,
+	holdPickupPeriod time.Duration,
+	fines FinePolicy,
 ) *libraryServiceServer {
 
 	s := &libraryServiceServer{}
 
-	s.store = DBStorage{db: dataBase, log: logger}
+	s.store = store
 	s.log = logger
 	s.minDurationBetweenUpdates = minDurationTimeBetweenUpdates
+	s.deletedBookRetention = deletedBookRetention
+	s.loanPolicies = defaultLoanPolicies
+	s.holdPickupPeriod = holdPickupPeriod
+	s.fines = fines
+	s.now = time.Now
 	return s
 }
 
 // RunGRPCServer initializes and Starts the grpc server. Here we listen on the
-// port given and then if successful we register a library server service.
-func (s *libraryServiceServer) RunGRPCServer(addr string) error {
+// port given and then if successful we register the library, member,
+// circulation, fines, calendar, branch, access and audit services. The
+// options, such as the interceptor of an Authenticator, are passed to the grpc
+// server.
+func (s *libraryServiceServer) RunGRPCServer(addr string,
+	opts ...grpc.ServerOption) error {
 	listenOn := addr
 	listener, err := net.Listen("tcp", listenOn)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", listenOn, err)
 	}
 
-	server := grpc.NewServer()
+	server := grpc.NewServer(opts...)
 	librarypb.RegisterLibraryServiceServer(server, s)
+	librarypb.RegisterMemberServiceServer(server, s)
+	librarypb.RegisterCirculationServiceServer(server, s)
+	librarypb.RegisterFinesServiceServer(server, s)
+	librarypb.RegisterCalendarServiceServer(server, s)
+	librarypb.RegisterBranchServiceServer(server, s)
+	librarypb.RegisterAccessServiceServer(server, s)
+	librarypb.RegisterAuditServiceServer(server, s)
 	if err := server.Serve(listener); err != nil {
 		return fmt.Errorf("failed to serve gRPC server: %w", err)
 	}
@@ -65,111 +101,274 @@ func (s *libraryServiceServer) RunGRPCServer(addr string) error {
 func (s *libraryServiceServer) CreateBook(ctx context.Context,
 	req *librarypb.CreateBookRequest) (*librarypb.Book, error) {
 
-	newBook := NewBookFromProto(req.Book) // creates a Book instance
-
-	if !(req.Book.GetCreateTime().AsTime().Unix() == 0 &&
-		req.Book.GetUpdateTime().AsTime().Unix() == 0) {
-		return nil, status.Errorf(codes.PermissionDenied,
-			"not allowed to change CreateTime or UpdateTime")
+	newBook, err := newBookFromRequest(req)
+	if err != nil {
+		return nil, err
 	}
-	if err := validate(newBook); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+
+	err = s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		if err := tx.InsertIntoDatabase(ctx, newBook); err != nil {
+			return err
+		}
+		if newBook, err = tx.FindSpecificBook(ctx, newBook.ISBN); err != nil {
+			return err
+		}
+		return auditBook(ctx, tx, "CreateBook", nil, &newBook)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
 	}
+	s.changes.notify()
 
-	newBook.CreateTime = time.Now()
-	newBook.UpdateTime = time.Now()
+	return newBook.AsProto(), nil
+}
+
+// newBookFromRequest creates the Book instance of a create request and checks
+// that the right information have been passed.
+func newBookFromRequest(req *librarypb.CreateBookRequest) (Book, error) {
+	newBook := NewBookFromProto(req.GetBook()) // creates a Book instance
 
-	if err := s.store.InsertIntoDatabase(newBook); err != nil {
-		return nil, status.Errorf(codes.AlreadyExists,
-			"the book with this isbn already existed")
+	if !(req.GetBook().GetCreateTime().AsTime().Unix() == 0 &&
+		req.GetBook().GetUpdateTime().AsTime().Unix() == 0) {
+		return Book{}, status.Errorf(codes.PermissionDenied,
+			"not allowed to change CreateTime or UpdateTime")
+	}
+	if violations := validate(newBook); violations != nil {
+		return Book{}, invalidFieldsError(inField("book", violations))
 	}
 
-	return newBook.AsProto(), nil
+	newBook.CreateTime = time.Now()
+	newBook.UpdateTime = newBook.CreateTime
+	return newBook, nil
 }
 
-// GetBook retreives a specific book that exists in the library structure.
+// GetBook retreives a specific book that exists in the library structure, or
+// a past revision of it if the name has a revision id.
 func (s *libraryServiceServer) GetBook(ctx context.Context,
 	req *librarypb.GetBookRequest) (*librarypb.Book, error) {
 
-	isbnPath := req.GetName()
-	bookIsbn := strings.Split(isbnPath, "/")[1]
+	bookIsbn, revisionID := bookRevisionFromName(req.GetName())
+	if revisionID != "" {
+		return s.getBookRevision(ctx, bookIsbn, revisionID, req.GetShowDeleted())
+	}
 
-	book := s.store.FindSpecificBook(bookIsbn)
-	if (Book{} == book) {
-		return nil, status.Errorf(codes.AlreadyExists,
-			"the book did not exist in the library")
+	book, err := s.store.FindSpecificBook(ctx, bookIsbn)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	if book.IsDeleted() && !req.GetShowDeleted() {
+		return nil, status.Errorf(codes.NotFound,
+			"the book has been deleted from the library")
 	}
 
 	return book.AsProto(), nil
 }
 
 // UpdateBook updates a book instance and checks that the right information have
-// been passed. If the information is validated then we store the information in
-// the database and sends back which book we updated as response
+// been passed. Only the fields in the update mask are validated and written,
+// or all the fields if the mask is empty. If the information is validated
+// then we store the information in the database and sends back which book we
+// updated as response
 func (s *libraryServiceServer) UpdateBook(ctx context.Context,
 	req *librarypb.UpdateBookRequest) (*librarypb.Book, error) {
-	bookIsbn := req.Book.GetName()
-
-	existingBook := s.store.FindSpecificBook(bookIsbn)
-	if (existingBook == Book{}) {
-		return nil, status.Errorf(codes.NotFound,
-			"the book did not exist in the library")
+	bookIsbn := isbnFromName(req.Book.GetName())
+	if req.GetName() != "" {
+		if bookIsbn != "" && bookIsbn != isbnFromName(req.GetName()) {
+			return nil, status.Errorf(codes.PermissionDenied,
+				"not allowed to chang the ISBN")
+		}
+		bookIsbn = isbnFromName(req.GetName())
 	}
 
-	newBook := NewBookFromProto(req.Book)
-	newBook.ISBN = bookIsbn
-
-	createdTime := existingBook.CreateTime
-	updatedTime := existingBook.UpdateTime
-
-	if existingBook.ISBN != newBook.ISBN {
-		return nil, status.Errorf(codes.PermissionDenied,
-			"not allowed to chang the ISBN")
-	}
-	if time.Since(updatedTime) < s.minDurationBetweenUpdates {
-		return nil, status.Errorf(codes.Internal, "updated a few seconds ago, "+
-			"please wait a moment before updating again")
-	}
-	if err := validate(newBook); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	paths, violations := updatePaths(req.GetUpdateMask().GetPaths())
+	if violations != nil {
+		return nil, invalidFieldsError(violations)
 	}
 
-	newBook.CreateTime = createdTime
-	newBook.UpdateTime = time.Now()
-
-	if err := s.store.DeleteBookFromDB(bookIsbn); err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+	update := NewBookFromProto(req.Book)
+	if violations := validateFields(update, paths); violations != nil {
+		return nil, invalidFieldsError(inField("book", violations))
 	}
-	if err := s.store.InsertIntoDatabase(newBook); err != nil {
-		return nil, status.Errorf(codes.AlreadyExists, err.Error())
+
+	// the book is read and its etag checked in the transaction of the write,
+	// so two updates with the same etag can not both succeed
+	var newBook Book
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		existingBook, err := tx.FindSpecificBook(ctx, bookIsbn)
+		if err != nil {
+			return err
+		}
+		if existingBook.IsDeleted() {
+			return ErrNotFound
+		}
+		if err := checkEtag(ctx, req.Book.GetEtag(), existingBook); err != nil {
+			return err
+		}
+		if time.Since(existingBook.UpdateTime) < s.minDurationBetweenUpdates {
+			return status.Errorf(codes.Internal, "updated a few seconds ago, "+
+				"please wait a moment before updating again")
+		}
+
+		newBook = applyUpdate(existingBook, update, paths)
+		newBook.UpdateTime = time.Now()
+		if err := tx.UpdateBookInDB(ctx, newBook, paths); err != nil {
+			return err
+		}
+		if newBook, err = tx.FindSpecificBook(ctx, bookIsbn); err != nil {
+			return err
+		}
+		return auditBook(ctx, tx, "UpdateBook", &existingBook, &newBook)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
 	}
+	s.changes.notify()
 
 	return newBook.AsProto(), nil
 }
 
-// DeleteBook deletes a book instance from the library database.
-// If successful it sends back which book we deleted as response
+// DeleteBook deletes a book instance from the library database. The book is
+// kept until its expire time has passed and can be restored with UndeleteBook
+// until then. If successful it sends back which book we deleted as response
 func (s *libraryServiceServer) DeleteBook(ctx context.Context,
 	req *librarypb.DeleteBookRequest) (*librarypb.Book, error) {
 
-	isbnPath := req.GetName()
-	bookIsbn := strings.Split(isbnPath, "/")[1]
+	bookIsbn := isbnFromName(req.GetName())
+
+	var deleted Book
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		exists, err := tx.FindSpecificBook(ctx, bookIsbn)
+		if err != nil {
+			return err
+		}
+		if exists.IsDeleted() {
+			return ErrNotFound
+		}
+		if err := checkEtag(ctx, req.GetEtag(), exists); err != nil {
+			return err
+		}
+
+		deleted = exists
+		deleted.DeleteTime = time.Now()
+		deleted.ExpireTime = deleted.DeleteTime.Add(s.deletedBookRetention)
+		if err := tx.SoftDeleteBook(ctx, bookIsbn, deleted.DeleteTime,
+			deleted.ExpireTime); err != nil {
+			return err
+		}
+		if deleted, err = tx.FindSpecificBook(ctx, bookIsbn); err != nil {
+			return err
+		}
+		return auditBook(ctx, tx, "DeleteBook", &exists, &deleted)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	s.changes.notify()
+	return deleted.AsProto(), nil
+}
 
-	exists := s.store.FindSpecificBook(bookIsbn)
+// UndeleteBook restores a deleted book which has not yet been purged.
+// If successful it sends back the restored book as response
+func (s *libraryServiceServer) UndeleteBook(ctx context.Context,
+	req *librarypb.UndeleteBookRequest) (*librarypb.Book, error) {
+
+	bookIsbn := isbnFromName(req.GetName())
+
+	var restored Book
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		book, err := tx.FindSpecificBook(ctx, bookIsbn)
+		if err != nil {
+			return err
+		}
+		if !book.IsDeleted() {
+			return status.Errorf(codes.AlreadyExists,
+				"the book has not been deleted")
+		}
+		if err := checkEtag(ctx, req.GetEtag(), book); err != nil {
+			return err
+		}
+		if err := tx.UndeleteBookInDB(ctx, bookIsbn); err != nil {
+			return err
+		}
+		if restored, err = tx.FindSpecificBook(ctx, bookIsbn); err != nil {
+			return err
+		}
+		return auditBook(ctx, tx, "UndeleteBook", &book, &restored)
+	})
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	s.changes.notify()
+	return restored.AsProto(), nil
+}
 
-	if err := s.store.DeleteBookFromDB(bookIsbn); err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+// RunPurger permanently removes the deleted books whose expire time has
+// passed, checking every interval until the context is done.
+func (s *libraryServiceServer) RunPurger(ctx context.Context,
+	interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			purged, err := s.purgeExpiredBooks(ctx, time.Now())
+			if err != nil {
+				s.log.Errorw("failed to purge deleted books", "error", err)
+				continue
+			}
+			if purged > 0 {
+				s.log.Infow("purged deleted books", "count", purged)
+			}
+		}
 	}
-	return exists.AsProto(), nil
 }
 
-// ListBooks retreives all the books that exists in the library structure
-// database. if successful, it sends all the book instances as a response to the
-// GRPC gateway.
+// purgeExpiredBooks permanently removes the deleted books whose expire time is
+// before now, and records the purge of every book in the audit log as a
+// change by the system principal.
+func (s *libraryServiceServer) purgeExpiredBooks(ctx context.Context,
+	now time.Time) (int64, error) {
+	ctx = withPrincipal(ctx, systemPrincipal)
+	var purged int64
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		expired, err := tx.ListExpiredBooks(ctx, now)
+		if err != nil {
+			return err
+		}
+		for i := range expired {
+			if err := auditBook(ctx, tx, "PurgeExpiredBooks", &expired[i],
+				nil); err != nil {
+				return err
+			}
+		}
+		purged, err = tx.PurgeExpiredBooks(ctx, now)
+		return err
+	})
+	return purged, err
+}
+
+// ListBooks retreives a page of the books that exists in the library structure
+// database, filtered and ordered as requested. if successful, it sends the
+// book instances and the token for the next page as a response to the GRPC
+// gateway.
 func (s *libraryServiceServer) ListBooks(ctx context.Context,
 	req *librarypb.ListBooksRequest) (*librarypb.ListBooksResponse, error) {
 
-	Books := s.store.ReadDatabaseList() // reads all the books from database
+	query, err := newListQuery(req.GetPageSize(), req.GetPageToken(),
+		req.GetFilter(), req.GetOrderBy(), req.GetShowDeleted(),
+		req.GetAvailableAtBranch())
+	if err != nil {
+		return nil, invalidArgumentError(err)
+	}
+
+	// reads a page of books from database
+	Books, next, total, err := s.store.ListBooks(ctx, query)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
 
 	var BooksConvert []*librarypb.Book
 
@@ -178,7 +377,11 @@ func (s *libraryServiceServer) ListBooks(ctx context.Context,
 	}
 
 	booksResp := &librarypb.ListBooksResponse{
-		Book: BooksConvert,
+		Book:      BooksConvert,
+		TotalSize: int32(total),
+	}
+	if next != nil {
+		booksResp.NextPageToken = encodePageToken(query.checksum, next)
 	}
 	return booksResp, nil
 }
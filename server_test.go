@@ -1,5 +1,20 @@
 package library
 
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
 /*
 func validBook(isbn string) Book {
 	b := Book{
@@ -537,3 +552,607 @@ func TestUpdate(t *testing.T) {
 	})
 }
 */
+
+// testStores creates the empty stores the handler tests run against.
+var testStores = map[string]func(t *testing.T) BookStore{
+	"db": newTestDBStorage,
+	"memory": func(t *testing.T) BookStore {
+		return NewMemoryStorage()
+	},
+}
+
+// newTestServer creates a server on a new store of the kind, holding the
+// author and the publisher of the test books.
+func newTestServer(t *testing.T, newStore func(t *testing.T) BookStore) *libraryServiceServer {
+	ctx := context.Background()
+	store := newStore(t)
+	require.NoError(t, store.CreateAuthor(ctx, testAuthor(testAuthorID, "george", "lucas")))
+	require.NoError(t, store.CreatePublisher(ctx, testPublisher(testPublisherID, "adlibris")))
+	return NewServer(store, zap.NewNop().Sugar(), 0, time.Hour, time.Hour,
+		DefaultFinePolicy)
+}
+
+func TestUpdateBookEtag(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newStore)
+			b := testBook("9780000000001", "star wars")
+			require.NoError(t, s.store.InsertIntoDatabase(ctx, b))
+			stored, err := s.store.FindSpecificBook(ctx, b.ISBN)
+			require.NoError(t, err)
+			etag := stored.Etag()
+
+			// two clients read the same etag and update the book one after
+			// the other, the second update must not overwrite the first
+			update := func(title string) error {
+				_, err := s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+					Book:       &librarypb.Book{Name: b.ISBN, Title: title, Etag: etag},
+					UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"title"}},
+				})
+				return err
+			}
+			require.NoError(t, update("a new hope"))
+			require.Equal(t, codes.Aborted, status.Code(update("the empire strikes back")))
+			got, err := s.store.FindSpecificBook(ctx, b.ISBN)
+			require.NoError(t, err)
+			require.Equal(t, "a new hope", got.Title)
+
+			// of concurrent updates with the same etag only one succeeds
+			etag = got.Etag()
+			errs := make(chan error)
+			for i := 0; i < 8; i++ {
+				go func(i int) { errs <- update(fmt.Sprintf("episode %d", i)) }(i)
+			}
+			succeeded := 0
+			for i := 0; i < 8; i++ {
+				err := <-errs
+				if err == nil {
+					succeeded++
+					continue
+				}
+				require.Equal(t, codes.Aborted, status.Code(err), err)
+			}
+			require.Equal(t, 1, succeeded)
+
+			// the same holds for deletes
+			got, err = s.store.FindSpecificBook(ctx, b.ISBN)
+			require.NoError(t, err)
+			_, err = s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+				Book:       &librarypb.Book{Name: b.ISBN, Title: "return of the jedi"},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"title"}},
+			})
+			require.NoError(t, err)
+			_, err = s.DeleteBook(ctx, &librarypb.DeleteBookRequest{
+				Name: b.ISBN, Etag: got.Etag()})
+			require.Equal(t, codes.Aborted, status.Code(err))
+		})
+	}
+}
+
+func TestUpdateBookMask(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, testStores["memory"])
+	otherPublisher := testPublisher("00000000000000d4", "penguin")
+	require.NoError(t, s.store.CreatePublisher(ctx, otherPublisher))
+	b := testBook("9780000000001", "star wars")
+	require.NoError(t, s.store.InsertIntoDatabase(ctx, b))
+
+	update := func(book *librarypb.Book, paths ...string) (*librarypb.Book, error) {
+		req := &librarypb.UpdateBookRequest{Book: book}
+		if paths != nil {
+			req.UpdateMask = &fieldmaskpb.FieldMask{Paths: paths}
+		}
+		return s.UpdateBook(ctx, req)
+	}
+	full := &librarypb.Book{
+		Name:      b.ISBN,
+		Title:     "the empire strikes back",
+		Publisher: "publishers/" + otherPublisher.ID,
+		Authors: []*librarypb.BookAuthor{{Author: "authors/" + testAuthorID,
+			Role: librarypb.BookAuthor_ROLE_EDITOR}},
+	}
+
+	t.Run("only the masked fields are written", func(t *testing.T) {
+		got, err := update(&librarypb.Book{Name: b.ISBN, Title: "a new hope"}, "title")
+		require.NoError(t, err)
+		require.Equal(t, "a new hope", got.GetTitle())
+		require.Equal(t, "publishers/"+testPublisherID, got.GetPublisher())
+		require.Len(t, got.GetAuthors(), 1)
+		require.Equal(t, librarypb.BookAuthor_ROLE_AUTHOR, got.GetAuthors()[0].GetRole())
+	})
+
+	t.Run("unmasked fields are not validated", func(t *testing.T) {
+		_, err := update(&librarypb.Book{Name: b.ISBN, Title: "a new hope",
+			Publisher: "publishers/unknown"}, "title")
+		require.NoError(t, err)
+	})
+
+	for name, paths := range map[string][]string{
+		"an empty mask": nil,
+		"*":             {"*"},
+	} {
+		t.Run(name+" replaces the book", func(t *testing.T) {
+			// every updatable field is validated, so a partial book fails
+			_, err := update(&librarypb.Book{Name: b.ISBN, Title: "a new hope"}, paths...)
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+			got, err := update(full, paths...)
+			require.NoError(t, err)
+			require.Equal(t, full.GetTitle(), got.GetTitle())
+			require.Equal(t, full.GetPublisher(), got.GetPublisher())
+			require.Equal(t, librarypb.BookAuthor_ROLE_EDITOR, got.GetAuthors()[0].GetRole())
+		})
+	}
+
+	for _, path := range []string{
+		// unknown
+		"isbn", "subtitle", "",
+		// immutable
+		"name", "create_time", "update_time", "etag",
+		// nested
+		"authors.role", "authors.author", "publisher.display_name",
+		"author.last_name", "title.text",
+	} {
+		t.Run("rejects "+path, func(t *testing.T) {
+			_, err := update(&librarypb.Book{Name: b.ISBN, Title: "return of the jedi"},
+				"title", path)
+			require.Equal(t, codes.InvalidArgument, status.Code(err))
+			got, err := s.store.FindSpecificBook(ctx, b.ISBN)
+			require.NoError(t, err)
+			require.NotEqual(t, "return of the jedi", got.Title)
+		})
+	}
+}
+
+func TestDeleteBook(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newStore)
+			b := testBook("9780000000001", "star wars")
+			require.NoError(t, s.store.InsertIntoDatabase(ctx, b))
+
+			_, err := s.UndeleteBook(ctx, &librarypb.UndeleteBookRequest{Name: b.ISBN})
+			require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+			deleted, err := s.DeleteBook(ctx, &librarypb.DeleteBookRequest{Name: b.ISBN})
+			require.NoError(t, err)
+			require.True(t, deleted.GetExpireTime().AsTime().After(
+				deleted.GetDeleteTime().AsTime()))
+			_, err = s.DeleteBook(ctx, &librarypb.DeleteBookRequest{Name: b.ISBN})
+			require.Equal(t, codes.NotFound, status.Code(err))
+
+			// a deleted book is only shown when asked for
+			_, err = s.GetBook(ctx, &librarypb.GetBookRequest{Name: b.ISBN})
+			require.Equal(t, codes.NotFound, status.Code(err))
+			got, err := s.GetBook(ctx, &librarypb.GetBookRequest{Name: b.ISBN,
+				ShowDeleted: true})
+			require.NoError(t, err)
+			require.NotNil(t, got.GetDeleteTime())
+			list, err := s.ListBooks(ctx, &librarypb.ListBooksRequest{})
+			require.NoError(t, err)
+			require.Empty(t, list.GetBook())
+			list, err = s.ListBooks(ctx, &librarypb.ListBooksRequest{ShowDeleted: true})
+			require.NoError(t, err)
+			require.Len(t, list.GetBook(), 1)
+
+			restored, err := s.UndeleteBook(ctx, &librarypb.UndeleteBookRequest{Name: b.ISBN})
+			require.NoError(t, err)
+			require.Nil(t, restored.GetDeleteTime())
+			require.Nil(t, restored.GetExpireTime())
+			_, err = s.GetBook(ctx, &librarypb.GetBookRequest{Name: b.ISBN})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRunPurger(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newStore)
+			retained := testBook("9780000000001", "star wars")
+			expired := testBook("9780000000002", "the empire strikes back")
+			for _, b := range []Book{retained, expired} {
+				require.NoError(t, s.store.InsertIntoDatabase(ctx, b))
+			}
+			_, err := s.DeleteBook(ctx, &librarypb.DeleteBookRequest{Name: retained.ISBN})
+			require.NoError(t, err)
+			s.deletedBookRetention = 0
+			_, err = s.DeleteBook(ctx, &librarypb.DeleteBookRequest{Name: expired.ISBN})
+			require.NoError(t, err)
+
+			purgeCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer cancel()
+			require.ErrorIs(t, s.RunPurger(purgeCtx, 10*time.Millisecond),
+				context.DeadlineExceeded)
+
+			// only the book past its expire time is purged
+			_, err = s.store.FindSpecificBook(ctx, expired.ISBN)
+			require.ErrorIs(t, err, ErrNotFound)
+			_, err = s.UndeleteBook(ctx, &librarypb.UndeleteBookRequest{Name: expired.ISBN})
+			require.Equal(t, codes.NotFound, status.Code(err))
+			_, err = s.UndeleteBook(ctx, &librarypb.UndeleteBookRequest{Name: retained.ISBN})
+			require.NoError(t, err)
+
+			// the purge is recorded in the audit log
+			events, _, err := s.store.ListAuditEvents(ctx, auditQuery{
+				pageSize: maxPageSize, resource: "books/" + expired.ISBN})
+			require.NoError(t, err)
+			purge := events[len(events)-1]
+			require.Equal(t, "PurgeExpiredBooks", purge.Method)
+			require.Equal(t, "system", purge.Principal)
+			require.NotEmpty(t, purge.Before)
+			require.Empty(t, purge.After)
+		})
+	}
+}
+
+func TestBatchCreateBooks(t *testing.T) {
+	ctx := context.Background()
+	newRequest := func(isbn, title string) *librarypb.CreateBookRequest {
+		return &librarypb.CreateBookRequest{Book: &librarypb.Book{
+			Name:      isbn,
+			Title:     title,
+			Publisher: "publishers/" + testPublisherID,
+			Authors:   []*librarypb.BookAuthor{{Author: "authors/" + testAuthorID}},
+		}}
+	}
+	requests := []*librarypb.CreateBookRequest{
+		newRequest("9780000000019", "star wars"),
+		newRequest("9780000000026", ""),
+		newRequest("9780000000033", "the empire strikes back"),
+	}
+	// the violations of an item name the request it belongs to
+	assertItemErrors := func(t *testing.T, errs []*librarypb.BatchItemError) {
+		require.Len(t, errs, 1)
+		require.EqualValues(t, 1, errs[0].GetIndex())
+		st := status.FromProto(errs[0].GetStatus())
+		require.Equal(t, codes.InvalidArgument, st.Code())
+		require.Len(t, st.Details(), 1)
+		violations := st.Details()[0].(*errdetails.BadRequest).GetFieldViolations()
+		require.Len(t, violations, 1)
+		require.Equal(t, "requests[1].book.title", violations[0].GetField())
+	}
+
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("all or nothing", func(t *testing.T) {
+				s := newTestServer(t, newStore)
+				resp, err := s.BatchCreateBooks(ctx, &librarypb.BatchCreateBooksRequest{
+					Requests: requests, AllOrNothing: true})
+				require.NoError(t, err)
+				require.Empty(t, resp.GetBooks())
+				assertItemErrors(t, resp.GetErrors())
+
+				// a failure in the store rolls back the books written before it
+				require.NoError(t, s.store.InsertIntoDatabase(ctx,
+					testBook("9780000000033", "a new hope")))
+				resp, err = s.BatchCreateBooks(ctx, &librarypb.BatchCreateBooksRequest{
+					Requests:     []*librarypb.CreateBookRequest{requests[0], requests[2]},
+					AllOrNothing: true})
+				require.NoError(t, err)
+				require.Empty(t, resp.GetBooks())
+				require.Len(t, resp.GetErrors(), 1)
+				require.EqualValues(t, 1, resp.GetErrors()[0].GetIndex())
+				require.Equal(t, codes.AlreadyExists,
+					status.FromProto(resp.GetErrors()[0].GetStatus()).Code())
+				_, err = s.store.FindSpecificBook(ctx, "9780000000019")
+				require.ErrorIs(t, err, ErrNotFound)
+			})
+
+			t.Run("partial success", func(t *testing.T) {
+				s := newTestServer(t, newStore)
+				resp, err := s.BatchCreateBooks(ctx, &librarypb.BatchCreateBooksRequest{
+					Requests: requests})
+				require.NoError(t, err)
+				require.Len(t, resp.GetBooks(), 2)
+				require.Equal(t, "9780000000019", resp.GetBooks()[0].GetName())
+				require.Equal(t, "9780000000033", resp.GetBooks()[1].GetName())
+				assertItemErrors(t, resp.GetErrors())
+				_, err = s.store.FindSpecificBook(ctx, "9780000000026")
+				require.ErrorIs(t, err, ErrNotFound)
+			})
+		})
+	}
+
+	t.Run("max batch size", func(t *testing.T) {
+		s := newTestServer(t, testStores["memory"])
+		tooMany := make([]*librarypb.CreateBookRequest, maxBatchSize+1)
+		for i := range tooMany {
+			tooMany[i] = requests[0]
+		}
+		_, err := s.BatchCreateBooks(ctx, &librarypb.BatchCreateBooksRequest{
+			Requests: tooMany})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = s.BatchGetBooks(ctx, &librarypb.BatchGetBooksRequest{
+			Names: make([]string, maxBatchSize+1)})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = s.BatchDeleteBooks(ctx, &librarypb.BatchDeleteBooksRequest{
+			Names: make([]string, maxBatchSize+1)})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestBatchDeleteBooks(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newStore)
+			for _, isbn := range []string{"9780000000001", "9780000000002"} {
+				require.NoError(t, s.store.InsertIntoDatabase(ctx, testBook(isbn, "star wars")))
+			}
+			names := []string{"9780000000001", "9780000000009", "9780000000002"}
+
+			resp, err := s.BatchDeleteBooks(ctx, &librarypb.BatchDeleteBooksRequest{
+				Names: names, AllOrNothing: true})
+			require.NoError(t, err)
+			require.Empty(t, resp.GetBooks())
+			require.Len(t, resp.GetErrors(), 1)
+			require.EqualValues(t, 1, resp.GetErrors()[0].GetIndex())
+			require.Equal(t, codes.NotFound,
+				status.FromProto(resp.GetErrors()[0].GetStatus()).Code())
+			got, err := s.store.FindSpecificBook(ctx, "9780000000001")
+			require.NoError(t, err)
+			require.False(t, got.IsDeleted())
+
+			resp, err = s.BatchDeleteBooks(ctx, &librarypb.BatchDeleteBooksRequest{
+				Names: names})
+			require.NoError(t, err)
+			require.Len(t, resp.GetBooks(), 2)
+			require.Len(t, resp.GetErrors(), 1)
+			got, err = s.store.FindSpecificBook(ctx, "9780000000002")
+			require.NoError(t, err)
+			require.True(t, got.IsDeleted())
+		})
+	}
+}
+
+func TestDeletePublisherAudit(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newStore)
+			published := testBook("9780000000001", "star wars")
+			deleted := testBook("9780000000002", "the empire strikes back")
+			other := testBook("9780000000003", "return of the jedi")
+			other.Publisher = "00000000000000d4"
+			require.NoError(t, s.store.CreatePublisher(ctx, testPublisher(other.Publisher,
+				"penguin")))
+			for _, b := range []Book{published, deleted, other} {
+				require.NoError(t, s.store.InsertIntoDatabase(ctx, b))
+			}
+			_, err := s.DeleteBook(ctx, &librarypb.DeleteBookRequest{Name: deleted.ISBN})
+			require.NoError(t, err)
+
+			name := "publishers/" + testPublisherID
+			_, err = s.DeletePublisher(ctx, &librarypb.DeletePublisherRequest{Name: name})
+			require.Equal(t, codes.FailedPrecondition, status.Code(err))
+			_, err = s.DeletePublisher(ctx, &librarypb.DeletePublisherRequest{Name: name,
+				Force: true})
+			require.NoError(t, err)
+
+			// the books whose publisher was cleared, deleted or not, are audited
+			resp, err := s.ListAuditEvents(ctx, &librarypb.ListAuditEventsRequest{})
+			require.NoError(t, err)
+			audited := map[string]*librarypb.AuditEvent{}
+			for _, e := range resp.GetAuditEvents() {
+				if e.GetMethod() == "DeletePublisher" {
+					audited[e.GetResource()] = e
+				}
+			}
+			require.Len(t, audited, 2)
+			for _, b := range []Book{published, deleted} {
+				e := audited["books/"+b.ISBN]
+				require.NotNil(t, e, b.ISBN)
+				require.Equal(t, name, e.GetBefore().GetFields()["publisher"].GetStringValue())
+				require.NotContains(t, e.GetAfter().GetFields(), "publisher")
+			}
+		})
+	}
+}
+
+func TestRollbackBook(t *testing.T) {
+	ctx := context.Background()
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, newStore)
+			b := testBook("9780000000001", "star wars")
+			require.NoError(t, s.store.InsertIntoDatabase(ctx, b))
+			lastRevision := func() string {
+				changes, err := s.store.ListBookChanges(ctx, 0, 100)
+				require.NoError(t, err)
+				return changes[len(changes)-1].RevisionID
+			}
+			setPublisher := func(id string) {
+				require.NoError(t, s.store.CreatePublisher(ctx, testPublisher(id, "penguin")))
+				_, err := s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+					Book:       &librarypb.Book{Name: b.ISBN, Publisher: "publishers/" + id},
+					UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"publisher"}},
+				})
+				require.NoError(t, err)
+			}
+			rollback := func(revisionID string) (*librarypb.Book, error) {
+				return s.RollbackBook(ctx, &librarypb.RollbackBookRequest{
+					Name: b.ISBN, RevisionId: revisionID})
+			}
+			deletePublisher := func(id string) {
+				_, err := s.DeletePublisher(ctx, &librarypb.DeletePublisherRequest{
+					Name: "publishers/" + id, Force: true})
+				require.NoError(t, err)
+			}
+
+			// the publisher of the revision has been deleted
+			original := lastRevision()
+			setPublisher("00000000000000d4")
+			deletePublisher(testPublisherID)
+			_, err := rollback(original)
+			require.Equal(t, codes.FailedPrecondition, status.Code(err))
+			require.Contains(t, status.Convert(err).Message(), "publishers/"+testPublisherID)
+
+			// the publisher of the revision was cleared by deleting it
+			deletePublisher("00000000000000d4")
+			cleared := lastRevision()
+			setPublisher("00000000000000d5")
+			_, err = rollback(cleared)
+			require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+			// the author of the revision has been deleted
+			require.NoError(t, s.store.CreateAuthor(ctx, testAuthor("00000000000000a2",
+				"mark", "hamill")))
+			_, err = s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+				Book: &librarypb.Book{Name: b.ISBN, Authors: []*librarypb.BookAuthor{
+					{Author: "authors/00000000000000a2"}}},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"authors"}},
+			})
+			require.NoError(t, err)
+			credited := lastRevision()
+			_, err = s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+				Book: &librarypb.Book{Name: b.ISBN, Authors: []*librarypb.BookAuthor{
+					{Author: "authors/" + testAuthorID}}},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"authors"}},
+			})
+			require.NoError(t, err)
+			current := lastRevision()
+			require.NoError(t, s.store.DeleteAuthor(ctx, "00000000000000a2"))
+			_, err = rollback(credited)
+			require.Equal(t, codes.FailedPrecondition, status.Code(err))
+			require.Contains(t, status.Convert(err).Message(), "authors/00000000000000a2")
+
+			// a revision whose references exist is restored
+			_, err = s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+				Book:       &librarypb.Book{Name: b.ISBN, Title: "a new hope"},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"title"}},
+			})
+			require.NoError(t, err)
+			got, err := rollback(current)
+			require.NoError(t, err)
+			require.Equal(t, "star wars", got.GetTitle())
+			require.Equal(t, "publishers/00000000000000d5", got.GetPublisher())
+		})
+	}
+}
+
+// fieldViolations returns the fields of the BadRequest detail of an
+// InvalidArgument error.
+func fieldViolations(t *testing.T, err error) []string {
+	t.Helper()
+	st := status.Convert(err)
+	require.Equal(t, codes.InvalidArgument, st.Code(), err)
+	var fields []string
+	for _, detail := range st.Details() {
+		br, ok := detail.(*errdetails.BadRequest)
+		require.True(t, ok, "unexpected detail %T", detail)
+		for _, v := range br.GetFieldViolations() {
+			require.NotEmpty(t, v.GetDescription(), v.GetField())
+			fields = append(fields, v.GetField())
+		}
+	}
+	return fields
+}
+
+func TestFieldViolations(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t, testStores["memory"])
+	validBook := func() *librarypb.Book {
+		return &librarypb.Book{
+			Name:      "9780000000019",
+			Title:     "star wars",
+			Publisher: "publishers/" + testPublisherID,
+			Authors:   []*librarypb.BookAuthor{{Author: "authors/" + testAuthorID}},
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(b *librarypb.Book)
+		fields []string
+	}{
+		{"isbn", func(b *librarypb.Book) { b.Name = "9780000000010" },
+			[]string{"book.name"}},
+		{"title", func(b *librarypb.Book) { b.Title = "" },
+			[]string{"book.title"}},
+		{"publisher", func(b *librarypb.Book) { b.Publisher = "penguin" },
+			[]string{"book.publisher"}},
+		{"no authors", func(b *librarypb.Book) { b.Authors = nil },
+			[]string{"book.authors"}},
+		{"author", func(b *librarypb.Book) {
+			b.Authors = []*librarypb.BookAuthor{{Author: "lucas"}}
+		}, []string{"book.authors[0].author"}},
+		{"role of the second author", func(b *librarypb.Book) {
+			b.Authors = append(b.Authors, &librarypb.BookAuthor{
+				Author: "authors/" + testAuthorID, Role: librarypb.BookAuthor_Role(99)})
+		}, []string{"book.authors[1].role"}},
+		{"every invalid field", func(b *librarypb.Book) {
+			b.Title = " star  wars"
+			b.Publisher = ""
+			b.Authors = []*librarypb.BookAuthor{{Author: "lucas"}}
+		}, []string{"book.title", "book.authors[0].author", "book.publisher"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := validBook()
+			tc.modify(b)
+			_, err := s.CreateBook(ctx, &librarypb.CreateBookRequest{Book: b})
+			require.ElementsMatch(t, tc.fields, fieldViolations(t, err))
+		})
+	}
+
+	t.Run("update", func(t *testing.T) {
+		_, err := s.CreateBook(ctx, &librarypb.CreateBookRequest{Book: validBook()})
+		require.NoError(t, err)
+		b := validBook()
+		b.Title = ""
+		b.Authors[0].Author = "lucas"
+		_, err = s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+			Book:       b,
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"title", "authors"}},
+		})
+		require.ElementsMatch(t, []string{"book.title", "book.authors[0].author"},
+			fieldViolations(t, err))
+	})
+
+	t.Run("update mask", func(t *testing.T) {
+		for _, path := range []string{"etag", "subtitle"} {
+			_, err := s.UpdateBook(ctx, &librarypb.UpdateBookRequest{
+				Book:       validBook(),
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{path}},
+			})
+			require.Equal(t, []string{"update_mask.paths"}, fieldViolations(t, err), path)
+		}
+		_, err := s.UpdatePublisher(ctx, &librarypb.UpdatePublisherRequest{
+			Publisher:  &librarypb.Publisher{Name: "publishers/" + testPublisherID},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"name"}},
+		})
+		require.Equal(t, []string{"update_mask.paths"}, fieldViolations(t, err))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		for _, tc := range []struct {
+			req   *librarypb.ListBooksRequest
+			field string
+		}{
+			{&librarypb.ListBooksRequest{Filter: "subtitle = \"x\""}, "filter"},
+			{&librarypb.ListBooksRequest{OrderBy: "subtitle"}, "order_by"},
+			{&librarypb.ListBooksRequest{PageToken: "nonsense"}, "page_token"},
+			{&librarypb.ListBooksRequest{PageSize: -1}, "page_size"},
+		} {
+			_, err := s.ListBooks(ctx, tc.req)
+			require.Equal(t, []string{tc.field}, fieldViolations(t, err), tc.field)
+		}
+		_, err := s.ListAuthors(ctx, &librarypb.ListAuthorsRequest{PageToken: "nonsense"})
+		require.Equal(t, []string{"page_token"}, fieldViolations(t, err))
+	})
+
+	t.Run("author", func(t *testing.T) {
+		_, err := s.CreateAuthor(ctx, &librarypb.CreateAuthorRequest{
+			Author: &librarypb.Author{FirstName: "george"}})
+		require.Equal(t, []string{"author.last_name"}, fieldViolations(t, err))
+	})
+
+	t.Run("publisher", func(t *testing.T) {
+		_, err := s.CreatePublisher(ctx, &librarypb.CreatePublisherRequest{
+			Publisher: &librarypb.Publisher{DisplayName: "penguin", Country: "denmark"}})
+		require.Equal(t, []string{"publisher.country"}, fieldViolations(t, err))
+	})
+}
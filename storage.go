@@ -1,123 +1,2879 @@
 package library
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
-
-	// sqlite database library
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 )
 
+// timeFormat is the layout used to store timestamps. It has a fixed width so
+// that stored timestamps sort in chronological order.
+const timeFormat = "2006-01-02 15:04:05.000000000-07:00"
+
+// dateLayout is the layout of the dates on the format YYYY-MM-DD, such as the
+// due dates of the loans.
+const dateLayout = "2006-01-02"
+
+// CatalogueStore stores the books of the catalogue.
+type CatalogueStore interface {
+	// InsertIntoDatabase stores a new book. It returns ErrAlreadyExists if a
+	// book with the same isbn is already stored, and an error matching
+	// ErrNotFound if its publisher or any of its authors did not exist.
+	InsertIntoDatabase(ctx context.Context, b Book) error
+	// FindSpecificBook returns the book with the isbn, the names of its
+	// publisher and authors and its copy counts, or ErrNotFound if it did not
+	// exist.
+	FindSpecificBook(ctx context.Context, isbn string) (Book, error)
+	// FindBooks returns the books with the given isbns keyed by their isbn.
+	// Books which do not exist are left out.
+	FindBooks(ctx context.Context, isbns []string) (map[string]Book, error)
+	// ListBooks returns one page of the books matching the query, the
+	// ordering values of the last book when more books follow, and the total
+	// number of books matching the filter.
+	ListBooks(ctx context.Context, q listQuery) ([]Book, []string, int, error)
+	// SearchBooks returns one page of the books matching the search query,
+	// the most relevant first, the rank and isbn of the last result when more
+	// results follow, and the total number of matching books.
+	SearchBooks(ctx context.Context, q searchQuery) ([]SearchResult, []string, int, error)
+	// UpdateBookInDB writes the given field paths and the update time of the
+	// book. It returns ErrNotFound if the book did not exist.
+	UpdateBookInDB(ctx context.Context, b Book, paths []string) error
+	// SoftDeleteBook marks a book as deleted until the expire time. It returns
+	// ErrNotFound if the book did not exist, ErrConflict if it was already
+	// deleted and an error matching ErrInUse if any of its copies is on loan.
+	SoftDeleteBook(ctx context.Context, isbn string, deleteTime,
+		expireTime time.Time) error
+	// UndeleteBookInDB restores a deleted book which has not yet been purged.
+	// It returns ErrNotFound if the book did not exist and ErrConflict if it
+	// was not deleted.
+	UndeleteBookInDB(ctx context.Context, isbn string) error
+	// ListExpiredBooks returns the deleted books whose expire time is before
+	// now, ordered by isbn.
+	ListExpiredBooks(ctx context.Context, now time.Time) ([]Book, error)
+	// PurgeExpiredBooks permanently removes the deleted books whose expire
+	// time is before now, their copies and their revisions, and returns the
+	// number of purged books.
+	PurgeExpiredBooks(ctx context.Context, now time.Time) (int64, error)
+}
+
+// RevisionStore reads the revisions and the changes of the books.
+type RevisionStore interface {
+	// ListBookRevisions returns one page of the revisions of the book, the
+	// latest first, starting after the given ordering values, and the
+	// ordering values of the last revision when more revisions follow. Every
+	// method writing a book stores the written book as a new revision.
+	ListBookRevisions(ctx context.Context, isbn string, pageSize int,
+		after []string) ([]Book, []string, error)
+	// GetBookRevision returns the revision of the book, or an error matching
+	// ErrNotFound if it did not exist.
+	GetBookRevision(ctx context.Context, isbn, revisionID string) (Book, error)
+	// ListBookChanges returns up to limit of the book changes after the seq,
+	// in the order they were made. Every method storing a revision of a book
+	// appends a change, and the changes are kept when the book is purged.
+	ListBookChanges(ctx context.Context, afterSeq int64, limit int) ([]BookChange, error)
+	// LastBookChange returns the seq of the latest book change, or 0 if no
+	// book has been changed.
+	LastBookChange(ctx context.Context) (int64, error)
+}
+
+// AuthorStore stores the authors.
+type AuthorStore interface {
+	// CreateAuthor stores a new author.
+	CreateAuthor(ctx context.Context, a Author) error
+	// GetAuthor returns the author with the id, or an error matching
+	// ErrNotFound if it did not exist.
+	GetAuthor(ctx context.Context, id string) (Author, error)
+	// ListAuthors returns one page of the authors ordered by last name, first
+	// name and id, starting after the given ordering values, and the
+	// ordering values of the last author when more authors follow.
+	ListAuthors(ctx context.Context, pageSize int, after []string) ([]Author, []string, error)
+	// UpdateAuthor writes the names and the update time of the author.
+	UpdateAuthor(ctx context.Context, a Author) error
+	// DeleteAuthor removes the author. It returns an error matching ErrInUse
+	// if any book credits the author.
+	DeleteAuthor(ctx context.Context, id string) error
+}
+
+// PublisherStore stores the publishers.
+type PublisherStore interface {
+	// CreatePublisher stores a new publisher.
+	CreatePublisher(ctx context.Context, p Publisher) error
+	// GetPublisher returns the publisher with the id, or an error matching
+	// ErrNotFound if it did not exist.
+	GetPublisher(ctx context.Context, id string) (Publisher, error)
+	// ListPublishers returns one page of the publishers ordered by display
+	// name and id, starting after the given ordering values, and the ordering
+	// values of the last publisher when more publishers follow.
+	ListPublishers(ctx context.Context, pageSize int, after []string) ([]Publisher, []string, error)
+	// UpdatePublisher writes the fields and the update time of the publisher.
+	UpdatePublisher(ctx context.Context, p Publisher) error
+	// DeletePublisher removes the publisher. It returns an error matching
+	// ErrInUse if any book refers to the publisher, unless force is set in
+	// which case the publisher of those books is cleared.
+	DeletePublisher(ctx context.Context, id string, force bool) error
+}
+
+// CopyStore stores the copies of the books.
+type CopyStore interface {
+	// CreateCopy stores a new copy. It returns ErrNotFound if the book did not
+	// exist and an error matching ErrAlreadyExists if another copy has the
+	// same barcode.
+	CreateCopy(ctx context.Context, c Copy) error
+	// GetCopy returns the copy of the book with the isbn, or an error matching
+	// ErrNotFound if it did not exist.
+	GetCopy(ctx context.Context, isbn, id string) (Copy, error)
+	// ListCopies returns one page of the copies of the book ordered by barcode
+	// and id, starting after the given ordering values, and the ordering
+	// values of the last copy when more copies follow.
+	ListCopies(ctx context.Context, isbn string, pageSize int, after []string) ([]Copy, []string, error)
+	// UpdateCopy writes the fields and the update time of the copy. It
+	// returns an error matching ErrAlreadyExists if another copy has the same
+	// barcode.
+	UpdateCopy(ctx context.Context, c Copy) error
+	// DeleteCopy removes the copy. It returns an error matching ErrInUse if
+	// the copy is on loan, on hold or in transit.
+	DeleteCopy(ctx context.Context, isbn, id string) error
+}
+
+// MemberStore stores the members.
+type MemberStore interface {
+	// CreateMember stores a new member. It returns an error matching
+	// ErrAlreadyExists if another member has the same card number.
+	CreateMember(ctx context.Context, m Member) error
+	// GetMember returns the member with the id, or an error matching
+	// ErrNotFound if it did not exist.
+	GetMember(ctx context.Context, id string) (Member, error)
+	// ListMembers returns one page of the members ordered by last name, first
+	// name and id, starting after the given ordering values, and the
+	// ordering values of the last member when more members follow.
+	ListMembers(ctx context.Context, pageSize int, after []string) ([]Member, []string, error)
+	// UpdateMember writes the fields and the update time of the member. It
+	// returns an error matching ErrAlreadyExists if another member has the
+	// same card number.
+	UpdateMember(ctx context.Context, m Member) error
+	// DeleteMember removes the member. It returns an error matching ErrInUse
+	// if the member has copies on loan or a balance.
+	DeleteMember(ctx context.Context, id string) error
+}
+
+// LoanStore stores the loans of the copies.
+type LoanStore interface {
+	// CreateLoan stores a new loan and marks its copy as on loan in the same
+	// transaction. It returns an error matching ErrNotFound if the copy did
+	// not exist and ErrInUse if the copy was not available.
+	CreateLoan(ctx context.Context, l Loan) error
+	// GetLoan returns the loan with the id, or an error matching ErrNotFound
+	// if it did not exist.
+	GetLoan(ctx context.Context, id string) (Loan, error)
+	// GetActiveLoan returns the loan of the copy which has not been returned,
+	// or an error matching ErrNotFound if the copy is not on loan.
+	GetActiveLoan(ctx context.Context, isbn, copyID string) (Loan, error)
+	// CountActiveLoans returns the number of loans of the member which have
+	// not been returned.
+	CountActiveLoans(ctx context.Context, memberID string) (int, error)
+	// ListLoans returns one page of the loans ordered by checkout time and id,
+	// starting after the given ordering values, and the ordering values of the
+	// last loan when more loans follow. Only the loans of the member are
+	// listed if memberID is set, and the returned loans only if showReturned
+	// is set.
+	ListLoans(ctx context.Context, memberID string, showReturned bool,
+		pageSize int, after []string) ([]Loan, []string, error)
+	// RenewLoan writes the due date and the renewals of an active loan. It
+	// returns an error matching ErrConflict if the loan has been returned.
+	RenewLoan(ctx context.Context, l Loan) error
+	// ReturnLoan writes the return time of an active loan and marks its copy
+	// as available, or as lost if the loan is lost, in the same transaction.
+	// It returns an error matching ErrConflict if the loan has already been
+	// returned.
+	ReturnLoan(ctx context.Context, l Loan) error
+}
+
+// HoldStore stores the holds on the books.
+type HoldStore interface {
+	// CreateHold stores a new hold. It returns an error matching
+	// ErrAlreadyExists if the member already has a waiting or ready hold on
+	// the book.
+	CreateHold(ctx context.Context, h Hold) error
+	// GetHold returns the hold on the book with the isbn, or an error
+	// matching ErrNotFound if it did not exist.
+	GetHold(ctx context.Context, isbn, id string) (Hold, error)
+	// ListHolds returns one page of the holds on the book ordered by place
+	// time and id, starting after the given ordering values, and the ordering
+	// values of the last hold when more holds follow. The closed holds are
+	// only listed if showClosed is set.
+	ListHolds(ctx context.Context, isbn string, showClosed bool, pageSize int,
+		after []string) ([]Hold, []string, error)
+	// NextWaitingHold returns the waiting hold on the book which was placed
+	// first and has no copy sent to it, or an error matching ErrNotFound if
+	// no such hold is waiting.
+	NextWaitingHold(ctx context.Context, isbn string) (Hold, error)
+	// GetHoldOfCopy returns the ready hold the copy is held for, or the
+	// waiting hold the copy is sent for, or an error matching ErrNotFound if
+	// there is no such hold.
+	GetHoldOfCopy(ctx context.Context, isbn, copyID string) (Hold, error)
+	// ListExpiredHolds returns the ready holds whose pickup expire time is
+	// before now.
+	ListExpiredHolds(ctx context.Context, now time.Time) ([]Hold, error)
+	// UpdateHold writes the state, the held copy, the pickup expire time and
+	// the update time of the hold.
+	UpdateHold(ctx context.Context, h Hold) error
+}
+
+// LedgerStore stores the ledgers of the members.
+type LedgerStore interface {
+	// AppendLedgerEntry stores a new entry in the ledger of a member. The
+	// entries are never changed or removed.
+	AppendLedgerEntry(ctx context.Context, e LedgerEntry) error
+	// ListLedgerEntries returns one page of the ledger entries of the member
+	// ordered by create time and id, starting after the given ordering
+	// values, and the ordering values of the last entry when more entries
+	// follow.
+	ListLedgerEntries(ctx context.Context, memberID string, pageSize int,
+		after []string) ([]LedgerEntry, []string, error)
+	// LedgerTotals returns the sums of the amounts of the ledger entries of
+	// the member by their type.
+	LedgerTotals(ctx context.Context, memberID string) (ledgerTotals, error)
+}
+
+// BranchStore stores the branches.
+type BranchStore interface {
+	// CreateBranch stores a new branch. It returns an error matching
+	// ErrAlreadyExists if a branch with the same id is already stored.
+	CreateBranch(ctx context.Context, b Branch) error
+	// GetBranch returns the branch with the id, or an error matching
+	// ErrNotFound if it did not exist.
+	GetBranch(ctx context.Context, id string) (Branch, error)
+	// ListBranches returns one page of the branches ordered by id, starting
+	// after the given ordering values, and the ordering values of the last
+	// branch when more branches follow.
+	ListBranches(ctx context.Context, pageSize int, after []string) ([]Branch, []string, error)
+	// UpdateBranch writes the fields and the update time of the branch.
+	UpdateBranch(ctx context.Context, b Branch) error
+	// DeleteBranch removes the branch and its calendar. It returns an error
+	// matching ErrInUse if any copy belongs to the branch or is sent to it.
+	DeleteBranch(ctx context.Context, id string) error
+}
+
+// CalendarStore stores the opening hours and the closures of the branches.
+type CalendarStore interface {
+	// GetOpeningHours returns the opening hours of the branch, without
+	// periods if none have been set.
+	GetOpeningHours(ctx context.Context, branch string) (OpeningHours, error)
+	// SetOpeningHours replaces the opening periods of the branch.
+	SetOpeningHours(ctx context.Context, h OpeningHours) error
+	// CreateClosure stores a new closure of a branch.
+	CreateClosure(ctx context.Context, c Closure) error
+	// GetClosure returns the closure of the branch, or an error matching
+	// ErrNotFound if it did not exist.
+	GetClosure(ctx context.Context, branch, id string) (Closure, error)
+	// ListClosures returns one page of the closures of the branch ordered by
+	// start date and id, starting after the given ordering values, and the
+	// ordering values of the last closure when more closures follow.
+	ListClosures(ctx context.Context, branch string, pageSize int,
+		after []string) ([]Closure, []string, error)
+	// ListClosuresBetween returns the closures of the branch ordered by start
+	// date which include a day from the from date to the to date.
+	ListClosuresBetween(ctx context.Context, branch, from, to string) ([]Closure, error)
+	// UpdateClosure writes the fields and the update time of the closure. It
+	// returns an error matching ErrNotFound if the closure did not exist.
+	UpdateClosure(ctx context.Context, c Closure) error
+	// DeleteClosure removes the closure of the branch. It returns an error
+	// matching ErrNotFound if the closure did not exist.
+	DeleteClosure(ctx context.Context, branch, id string) error
+}
+
+// APIKeyStore stores the API keys.
+type APIKeyStore interface {
+	// CreateAPIKey stores a new API key.
+	CreateAPIKey(ctx context.Context, k APIKey) error
+	// GetAPIKeyByHash returns the API key with the key hash, or an error
+	// matching ErrNotFound if it did not exist.
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error)
+	// ListAPIKeys returns all the API keys ordered by create time and id.
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// DeleteAPIKey removes the API key. It returns an error matching
+	// ErrNotFound if the API key did not exist.
+	DeleteAPIKey(ctx context.Context, id string) error
+}
+
+// RoleBindingStore stores the role bindings of the principals.
+type RoleBindingStore interface {
+	// SetRoleBinding stores the role binding, replacing the role binding of
+	// the principal if it has one.
+	SetRoleBinding(ctx context.Context, b RoleBinding) error
+	// GetRoleBinding returns the role binding of the principal, or an error
+	// matching ErrNotFound if it has none.
+	GetRoleBinding(ctx context.Context, principal string) (RoleBinding, error)
+	// ListRoleBindings returns one page of the role bindings ordered by
+	// principal, starting after the given ordering values, and the ordering
+	// values of the last role binding when more role bindings follow.
+	ListRoleBindings(ctx context.Context, pageSize int,
+		after []string) ([]RoleBinding, []string, error)
+	// DeleteRoleBinding removes the role binding of the principal. It returns
+	// an error matching ErrNotFound if the principal had none.
+	DeleteRoleBinding(ctx context.Context, principal string) error
+}
+
+// AuditStore stores the audit log.
+type AuditStore interface {
+	// AppendAuditEvent stores a new audit event. The events are never changed
+	// or removed.
+	AppendAuditEvent(ctx context.Context, e AuditEvent) error
+	// ListAuditEvents returns one page of the audit events selected by the
+	// query ordered by event time and id, and the ordering values of the last
+	// event when more events follow.
+	ListAuditEvents(ctx context.Context, q auditQuery) ([]AuditEvent, []string, error)
+}
+
+// BookStore is the storage of the books used by the server. The methods
+// return ErrNotFound, ErrAlreadyExists, ErrConflict or ErrInUse when the
+// resources are not in the expected state, and stop when the context is done.
+//
+// The handlers and the helpers which use only some of the resources depend
+// on the store interfaces of those resources.
+type BookStore interface {
+	CatalogueStore
+	RevisionStore
+	AuthorStore
+	PublisherStore
+	CopyStore
+	MemberStore
+	LoanStore
+	HoldStore
+	LedgerStore
+	BranchStore
+	CalendarStore
+	APIKeyStore
+	RoleBindingStore
+	AuditStore
+	// RunInTransaction calls fn with a store whose changes are only kept if fn
+	// returns nil. Calls within a transaction join the transaction.
+	RunInTransaction(ctx context.Context, fn func(tx BookStore) error) error
+}
+
+// checks if we have implementat all the different functions
+var _ BookStore = new(DBStorage)
+
+// DBStorage stores the books in the library, authors, book_authors,
+// publishers and copies tables of an sql database and their revisions in the
+// book_revisions table, the members in the members table, their loans and
+// holds in the loans and holds tables, their fines and payments in the
+// ledger_entries table, the branches and their calendars in the branches,
+// opening_periods and closures tables, the API keys in the api_keys table,
+// the roles of the principals in the role_bindings table and the audit log in
+// the audit_events table.
 type DBStorage struct {
 	db  *sql.DB
+	tx  *sql.Tx // set while running in a transaction
 	log *zap.SugaredLogger
 }
 
-// DatabaseQuery Prepers a database query and executes the query on the
-// database. It takes as input a query string and gives as output the rows
-func (storage *DBStorage) InsertIntoDatabase(b Book) error {
-	stmtL, errL := storage.db.Prepare("INSERT INTO library (isbn,title ,createTime,updateTime, publisher) VALUES(?,?,?,?,?)")
-	stmtA, errA := storage.db.Prepare("INSERT INTO author(isbn,firstName, lastName) VALUES(?,?,?)")
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NewDBStorage creates a DBStorage using the database connection.
+func NewDBStorage(db *sql.DB, log *zap.SugaredLogger) *DBStorage {
+	return &DBStorage{db: db, log: log}
+}
+
+// conn returns the transaction if one is running and the database otherwise.
+func (storage *DBStorage) conn() queryer {
+	if storage.tx != nil {
+		return storage.tx
+	}
+	return storage.db
+}
+
+// RunInTransaction runs fn in a database transaction which is committed if fn
+// returns nil and rolled back otherwise.
+func (storage *DBStorage) RunInTransaction(ctx context.Context,
+	fn func(tx BookStore) error) error {
+	if storage.tx != nil {
+		return fn(storage)
+	}
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.handleErr("failed to begin transaction", err)
+	}
+	defer func() { _ = tx.Rollback() }()
 
-	if errL != nil || errA != nil {
-		err := errors.New(errL.Error())
-		err = fmt.Errorf("%w, %s", err, errA.Error())
-		storage.handleErr("Failed to prepare statement", err)
+	if err := fn(&DBStorage{db: storage.db, tx: tx, log: storage.log}); err != nil {
 		return err
 	}
-	_, errA = stmtA.Exec(b.ISBN, b.Author.FirstName, b.Author.LastName)
-	_, errL = stmtL.Exec(b.ISBN, b.Title, b.CreateTime, b.UpdateTime, b.Publisher)
+	if err := tx.Commit(); err != nil {
+		return storage.handleErr("failed to commit transaction", err)
+	}
+	return nil
+}
 
-	if errL != nil || errA != nil {
-		err := errors.New(errL.Error())
-		err = fmt.Errorf("%w, %s", err, errA.Error())
-		storage.handleErr("Failed to insert into database", err)
+// atomically runs fn so that either all or none of its statements are
+// applied. Within a transaction a savepoint is used, so that a failing
+// statement does not abort the whole transaction.
+func (storage *DBStorage) atomically(ctx context.Context,
+	fn func(q queryer) error) error {
+	if storage.tx == nil {
+		return storage.RunInTransaction(ctx, func(tx BookStore) error {
+			return fn(tx.(*DBStorage).tx)
+		})
+	}
+	if _, err := storage.tx.ExecContext(ctx, "SAVEPOINT atomically"); err != nil {
+		return storage.handleErr("failed to create savepoint", err)
+	}
+	if err := fn(storage.tx); err != nil {
+		if _, rollbackErr := storage.tx.ExecContext(ctx,
+			"ROLLBACK TO atomically"); rollbackErr != nil {
+			return storage.handleErr("failed to roll back savepoint", rollbackErr)
+		}
+		_, _ = storage.tx.ExecContext(ctx, "RELEASE atomically")
 		return err
 	}
+	if _, err := storage.tx.ExecContext(ctx, "RELEASE atomically"); err != nil {
+		return storage.handleErr("failed to release savepoint", err)
+	}
+	return nil
+}
+
+// InsertIntoDatabase stores a new book in the library and book_authors tables.
+// It returns ErrAlreadyExists if a book with the same isbn is already stored.
+func (storage *DBStorage) InsertIntoDatabase(ctx context.Context, b Book) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var exists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM library WHERE isbn = ?);",
+			b.ISBN).Scan(&exists)
+		if err != nil {
+			return storage.handleErr("failed to read book", err)
+		}
+		if exists {
+			return ErrAlreadyExists
+		}
+
+		if err := storage.checkPublisher(ctx, q, b.Publisher); err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, "INSERT INTO library (isbn,title ,createTime,updateTime, publisherId) VALUES(?,?,?,?,?)",
+			b.ISBN, b.Title, formatTime(b.CreateTime), formatTime(b.UpdateTime), b.Publisher)
+		if err != nil {
+			return storage.handleErr("failed to insert into library", err)
+		}
+		if err := storage.insertBookAuthors(ctx, q, b); err != nil {
+			return err
+		}
+		return storage.recordRevision(ctx, q, b.ISBN, changeCreated)
+	})
+}
+
+// checkPublisher returns an error matching ErrNotFound if the publisher of a
+// book did not exist.
+func (storage *DBStorage) checkPublisher(ctx context.Context, q queryer,
+	id string) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM publishers WHERE id = ?);",
+		id).Scan(&exists)
+	if err != nil {
+		return storage.handleErr("failed to read publisher", err)
+	}
+	if !exists {
+		return unknownPublisherError(id)
+	}
+	return nil
+}
 
+// insertBookAuthors stores the authors of the book in the given order. It
+// returns an error matching ErrNotFound if any of the authors did not exist.
+func (storage *DBStorage) insertBookAuthors(ctx context.Context, q queryer,
+	b Book) error {
+	for i, a := range b.Authors {
+		var exists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM authors WHERE id = ?);",
+			a.AuthorID).Scan(&exists)
+		if err != nil {
+			return storage.handleErr("failed to read author", err)
+		}
+		if !exists {
+			return unknownAuthorError(a.AuthorID)
+		}
+		_, err = q.ExecContext(ctx, "INSERT INTO book_authors (isbn, authorId, role, position)"+
+			" VALUES(?,?,?,?);", b.ISBN, a.AuthorID, a.Role, i)
+		if err != nil {
+			return storage.handleErr("failed to insert into book_authors", err)
+		}
+	}
 	return nil
 }
 
-// ReadDatabase reads the information that we get from the database.
-func (storage *DBStorage) ReadDatabaseList() []Book {
-	rows, err := storage.db.Query("SELECT library.isbn, library.title, library.createTime,library.updateTime,author.firstName, author.lastName ,library.publisher FROM library INNER JOIN author ON library.isbn = author.isbn;")
-	var b []Book
+// readBookAuthors fills in the authors of the books.
+func (storage *DBStorage) readBookAuthors(ctx context.Context, books []Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+	index := map[string]int{}
+	args := make([]interface{}, len(books))
+	for i, b := range books {
+		index[b.ISBN] = i
+		args[i] = b.ISBN
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(books)), ",")
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT book_authors.isbn,"+
+		" book_authors.authorId, book_authors.role, authors.firstName, authors.lastName"+
+		" FROM book_authors INNER JOIN authors ON authors.id = book_authors.authorId"+
+		" WHERE book_authors.isbn IN ("+placeholders+")"+
+		" ORDER BY book_authors.isbn, book_authors.position;", args...)
 	if err != nil {
-		storage.handleErr("Failed to QUERY the statement to the database", err)
-		return b
+		return storage.handleErr("failed to read book authors", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var isbn string
+		var a BookAuthor
+		if err := rows.Scan(&isbn, &a.AuthorID, &a.Role, &a.FirstName,
+			&a.LastName); err != nil {
+			return storage.handleErr("failed to read book authors", err)
+		}
+		books[index[isbn]].Authors = append(books[index[isbn]].Authors, a)
 	}
-	return storage.ReadRows(rows, b)
+	if err := rows.Err(); err != nil {
+		return storage.handleErr("failed to read book authors", err)
+	}
+	return nil
 }
 
-// Reads from the database and find a specific book that exists.
-func (storage *DBStorage) FindSpecificBook(isbnToFind string) Book {
-	rows, err := storage.db.Query(fmt.Sprintf("SELECT library.isbn, library.title,library.createTime,library.updateTime,author.firstName, author.lastName ,library.publisher FROM library INNER JOIN author ON library.isbn = author.isbn WHERE library.isbn=%s;", isbnToFind))
-	var b []Book
+// ListBooks reads one page of the books matching the query from the database.
+// It also returns the ordering values of the last book when more books
+// follow, and the total number of books matching the filter.
+func (storage *DBStorage) ListBooks(ctx context.Context,
+	q listQuery) ([]Book, []string, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	if !q.showDeleted {
+		conditions = append(conditions, "library.deleteTime IS NULL")
+	}
+	if q.availableAt != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM copies"+
+			" WHERE copies.isbn = library.isbn AND copies.branch = ?"+
+			" AND copies.status = ?)")
+		args = append(args, q.availableAt, statusAvailable)
+	}
+	for _, c := range q.filter {
+		conditions = append(conditions,
+			fmt.Sprintf("%s %s ?", c.column.expr, c.operator))
+		args = append(args, c.value)
+	}
+
+	var total int
+	countQuery := "SELECT COUNT(*) FROM library" + whereClause(conditions)
+	if err := storage.conn().QueryRowContext(ctx, countQuery,
+		args...).Scan(&total); err != nil {
+		return nil, nil, 0, storage.handleErr("failed to count books", err)
+	}
+
+	// Keyset pagination: only read the books ordered after the last book of
+	// the previous page, so that inserts do not shift the pages.
+	if q.after != nil {
+		var alternatives []string
+		for i, field := range q.orderBy {
+			var parts []string
+			for j := 0; j < i; j++ {
+				parts = append(parts, q.orderBy[j].column.expr+" = ?")
+				args = append(args, q.after[j])
+			}
+			operator := ">"
+			if field.desc {
+				operator = "<"
+			}
+			parts = append(parts, fmt.Sprintf("%s %s ?", field.column.expr, operator))
+			args = append(args, q.after[i])
+			alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+		}
+		conditions = append(conditions, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	var keys, ordering []string
+	for _, field := range q.orderBy {
+		keys = append(keys, fmt.Sprintf("CAST(%s AS TEXT)", field.column.expr))
+		direction := "ASC"
+		if field.desc {
+			direction = "DESC"
+		}
+		ordering = append(ordering, field.column.expr+" "+direction)
+	}
+
+	query := "SELECT " + bookColumns + ", " + strings.Join(keys, ", ") +
+		" FROM library" + whereClause(conditions) +
+		" ORDER BY " + strings.Join(ordering, ", ") +
+		" LIMIT ?"
+	args = append(args, q.pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, query, args...)
 	if err != nil {
-		storage.handleErr("Failed to QUERY the statement to the database", err)
-		return Book{}
+		return nil, nil, 0, storage.handleErr("failed to list books", err)
+	}
+	defer rows.Close()
+
+	var books []Book
+	var next, last []string
+	for rows.Next() {
+		var row bookRow
+		key := make([]string, len(q.orderBy))
+		dest := row.dest()
+		for i := range key {
+			dest = append(dest, &key[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, 0, storage.handleErr("failed to read books", err)
+		}
+		if len(books) == q.pageSize {
+			next = last // one more book than requested, so a next page exists
+			break
+		}
+		books = append(books, row.book())
+		last = key
 	}
-	res := storage.ReadRows(rows, b)
-	if len(res) != 0 {
-		return res[0]
+	if err := rows.Err(); err != nil {
+		return nil, nil, 0, storage.handleErr("failed to read books", err)
 	}
-	return Book{}
+	rows.Close()
+	if err := storage.readBookAuthors(ctx, books); err != nil {
+		return nil, nil, 0, err
+	}
+	return books, next, total, nil
 }
 
-// ReadRows gets the information from the query and stores it in the Book slice.
-func (storage *DBStorage) ReadRows(rows *sql.Rows, b []Book) []Book {
-	var isbndb string
-	var titledb string
-	var createTimedb time.Time
-	var updateTimedb time.Time
-	var firstNamedb string
-	var lastNamedb string
-	var publisherdb string
+// SearchBooks finds one page of the books matching the query in the full-text
+// index, ordered by their bm25 rank. It also returns the rank and isbn of the
+// last result when more results follow, and the total number of matching
+// books.
+func (storage *DBStorage) SearchBooks(ctx context.Context,
+	q searchQuery) ([]SearchResult, []string, int, error) {
+	expression := q.ftsExpression()
+
+	var total int
+	if err := storage.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM book_search"+
+		" INNER JOIN library ON library.isbn = book_search.isbn"+
+		" WHERE book_search MATCH ? AND library.deleteTime IS NULL;",
+		expression).Scan(&total); err != nil {
+		return nil, nil, 0, storage.handleErr("failed to count search results", err)
+	}
+
+	conditions := []string{"library.deleteTime IS NULL"}
+	args := []interface{}{expression}
+	if q.after != nil {
+		rank, _ := strconv.ParseFloat(q.after[0], 64)
+		conditions = append(conditions,
+			"(search.rank > ? OR (search.rank = ? AND library.isbn > ?))")
+		args = append(args, rank, rank, q.after[1])
+	}
+	args = append(args, q.pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+bookColumns+
+		", search.rank, search.snippet FROM"+
+		" (SELECT isbn, bm25(book_search) AS rank,"+
+		" snippet(book_search, -1, '"+snippetStart+"', '"+snippetEnd+"', '...', 16) AS snippet"+
+		" FROM book_search WHERE book_search MATCH ?) AS search"+
+		" INNER JOIN library ON library.isbn = search.isbn"+
+		whereClause(conditions)+
+		" ORDER BY search.rank, library.isbn LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, 0, storage.handleErr("failed to search books", err)
+	}
+	defer rows.Close()
 
+	var results []SearchResult
+	var next []string
 	for rows.Next() {
-		err := rows.Scan(
-			&isbndb,
-			&titledb,
-			&createTimedb,
-			&updateTimedb,
-			&firstNamedb,
-			&lastNamedb,
-			&publisherdb,
-		)
-		if err != nil {
-			storage.handleErr("Failed to QUERY the statement to the database", err)
-			return []Book{}
+		var row bookRow
+		var r SearchResult
+		if err := rows.Scan(append(row.dest(), &r.Rank, &r.Snippet)...); err != nil {
+			return nil, nil, 0, storage.handleErr("failed to read search results", err)
+		}
+		if len(results) == q.pageSize {
+			last := results[len(results)-1]
+			next = []string{strconv.FormatFloat(last.Rank, 'g', -1, 64), last.Book.ISBN}
+			break
 		}
+		r.Book = row.book()
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, 0, storage.handleErr("failed to read search results", err)
+	}
+	rows.Close()
+
+	books := make([]Book, len(results))
+	for i, r := range results {
+		books[i] = r.Book
+	}
+	if err := storage.readBookAuthors(ctx, books); err != nil {
+		return nil, nil, 0, err
+	}
+	for i := range results {
+		results[i].Book = books[i]
+	}
+	return results, next, total, nil
+}
+
+// whereClause joins the conditions into an SQL WHERE clause.
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// formatTime formats a timestamp the way it is stored in the database.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+// FindSpecificBook reads the book with the isbn from the database. It returns
+// ErrNotFound if the book did not exist.
+func (storage *DBStorage) FindSpecificBook(ctx context.Context,
+	isbnToFind string) (Book, error) {
+	var row bookRow
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+bookColumns+
+		" FROM library WHERE library.isbn = ?;", isbnToFind).Scan(row.dest()...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Book{}, ErrNotFound
+	}
+	if err != nil {
+		return Book{}, storage.handleErr("failed to read book", err)
+	}
+	books := []Book{row.book()}
+	if err := storage.readBookAuthors(ctx, books); err != nil {
+		return Book{}, err
+	}
+	return books[0], nil
+}
+
+// FindBooks reads the books with the given isbns from the database, keyed by
+// their isbn. Books which do not exist are left out.
+func (storage *DBStorage) FindBooks(ctx context.Context,
+	isbns []string) (map[string]Book, error) {
+	books := map[string]Book{}
+	if len(isbns) == 0 {
+		return books, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(isbns)), ",")
+	args := make([]interface{}, len(isbns))
+	for i, isbn := range isbns {
+		args[i] = isbn
+	}
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+bookColumns+
+		" FROM library WHERE library.isbn IN ("+placeholders+");", args...)
+	if err != nil {
+		return nil, storage.handleErr("failed to read books", err)
+	}
+	defer rows.Close()
 
-		b = append(b, Book{ISBN: isbndb, Title: titledb, CreateTime: createTimedb,
-			UpdateTime: updateTimedb, Author: Author{FirstName: firstNamedb,
-				LastName: lastNamedb}, Publisher: publisherdb})
+	var found []Book
+	for rows.Next() {
+		var row bookRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, storage.handleErr("failed to read books", err)
+		}
+		found = append(found, row.book())
 	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.handleErr("failed to read books", err)
+	}
+	rows.Close()
+	if err := storage.readBookAuthors(ctx, found); err != nil {
+		return nil, err
+	}
+	for _, b := range found {
+		books[b.ISBN] = b
+	}
+	return books, nil
+}
+
+// bookColumns are the columns selected for a book, in the order expected by
+// bookRow.dest.
+const bookColumns = "library.isbn, library.title, library.createTime, " +
+	"library.updateTime, COALESCE(library.publisherId, ''), " +
+	"COALESCE((SELECT publishers.displayName FROM publishers" +
+	" WHERE publishers.id = library.publisherId), ''), " +
+	"library.deleteTime, library.expireTime, " +
+	"(SELECT COUNT(*) FROM copies WHERE copies.isbn = library.isbn" +
+	" AND copies.status != '" + statusWithdrawn + "'), " +
+	"(SELECT COUNT(*) FROM copies WHERE copies.isbn = library.isbn" +
+	" AND copies.status = '" + statusAvailable + "'), " +
+	"COALESCE((SELECT revisionId FROM book_revisions" +
+	" WHERE book_revisions.isbn = library.isbn ORDER BY seq DESC LIMIT 1), ''), " +
+	"COALESCE((SELECT revisionCreateTime FROM book_revisions" +
+	" WHERE book_revisions.isbn = library.isbn ORDER BY seq DESC LIMIT 1), '')"
+
+// bookRow holds a book as scanned from the bookColumns of a row.
+type bookRow struct {
+	b          Book
+	deleteTime sql.NullTime
+	expireTime sql.NullTime
+	// the time of the latest revision is selected by a subquery, which
+	// returns it as text
+	revisionCreateTime string
+}
+
+// dest returns the scan destinations of the bookColumns.
+func (r *bookRow) dest() []interface{} {
+	return []interface{}{&r.b.ISBN, &r.b.Title, &r.b.CreateTime,
+		&r.b.UpdateTime, &r.b.Publisher, &r.b.PublisherName, &r.deleteTime,
+		&r.expireTime, &r.b.TotalCopies, &r.b.AvailableCopies, &r.b.RevisionID,
+		&r.revisionCreateTime}
+}
+
+// book returns the scanned book.
+func (r *bookRow) book() Book {
+	b := r.b
+	b.DeleteTime = r.deleteTime.Time
+	b.ExpireTime = r.expireTime.Time
+	// the time was written by formatTime, and is left zero if the book has
+	// no revision
+	b.RevisionCreateTime, _ = time.Parse(timeFormat, r.revisionCreateTime)
 	return b
 }
 
-// Deletes a specific book from the database
-func (storage *DBStorage) DeleteBookFromDB(isbn string) error {
-	for _, table := range []string{"library", "author"} {
-		res, err := storage.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE isbn=%s;",
-			table, isbn))
+// UpdateBookInDB writes the given field paths and the update time of the book
+// to the database. It returns ErrNotFound if the book did not exist.
+func (storage *DBStorage) UpdateBookInDB(ctx context.Context, b Book,
+	paths []string) error {
+	librarySet := []string{"updateTime = ?"}
+	libraryArgs := []interface{}{formatTime(b.UpdateTime)}
+	updatePublisher, updateAuthors := false, false
+
+	for _, path := range paths {
+		switch path {
+		case fieldTitle:
+			librarySet = append(librarySet, "title = ?")
+			libraryArgs = append(libraryArgs, b.Title)
+		case fieldPublisher:
+			librarySet = append(librarySet, "publisherId = ?")
+			libraryArgs = append(libraryArgs, b.Publisher)
+			updatePublisher = true
+		case fieldAuthors:
+			updateAuthors = true
+		}
+	}
+
+	return storage.atomically(ctx, func(q queryer) error {
+		if updatePublisher {
+			if err := storage.checkPublisher(ctx, q, b.Publisher); err != nil {
+				return err
+			}
+		}
+		res, err := q.ExecContext(ctx, "UPDATE library SET "+strings.Join(librarySet, ", ")+
+			" WHERE isbn = ?", append(libraryArgs, b.ISBN)...)
+		if err != nil {
+			return storage.handleErr("failed to update library", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return ErrNotFound
+		}
+		if updateAuthors {
+			_, err = q.ExecContext(ctx, "DELETE FROM book_authors WHERE isbn = ?;", b.ISBN)
+			if err != nil {
+				return storage.handleErr("failed to update book_authors", err)
+			}
+			if err := storage.insertBookAuthors(ctx, q, b); err != nil {
+				return err
+			}
+		}
+		return storage.recordRevision(ctx, q, b.ISBN, changeUpdated)
+	})
+}
+
+// SoftDeleteBook marks a book as deleted. The book is kept in the database
+// until it is purged after the expire time. It returns ErrNotFound if the book
+// did not exist, ErrConflict if it was already deleted and an error matching
+// ErrInUse if any of its copies is on loan or on hold.
+func (storage *DBStorage) SoftDeleteBook(ctx context.Context, isbn string,
+	deleteTime, expireTime time.Time) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var onLoan bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM copies"+
+			" WHERE isbn = ? AND status IN (?, ?));",
+			isbn, statusOnLoan, statusOnHold).Scan(&onLoan)
+		if err != nil {
+			return storage.handleErr("failed to read copies", err)
+		}
+		if onLoan {
+			return errBookHasLoans
+		}
+
+		res, err := q.ExecContext(ctx, "UPDATE library SET deleteTime = ?, expireTime = ?"+
+			" WHERE isbn = ? AND deleteTime IS NULL;",
+			formatTime(deleteTime), formatTime(expireTime), isbn)
+		if err != nil {
+			return storage.handleErr(fmt.Sprintf("failed to delete %s", isbn), err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return storage.missingOrConflict(ctx, q, isbn)
+		}
+		return storage.recordRevision(ctx, q, isbn, changeDeleted)
+	})
+}
+
+// UndeleteBookInDB restores a deleted book which has not yet been purged. It
+// returns ErrNotFound if the book did not exist and ErrConflict if it was not
+// deleted.
+func (storage *DBStorage) UndeleteBookInDB(ctx context.Context, isbn string) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		res, err := q.ExecContext(ctx, "UPDATE library SET deleteTime = NULL, expireTime = NULL"+
+			" WHERE isbn = ? AND deleteTime IS NOT NULL;", isbn)
 		if err != nil {
-			storage.handleErr(fmt.Sprintf("failed to delete %s from database",
-				isbn), err)
+			return storage.handleErr(fmt.Sprintf("failed to undelete %s", isbn), err)
 		}
 		if rows, _ := res.RowsAffected(); rows == 0 {
-			return errors.New("book did not exist in the library database")
+			return storage.missingOrConflict(ctx, q, isbn)
+		}
+		return storage.recordRevision(ctx, q, isbn, changeUpdated)
+	})
+}
+
+// missingOrConflict tells why an update of the book with the isbn changed no
+// rows: ErrNotFound if the book did not exist and ErrConflict otherwise.
+func (storage *DBStorage) missingOrConflict(ctx context.Context, q queryer,
+	isbn string) error {
+	var exists bool
+	err := q.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM library WHERE isbn = ?);", isbn).Scan(&exists)
+	switch {
+	case err != nil:
+		return storage.handleErr("failed to read book", err)
+	case !exists:
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+// ListExpiredBooks reads the deleted books whose expire time is before now
+// from the database, ordered by isbn.
+func (storage *DBStorage) ListExpiredBooks(ctx context.Context,
+	now time.Time) ([]Book, error) {
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+bookColumns+
+		" FROM library WHERE expireTime IS NOT NULL AND expireTime <= ?"+
+		" ORDER BY isbn;", formatTime(now))
+	if err != nil {
+		return nil, storage.handleErr("failed to read expired books", err)
+	}
+	defer rows.Close()
+
+	var expired []Book
+	for rows.Next() {
+		var row bookRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, storage.handleErr("failed to read expired books", err)
+		}
+		expired = append(expired, row.book())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.handleErr("failed to read expired books", err)
+	}
+	rows.Close()
+	if err := storage.readBookAuthors(ctx, expired); err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// PurgeExpiredBooks permanently removes the deleted books whose expire time
+// is before now, their copies and their revisions. It returns the number of
+// purged books.
+func (storage *DBStorage) PurgeExpiredBooks(ctx context.Context,
+	now time.Time) (int64, error) {
+	var purged int64
+	err := storage.atomically(ctx, func(q queryer) error {
+		expired := "SELECT isbn FROM library WHERE expireTime IS NOT NULL AND expireTime <= ?"
+		if _, err := q.ExecContext(ctx, "DELETE FROM book_authors WHERE isbn IN ("+expired+");",
+			formatTime(now)); err != nil {
+			return storage.handleErr("failed to purge book authors", err)
+		}
+		if _, err := q.ExecContext(ctx, "DELETE FROM copies WHERE isbn IN ("+expired+");",
+			formatTime(now)); err != nil {
+			return storage.handleErr("failed to purge copies", err)
+		}
+		if _, err := q.ExecContext(ctx, "DELETE FROM holds WHERE isbn IN ("+expired+");",
+			formatTime(now)); err != nil {
+			return storage.handleErr("failed to purge holds", err)
+		}
+		if _, err := q.ExecContext(ctx, "DELETE FROM book_revisions WHERE isbn IN ("+expired+");",
+			formatTime(now)); err != nil {
+			return storage.handleErr("failed to purge book revisions", err)
+		}
+		res, err := q.ExecContext(ctx, "DELETE FROM library WHERE isbn IN ("+expired+");",
+			formatTime(now))
+		if err != nil {
+			return storage.handleErr("failed to purge books", err)
+		}
+		purged, err = res.RowsAffected()
+		return err
+	})
+	return purged, err
+}
+
+// recordRevision stores the book with the isbn, as written by q, as a new
+// revision in the book_revisions table, and appends the change of the given
+// type which wrote it to the book_changes table.
+func (storage *DBStorage) recordRevision(ctx context.Context, q queryer,
+	isbn, changeType string) error {
+	id, err := newResourceID()
+	if err != nil {
+		return fmt.Errorf("failed to create revision id, %w", err)
+	}
+
+	rows, err := q.QueryContext(ctx, "SELECT authorId, role FROM book_authors"+
+		" WHERE isbn = ? ORDER BY position;", isbn)
+	if err != nil {
+		return storage.handleErr("failed to read book authors", err)
+	}
+	defer rows.Close()
+	authors := []revisionAuthor{}
+	for rows.Next() {
+		var a revisionAuthor
+		if err := rows.Scan(&a.AuthorID, &a.Role); err != nil {
+			return storage.handleErr("failed to read book authors", err)
 		}
+		authors = append(authors, a)
+	}
+	if err := rows.Err(); err != nil {
+		return storage.handleErr("failed to read book authors", err)
+	}
+	rows.Close()
+	authorsJSON, err := json.Marshal(authors)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revision authors, %w", err)
+	}
+
+	now := time.Now()
+
+	_, err = q.ExecContext(ctx, "INSERT INTO book_revisions (isbn, revisionId,"+
+		" revisionCreateTime, title, publisherId, authors, createTime, updateTime,"+
+		" deleteTime, expireTime) SELECT isbn, ?, ?, title, COALESCE(publisherId, ''),"+
+		" ?, createTime, updateTime, deleteTime, expireTime FROM library WHERE isbn = ?;",
+		id, formatTime(now), string(authorsJSON), isbn)
+	if err != nil {
+		return storage.handleErr("failed to insert into book_revisions", err)
+	}
+	_, err = q.ExecContext(ctx, "INSERT INTO book_changes (isbn, changeType,"+
+		" revisionId, changeTime) VALUES(?,?,?,?);",
+		isbn, changeType, id, formatTime(now))
+	if err != nil {
+		return storage.handleErr("failed to insert into book_changes", err)
 	}
 	return nil
 }
 
-// Handles the error printing
-func (storage *DBStorage) handleErr(errMessage string, err error) {
-	storage.log.Infow("starting server", "Error",
-		fmt.Errorf("database Error: %s, %v", errMessage, err.Error()))
+// revisionColumns are the columns selected for a revision, in the order of
+// revisionRow.dest.
+const revisionColumns = "seq, isbn, revisionId, revisionCreateTime, title," +
+	" publisherId, authors, createTime, updateTime, deleteTime, expireTime"
+
+// revisionRow holds a revision as scanned from the revisionColumns of a row.
+type revisionRow struct {
+	seq        int64
+	b          Book
+	authors    string
+	deleteTime sql.NullTime
+	expireTime sql.NullTime
+}
+
+// dest returns the scan destinations of the revisionColumns.
+func (r *revisionRow) dest() []interface{} {
+	return []interface{}{&r.seq, &r.b.ISBN, &r.b.RevisionID,
+		&r.b.RevisionCreateTime, &r.b.Title, &r.b.Publisher, &r.authors,
+		&r.b.CreateTime, &r.b.UpdateTime, &r.deleteTime, &r.expireTime}
+}
+
+// book returns the book as it was in the scanned revision.
+func (r *revisionRow) book() (Book, error) {
+	b := r.b
+	b.DeleteTime = r.deleteTime.Time
+	b.ExpireTime = r.expireTime.Time
+	var authors []revisionAuthor
+	if err := json.Unmarshal([]byte(r.authors), &authors); err != nil {
+		return Book{}, fmt.Errorf("failed to unmarshal revision authors, %w", err)
+	}
+	for _, a := range authors {
+		b.Authors = append(b.Authors, BookAuthor{AuthorID: a.AuthorID, Role: a.Role})
+	}
+	return b, nil
+}
+
+// ListBookRevisions reads one page of the revisions of the book from the
+// database, the latest first.
+func (storage *DBStorage) ListBookRevisions(ctx context.Context, isbn string,
+	pageSize int, after []string) ([]Book, []string, error) {
+	conditions := []string{"isbn = ?"}
+	args := []interface{}{isbn}
+	if after != nil {
+		seq, err := strconv.ParseInt(after[0], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid revision ordering value, %w", err)
+		}
+		conditions = append(conditions, "seq < ?")
+		args = append(args, seq)
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+revisionColumns+
+		" FROM book_revisions"+whereClause(conditions)+" ORDER BY seq DESC LIMIT ?;",
+		args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list book revisions", err)
+	}
+	defer rows.Close()
+
+	var revisions []Book
+	var next []string
+	var last int64
+	for rows.Next() {
+		var row revisionRow
+		if err := rows.Scan(row.dest()...); err != nil {
+			return nil, nil, storage.handleErr("failed to read book revisions", err)
+		}
+		if len(revisions) == pageSize {
+			next = []string{strconv.FormatInt(last, 10)}
+			break
+		}
+		b, err := row.book()
+		if err != nil {
+			return nil, nil, err
+		}
+		revisions = append(revisions, b)
+		last = row.seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read book revisions", err)
+	}
+	return revisions, next, nil
+}
+
+// GetBookRevision reads the revision of the book from the database. It
+// returns an error matching ErrNotFound if the revision did not exist.
+func (storage *DBStorage) GetBookRevision(ctx context.Context, isbn,
+	revisionID string) (Book, error) {
+	var row revisionRow
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+revisionColumns+
+		" FROM book_revisions WHERE isbn = ? AND revisionId = ?;",
+		isbn, revisionID).Scan(row.dest()...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Book{}, errRevisionNotFound
+	}
+	if err != nil {
+		return Book{}, storage.handleErr("failed to read book revision", err)
+	}
+	return row.book()
+}
+
+// ListBookChanges reads up to limit of the book changes after the seq from
+// the database, in the order they were made.
+func (storage *DBStorage) ListBookChanges(ctx context.Context, afterSeq int64,
+	limit int) ([]BookChange, error) {
+	rows, err := storage.conn().QueryContext(ctx, "SELECT seq, isbn, changeType,"+
+		" revisionId, changeTime FROM book_changes WHERE seq > ? ORDER BY seq LIMIT ?;",
+		afterSeq, limit)
+	if err != nil {
+		return nil, storage.handleErr("failed to list book changes", err)
+	}
+	defer rows.Close()
+
+	var changes []BookChange
+	for rows.Next() {
+		var c BookChange
+		if err := rows.Scan(&c.Seq, &c.ISBN, &c.Type, &c.RevisionID,
+			&c.ChangeTime); err != nil {
+			return nil, storage.handleErr("failed to read book changes", err)
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.handleErr("failed to read book changes", err)
+	}
+	return changes, nil
+}
+
+// LastBookChange reads the seq of the latest book change from the database,
+// or 0 if no book has been changed.
+func (storage *DBStorage) LastBookChange(ctx context.Context) (int64, error) {
+	var seq int64
+	err := storage.conn().QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(seq), 0) FROM book_changes;").Scan(&seq)
+	if err != nil {
+		return 0, storage.handleErr("failed to read last book change", err)
+	}
+	return seq, nil
+}
+
+// CreateAuthor stores a new author in the authors table.
+func (storage *DBStorage) CreateAuthor(ctx context.Context, a Author) error {
+	_, err := storage.conn().ExecContext(ctx, "INSERT INTO authors"+
+		" (id, firstName, lastName, createTime, updateTime) VALUES(?,?,?,?,?);",
+		a.ID, a.FirstName, a.LastName, formatTime(a.CreateTime), formatTime(a.UpdateTime))
+	if err != nil {
+		return storage.handleErr("failed to insert into authors", err)
+	}
+	return nil
+}
+
+// authorColumns are the columns selected for an author, in the order of
+// authorDest.
+const authorColumns = "id, firstName, lastName, createTime, updateTime"
+
+// authorDest returns the scan destinations of the authorColumns.
+func authorDest(a *Author) []interface{} {
+	return []interface{}{&a.ID, &a.FirstName, &a.LastName, &a.CreateTime,
+		&a.UpdateTime}
+}
+
+// GetAuthor reads the author with the id from the database.
+func (storage *DBStorage) GetAuthor(ctx context.Context, id string) (Author, error) {
+	var a Author
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+authorColumns+
+		" FROM authors WHERE id = ?;", id).Scan(authorDest(&a)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Author{}, errAuthorNotFound
+	}
+	if err != nil {
+		return Author{}, storage.handleErr("failed to read author", err)
+	}
+	return a, nil
+}
+
+// ListAuthors reads one page of the authors ordered by last name, first name
+// and id from the database.
+func (storage *DBStorage) ListAuthors(ctx context.Context, pageSize int,
+	after []string) ([]Author, []string, error) {
+	var conditions []string
+	var args []interface{}
+	if after != nil {
+		conditions = append(conditions, "(lastName, firstName, id) > (?, ?, ?)")
+		args = append(args, after[0], after[1], after[2])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+authorColumns+
+		" FROM authors"+whereClause(conditions)+
+		" ORDER BY lastName, firstName, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list authors", err)
+	}
+	defer rows.Close()
+
+	var authors []Author
+	var next []string
+	for rows.Next() {
+		var a Author
+		if err := rows.Scan(authorDest(&a)...); err != nil {
+			return nil, nil, storage.handleErr("failed to read authors", err)
+		}
+		if len(authors) == pageSize {
+			next = authorKey(authors[len(authors)-1])
+			break
+		}
+		authors = append(authors, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read authors", err)
+	}
+	return authors, next, nil
+}
+
+// authorKey returns the ordering values of an author.
+func authorKey(a Author) []string {
+	return []string{a.LastName, a.FirstName, a.ID}
+}
+
+// UpdateAuthor writes the names and the update time of the author to the
+// database.
+func (storage *DBStorage) UpdateAuthor(ctx context.Context, a Author) error {
+	res, err := storage.conn().ExecContext(ctx, "UPDATE authors"+
+		" SET firstName = ?, lastName = ?, updateTime = ? WHERE id = ?;",
+		a.FirstName, a.LastName, formatTime(a.UpdateTime), a.ID)
+	if err != nil {
+		return storage.handleErr("failed to update author", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errAuthorNotFound
+	}
+	return nil
+}
+
+// DeleteAuthor removes an author which no book credits from the database.
+func (storage *DBStorage) DeleteAuthor(ctx context.Context, id string) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var inUse bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS"+
+			" (SELECT 1 FROM book_authors WHERE authorId = ?);", id).Scan(&inUse)
+		if err != nil {
+			return storage.handleErr("failed to read book authors", err)
+		}
+		if inUse {
+			return errAuthorInUse
+		}
+		res, err := q.ExecContext(ctx, "DELETE FROM authors WHERE id = ?;", id)
+		if err != nil {
+			return storage.handleErr("failed to delete author", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return errAuthorNotFound
+		}
+		return nil
+	})
+}
+
+// CreatePublisher stores a new publisher in the publishers table.
+func (storage *DBStorage) CreatePublisher(ctx context.Context, p Publisher) error {
+	_, err := storage.conn().ExecContext(ctx, "INSERT INTO publishers"+
+		" (id, displayName, country, website, createTime, updateTime) VALUES(?,?,?,?,?,?);",
+		p.ID, p.DisplayName, p.Country, p.Website, formatTime(p.CreateTime),
+		formatTime(p.UpdateTime))
+	if err != nil {
+		return storage.handleErr("failed to insert into publishers", err)
+	}
+	return nil
+}
+
+// publisherColumns are the columns selected for a publisher, in the order of
+// publisherDest.
+const publisherColumns = "id, displayName, country, website, createTime, updateTime"
+
+// publisherDest returns the scan destinations of the publisherColumns.
+func publisherDest(p *Publisher) []interface{} {
+	return []interface{}{&p.ID, &p.DisplayName, &p.Country, &p.Website,
+		&p.CreateTime, &p.UpdateTime}
+}
+
+// GetPublisher reads the publisher with the id from the database.
+func (storage *DBStorage) GetPublisher(ctx context.Context, id string) (Publisher, error) {
+	var p Publisher
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+publisherColumns+
+		" FROM publishers WHERE id = ?;", id).Scan(publisherDest(&p)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Publisher{}, errPublisherNotFound
+	}
+	if err != nil {
+		return Publisher{}, storage.handleErr("failed to read publisher", err)
+	}
+	return p, nil
+}
+
+// ListPublishers reads one page of the publishers ordered by display name and
+// id from the database.
+func (storage *DBStorage) ListPublishers(ctx context.Context, pageSize int,
+	after []string) ([]Publisher, []string, error) {
+	var conditions []string
+	var args []interface{}
+	if after != nil {
+		conditions = append(conditions, "(displayName, id) > (?, ?)")
+		args = append(args, after[0], after[1])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+publisherColumns+
+		" FROM publishers"+whereClause(conditions)+
+		" ORDER BY displayName, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list publishers", err)
+	}
+	defer rows.Close()
+
+	var publishers []Publisher
+	var next []string
+	for rows.Next() {
+		var p Publisher
+		if err := rows.Scan(publisherDest(&p)...); err != nil {
+			return nil, nil, storage.handleErr("failed to read publishers", err)
+		}
+		if len(publishers) == pageSize {
+			next = publisherKey(publishers[len(publishers)-1])
+			break
+		}
+		publishers = append(publishers, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read publishers", err)
+	}
+	return publishers, next, nil
+}
+
+// publisherKey returns the ordering values of a publisher.
+func publisherKey(p Publisher) []string {
+	return []string{p.DisplayName, p.ID}
+}
+
+// UpdatePublisher writes the fields and the update time of the publisher to
+// the database.
+func (storage *DBStorage) UpdatePublisher(ctx context.Context, p Publisher) error {
+	res, err := storage.conn().ExecContext(ctx, "UPDATE publishers"+
+		" SET displayName = ?, country = ?, website = ?, updateTime = ? WHERE id = ?;",
+		p.DisplayName, p.Country, p.Website, formatTime(p.UpdateTime), p.ID)
+	if err != nil {
+		return storage.handleErr("failed to update publisher", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errPublisherNotFound
+	}
+	return nil
+}
+
+// DeletePublisher removes a publisher from the database. If force is set the
+// publisher of its books is cleared, otherwise a publisher with books is kept.
+func (storage *DBStorage) DeletePublisher(ctx context.Context, id string,
+	force bool) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var exists, inUse bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM publishers WHERE id = ?),"+
+			" EXISTS (SELECT 1 FROM library WHERE publisherId = ?);", id, id).Scan(&exists, &inUse)
+		switch {
+		case err != nil:
+			return storage.handleErr("failed to read publisher", err)
+		case !exists:
+			return errPublisherNotFound
+		case inUse && !force:
+			return errPublisherInUse
+		}
+		isbns, err := storage.publisherBooks(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		if _, err := q.ExecContext(ctx, "UPDATE library SET publisherId = NULL"+
+			" WHERE publisherId = ?;", id); err != nil {
+			return storage.handleErr("failed to clear publisher of books", err)
+		}
+		for _, isbn := range isbns {
+			if err := storage.recordRevision(ctx, q, isbn, changeUpdated); err != nil {
+				return err
+			}
+		}
+		if _, err := q.ExecContext(ctx, "DELETE FROM publishers WHERE id = ?;", id); err != nil {
+			return storage.handleErr("failed to delete publisher", err)
+		}
+		return nil
+	})
+}
+
+// publisherBooks reads the isbns of the books of the publisher.
+func (storage *DBStorage) publisherBooks(ctx context.Context, q queryer,
+	id string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT isbn FROM library WHERE publisherId = ?;", id)
+	if err != nil {
+		return nil, storage.handleErr("failed to read books of publisher", err)
+	}
+	defer rows.Close()
+
+	var isbns []string
+	for rows.Next() {
+		var isbn string
+		if err := rows.Scan(&isbn); err != nil {
+			return nil, storage.handleErr("failed to read books of publisher", err)
+		}
+		isbns = append(isbns, isbn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.handleErr("failed to read books of publisher", err)
+	}
+	return isbns, nil
+}
+
+// CreateCopy stores a new copy of an existing book in the copies table.
+func (storage *DBStorage) CreateCopy(ctx context.Context, c Copy) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var bookExists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM library WHERE isbn = ?);",
+			c.ISBN).Scan(&bookExists)
+		if err != nil {
+			return storage.handleErr("failed to read book", err)
+		}
+		if !bookExists {
+			return ErrNotFound
+		}
+		if err := storage.checkBarcode(ctx, q, c); err != nil {
+			return err
+		}
+
+		_, err = q.ExecContext(ctx, "INSERT INTO copies (id, isbn, barcode,"+
+			" acquisitionDate, priceCents, currencyCode, condition, shelfLocation,"+
+			" status, branch, transferBranch, createTime, updateTime)"+
+			" VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?);",
+			c.ID, c.ISBN, c.Barcode, c.AcquisitionDate, c.PriceCents, c.CurrencyCode,
+			c.Condition, c.ShelfLocation, c.Status, c.Branch, c.TransferBranch,
+			formatTime(c.CreateTime), formatTime(c.UpdateTime))
+		if err != nil {
+			return storage.handleErr("failed to insert into copies", err)
+		}
+		return nil
+	})
+}
+
+// checkBarcode returns an error matching ErrAlreadyExists if another copy has
+// the barcode of the copy.
+func (storage *DBStorage) checkBarcode(ctx context.Context, q queryer,
+	c Copy) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM copies"+
+		" WHERE barcode = ? AND id != ?);", c.Barcode, c.ID).Scan(&exists)
+	if err != nil {
+		return storage.handleErr("failed to read copies", err)
+	}
+	if exists {
+		return errBarcodeExists
+	}
+	return nil
+}
+
+// copyColumns are the columns selected for a copy, in the order of copyDest.
+const copyColumns = "isbn, id, barcode, acquisitionDate, priceCents, currencyCode," +
+	" condition, shelfLocation, status, branch, transferBranch, createTime, updateTime"
+
+// copyDest returns the scan destinations of the copyColumns.
+func copyDest(c *Copy) []interface{} {
+	return []interface{}{&c.ISBN, &c.ID, &c.Barcode, &c.AcquisitionDate,
+		&c.PriceCents, &c.CurrencyCode, &c.Condition, &c.ShelfLocation, &c.Status,
+		&c.Branch, &c.TransferBranch, &c.CreateTime, &c.UpdateTime}
+}
+
+// GetCopy reads the copy of the book with the isbn from the database.
+func (storage *DBStorage) GetCopy(ctx context.Context, isbn, id string) (Copy, error) {
+	var c Copy
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+copyColumns+
+		" FROM copies WHERE isbn = ? AND id = ?;", isbn, id).Scan(copyDest(&c)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Copy{}, errCopyNotFound
+	}
+	if err != nil {
+		return Copy{}, storage.handleErr("failed to read copy", err)
+	}
+	return c, nil
+}
+
+// ListCopies reads one page of the copies of the book ordered by barcode and
+// id from the database.
+func (storage *DBStorage) ListCopies(ctx context.Context, isbn string,
+	pageSize int, after []string) ([]Copy, []string, error) {
+	conditions := []string{"isbn = ?"}
+	args := []interface{}{isbn}
+	if after != nil {
+		conditions = append(conditions, "(barcode, id) > (?, ?)")
+		args = append(args, after[0], after[1])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+copyColumns+
+		" FROM copies"+whereClause(conditions)+
+		" ORDER BY barcode, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list copies", err)
+	}
+	defer rows.Close()
+
+	var copies []Copy
+	var next []string
+	for rows.Next() {
+		var c Copy
+		if err := rows.Scan(copyDest(&c)...); err != nil {
+			return nil, nil, storage.handleErr("failed to read copies", err)
+		}
+		if len(copies) == pageSize {
+			next = copyKey(copies[len(copies)-1])
+			break
+		}
+		copies = append(copies, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read copies", err)
+	}
+	return copies, next, nil
+}
+
+// copyKey returns the ordering values of a copy.
+func copyKey(c Copy) []string {
+	return []string{c.Barcode, c.ID}
+}
+
+// UpdateCopy writes the fields and the update time of the copy to the
+// database.
+func (storage *DBStorage) UpdateCopy(ctx context.Context, c Copy) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		if err := storage.checkBarcode(ctx, q, c); err != nil {
+			return err
+		}
+		res, err := q.ExecContext(ctx, "UPDATE copies SET barcode = ?,"+
+			" acquisitionDate = ?, priceCents = ?, currencyCode = ?, condition = ?,"+
+			" shelfLocation = ?, status = ?, branch = ?, transferBranch = ?,"+
+			" updateTime = ? WHERE isbn = ? AND id = ?;",
+			c.Barcode, c.AcquisitionDate, c.PriceCents, c.CurrencyCode, c.Condition,
+			c.ShelfLocation, c.Status, c.Branch, c.TransferBranch,
+			formatTime(c.UpdateTime), c.ISBN, c.ID)
+		if err != nil {
+			return storage.handleErr("failed to update copy", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return errCopyNotFound
+		}
+		return nil
+	})
+}
+
+// DeleteCopy removes a copy which is neither on loan, on hold nor in transit
+// from the database.
+func (storage *DBStorage) DeleteCopy(ctx context.Context, isbn, id string) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var status string
+		err := q.QueryRowContext(ctx, "SELECT status FROM copies WHERE isbn = ? AND id = ?;",
+			isbn, id).Scan(&status)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return errCopyNotFound
+		case err != nil:
+			return storage.handleErr("failed to read copy", err)
+		case status == statusOnLoan:
+			return errCopyOnLoan
+		case status == statusOnHold:
+			return errCopyOnHold
+		case status == statusInTransit:
+			return errCopyInTransit
+		}
+		if _, err := q.ExecContext(ctx, "DELETE FROM copies WHERE id = ?;", id); err != nil {
+			return storage.handleErr("failed to delete copy", err)
+		}
+		return nil
+	})
+}
+
+// CreateMember stores a new member in the members table.
+func (storage *DBStorage) CreateMember(ctx context.Context, m Member) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		if err := storage.checkCardNumber(ctx, q, m); err != nil {
+			return err
+		}
+		_, err := q.ExecContext(ctx, "INSERT INTO members (id, firstName, lastName,"+
+			" email, phoneNumber, postalAddress, tier, cardNumber, expiryDate, blocked,"+
+			" blockReason, createTime, updateTime) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?);",
+			m.ID, m.FirstName, m.LastName, m.Email, m.PhoneNumber, m.PostalAddress,
+			m.Tier, m.CardNumber, m.ExpiryDate, m.Blocked, m.BlockReason,
+			formatTime(m.CreateTime), formatTime(m.UpdateTime))
+		if err != nil {
+			return storage.handleErr("failed to insert into members", err)
+		}
+		return nil
+	})
+}
+
+// checkCardNumber returns an error matching ErrAlreadyExists if another member
+// has the card number of the member.
+func (storage *DBStorage) checkCardNumber(ctx context.Context, q queryer,
+	m Member) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM members"+
+		" WHERE cardNumber = ? AND id != ?);", m.CardNumber, m.ID).Scan(&exists)
+	if err != nil {
+		return storage.handleErr("failed to read members", err)
+	}
+	if exists {
+		return errCardNumberExists
+	}
+	return nil
+}
+
+// memberColumns are the columns selected for a member, in the order of
+// memberDest.
+const memberColumns = "id, firstName, lastName, email, phoneNumber, postalAddress," +
+	" tier, cardNumber, expiryDate, blocked, blockReason, createTime, updateTime"
+
+// memberDest returns the scan destinations of the memberColumns.
+func memberDest(m *Member) []interface{} {
+	return []interface{}{&m.ID, &m.FirstName, &m.LastName, &m.Email,
+		&m.PhoneNumber, &m.PostalAddress, &m.Tier, &m.CardNumber, &m.ExpiryDate,
+		&m.Blocked, &m.BlockReason, &m.CreateTime, &m.UpdateTime}
+}
+
+// GetMember reads the member with the id from the database.
+func (storage *DBStorage) GetMember(ctx context.Context, id string) (Member, error) {
+	var m Member
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+memberColumns+
+		" FROM members WHERE id = ?;", id).Scan(memberDest(&m)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Member{}, errMemberNotFound
+	}
+	if err != nil {
+		return Member{}, storage.handleErr("failed to read member", err)
+	}
+	return m, nil
+}
+
+// ListMembers reads one page of the members ordered by last name, first name
+// and id from the database.
+func (storage *DBStorage) ListMembers(ctx context.Context, pageSize int,
+	after []string) ([]Member, []string, error) {
+	var conditions []string
+	var args []interface{}
+	if after != nil {
+		conditions = append(conditions, "(lastName, firstName, id) > (?, ?, ?)")
+		args = append(args, after[0], after[1], after[2])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+memberColumns+
+		" FROM members"+whereClause(conditions)+
+		" ORDER BY lastName, firstName, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list members", err)
+	}
+	defer rows.Close()
+
+	var members []Member
+	var next []string
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(memberDest(&m)...); err != nil {
+			return nil, nil, storage.handleErr("failed to read members", err)
+		}
+		if len(members) == pageSize {
+			next = memberKey(members[len(members)-1])
+			break
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read members", err)
+	}
+	return members, next, nil
+}
+
+// memberKey returns the ordering values of a member.
+func memberKey(m Member) []string {
+	return []string{m.LastName, m.FirstName, m.ID}
+}
+
+// UpdateMember writes the fields and the update time of the member to the
+// database.
+func (storage *DBStorage) UpdateMember(ctx context.Context, m Member) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		if err := storage.checkCardNumber(ctx, q, m); err != nil {
+			return err
+		}
+		res, err := q.ExecContext(ctx, "UPDATE members SET firstName = ?, lastName = ?,"+
+			" email = ?, phoneNumber = ?, postalAddress = ?, tier = ?, cardNumber = ?,"+
+			" expiryDate = ?, blocked = ?, blockReason = ?, updateTime = ? WHERE id = ?;",
+			m.FirstName, m.LastName, m.Email, m.PhoneNumber, m.PostalAddress, m.Tier,
+			m.CardNumber, m.ExpiryDate, m.Blocked, m.BlockReason,
+			formatTime(m.UpdateTime), m.ID)
+		if err != nil {
+			return storage.handleErr("failed to update member", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return errMemberNotFound
+		}
+		return nil
+	})
+}
+
+// DeleteMember removes a member without copies on loan or a balance from the
+// database. The ledger entries of the member are kept.
+func (storage *DBStorage) DeleteMember(ctx context.Context, id string) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		active, err := countActiveLoans(ctx, q, id)
+		if err != nil {
+			return storage.handleErr("failed to read loans", err)
+		}
+		if active > 0 {
+			return errMemberHasLoans
+		}
+		totals, err := ledgerTotalsOf(ctx, q, id)
+		if err != nil {
+			return storage.handleErr("failed to read ledger entries", err)
+		}
+		if totals.balance() != 0 {
+			return errMemberHasBalance
+		}
+		res, err := q.ExecContext(ctx, "DELETE FROM members WHERE id = ?;", id)
+		if err != nil {
+			return storage.handleErr("failed to delete member", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return errMemberNotFound
+		}
+		return nil
+	})
+}
+
+// CreateLoan stores a new loan in the loans table and marks its copy as on
+// loan. The status of the copy is only changed if it is available, so a copy
+// is never lent twice.
+func (storage *DBStorage) CreateLoan(ctx context.Context, l Loan) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		res, err := q.ExecContext(ctx, "UPDATE copies SET status = ?, updateTime = ?"+
+			" WHERE isbn = ? AND id = ? AND status = ?;",
+			statusOnLoan, formatTime(l.CheckoutTime), l.ISBN, l.CopyID, statusAvailable)
+		if err != nil {
+			return storage.handleErr("failed to update copy", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			var exists bool
+			err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM copies"+
+				" WHERE isbn = ? AND id = ?);", l.ISBN, l.CopyID).Scan(&exists)
+			switch {
+			case err != nil:
+				return storage.handleErr("failed to read copies", err)
+			case !exists:
+				return errCopyNotFound
+			}
+			return errCopyNotAvailable
+		}
+		_, err = q.ExecContext(ctx, "INSERT INTO loans (id, isbn, copyId, memberId,"+
+			" branch, checkoutTime, dueDate, renewals) VALUES(?,?,?,?,?,?,?,?);",
+			l.ID, l.ISBN, l.CopyID, l.MemberID, l.Branch, formatTime(l.CheckoutTime),
+			l.DueDate, l.Renewals)
+		if err != nil {
+			return storage.handleErr("failed to insert into loans", err)
+		}
+		return nil
+	})
+}
+
+// loanColumns are the columns selected for a loan, in the order of loanRow.
+const loanColumns = "id, isbn, copyId, memberId, branch, checkoutTime, dueDate," +
+	" renewals, returnTime, lost"
+
+// loanRow holds the columns of a loan read from the database.
+type loanRow struct {
+	l          Loan
+	returnTime sql.NullTime
+}
+
+// dest returns the scan destinations of the loanColumns.
+func (r *loanRow) dest() []interface{} {
+	return []interface{}{&r.l.ID, &r.l.ISBN, &r.l.CopyID, &r.l.MemberID, &r.l.Branch,
+		&r.l.CheckoutTime, &r.l.DueDate, &r.l.Renewals, &r.returnTime, &r.l.Lost}
+}
+
+// loan returns the loan of the row.
+func (r *loanRow) loan() Loan {
+	l := r.l
+	l.ReturnTime = r.returnTime.Time
+	return l
+}
+
+// GetLoan reads the loan with the id from the database.
+func (storage *DBStorage) GetLoan(ctx context.Context, id string) (Loan, error) {
+	var r loanRow
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+loanColumns+
+		" FROM loans WHERE id = ?;", id).Scan(r.dest()...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Loan{}, errLoanNotFound
+	}
+	if err != nil {
+		return Loan{}, storage.handleErr("failed to read loan", err)
+	}
+	return r.loan(), nil
+}
+
+// GetActiveLoan reads the loan of the copy which has not been returned from
+// the database.
+func (storage *DBStorage) GetActiveLoan(ctx context.Context, isbn,
+	copyID string) (Loan, error) {
+	var r loanRow
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+loanColumns+
+		" FROM loans WHERE isbn = ? AND copyId = ? AND returnTime IS NULL;",
+		isbn, copyID).Scan(r.dest()...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Loan{}, errCopyNotOnLoan
+	}
+	if err != nil {
+		return Loan{}, storage.handleErr("failed to read loan", err)
+	}
+	return r.loan(), nil
+}
+
+// CountActiveLoans counts the loans of the member which have not been
+// returned.
+func (storage *DBStorage) CountActiveLoans(ctx context.Context,
+	memberID string) (int, error) {
+	count, err := countActiveLoans(ctx, storage.conn(), memberID)
+	if err != nil {
+		return 0, storage.handleErr("failed to count loans", err)
+	}
+	return count, nil
+}
+
+// countActiveLoans counts the loans of the member which have not been
+// returned.
+func countActiveLoans(ctx context.Context, q queryer, memberID string) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM loans"+
+		" WHERE memberId = ? AND returnTime IS NULL;", memberID).Scan(&count)
+	return count, err
+}
+
+// ListLoans reads one page of the loans ordered by checkout time and id from
+// the database.
+func (storage *DBStorage) ListLoans(ctx context.Context, memberID string,
+	showReturned bool, pageSize int, after []string) ([]Loan, []string, error) {
+	var conditions []string
+	var args []interface{}
+	if memberID != "" {
+		conditions = append(conditions, "memberId = ?")
+		args = append(args, memberID)
+	}
+	if !showReturned {
+		conditions = append(conditions, "returnTime IS NULL")
+	}
+	if after != nil {
+		conditions = append(conditions, "(checkoutTime, id) > (?, ?)")
+		args = append(args, after[0], after[1])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+loanColumns+
+		" FROM loans"+whereClause(conditions)+
+		" ORDER BY checkoutTime, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list loans", err)
+	}
+	defer rows.Close()
+
+	var loans []Loan
+	var next []string
+	for rows.Next() {
+		var r loanRow
+		if err := rows.Scan(r.dest()...); err != nil {
+			return nil, nil, storage.handleErr("failed to read loans", err)
+		}
+		if len(loans) == pageSize {
+			next = loanKey(loans[len(loans)-1])
+			break
+		}
+		loans = append(loans, r.loan())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read loans", err)
+	}
+	return loans, next, nil
+}
+
+// loanKey returns the ordering values of a loan.
+func loanKey(l Loan) []string {
+	return []string{formatTime(l.CheckoutTime), l.ID}
+}
+
+// RenewLoan writes the due date and the renewals of an active loan to the
+// database.
+func (storage *DBStorage) RenewLoan(ctx context.Context, l Loan) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		res, err := q.ExecContext(ctx, "UPDATE loans SET dueDate = ?, renewals = ?"+
+			" WHERE id = ? AND returnTime IS NULL;", l.DueDate, l.Renewals, l.ID)
+		if err != nil {
+			return storage.handleErr("failed to update loan", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return storage.missingLoan(ctx, q, l.ID)
+		}
+		return nil
+	})
+}
+
+// ReturnLoan writes the return time of an active loan to the database and
+// marks its copy as available, or as lost if the loan is lost.
+func (storage *DBStorage) ReturnLoan(ctx context.Context, l Loan) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		res, err := q.ExecContext(ctx, "UPDATE loans SET returnTime = ?, lost = ?"+
+			" WHERE id = ? AND returnTime IS NULL;", formatTime(l.ReturnTime), l.Lost, l.ID)
+		if err != nil {
+			return storage.handleErr("failed to update loan", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return storage.missingLoan(ctx, q, l.ID)
+		}
+		status := statusAvailable
+		if l.Lost {
+			status = statusLost
+		}
+		_, err = q.ExecContext(ctx, "UPDATE copies SET status = ?, updateTime = ?"+
+			" WHERE isbn = ? AND id = ?;", status, formatTime(l.ReturnTime), l.ISBN, l.CopyID)
+		if err != nil {
+			return storage.handleErr("failed to update copy", err)
+		}
+		return nil
+	})
+}
+
+// missingLoan returns the error of a loan which could not be updated because
+// it did not exist or has already been returned.
+func (storage *DBStorage) missingLoan(ctx context.Context, q queryer, id string) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM loans WHERE id = ?);",
+		id).Scan(&exists)
+	switch {
+	case err != nil:
+		return storage.handleErr("failed to read loans", err)
+	case !exists:
+		return errLoanNotFound
+	}
+	return errLoanReturned
+}
+
+// CreateHold stores a new hold in the holds table.
+func (storage *DBStorage) CreateHold(ctx context.Context, h Hold) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var exists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM holds"+
+			" WHERE isbn = ? AND memberId = ? AND state IN (?, ?));",
+			h.ISBN, h.MemberID, holdWaiting, holdReady).Scan(&exists)
+		if err != nil {
+			return storage.handleErr("failed to read holds", err)
+		}
+		if exists {
+			return errHoldExists
+		}
+		_, err = q.ExecContext(ctx, "INSERT INTO holds (id, isbn, memberId,"+
+			" pickupBranch, state, copyId, placeTime, pickupExpireTime, updateTime)"+
+			" VALUES(?,?,?,?,?,?,?,?,?);",
+			h.ID, h.ISBN, h.MemberID, h.PickupBranch, h.State, h.CopyID,
+			formatTime(h.PlaceTime), nullTime(h.PickupExpireTime),
+			formatTime(h.UpdateTime))
+		if err != nil {
+			return storage.handleErr("failed to insert into holds", err)
+		}
+		return nil
+	})
+}
+
+// nullTime formats a timestamp the way it is stored in the database, or
+// returns nil for the zero time.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return formatTime(t)
+}
+
+// holdColumns are the columns selected for a hold, in the order of holdRow.
+const holdColumns = "id, isbn, memberId, pickupBranch, state, copyId, placeTime," +
+	" pickupExpireTime, updateTime"
+
+// holdRow holds the columns of a hold read from the database.
+type holdRow struct {
+	h                Hold
+	pickupExpireTime sql.NullTime
+}
+
+// dest returns the scan destinations of the holdColumns.
+func (r *holdRow) dest() []interface{} {
+	return []interface{}{&r.h.ID, &r.h.ISBN, &r.h.MemberID, &r.h.PickupBranch,
+		&r.h.State, &r.h.CopyID, &r.h.PlaceTime, &r.pickupExpireTime, &r.h.UpdateTime}
+}
+
+// hold returns the hold of the row.
+func (r *holdRow) hold() Hold {
+	h := r.h
+	h.PickupExpireTime = r.pickupExpireTime.Time
+	return h
+}
+
+// getHold reads the first hold matching the condition from the database, or
+// returns notFound if no hold matches.
+func (storage *DBStorage) getHold(ctx context.Context, notFound error,
+	condition string, args ...interface{}) (Hold, error) {
+	var r holdRow
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+holdColumns+
+		" FROM holds WHERE "+condition+" ORDER BY placeTime, id LIMIT 1;",
+		args...).Scan(r.dest()...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Hold{}, notFound
+	}
+	if err != nil {
+		return Hold{}, storage.handleErr("failed to read hold", err)
+	}
+	return r.hold(), nil
+}
+
+// GetHold reads the hold on the book with the isbn from the database.
+func (storage *DBStorage) GetHold(ctx context.Context, isbn, id string) (Hold, error) {
+	return storage.getHold(ctx, errHoldNotFound, "isbn = ? AND id = ?", isbn, id)
+}
+
+// NextWaitingHold reads the waiting hold on the book which was placed first
+// and has no copy sent to it from the database.
+func (storage *DBStorage) NextWaitingHold(ctx context.Context, isbn string) (Hold, error) {
+	return storage.getHold(ctx, errNoWaitingHold,
+		"isbn = ? AND state = ? AND copyId = ''", isbn, holdWaiting)
+}
+
+// GetHoldOfCopy reads the ready hold the copy is held for, or the waiting
+// hold the copy is sent for, from the database.
+func (storage *DBStorage) GetHoldOfCopy(ctx context.Context, isbn,
+	copyID string) (Hold, error) {
+	return storage.getHold(ctx, errCopyNotOnHold,
+		"isbn = ? AND copyId = ? AND state IN (?, ?)", isbn, copyID, holdWaiting,
+		holdReady)
+}
+
+// ListHolds reads one page of the holds on the book ordered by place time and
+// id from the database.
+func (storage *DBStorage) ListHolds(ctx context.Context, isbn string,
+	showClosed bool, pageSize int, after []string) ([]Hold, []string, error) {
+	conditions := []string{"isbn = ?"}
+	args := []interface{}{isbn}
+	if !showClosed {
+		conditions = append(conditions, "state IN (?, ?)")
+		args = append(args, holdWaiting, holdReady)
+	}
+	if after != nil {
+		conditions = append(conditions, "(placeTime, id) > (?, ?)")
+		args = append(args, after[0], after[1])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+holdColumns+
+		" FROM holds"+whereClause(conditions)+
+		" ORDER BY placeTime, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list holds", err)
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	var next []string
+	for rows.Next() {
+		var r holdRow
+		if err := rows.Scan(r.dest()...); err != nil {
+			return nil, nil, storage.handleErr("failed to read holds", err)
+		}
+		if len(holds) == pageSize {
+			next = holdKey(holds[len(holds)-1])
+			break
+		}
+		holds = append(holds, r.hold())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read holds", err)
+	}
+	return holds, next, nil
+}
+
+// holdKey returns the ordering values of a hold.
+func holdKey(h Hold) []string {
+	return []string{formatTime(h.PlaceTime), h.ID}
+}
+
+// ListExpiredHolds reads the ready holds whose pickup expire time is before
+// now from the database.
+func (storage *DBStorage) ListExpiredHolds(ctx context.Context,
+	now time.Time) ([]Hold, error) {
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+holdColumns+
+		" FROM holds WHERE state = ? AND pickupExpireTime <= ?"+
+		" ORDER BY placeTime, id;", holdReady, formatTime(now))
+	if err != nil {
+		return nil, storage.handleErr("failed to list holds", err)
+	}
+	defer rows.Close()
+
+	var holds []Hold
+	for rows.Next() {
+		var r holdRow
+		if err := rows.Scan(r.dest()...); err != nil {
+			return nil, storage.handleErr("failed to read holds", err)
+		}
+		holds = append(holds, r.hold())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.handleErr("failed to read holds", err)
+	}
+	return holds, nil
+}
+
+// UpdateHold writes the state, the held copy, the pickup expire time and the
+// update time of the hold to the database.
+func (storage *DBStorage) UpdateHold(ctx context.Context, h Hold) error {
+	res, err := storage.conn().ExecContext(ctx, "UPDATE holds SET state = ?,"+
+		" copyId = ?, pickupExpireTime = ?, updateTime = ? WHERE isbn = ? AND id = ?;",
+		h.State, h.CopyID, nullTime(h.PickupExpireTime), formatTime(h.UpdateTime),
+		h.ISBN, h.ID)
+	if err != nil {
+		return storage.handleErr("failed to update hold", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errHoldNotFound
+	}
+	return nil
+}
+
+// AppendLedgerEntry stores a new entry in the ledger_entries table.
+func (storage *DBStorage) AppendLedgerEntry(ctx context.Context, e LedgerEntry) error {
+	_, err := storage.conn().ExecContext(ctx, "INSERT INTO ledger_entries (id, memberId,"+
+		" type, amountCents, currencyCode, loanId, description, balanceCents, createTime)"+
+		" VALUES(?,?,?,?,?,?,?,?,?);",
+		e.ID, e.MemberID, e.Type, e.AmountCents, e.CurrencyCode, e.LoanID,
+		e.Description, e.BalanceCents, formatTime(e.CreateTime))
+	if err != nil {
+		return storage.handleErr("failed to insert into ledger_entries", err)
+	}
+	return nil
+}
+
+// ledgerEntryColumns are the columns selected for a ledger entry, in the
+// order of ledgerEntryDest.
+const ledgerEntryColumns = "id, memberId, type, amountCents, currencyCode, loanId," +
+	" description, balanceCents, createTime"
+
+// ledgerEntryDest returns the scan destinations of the ledgerEntryColumns.
+func ledgerEntryDest(e *LedgerEntry) []interface{} {
+	return []interface{}{&e.ID, &e.MemberID, &e.Type, &e.AmountCents,
+		&e.CurrencyCode, &e.LoanID, &e.Description, &e.BalanceCents, &e.CreateTime}
+}
+
+// ListLedgerEntries reads one page of the ledger entries of the member ordered
+// by create time and id from the database.
+func (storage *DBStorage) ListLedgerEntries(ctx context.Context, memberID string,
+	pageSize int, after []string) ([]LedgerEntry, []string, error) {
+	conditions := []string{"memberId = ?"}
+	args := []interface{}{memberID}
+	if after != nil {
+		conditions = append(conditions, "(createTime, id) > (?, ?)")
+		args = append(args, after[0], after[1])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+ledgerEntryColumns+
+		" FROM ledger_entries"+whereClause(conditions)+
+		" ORDER BY createTime, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list ledger entries", err)
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	var next []string
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(ledgerEntryDest(&e)...); err != nil {
+			return nil, nil, storage.handleErr("failed to read ledger entries", err)
+		}
+		if len(entries) == pageSize {
+			next = ledgerEntryKey(entries[len(entries)-1])
+			break
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read ledger entries", err)
+	}
+	return entries, next, nil
+}
+
+// ledgerEntryKey returns the ordering values of a ledger entry.
+func ledgerEntryKey(e LedgerEntry) []string {
+	return []string{formatTime(e.CreateTime), e.ID}
+}
+
+// LedgerTotals sums the amounts of the ledger entries of the member by their
+// type.
+func (storage *DBStorage) LedgerTotals(ctx context.Context,
+	memberID string) (ledgerTotals, error) {
+	totals, err := ledgerTotalsOf(ctx, storage.conn(), memberID)
+	if err != nil {
+		return nil, storage.handleErr("failed to read ledger entries", err)
+	}
+	return totals, nil
+}
+
+// ledgerTotalsOf sums the amounts of the ledger entries of the member by their
+// type.
+func ledgerTotalsOf(ctx context.Context, q queryer, memberID string) (ledgerTotals, error) {
+	rows, err := q.QueryContext(ctx, "SELECT type, SUM(amountCents) FROM ledger_entries"+
+		" WHERE memberId = ? GROUP BY type;", memberID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := ledgerTotals{}
+	for rows.Next() {
+		var entryType string
+		var sum int64
+		if err := rows.Scan(&entryType, &sum); err != nil {
+			return nil, err
+		}
+		totals[entryType] = sum
+	}
+	return totals, rows.Err()
+}
+
+// CreateBranch stores a new branch in the branches table.
+func (storage *DBStorage) CreateBranch(ctx context.Context, b Branch) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var exists bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM branches"+
+			" WHERE id = ?);", b.ID).Scan(&exists)
+		if err != nil {
+			return storage.handleErr("failed to read branches", err)
+		}
+		if exists {
+			return errBranchExists
+		}
+		_, err = q.ExecContext(ctx, "INSERT INTO branches (id, displayName, address,"+
+			" createTime, updateTime) VALUES(?,?,?,?,?);",
+			b.ID, b.DisplayName, b.Address, formatTime(b.CreateTime),
+			formatTime(b.UpdateTime))
+		if err != nil {
+			return storage.handleErr("failed to insert into branches", err)
+		}
+		return nil
+	})
+}
+
+// branchColumns are the columns selected for a branch, in the order of
+// branchDest.
+const branchColumns = "id, displayName, address, createTime, updateTime"
+
+// branchDest returns the scan destinations of the branchColumns.
+func branchDest(b *Branch) []interface{} {
+	return []interface{}{&b.ID, &b.DisplayName, &b.Address, &b.CreateTime,
+		&b.UpdateTime}
+}
+
+// GetBranch reads the branch with the id from the database.
+func (storage *DBStorage) GetBranch(ctx context.Context, id string) (Branch, error) {
+	var b Branch
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+branchColumns+
+		" FROM branches WHERE id = ?;", id).Scan(branchDest(&b)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Branch{}, errBranchNotFound
+	}
+	if err != nil {
+		return Branch{}, storage.handleErr("failed to read branch", err)
+	}
+	return b, nil
+}
+
+// ListBranches reads one page of the branches ordered by id from the
+// database.
+func (storage *DBStorage) ListBranches(ctx context.Context, pageSize int,
+	after []string) ([]Branch, []string, error) {
+	var conditions []string
+	var args []interface{}
+	if after != nil {
+		conditions = append(conditions, "id > ?")
+		args = append(args, after[0])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+branchColumns+
+		" FROM branches"+whereClause(conditions)+" ORDER BY id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list branches", err)
+	}
+	defer rows.Close()
+
+	var branches []Branch
+	var next []string
+	for rows.Next() {
+		var b Branch
+		if err := rows.Scan(branchDest(&b)...); err != nil {
+			return nil, nil, storage.handleErr("failed to read branches", err)
+		}
+		if len(branches) == pageSize {
+			next = branchKey(branches[len(branches)-1])
+			break
+		}
+		branches = append(branches, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read branches", err)
+	}
+	return branches, next, nil
+}
+
+// branchKey returns the ordering values of a branch.
+func branchKey(b Branch) []string {
+	return []string{b.ID}
+}
+
+// UpdateBranch writes the fields and the update time of the branch to the
+// database.
+func (storage *DBStorage) UpdateBranch(ctx context.Context, b Branch) error {
+	res, err := storage.conn().ExecContext(ctx, "UPDATE branches SET displayName = ?,"+
+		" address = ?, updateTime = ? WHERE id = ?;",
+		b.DisplayName, b.Address, formatTime(b.UpdateTime), b.ID)
+	if err != nil {
+		return storage.handleErr("failed to update branch", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errBranchNotFound
+	}
+	return nil
+}
+
+// DeleteBranch removes a branch which owns no copies, and its opening periods
+// and closures, from the database.
+func (storage *DBStorage) DeleteBranch(ctx context.Context, id string) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		var inUse bool
+		err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM copies"+
+			" WHERE branch = ? OR transferBranch = ?);", id, id).Scan(&inUse)
+		if err != nil {
+			return storage.handleErr("failed to read copies", err)
+		}
+		if inUse {
+			return errBranchInUse
+		}
+		res, err := q.ExecContext(ctx, "DELETE FROM branches WHERE id = ?;", id)
+		if err != nil {
+			return storage.handleErr("failed to delete branch", err)
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			return errBranchNotFound
+		}
+		for _, table := range []string{"opening_periods", "closures"} {
+			_, err := q.ExecContext(ctx, "DELETE FROM "+table+" WHERE branch = ?;", id)
+			if err != nil {
+				return storage.handleErr("failed to delete from "+table, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetOpeningHours reads the opening periods of the branch from the database.
+func (storage *DBStorage) GetOpeningHours(ctx context.Context,
+	branch string) (OpeningHours, error) {
+	rows, err := storage.conn().QueryContext(ctx, "SELECT day, openTime, closeTime"+
+		" FROM opening_periods WHERE branch = ? ORDER BY day, openTime;", branch)
+	if err != nil {
+		return OpeningHours{}, storage.handleErr("failed to read opening hours", err)
+	}
+	defer rows.Close()
+
+	h := OpeningHours{Branch: branch}
+	for rows.Next() {
+		var p OpeningPeriod
+		if err := rows.Scan(&p.Day, &p.OpenTime, &p.CloseTime); err != nil {
+			return OpeningHours{}, storage.handleErr("failed to read opening hours", err)
+		}
+		h.Periods = append(h.Periods, p)
+	}
+	if err := rows.Err(); err != nil {
+		return OpeningHours{}, storage.handleErr("failed to read opening hours", err)
+	}
+	return h, nil
+}
+
+// SetOpeningHours replaces the opening periods of the branch in the database.
+func (storage *DBStorage) SetOpeningHours(ctx context.Context, h OpeningHours) error {
+	return storage.atomically(ctx, func(q queryer) error {
+		_, err := q.ExecContext(ctx, "DELETE FROM opening_periods WHERE branch = ?;",
+			h.Branch)
+		if err != nil {
+			return storage.handleErr("failed to delete opening hours", err)
+		}
+		for _, p := range h.Periods {
+			_, err := q.ExecContext(ctx, "INSERT INTO opening_periods (branch, day,"+
+				" openTime, closeTime) VALUES(?,?,?,?);",
+				h.Branch, p.Day, p.OpenTime, p.CloseTime)
+			if err != nil {
+				return storage.handleErr("failed to insert into opening_periods", err)
+			}
+		}
+		return nil
+	})
+}
+
+// CreateClosure stores a new closure in the closures table.
+func (storage *DBStorage) CreateClosure(ctx context.Context, c Closure) error {
+	_, err := storage.conn().ExecContext(ctx, "INSERT INTO closures (id, branch, kind,"+
+		" startDate, endDate, reason, createTime, updateTime) VALUES(?,?,?,?,?,?,?,?);",
+		c.ID, c.Branch, c.Kind, c.StartDate, c.EndDate, c.Reason,
+		formatTime(c.CreateTime), formatTime(c.UpdateTime))
+	if err != nil {
+		return storage.handleErr("failed to insert into closures", err)
+	}
+	return nil
+}
+
+// closureColumns are the columns selected for a closure, in the order of
+// closureDest.
+const closureColumns = "branch, id, kind, startDate, endDate, reason, createTime," +
+	" updateTime"
+
+// closureDest returns the scan destinations of the closureColumns.
+func closureDest(c *Closure) []interface{} {
+	return []interface{}{&c.Branch, &c.ID, &c.Kind, &c.StartDate, &c.EndDate,
+		&c.Reason, &c.CreateTime, &c.UpdateTime}
+}
+
+// GetClosure reads the closure of the branch from the database.
+func (storage *DBStorage) GetClosure(ctx context.Context, branch,
+	id string) (Closure, error) {
+	var c Closure
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+closureColumns+
+		" FROM closures WHERE branch = ? AND id = ?;", branch, id).Scan(closureDest(&c)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Closure{}, errClosureNotFound
+	}
+	if err != nil {
+		return Closure{}, storage.handleErr("failed to read closure", err)
+	}
+	return c, nil
+}
+
+// ListClosures reads one page of the closures of the branch ordered by start
+// date and id from the database.
+func (storage *DBStorage) ListClosures(ctx context.Context, branch string,
+	pageSize int, after []string) ([]Closure, []string, error) {
+	conditions := []string{"branch = ?"}
+	args := []interface{}{branch}
+	if after != nil {
+		conditions = append(conditions, "(startDate, id) > (?, ?)")
+		args = append(args, after[0], after[1])
+	}
+	args = append(args, pageSize+1)
+
+	closures, err := storage.queryClosures(ctx, "SELECT "+closureColumns+
+		" FROM closures"+whereClause(conditions)+
+		" ORDER BY startDate, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var next []string
+	if len(closures) > pageSize {
+		closures = closures[:pageSize]
+		next = closureKey(closures[pageSize-1])
+	}
+	return closures, next, nil
+}
+
+// closureKey returns the ordering values of a closure.
+func closureKey(c Closure) []string {
+	return []string{c.StartDate, c.ID}
+}
+
+// ListClosuresBetween reads the closures of the branch which include a day
+// from the from date to the to date from the database.
+func (storage *DBStorage) ListClosuresBetween(ctx context.Context, branch, from,
+	to string) ([]Closure, error) {
+	return storage.queryClosures(ctx, "SELECT "+closureColumns+" FROM closures"+
+		" WHERE branch = ? AND startDate <= ? AND endDate >= ?"+
+		" ORDER BY startDate, id;", branch, to, from)
+}
+
+// queryClosures reads the closures selected by the query.
+func (storage *DBStorage) queryClosures(ctx context.Context, query string,
+	args ...interface{}) ([]Closure, error) {
+	rows, err := storage.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, storage.handleErr("failed to list closures", err)
+	}
+	defer rows.Close()
+
+	var closures []Closure
+	for rows.Next() {
+		var c Closure
+		if err := rows.Scan(closureDest(&c)...); err != nil {
+			return nil, storage.handleErr("failed to read closures", err)
+		}
+		closures = append(closures, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.handleErr("failed to read closures", err)
+	}
+	return closures, nil
+}
+
+// UpdateClosure writes the fields and the update time of the closure to the
+// database.
+func (storage *DBStorage) UpdateClosure(ctx context.Context, c Closure) error {
+	res, err := storage.conn().ExecContext(ctx, "UPDATE closures SET kind = ?,"+
+		" startDate = ?, endDate = ?, reason = ?, updateTime = ?"+
+		" WHERE branch = ? AND id = ?;",
+		c.Kind, c.StartDate, c.EndDate, c.Reason, formatTime(c.UpdateTime), c.Branch, c.ID)
+	if err != nil {
+		return storage.handleErr("failed to update closure", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errClosureNotFound
+	}
+	return nil
+}
+
+// DeleteClosure removes the closure of the branch from the database.
+func (storage *DBStorage) DeleteClosure(ctx context.Context, branch, id string) error {
+	res, err := storage.conn().ExecContext(ctx,
+		"DELETE FROM closures WHERE branch = ? AND id = ?;", branch, id)
+	if err != nil {
+		return storage.handleErr("failed to delete closure", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errClosureNotFound
+	}
+	return nil
+}
+
+// CreateAPIKey stores a new API key in the api_keys table.
+func (storage *DBStorage) CreateAPIKey(ctx context.Context, k APIKey) error {
+	_, err := storage.conn().ExecContext(ctx, "INSERT INTO api_keys (id, displayName,"+
+		" keyHash, createTime) VALUES(?,?,?,?);",
+		k.ID, k.DisplayName, k.KeyHash, formatTime(k.CreateTime))
+	if err != nil {
+		return storage.handleErr("failed to insert into api_keys", err)
+	}
+	return nil
+}
+
+// apiKeyColumns are the columns selected for an API key, in the order of
+// apiKeyDest.
+const apiKeyColumns = "id, displayName, keyHash, createTime"
+
+// apiKeyDest returns the scan destinations of the apiKeyColumns.
+func apiKeyDest(k *APIKey) []interface{} {
+	return []interface{}{&k.ID, &k.DisplayName, &k.KeyHash, &k.CreateTime}
+}
+
+// GetAPIKeyByHash reads the API key with the key hash from the database.
+func (storage *DBStorage) GetAPIKeyByHash(ctx context.Context,
+	keyHash string) (APIKey, error) {
+	var k APIKey
+	err := storage.conn().QueryRowContext(ctx, "SELECT "+apiKeyColumns+
+		" FROM api_keys WHERE keyHash = ?;", keyHash).Scan(apiKeyDest(&k)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, errAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, storage.handleErr("failed to read API key", err)
+	}
+	return k, nil
+}
+
+// ListAPIKeys reads all the API keys ordered by create time and id from the
+// database.
+func (storage *DBStorage) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := storage.conn().QueryContext(ctx, "SELECT "+apiKeyColumns+
+		" FROM api_keys ORDER BY createTime, id;")
+	if err != nil {
+		return nil, storage.handleErr("failed to list API keys", err)
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(apiKeyDest(&k)...); err != nil {
+			return nil, storage.handleErr("failed to read API keys", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storage.handleErr("failed to read API keys", err)
+	}
+	return keys, nil
+}
+
+// apiKeyKey returns the ordering values of an API key.
+func apiKeyKey(k APIKey) []string {
+	return []string{formatTime(k.CreateTime), k.ID}
+}
+
+// DeleteAPIKey removes the API key from the database.
+func (storage *DBStorage) DeleteAPIKey(ctx context.Context, id string) error {
+	res, err := storage.conn().ExecContext(ctx, "DELETE FROM api_keys WHERE id = ?;", id)
+	if err != nil {
+		return storage.handleErr("failed to delete API key", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// SetRoleBinding inserts or replaces the role binding of the principal in the
+// role_bindings table.
+func (storage *DBStorage) SetRoleBinding(ctx context.Context, b RoleBinding) error {
+	_, err := storage.conn().ExecContext(ctx, "INSERT INTO role_bindings (principal,"+
+		" role, updateTime) VALUES(?,?,?) ON CONFLICT (principal) DO UPDATE"+
+		" SET role = excluded.role, updateTime = excluded.updateTime;",
+		b.Principal, b.Role, formatTime(b.UpdateTime))
+	if err != nil {
+		return storage.handleErr("failed to insert into role_bindings", err)
+	}
+	return nil
+}
+
+// GetRoleBinding reads the role binding of the principal from the database.
+func (storage *DBStorage) GetRoleBinding(ctx context.Context,
+	principal string) (RoleBinding, error) {
+	b := RoleBinding{Principal: principal}
+	err := storage.conn().QueryRowContext(ctx, "SELECT role, updateTime"+
+		" FROM role_bindings WHERE principal = ?;", principal).Scan(&b.Role, &b.UpdateTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RoleBinding{}, errRoleBindingNotFound
+	}
+	if err != nil {
+		return RoleBinding{}, storage.handleErr("failed to read role binding", err)
+	}
+	return b, nil
+}
+
+// ListRoleBindings reads one page of the role bindings ordered by principal
+// from the database.
+func (storage *DBStorage) ListRoleBindings(ctx context.Context, pageSize int,
+	after []string) ([]RoleBinding, []string, error) {
+	var conditions []string
+	var args []interface{}
+	if after != nil {
+		conditions = append(conditions, "principal > ?")
+		args = append(args, after[0])
+	}
+	args = append(args, pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT principal, role, updateTime"+
+		" FROM role_bindings"+whereClause(conditions)+" ORDER BY principal LIMIT ?;",
+		args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list role bindings", err)
+	}
+	defer rows.Close()
+
+	var bindings []RoleBinding
+	var next []string
+	for rows.Next() {
+		var b RoleBinding
+		if err := rows.Scan(&b.Principal, &b.Role, &b.UpdateTime); err != nil {
+			return nil, nil, storage.handleErr("failed to read role bindings", err)
+		}
+		if len(bindings) == pageSize {
+			next = roleBindingKey(bindings[len(bindings)-1])
+			break
+		}
+		bindings = append(bindings, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read role bindings", err)
+	}
+	return bindings, next, nil
+}
+
+// roleBindingKey returns the ordering values of a role binding.
+func roleBindingKey(b RoleBinding) []string {
+	return []string{b.Principal}
+}
+
+// DeleteRoleBinding removes the role binding of the principal from the
+// database.
+func (storage *DBStorage) DeleteRoleBinding(ctx context.Context, principal string) error {
+	res, err := storage.conn().ExecContext(ctx,
+		"DELETE FROM role_bindings WHERE principal = ?;", principal)
+	if err != nil {
+		return storage.handleErr("failed to delete role binding", err)
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errRoleBindingNotFound
+	}
+	return nil
+}
+
+// AppendAuditEvent stores a new audit event in the audit_events table.
+func (storage *DBStorage) AppendAuditEvent(ctx context.Context, e AuditEvent) error {
+	_, err := storage.conn().ExecContext(ctx, "INSERT INTO audit_events (id, principal,"+
+		" method, resource, beforeJson, afterJson, eventTime) VALUES(?,?,?,?,?,?,?);",
+		e.ID, e.Principal, e.Method, e.Resource, e.Before, e.After,
+		formatTime(e.EventTime))
+	if err != nil {
+		return storage.handleErr("failed to insert into audit_events", err)
+	}
+	return nil
+}
+
+// ListAuditEvents reads one page of the audit events selected by the query
+// ordered by event time and id from the database.
+func (storage *DBStorage) ListAuditEvents(ctx context.Context,
+	q auditQuery) ([]AuditEvent, []string, error) {
+	var conditions []string
+	var args []interface{}
+	if q.resource != "" {
+		conditions = append(conditions, "resource = ?")
+		args = append(args, q.resource)
+	}
+	if !q.startTime.IsZero() {
+		conditions = append(conditions, "eventTime >= ?")
+		args = append(args, formatTime(q.startTime))
+	}
+	if !q.endTime.IsZero() {
+		conditions = append(conditions, "eventTime < ?")
+		args = append(args, formatTime(q.endTime))
+	}
+	if q.after != nil {
+		conditions = append(conditions, "(eventTime, id) > (?, ?)")
+		args = append(args, q.after[0], q.after[1])
+	}
+	args = append(args, q.pageSize+1)
+
+	rows, err := storage.conn().QueryContext(ctx, "SELECT id, principal, method,"+
+		" resource, beforeJson, afterJson, eventTime FROM audit_events"+
+		whereClause(conditions)+" ORDER BY eventTime, id LIMIT ?;", args...)
+	if err != nil {
+		return nil, nil, storage.handleErr("failed to list audit events", err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	var next []string
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.Principal, &e.Method, &e.Resource,
+			&e.Before, &e.After, &e.EventTime); err != nil {
+			return nil, nil, storage.handleErr("failed to read audit events", err)
+		}
+		if len(events) == q.pageSize {
+			next = auditEventKey(events[len(events)-1])
+			break
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, storage.handleErr("failed to read audit events", err)
+	}
+	return events, next, nil
+}
+
+// auditEventKey returns the ordering values of an audit event.
+func auditEventKey(e AuditEvent) []string {
+	return []string{formatTime(e.EventTime), e.ID}
+}
+
+// handleErr logs an unexpected database error and returns it wrapped with
+// the message.
+func (storage *DBStorage) handleErr(errMessage string, err error) error {
+	storage.log.Debugw("database error", "message", errMessage, "error", err)
+	if isBusy(err) {
+		return fmt.Errorf("%s, %w", errMessage, errBusy)
+	}
+	return fmt.Errorf("%s, %w", errMessage, err)
+}
+
+// sqliteBusy is the primary result code of SQLite when a concurrent
+// transaction holds a conflicting lock on the database.
+const sqliteBusy = 5
+
+// isBusy reports whether the error is SQLite failing to lock the database
+// because of a concurrent transaction, e.g. when two transactions which have
+// both read the database try to write it.
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()&0xff == sqliteBusy
+	}
+	// the driver reports a busy statement only by the text of the code
+	return strings.Contains(err.Error(), sqlite.ErrorCodeString[sqliteBusy])
 }
@@ -0,0 +1,1348 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDBStorage(t *testing.T) {
+	testBookStore(t, newTestDBStorage)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testBookStore(t, func(t *testing.T) BookStore {
+		return NewMemoryStorage()
+	})
+}
+
+// newTestDBStorage creates a DBStorage in a new database file, which is
+// removed when the test ends.
+func newTestDBStorage(t *testing.T) BookStore {
+	db, err := NewDB(filepath.Join(t.TempDir(), "library.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	require.NoError(t, EnsureSchema(db))
+	return NewDBStorage(db, zap.NewNop().Sugar())
+}
+
+// testBookStore is the conformance suite every BookStore implementation must
+// pass. newStore creates a new empty store.
+func testBookStore(t *testing.T, newEmptyStore func(t *testing.T) BookStore) {
+	ctx := context.Background()
+	// newStore creates a store holding the author and the publisher of the
+	// test books
+	newStore := func(t *testing.T) BookStore {
+		store := newEmptyStore(t)
+		require.NoError(t, store.CreateAuthor(ctx, testAuthor(testAuthorID, "george", "lucas")))
+		require.NoError(t, store.CreatePublisher(ctx, testPublisher(testPublisherID, "adlibris")))
+		return store
+	}
+
+	t.Run("insert and find", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		require.ErrorIs(t, store.InsertIntoDatabase(ctx, b), ErrAlreadyExists)
+
+		got, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, b.Etag(), got.Etag())
+		_, err = store.FindSpecificBook(ctx, "9780000000002")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		books, err := store.FindBooks(ctx, []string{b.ISBN, "9780000000002"})
+		require.NoError(t, err)
+		require.Len(t, books, 1)
+		found := books[b.ISBN]
+		require.Equal(t, b.Etag(), found.Etag())
+	})
+
+	t.Run("update", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+
+		update := b
+		update.Title = "the empire strikes back"
+		update.Publisher = "00000000000000d4"
+		update.UpdateTime = b.UpdateTime.Add(time.Hour)
+		require.NoError(t, store.UpdateBookInDB(ctx, update, []string{fieldTitle}))
+
+		got, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, "the empire strikes back", got.Title)
+		require.Equal(t, b.Publisher, got.Publisher)
+		require.True(t, got.UpdateTime.Equal(update.UpdateTime))
+
+		update.ISBN = "9780000000002"
+		require.ErrorIs(t, store.UpdateBookInDB(ctx, update, []string{fieldTitle}),
+			ErrNotFound)
+	})
+
+	t.Run("soft delete, undelete and purge", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+
+		deleteTime := b.CreateTime.Add(time.Hour)
+		expireTime := deleteTime.Add(time.Hour)
+		require.NoError(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime, expireTime))
+		require.ErrorIs(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime, expireTime),
+			ErrConflict)
+		require.ErrorIs(t, store.SoftDeleteBook(ctx, "9780000000002", deleteTime,
+			expireTime), ErrNotFound)
+		deleted, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.True(t, deleted.IsDeleted())
+
+		require.NoError(t, store.UndeleteBookInDB(ctx, b.ISBN))
+		require.ErrorIs(t, store.UndeleteBookInDB(ctx, b.ISBN), ErrConflict)
+		require.ErrorIs(t, store.UndeleteBookInDB(ctx, "9780000000002"), ErrNotFound)
+		restored, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.False(t, restored.IsDeleted())
+
+		require.NoError(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime, expireTime))
+		expired, err := store.ListExpiredBooks(ctx, expireTime.Add(-time.Second))
+		require.NoError(t, err)
+		require.Empty(t, expired)
+		purged, err := store.PurgeExpiredBooks(ctx, expireTime.Add(-time.Second))
+		require.NoError(t, err)
+		require.Zero(t, purged)
+		expired, err = store.ListExpiredBooks(ctx, expireTime)
+		require.NoError(t, err)
+		require.Len(t, expired, 1)
+		require.Equal(t, b.ISBN, expired[0].ISBN)
+		require.True(t, expired[0].IsDeleted())
+		purged, err = store.PurgeExpiredBooks(ctx, expireTime)
+		require.NoError(t, err)
+		require.EqualValues(t, 1, purged)
+		_, err = store.FindSpecificBook(ctx, b.ISBN)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("purge removes the dependent rows", func(t *testing.T) {
+		store := newStore(t)
+		// the other author is only credited by the purged book
+		require.NoError(t, store.CreateAuthor(ctx, testAuthor("00000000000000a2", "mark", "hamill")))
+		require.NoError(t, store.CreateMember(ctx, testMember("00000000000000b1", "luke",
+			"skywalker", "12345678")))
+		purgedBook := testBook("9780000000001", "star wars")
+		purgedBook.Authors = append(purgedBook.Authors,
+			BookAuthor{AuthorID: "00000000000000a2", Role: roleEditor})
+		liveBook := testBook("9780000000002", "the empire strikes back")
+		for _, b := range []Book{purgedBook, liveBook} {
+			require.NoError(t, store.InsertIntoDatabase(ctx, b))
+			require.NoError(t, store.CreateCopy(ctx, testCopy(b.ISBN, "c"+b.ISBN[10:],
+				"barcode"+b.ISBN[10:], statusAvailable)))
+			require.NoError(t, store.CreateHold(ctx, testHold(b.ISBN, "h"+b.ISBN[10:],
+				"00000000000000b1")))
+		}
+		require.ErrorIs(t, store.DeleteAuthor(ctx, "00000000000000a2"), ErrInUse)
+
+		deleteTime := purgedBook.CreateTime.Add(time.Hour)
+		require.NoError(t, store.SoftDeleteBook(ctx, purgedBook.ISBN, deleteTime,
+			deleteTime.Add(time.Hour)))
+		purged, err := store.PurgeExpiredBooks(ctx, deleteTime.Add(time.Hour))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, purged)
+
+		for isbn, want := range map[string]int{purgedBook.ISBN: 0, liveBook.ISBN: 1} {
+			copies, _, err := store.ListCopies(ctx, isbn, 10, nil)
+			require.NoError(t, err)
+			require.Len(t, copies, want, isbn)
+			holds, _, err := store.ListHolds(ctx, isbn, true, 10, nil)
+			require.NoError(t, err)
+			require.Len(t, holds, want, isbn)
+			revisions, _, err := store.ListBookRevisions(ctx, isbn, 10, nil)
+			require.NoError(t, err)
+			require.Len(t, revisions, want, isbn)
+		}
+		// the authors of the purged book are no longer credited
+		require.NoError(t, store.DeleteAuthor(ctx, "00000000000000a2"))
+		require.ErrorIs(t, store.DeleteAuthor(ctx, testAuthorID), ErrInUse)
+		live, err := store.FindSpecificBook(ctx, liveBook.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, liveBook.Etag(), live.Etag())
+		require.Equal(t, 1, live.TotalCopies)
+	})
+
+	t.Run("revisions", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		update := b
+		update.Title = "the empire strikes back"
+		update.Authors = append(update.Authors,
+			BookAuthor{AuthorID: testAuthorID, Role: roleEditor})
+		update.UpdateTime = b.UpdateTime.Add(time.Hour)
+		require.NoError(t, store.UpdateBookInDB(ctx, update,
+			[]string{fieldTitle, fieldAuthors}))
+		deleteTime := update.UpdateTime.Add(time.Hour)
+		require.NoError(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime,
+			deleteTime.Add(time.Hour)))
+		require.NoError(t, store.UndeleteBookInDB(ctx, b.ISBN))
+		require.NoError(t, store.DeletePublisher(ctx, testPublisherID, true))
+		// failed writes store no revision
+		require.Error(t, store.UpdateBookInDB(ctx, update, []string{fieldPublisher}))
+
+		var revisions []Book
+		var after []string
+		for {
+			page, next, err := store.ListBookRevisions(ctx, b.ISBN, 2, after)
+			require.NoError(t, err)
+			revisions = append(revisions, page...)
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Len(t, revisions, 5)
+		require.Empty(t, revisions[0].Publisher)
+		require.False(t, revisions[1].IsDeleted())
+		require.True(t, revisions[2].IsDeleted())
+		require.True(t, deleteTime.Equal(revisions[2].DeleteTime))
+		require.Equal(t, "the empire strikes back", revisions[3].Title)
+		require.Equal(t, []BookAuthor{{AuthorID: testAuthorID, Role: roleAuthor},
+			{AuthorID: testAuthorID, Role: roleEditor}}, revisions[3].Authors)
+		require.Equal(t, "star wars", revisions[4].Title)
+		require.Equal(t, testPublisherID, revisions[4].Publisher)
+		require.True(t, b.UpdateTime.Equal(revisions[4].UpdateTime))
+
+		latest, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, revisions[0].RevisionID, latest.RevisionID)
+		require.True(t, revisions[0].RevisionCreateTime.Equal(latest.RevisionCreateTime))
+
+		first, err := store.GetBookRevision(ctx, b.ISBN, revisions[4].RevisionID)
+		require.NoError(t, err)
+		require.Equal(t, revisions[4], first)
+		_, err = store.GetBookRevision(ctx, b.ISBN, "0000000000000000")
+		require.ErrorIs(t, err, ErrNotFound)
+		_, err = store.GetBookRevision(ctx, "9780000000002", revisions[4].RevisionID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		require.NoError(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime,
+			deleteTime.Add(time.Hour)))
+		_, err = store.PurgeExpiredBooks(ctx, deleteTime.Add(time.Hour))
+		require.NoError(t, err)
+		revisions, _, err = store.ListBookRevisions(ctx, b.ISBN, 10, nil)
+		require.NoError(t, err)
+		require.Empty(t, revisions)
+	})
+
+	t.Run("book changes", func(t *testing.T) {
+		store := newStore(t)
+		last, err := store.LastBookChange(ctx)
+		require.NoError(t, err)
+		require.Zero(t, last)
+
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		update := b
+		update.Title = "the empire strikes back"
+		update.UpdateTime = b.UpdateTime.Add(time.Hour)
+		require.NoError(t, store.UpdateBookInDB(ctx, update, []string{fieldTitle}))
+		deleteTime := update.UpdateTime.Add(time.Hour)
+		require.NoError(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime,
+			deleteTime.Add(time.Hour)))
+		require.NoError(t, store.UndeleteBookInDB(ctx, b.ISBN))
+		require.NoError(t, store.DeletePublisher(ctx, testPublisherID, true))
+		// failed writes append no change
+		require.Error(t, store.InsertIntoDatabase(ctx, b))
+
+		changes, err := store.ListBookChanges(ctx, 0, 10)
+		require.NoError(t, err)
+		var types []string
+		for i, c := range changes {
+			require.Equal(t, int64(i+1), c.Seq)
+			require.Equal(t, b.ISBN, c.ISBN)
+			types = append(types, c.Type)
+		}
+		require.Equal(t, []string{changeCreated, changeUpdated, changeDeleted,
+			changeUpdated, changeUpdated}, types)
+		revision, err := store.GetBookRevision(ctx, b.ISBN, changes[1].RevisionID)
+		require.NoError(t, err)
+		require.Equal(t, "the empire strikes back", revision.Title)
+		require.True(t, revision.RevisionCreateTime.Equal(changes[1].ChangeTime))
+		last, err = store.LastBookChange(ctx)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), last)
+
+		page, err := store.ListBookChanges(ctx, 2, 2)
+		require.NoError(t, err)
+		require.Equal(t, changes[2:4], page)
+		page, err = store.ListBookChanges(ctx, 5, 10)
+		require.NoError(t, err)
+		require.Empty(t, page)
+
+		// the changes are kept when the book is purged
+		require.NoError(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime,
+			deleteTime.Add(time.Hour)))
+		_, err = store.PurgeExpiredBooks(ctx, deleteTime.Add(time.Hour))
+		require.NoError(t, err)
+		changes, err = store.ListBookChanges(ctx, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, changes, 6)
+		require.Equal(t, changeDeleted, changes[5].Type)
+	})
+
+	t.Run("list pages", func(t *testing.T) {
+		store := newStore(t)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, store.InsertIntoDatabase(ctx,
+				testBook(fmt.Sprintf("978000000000%d", i), fmt.Sprintf("title %d", 4-i))))
+		}
+		require.NoError(t, store.SoftDeleteBook(ctx, "9780000000004",
+			time.Now(), time.Now().Add(time.Hour)))
+
+		q, err := newListQuery(2, "", "", "title desc", false, "")
+		require.NoError(t, err)
+		var titles []string
+		for {
+			books, next, total, err := store.ListBooks(ctx, q)
+			require.NoError(t, err)
+			require.Equal(t, 4, total)
+			for _, b := range books {
+				titles = append(titles, b.Title)
+			}
+			if next == nil {
+				break
+			}
+			q.after = next
+		}
+		require.Equal(t, []string{"title 4", "title 3", "title 2", "title 1"}, titles)
+
+		q, err = newListQuery(10, "", `title >= "title 2"`, "", true, "")
+		require.NoError(t, err)
+		books, next, total, err := store.ListBooks(ctx, q)
+		require.NoError(t, err)
+		require.Nil(t, next)
+		require.Equal(t, 3, total)
+		require.Len(t, books, 3)
+		require.Equal(t, "9780000000000", books[0].ISBN)
+	})
+
+	t.Run("search", func(t *testing.T) {
+		store := newStore(t)
+		titles := []string{"Star Wars: A New Hope", "A New Star", "Starship Troopers",
+			"The Hobbit"}
+		for i, title := range titles {
+			require.NoError(t, store.InsertIntoDatabase(ctx,
+				testBook(fmt.Sprintf("978000000000%d", i), title)))
+		}
+		search := func(query string, pageSize int32) []string {
+			q, err := newSearchQuery(query, pageSize, "")
+			require.NoError(t, err)
+			var isbns []string
+			for {
+				results, next, total, err := store.SearchBooks(ctx, q)
+				require.NoError(t, err)
+				for _, r := range results {
+					require.Contains(t, r.Snippet, snippetStart)
+					isbns = append(isbns, r.Book.ISBN)
+				}
+				if next == nil {
+					require.Len(t, isbns, total)
+					return isbns
+				}
+				q.after = next
+			}
+		}
+
+		require.ElementsMatch(t, []string{"9780000000000", "9780000000001"},
+			search("star", 1))
+		require.ElementsMatch(t,
+			[]string{"9780000000000", "9780000000001", "9780000000002"},
+			search("sta*", 2))
+		require.Equal(t, []string{"9780000000000"}, search(`"new hope"`, 0))
+		require.Empty(t, search(`"hope new"`, 0))
+		require.ElementsMatch(t, []string{"9780000000000", "9780000000001"},
+			search("star LUCAS", 0))
+
+		update := testBook("9780000000003", "The Star of the Hobbit")
+		require.NoError(t, store.UpdateBookInDB(ctx, update, []string{fieldTitle}))
+		require.NoError(t, store.SoftDeleteBook(ctx, "9780000000000",
+			time.Now(), time.Now().Add(time.Hour)))
+		require.ElementsMatch(t, []string{"9780000000001", "9780000000003"},
+			search("star", 0))
+	})
+
+	t.Run("authors", func(t *testing.T) {
+		store := newStore(t)
+		const editorID = "00000000000000b2"
+		require.NoError(t, store.CreateAuthor(ctx, testAuthor(editorID, "ann", "abbot")))
+
+		got, err := store.GetAuthor(ctx, editorID)
+		require.NoError(t, err)
+		require.Equal(t, "abbot", got.LastName)
+		_, err = store.GetAuthor(ctx, "00000000000000c3")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		var names []string
+		var after []string
+		for {
+			authors, next, err := store.ListAuthors(ctx, 1, after)
+			require.NoError(t, err)
+			for _, a := range authors {
+				names = append(names, a.LastName)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{"abbot", "lucas"}, names)
+
+		b := testBook("9780000000001", "star wars")
+		b.Authors = append(b.Authors, BookAuthor{AuthorID: editorID, Role: roleEditor})
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		found, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, []BookAuthor{
+			{AuthorID: testAuthorID, Role: roleAuthor, FirstName: "george", LastName: "lucas"},
+			{AuthorID: editorID, Role: roleEditor, FirstName: "ann", LastName: "abbot"},
+		}, found.Authors)
+
+		q, err := newListQuery(0, "", `author.last_name = "lucas"`, "", false, "")
+		require.NoError(t, err)
+		books, _, _, err := store.ListBooks(ctx, q)
+		require.NoError(t, err)
+		require.Len(t, books, 1)
+
+		renamed := testAuthor(editorID, "ann", "zabbot")
+		require.NoError(t, store.UpdateAuthor(ctx, renamed))
+		sq, err := newSearchQuery("zabbot", 0, "")
+		require.NoError(t, err)
+		results, _, _, err := store.SearchBooks(ctx, sq)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		require.Equal(t, "zabbot", results[0].Book.Authors[1].LastName)
+
+		require.ErrorIs(t, store.DeleteAuthor(ctx, editorID), ErrInUse)
+		unknown := testBook("9780000000002", "unknown author")
+		unknown.Authors[0].AuthorID = "00000000000000c3"
+		require.ErrorIs(t, store.InsertIntoDatabase(ctx, unknown), ErrNotFound)
+		unknown.ISBN = b.ISBN
+		require.ErrorIs(t, store.UpdateBookInDB(ctx, unknown, []string{fieldAuthors}),
+			ErrNotFound)
+		found, err = store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Len(t, found.Authors, 2)
+
+		require.NoError(t, store.UpdateBookInDB(ctx, testBook(b.ISBN, b.Title),
+			[]string{fieldAuthors}))
+		require.NoError(t, store.DeleteAuthor(ctx, editorID))
+		require.ErrorIs(t, store.DeleteAuthor(ctx, editorID), ErrNotFound)
+		require.ErrorIs(t, store.UpdateAuthor(ctx, renamed), ErrNotFound)
+	})
+
+	t.Run("publishers", func(t *testing.T) {
+		store := newStore(t)
+		const penguinID = "00000000000000b2"
+		require.NoError(t, store.CreatePublisher(ctx, testPublisher(penguinID, "penguin")))
+
+		got, err := store.GetPublisher(ctx, penguinID)
+		require.NoError(t, err)
+		require.Equal(t, "penguin", got.DisplayName)
+		_, err = store.GetPublisher(ctx, "00000000000000c3")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		var names []string
+		var after []string
+		for {
+			publishers, next, err := store.ListPublishers(ctx, 1, after)
+			require.NoError(t, err)
+			for _, p := range publishers {
+				names = append(names, p.DisplayName)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{"adlibris", "penguin"}, names)
+
+		b := testBook("9780000000001", "star wars")
+		b.Publisher = penguinID
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		found, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, "penguin", found.PublisherName)
+
+		q, err := newListQuery(0, "", `publisher = "publishers/`+penguinID+`"`, "", false, "")
+		require.NoError(t, err)
+		books, _, _, err := store.ListBooks(ctx, q)
+		require.NoError(t, err)
+		require.Len(t, books, 1)
+		q, err = newListQuery(0, "", `publisher.display_name = "penguin"`, "", false, "")
+		require.NoError(t, err)
+		books, _, _, err = store.ListBooks(ctx, q)
+		require.NoError(t, err)
+		require.Len(t, books, 1)
+
+		renamed := testPublisher(penguinID, "penguin books")
+		renamed.Country = "GB"
+		require.NoError(t, store.UpdatePublisher(ctx, renamed))
+		got, err = store.GetPublisher(ctx, penguinID)
+		require.NoError(t, err)
+		require.Equal(t, "GB", got.Country)
+		sq, err := newSearchQuery("books", 0, "")
+		require.NoError(t, err)
+		results, _, _, err := store.SearchBooks(ctx, sq)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		require.Equal(t, "penguin books", results[0].Book.PublisherName)
+
+		unknown := testBook("9780000000002", "unknown publisher")
+		unknown.Publisher = "00000000000000c3"
+		require.ErrorIs(t, store.InsertIntoDatabase(ctx, unknown), ErrNotFound)
+		unknown.ISBN = b.ISBN
+		require.ErrorIs(t, store.UpdateBookInDB(ctx, unknown, []string{fieldPublisher}),
+			ErrNotFound)
+
+		require.ErrorIs(t, store.DeletePublisher(ctx, penguinID, false), ErrInUse)
+		require.NoError(t, store.DeletePublisher(ctx, penguinID, true))
+		found, err = store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Empty(t, found.Publisher)
+		require.Empty(t, found.PublisherName)
+		require.ErrorIs(t, store.DeletePublisher(ctx, penguinID, false), ErrNotFound)
+		require.ErrorIs(t, store.UpdatePublisher(ctx, renamed), ErrNotFound)
+
+		// the cleared publisher does not keep the other fields from being updated
+		require.NoError(t, store.UpdateBookInDB(ctx, testBook(b.ISBN, "a new hope"),
+			[]string{fieldTitle}))
+		require.NoError(t, store.DeletePublisher(ctx, testPublisherID, false))
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+
+		onLoan := testCopy(b.ISBN, "00000000000000c1", "B-2", statusOnLoan)
+		for _, c := range []Copy{
+			testCopy(b.ISBN, "00000000000000c0", "B-1", statusAvailable),
+			onLoan,
+			testCopy(b.ISBN, "00000000000000c2", "B-3", statusWithdrawn),
+		} {
+			require.NoError(t, store.CreateCopy(ctx, c))
+		}
+		duplicate := testCopy(b.ISBN, "00000000000000c3", "B-1", statusAvailable)
+		require.ErrorIs(t, store.CreateCopy(ctx, duplicate), ErrAlreadyExists)
+		require.ErrorIs(t, store.CreateCopy(ctx,
+			testCopy("9780000000002", "00000000000000c3", "B-4", statusAvailable)),
+			ErrNotFound)
+
+		got, err := store.GetCopy(ctx, b.ISBN, onLoan.ID)
+		require.NoError(t, err)
+		require.Equal(t, "B-2", got.Barcode)
+		_, err = store.GetCopy(ctx, "9780000000002", onLoan.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		found, err := store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, 2, found.TotalCopies)
+		require.Equal(t, 1, found.AvailableCopies)
+
+		var barcodes []string
+		var after []string
+		for {
+			copies, next, err := store.ListCopies(ctx, b.ISBN, 2, after)
+			require.NoError(t, err)
+			for _, c := range copies {
+				barcodes = append(barcodes, c.Barcode)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{"B-1", "B-2", "B-3"}, barcodes)
+
+		require.ErrorIs(t, store.DeleteCopy(ctx, b.ISBN, onLoan.ID), ErrInUse)
+		require.ErrorIs(t, store.SoftDeleteBook(ctx, b.ISBN, time.Now(),
+			time.Now().Add(time.Hour)), ErrInUse)
+
+		returned := onLoan
+		returned.Status = statusAvailable
+		require.NoError(t, store.UpdateCopy(ctx, returned))
+		returned.Barcode = "B-1"
+		require.ErrorIs(t, store.UpdateCopy(ctx, returned), ErrAlreadyExists)
+		found, err = store.FindSpecificBook(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, 2, found.AvailableCopies)
+
+		require.NoError(t, store.DeleteCopy(ctx, b.ISBN, "00000000000000c2"))
+		require.ErrorIs(t, store.DeleteCopy(ctx, b.ISBN, "00000000000000c2"), ErrNotFound)
+		deleteTime := b.CreateTime.Add(time.Hour)
+		require.NoError(t, store.SoftDeleteBook(ctx, b.ISBN, deleteTime,
+			deleteTime.Add(time.Hour)))
+		_, err = store.PurgeExpiredBooks(ctx, deleteTime.Add(time.Hour))
+		require.NoError(t, err)
+		_, err = store.GetCopy(ctx, b.ISBN, onLoan.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("members", func(t *testing.T) {
+		store := newStore(t)
+		ann := testMember("00000000000000f1", "ann", "abbot", "10000001")
+		bob := testMember("00000000000000f2", "bob", "abbot", "10000002")
+		require.NoError(t, store.CreateMember(ctx, bob))
+		require.NoError(t, store.CreateMember(ctx, ann))
+		sameCard := testMember("00000000000000f3", "cid", "carter", ann.CardNumber)
+		require.ErrorIs(t, store.CreateMember(ctx, sameCard), ErrAlreadyExists)
+
+		got, err := store.GetMember(ctx, ann.ID)
+		require.NoError(t, err)
+		require.Equal(t, ann.Email, got.Email)
+		_, err = store.GetMember(ctx, sameCard.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		var names []string
+		var after []string
+		for {
+			members, next, err := store.ListMembers(ctx, 1, after)
+			require.NoError(t, err)
+			for _, m := range members {
+				names = append(names, m.FirstName)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{"ann", "bob"}, names)
+
+		blocked := ann
+		blocked.Blocked = true
+		blocked.BlockReason = "unpaid fines"
+		require.NoError(t, store.UpdateMember(ctx, blocked))
+		got, err = store.GetMember(ctx, ann.ID)
+		require.NoError(t, err)
+		require.True(t, got.Blocked)
+		blocked.CardNumber = bob.CardNumber
+		require.ErrorIs(t, store.UpdateMember(ctx, blocked), ErrAlreadyExists)
+		missing := testMember("00000000000000f3", "cid", "carter", "10000003")
+		require.ErrorIs(t, store.UpdateMember(ctx, missing), ErrNotFound)
+
+		require.NoError(t, store.DeleteMember(ctx, ann.ID))
+		require.ErrorIs(t, store.DeleteMember(ctx, ann.ID), ErrNotFound)
+	})
+
+	t.Run("loans", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		c := testCopy(b.ISBN, "00000000000000c0", "B-1", statusAvailable)
+		require.NoError(t, store.CreateCopy(ctx, c))
+		m := testMember("00000000000000f1", "ann", "abbot", "10000001")
+		require.NoError(t, store.CreateMember(ctx, m))
+
+		loan := testLoan("0000000000000010", c, m.ID)
+		loan.Branch = "central"
+		require.NoError(t, store.CreateLoan(ctx, loan))
+		second := testLoan("0000000000000011", c, m.ID)
+		require.ErrorIs(t, store.CreateLoan(ctx, second), ErrInUse)
+		second.CopyID = "00000000000000c1"
+		require.ErrorIs(t, store.CreateLoan(ctx, second), ErrNotFound)
+
+		got, err := store.GetCopy(ctx, b.ISBN, c.ID)
+		require.NoError(t, err)
+		require.Equal(t, statusOnLoan, got.Status)
+		count, err := store.CountActiveLoans(ctx, m.ID)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		require.ErrorIs(t, store.DeleteMember(ctx, m.ID), ErrInUse)
+
+		active, err := store.GetActiveLoan(ctx, b.ISBN, c.ID)
+		require.NoError(t, err)
+		require.Equal(t, loan.ID, active.ID)
+		active.DueDate = "2021-10-13"
+		active.Renewals = 1
+		require.NoError(t, store.RenewLoan(ctx, active))
+		renewed, err := store.GetLoan(ctx, loan.ID)
+		require.NoError(t, err)
+		require.Equal(t, "2021-10-13", renewed.DueDate)
+		require.Equal(t, 1, renewed.Renewals)
+		require.Equal(t, "central", renewed.Branch)
+		require.True(t, renewed.IsActive())
+
+		active.ReturnTime = loan.CheckoutTime.Add(24 * time.Hour)
+		require.NoError(t, store.ReturnLoan(ctx, active))
+		require.ErrorIs(t, store.ReturnLoan(ctx, active), ErrConflict)
+		require.ErrorIs(t, store.RenewLoan(ctx, active), ErrConflict)
+		_, err = store.GetActiveLoan(ctx, b.ISBN, c.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+		got, err = store.GetCopy(ctx, b.ISBN, c.ID)
+		require.NoError(t, err)
+		require.Equal(t, statusAvailable, got.Status)
+
+		// the copy can be lent again once it is returned
+		again := testLoan("0000000000000012", c, m.ID)
+		again.CheckoutTime = active.ReturnTime
+		require.NoError(t, store.CreateLoan(ctx, again))
+
+		loans, _, err := store.ListLoans(ctx, m.ID, false, 10, nil)
+		require.NoError(t, err)
+		require.Len(t, loans, 1)
+		require.Equal(t, again.ID, loans[0].ID)
+		var ids []string
+		var after []string
+		for {
+			loans, next, err := store.ListLoans(ctx, m.ID, true, 1, after)
+			require.NoError(t, err)
+			for _, l := range loans {
+				ids = append(ids, l.ID)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{loan.ID, again.ID}, ids)
+		loans, _, err = store.ListLoans(ctx, "00000000000000f2", true, 10, nil)
+		require.NoError(t, err)
+		require.Empty(t, loans)
+		_, err = store.GetLoan(ctx, "0000000000000011")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("holds", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+
+		first := testHold(b.ISBN, "0000000000000020", "00000000000000f1")
+		second := testHold(b.ISBN, "0000000000000021", "00000000000000f2")
+		second.PlaceTime = first.PlaceTime.Add(time.Minute)
+		require.NoError(t, store.CreateHold(ctx, second))
+		require.NoError(t, store.CreateHold(ctx, first))
+		again := testHold(b.ISBN, "0000000000000022", first.MemberID)
+		require.ErrorIs(t, store.CreateHold(ctx, again), ErrAlreadyExists)
+
+		got, err := store.GetHold(ctx, b.ISBN, second.ID)
+		require.NoError(t, err)
+		require.Equal(t, second.MemberID, got.MemberID)
+		require.True(t, got.PickupExpireTime.IsZero())
+		_, err = store.GetHold(ctx, "9780000000002", second.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		next, err := store.NextWaitingHold(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, first.ID, next.ID)
+
+		ready := next
+		ready.State = holdReady
+		ready.CopyID = "00000000000000c0"
+		ready.PickupExpireTime = first.PlaceTime.Add(time.Hour)
+		require.NoError(t, store.UpdateHold(ctx, ready))
+		held, err := store.GetHoldOfCopy(ctx, b.ISBN, ready.CopyID)
+		require.NoError(t, err)
+		require.Equal(t, first.ID, held.ID)
+		require.True(t, ready.PickupExpireTime.Equal(held.PickupExpireTime))
+		next, err = store.NextWaitingHold(ctx, b.ISBN)
+		require.NoError(t, err)
+		require.Equal(t, second.ID, next.ID)
+
+		expired, err := store.ListExpiredHolds(ctx, ready.PickupExpireTime.Add(-time.Second))
+		require.NoError(t, err)
+		require.Empty(t, expired)
+		expired, err = store.ListExpiredHolds(ctx, ready.PickupExpireTime)
+		require.NoError(t, err)
+		require.Len(t, expired, 1)
+		require.Equal(t, first.ID, expired[0].ID)
+
+		cancelled := second
+		cancelled.State = holdCancelled
+		require.NoError(t, store.UpdateHold(ctx, cancelled))
+		_, err = store.NextWaitingHold(ctx, b.ISBN)
+		require.ErrorIs(t, err, ErrNotFound)
+		// a member can hold the book again once the hold is closed
+		repeated := testHold(b.ISBN, "0000000000000023", second.MemberID)
+		repeated.PlaceTime = second.PlaceTime.Add(time.Minute)
+		require.NoError(t, store.CreateHold(ctx, repeated))
+
+		holds, _, err := store.ListHolds(ctx, b.ISBN, false, 10, nil)
+		require.NoError(t, err)
+		require.Len(t, holds, 2)
+		var ids []string
+		var after []string
+		for {
+			holds, next, err := store.ListHolds(ctx, b.ISBN, true, 1, after)
+			require.NoError(t, err)
+			for _, h := range holds {
+				ids = append(ids, h.ID)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{first.ID, second.ID, repeated.ID}, ids)
+		require.ErrorIs(t, store.UpdateHold(ctx, again), ErrNotFound)
+	})
+
+	t.Run("ledger", func(t *testing.T) {
+		store := newStore(t)
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		c := testCopy(b.ISBN, "00000000000000c0", "B-1", statusAvailable)
+		require.NoError(t, store.CreateCopy(ctx, c))
+		m := testMember("00000000000000f1", "ann", "abbot", "10000001")
+		require.NoError(t, store.CreateMember(ctx, m))
+
+		// a lost copy is not made available when its loan is closed
+		loan := testLoan("0000000000000010", c, m.ID)
+		require.NoError(t, store.CreateLoan(ctx, loan))
+		loan.ReturnTime = loan.CheckoutTime.Add(24 * time.Hour)
+		loan.Lost = true
+		require.NoError(t, store.ReturnLoan(ctx, loan))
+		got, err := store.GetCopy(ctx, b.ISBN, c.ID)
+		require.NoError(t, err)
+		require.Equal(t, statusLost, got.Status)
+		lost, err := store.GetLoan(ctx, loan.ID)
+		require.NoError(t, err)
+		require.True(t, lost.Lost)
+
+		fine := testLedgerEntry(m.ID, "0000000000000020", entryOverdueFine, 300)
+		fine.LoanID = loan.ID
+		require.NoError(t, store.AppendLedgerEntry(ctx, fine))
+		charge := testLedgerEntry(m.ID, "0000000000000021", entryLostItem, 2500)
+		require.NoError(t, store.AppendLedgerEntry(ctx, charge))
+		payment := testLedgerEntry(m.ID, "0000000000000022", entryPayment, 2000)
+		require.NoError(t, store.AppendLedgerEntry(ctx, payment))
+		waiver := testLedgerEntry(m.ID, "0000000000000023", entryWaiver, 800)
+		require.NoError(t, store.AppendLedgerEntry(ctx, waiver))
+
+		totals, err := store.LedgerTotals(ctx, m.ID)
+		require.NoError(t, err)
+		require.Equal(t, ledgerTotals{entryOverdueFine: 300, entryLostItem: 2500,
+			entryPayment: 2000, entryWaiver: 800}, totals)
+		require.Equal(t, int64(0), totals.balance())
+		totals, err = store.LedgerTotals(ctx, "00000000000000f2")
+		require.NoError(t, err)
+		require.Equal(t, int64(0), totals.balance())
+
+		var ids []string
+		var after []string
+		for {
+			entries, next, err := store.ListLedgerEntries(ctx, m.ID, 3, after)
+			require.NoError(t, err)
+			for _, e := range entries {
+				ids = append(ids, e.ID)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{fine.ID, charge.ID, payment.ID, waiver.ID}, ids)
+		entries, _, err := store.ListLedgerEntries(ctx, m.ID, 1, nil)
+		require.NoError(t, err)
+		require.Equal(t, loan.ID, entries[0].LoanID)
+		require.Equal(t, int64(300), entries[0].AmountCents)
+
+		// a member with a balance or a credit can not be deleted
+		overpaid := testLedgerEntry(m.ID, "0000000000000024", entryPayment, 100)
+		require.NoError(t, store.AppendLedgerEntry(ctx, overpaid))
+		require.ErrorIs(t, store.DeleteMember(ctx, m.ID), ErrInUse)
+		refund := testLedgerEntry(m.ID, "0000000000000025", entryRefund, 100)
+		require.NoError(t, store.AppendLedgerEntry(ctx, refund))
+		require.NoError(t, store.DeleteMember(ctx, m.ID))
+	})
+
+	t.Run("calendar", func(t *testing.T) {
+		store := newStore(t)
+
+		hours, err := store.GetOpeningHours(ctx, "central")
+		require.NoError(t, err)
+		require.Empty(t, hours.Periods)
+		hours.Periods = []OpeningPeriod{
+			{Day: 6, OpenTime: "10:00", CloseTime: "14:00"},
+			{Day: 1, OpenTime: "13:00", CloseTime: "18:00"},
+			{Day: 1, OpenTime: "09:00", CloseTime: "12:00"},
+		}
+		require.NoError(t, store.SetOpeningHours(ctx, hours))
+		hours.Periods = hours.Periods[:1]
+		require.NoError(t, store.SetOpeningHours(ctx, OpeningHours{
+			Branch:  "north",
+			Periods: []OpeningPeriod{{Day: 2, OpenTime: "09:00", CloseTime: "17:00"}},
+		}))
+		got, err := store.GetOpeningHours(ctx, "central")
+		require.NoError(t, err)
+		require.Equal(t, []OpeningPeriod{
+			{Day: 1, OpenTime: "09:00", CloseTime: "12:00"},
+			{Day: 1, OpenTime: "13:00", CloseTime: "18:00"},
+			{Day: 6, OpenTime: "10:00", CloseTime: "14:00"},
+		}, got.Periods)
+		require.NoError(t, store.SetOpeningHours(ctx, hours))
+		got, err = store.GetOpeningHours(ctx, "central")
+		require.NoError(t, err)
+		require.Equal(t, hours.Periods, got.Periods)
+
+		christmas := testClosure("central", "00000000000000d1", "2021-12-24", "2021-12-26")
+		require.NoError(t, store.CreateClosure(ctx, christmas))
+		easter := testClosure("central", "00000000000000d2", "2021-04-02", "2021-04-05")
+		require.NoError(t, store.CreateClosure(ctx, easter))
+		other := testClosure("north", "00000000000000d3", "2021-12-24", "2021-12-24")
+		require.NoError(t, store.CreateClosure(ctx, other))
+
+		closure, err := store.GetClosure(ctx, "central", christmas.ID)
+		require.NoError(t, err)
+		require.Equal(t, christmas.EndDate, closure.EndDate)
+		_, err = store.GetClosure(ctx, "north", christmas.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		var ids []string
+		var after []string
+		for {
+			closures, next, err := store.ListClosures(ctx, "central", 1, after)
+			require.NoError(t, err)
+			for _, c := range closures {
+				ids = append(ids, c.ID)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{easter.ID, christmas.ID}, ids)
+
+		between, err := store.ListClosuresBetween(ctx, "central", "2021-12-26", "2022-01-31")
+		require.NoError(t, err)
+		require.Len(t, between, 1)
+		require.Equal(t, christmas.ID, between[0].ID)
+		between, err = store.ListClosuresBetween(ctx, "central", "2021-04-06", "2021-12-23")
+		require.NoError(t, err)
+		require.Empty(t, between)
+
+		closure.EndDate = "2021-12-27"
+		closure.Reason = "christmas"
+		require.NoError(t, store.UpdateClosure(ctx, closure))
+		closure, err = store.GetClosure(ctx, "central", christmas.ID)
+		require.NoError(t, err)
+		require.Equal(t, "2021-12-27", closure.EndDate)
+		require.Equal(t, "christmas", closure.Reason)
+		other.Branch = "central"
+		require.ErrorIs(t, store.UpdateClosure(ctx, other), ErrNotFound)
+
+		require.NoError(t, store.DeleteClosure(ctx, "central", easter.ID))
+		require.ErrorIs(t, store.DeleteClosure(ctx, "central", easter.ID), ErrNotFound)
+		_, err = store.GetClosure(ctx, "central", easter.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("branches", func(t *testing.T) {
+		store := newStore(t)
+		central := testBranch("central", "central library")
+		north := testBranch("north", "north side")
+		require.NoError(t, store.CreateBranch(ctx, north))
+		require.NoError(t, store.CreateBranch(ctx, central))
+		require.ErrorIs(t, store.CreateBranch(ctx, central), ErrAlreadyExists)
+
+		got, err := store.GetBranch(ctx, central.ID)
+		require.NoError(t, err)
+		require.Equal(t, central.DisplayName, got.DisplayName)
+		_, err = store.GetBranch(ctx, "south")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		var ids []string
+		var after []string
+		for {
+			branches, next, err := store.ListBranches(ctx, 1, after)
+			require.NoError(t, err)
+			for _, b := range branches {
+				ids = append(ids, b.ID)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{"central", "north"}, ids)
+
+		got.Address = "main street 1"
+		require.NoError(t, store.UpdateBranch(ctx, got))
+		got, err = store.GetBranch(ctx, central.ID)
+		require.NoError(t, err)
+		require.Equal(t, "main street 1", got.Address)
+		require.ErrorIs(t, store.UpdateBranch(ctx, testBranch("south", "south")), ErrNotFound)
+
+		b := testBook("9780000000001", "star wars")
+		require.NoError(t, store.InsertIntoDatabase(ctx, b))
+		other := testBook("9780000000002", "empire")
+		require.NoError(t, store.InsertIntoDatabase(ctx, other))
+		shelved := testCopy(b.ISBN, "00000000000000c0", "B-1", statusAvailable)
+		shelved.Branch = central.ID
+		require.NoError(t, store.CreateCopy(ctx, shelved))
+		sent := testCopy(other.ISBN, "00000000000000c1", "B-2", statusInTransit)
+		sent.Branch = central.ID
+		sent.TransferBranch = north.ID
+		require.NoError(t, store.CreateCopy(ctx, sent))
+		inTransit, err := store.GetCopy(ctx, other.ISBN, sent.ID)
+		require.NoError(t, err)
+		require.Equal(t, north.ID, inTransit.TransferBranch)
+
+		// only the books with an available copy at the branch are listed
+		for branch, want := range map[string][]string{
+			central.ID: {b.ISBN},
+			north.ID:   nil,
+		} {
+			q, err := newListQuery(0, "", "", "", false, branch)
+			require.NoError(t, err)
+			books, _, total, err := store.ListBooks(ctx, q)
+			require.NoError(t, err)
+			var isbns []string
+			for _, book := range books {
+				isbns = append(isbns, book.ISBN)
+			}
+			require.Equal(t, want, isbns)
+			require.Equal(t, len(want), total)
+		}
+
+		require.ErrorIs(t, store.DeleteCopy(ctx, other.ISBN, sent.ID), ErrInUse)
+		require.ErrorIs(t, store.DeleteBranch(ctx, north.ID), ErrInUse)
+
+		// a waiting hold with a copy sent to it is not served again
+		hold := testHold(other.ISBN, "0000000000000020", "00000000000000f1")
+		hold.PickupBranch = north.ID
+		hold.CopyID = sent.ID
+		require.NoError(t, store.CreateHold(ctx, hold))
+		_, err = store.NextWaitingHold(ctx, other.ISBN)
+		require.ErrorIs(t, err, ErrNotFound)
+		sentFor, err := store.GetHoldOfCopy(ctx, other.ISBN, sent.ID)
+		require.NoError(t, err)
+		require.Equal(t, hold.ID, sentFor.ID)
+
+		received := inTransit
+		received.Branch = north.ID
+		received.TransferBranch = ""
+		received.Status = statusAvailable
+		require.NoError(t, store.UpdateCopy(ctx, received))
+		require.ErrorIs(t, store.DeleteBranch(ctx, north.ID), ErrInUse)
+		require.NoError(t, store.DeleteCopy(ctx, other.ISBN, sent.ID))
+
+		require.NoError(t, store.SetOpeningHours(ctx, OpeningHours{
+			Branch:  north.ID,
+			Periods: []OpeningPeriod{{Day: 1, OpenTime: "09:00", CloseTime: "17:00"}},
+		}))
+		require.NoError(t, store.CreateClosure(ctx,
+			testClosure(north.ID, "00000000000000d1", "2021-12-24", "2021-12-26")))
+		require.NoError(t, store.DeleteBranch(ctx, north.ID))
+		require.ErrorIs(t, store.DeleteBranch(ctx, north.ID), ErrNotFound)
+		hours, err := store.GetOpeningHours(ctx, north.ID)
+		require.NoError(t, err)
+		require.Empty(t, hours.Periods)
+		_, err = store.GetClosure(ctx, north.ID, "00000000000000d1")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		store := newEmptyStore(t)
+		now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+		first, firstKey, err := NewAPIKey("importer", now)
+		require.NoError(t, err)
+		second, secondKey, err := NewAPIKey("reports", now.Add(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAPIKey(ctx, secondKey))
+		require.NoError(t, store.CreateAPIKey(ctx, firstKey))
+
+		got, err := store.GetAPIKeyByHash(ctx, hashAPIKey(first))
+		require.NoError(t, err)
+		require.Equal(t, firstKey.ID, got.ID)
+		require.Equal(t, "importer", got.DisplayName)
+		_, err = store.GetAPIKeyByHash(ctx, hashAPIKey(apiKeyPrefix+"unknown"))
+		require.ErrorIs(t, err, ErrNotFound)
+
+		keys, err := store.ListAPIKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		require.Equal(t, firstKey.ID, keys[0].ID)
+		require.Equal(t, secondKey.ID, keys[1].ID)
+
+		require.NoError(t, store.DeleteAPIKey(ctx, secondKey.ID))
+		require.ErrorIs(t, store.DeleteAPIKey(ctx, secondKey.ID), ErrNotFound)
+		_, err = store.GetAPIKeyByHash(ctx, hashAPIKey(second))
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("role bindings", func(t *testing.T) {
+		store := newEmptyStore(t)
+		now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+		for _, b := range []RoleBinding{
+			{Principal: "bob", Role: rolePatron, UpdateTime: now},
+			{Principal: "apiKeys/00000000000000a1", Role: roleLibrarian, UpdateTime: now},
+			{Principal: "alice", Role: roleLibrarian, UpdateTime: now},
+		} {
+			require.NoError(t, store.SetRoleBinding(ctx, b))
+		}
+		require.NoError(t, store.SetRoleBinding(ctx, RoleBinding{
+			Principal: "alice", Role: roleAdmin, UpdateTime: now.Add(time.Hour)}))
+
+		got, err := store.GetRoleBinding(ctx, "alice")
+		require.NoError(t, err)
+		require.Equal(t, roleAdmin, got.Role)
+		require.True(t, now.Add(time.Hour).Equal(got.UpdateTime))
+		_, err = store.GetRoleBinding(ctx, "carol")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		var principals []string
+		var after []string
+		for {
+			bindings, next, err := store.ListRoleBindings(ctx, 2, after)
+			require.NoError(t, err)
+			for _, b := range bindings {
+				principals = append(principals, b.Principal)
+			}
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		require.Equal(t, []string{"alice", "apiKeys/00000000000000a1", "bob"}, principals)
+
+		require.NoError(t, store.DeleteRoleBinding(ctx, "bob"))
+		require.ErrorIs(t, store.DeleteRoleBinding(ctx, "bob"), ErrNotFound)
+		_, err = store.GetRoleBinding(ctx, "bob")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("audit events", func(t *testing.T) {
+		store := newEmptyStore(t)
+		start := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+		for i, resource := range []string{"books/9780000000001",
+			"books/9780000000002", "books/9780000000001", "books/9780000000001"} {
+			require.NoError(t, store.AppendAuditEvent(ctx, AuditEvent{
+				ID:        fmt.Sprintf("%016x", i),
+				Principal: "alice",
+				Method:    "UpdateBook",
+				Resource:  resource,
+				Before:    `{"title":"old"}`,
+				After:     `{"title":"new"}`,
+				EventTime: start.Add(time.Duration(i) * time.Hour),
+			}))
+		}
+		// a transaction which fails keeps none of its events
+		err := store.RunInTransaction(ctx, func(tx BookStore) error {
+			require.NoError(t, tx.AppendAuditEvent(ctx, AuditEvent{ID: "ff",
+				Method: "CreateBook", Resource: "books/9780000000003",
+				After: "{}", EventTime: start}))
+			return ErrConflict
+		})
+		require.ErrorIs(t, err, ErrConflict)
+
+		list := func(q auditQuery) []string {
+			var ids []string
+			q.pageSize = 2
+			for {
+				events, next, err := store.ListAuditEvents(ctx, q)
+				require.NoError(t, err)
+				for _, e := range events {
+					ids = append(ids, e.ID)
+				}
+				if next == nil {
+					return ids
+				}
+				q.after = next
+			}
+		}
+		require.Equal(t, []string{"0000000000000000", "0000000000000001",
+			"0000000000000002", "0000000000000003"}, list(auditQuery{}))
+		require.Equal(t, []string{"0000000000000000", "0000000000000002",
+			"0000000000000003"}, list(auditQuery{resource: "books/9780000000001"}))
+		require.Equal(t, []string{"0000000000000001", "0000000000000002"},
+			list(auditQuery{startTime: start.Add(time.Hour),
+				endTime: start.Add(3 * time.Hour)}))
+
+		events, _, err := store.ListAuditEvents(ctx, auditQuery{pageSize: 1,
+			resource: "books/9780000000002"})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		require.Equal(t, "alice", events[0].Principal)
+		require.Equal(t, `{"title":"old"}`, events[0].Before)
+		require.Equal(t, `{"title":"new"}`, events[0].After)
+		require.True(t, start.Add(time.Hour).Equal(events[0].EventTime))
+	})
+
+	t.Run("transactions", func(t *testing.T) {
+		store := newStore(t)
+		errRollback := errors.New("rollback")
+
+		err := store.RunInTransaction(ctx, func(tx BookStore) error {
+			require.NoError(t, tx.InsertIntoDatabase(ctx, testBook("9780000000001", "a")))
+			require.ErrorIs(t, tx.InsertIntoDatabase(ctx, testBook("9780000000001", "a")),
+				ErrAlreadyExists)
+			b, err := tx.FindSpecificBook(ctx, "9780000000001")
+			require.NoError(t, err)
+			require.Equal(t, "a", b.Title)
+			return errRollback
+		})
+		require.ErrorIs(t, err, errRollback)
+		_, err = store.FindSpecificBook(ctx, "9780000000001")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		err = store.RunInTransaction(ctx, func(tx BookStore) error {
+			return tx.InsertIntoDatabase(ctx, testBook("9780000000001", "a"))
+		})
+		require.NoError(t, err)
+		b, err := store.FindSpecificBook(ctx, "9780000000001")
+		require.NoError(t, err)
+		require.Equal(t, "a", b.Title)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		err = store.RunInTransaction(canceled, func(tx BookStore) error {
+			return nil
+		})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+// testBook creates a valid book with the given isbn and title.
+func testBook(isbn, title string) Book {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Book{
+		ISBN:       isbn,
+		Title:      title,
+		CreateTime: now,
+		UpdateTime: now,
+		Publisher:  testPublisherID,
+		Authors:    []BookAuthor{{AuthorID: testAuthorID, Role: roleAuthor}},
+	}
+}
+
+// testAuthorID is the id of the author of the test books.
+const testAuthorID = "00000000000000a1"
+
+// testAuthor creates an author with the given id and names.
+func testAuthor(id, firstName, lastName string) Author {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Author{
+		ID:         id,
+		FirstName:  firstName,
+		LastName:   lastName,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+}
+
+// testPublisherID is the id of the publisher of the test books.
+const testPublisherID = "00000000000000e5"
+
+// testPublisher creates a publisher with the given id and display name.
+func testPublisher(id, displayName string) Publisher {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Publisher{
+		ID:          id,
+		DisplayName: displayName,
+		CreateTime:  now,
+		UpdateTime:  now,
+	}
+}
+
+// testCopy creates a copy of the book with the given id, barcode and status.
+func testCopy(isbn, id, barcode, status string) Copy {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Copy{
+		ISBN:            isbn,
+		ID:              id,
+		Barcode:         barcode,
+		AcquisitionDate: "2021-08-30",
+		PriceCents:      1999,
+		CurrencyCode:    "EUR",
+		Condition:       conditionNew,
+		Status:          status,
+		CreateTime:      now,
+		UpdateTime:      now,
+	}
+}
+
+// testMember creates a member with the given id, names and card number.
+func testMember(id, firstName, lastName, cardNumber string) Member {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Member{
+		ID:         id,
+		FirstName:  firstName,
+		LastName:   lastName,
+		Email:      firstName + "@example.com",
+		Tier:       tierStandard,
+		CardNumber: cardNumber,
+		ExpiryDate: "2022-09-01",
+		CreateTime: now,
+		UpdateTime: now,
+	}
+}
+
+// testLoan creates an active loan of the copy to the member.
+func testLoan(id string, c Copy, memberID string) Loan {
+	return Loan{
+		ID:           id,
+		ISBN:         c.ISBN,
+		CopyID:       c.ID,
+		MemberID:     memberID,
+		CheckoutTime: time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC),
+		DueDate:      "2021-09-22",
+	}
+}
+
+// testLedgerEntry creates a ledger entry of the member with the given type and
+// amount in euro cents.
+func testLedgerEntry(memberID, id, entryType string, amountCents int64) LedgerEntry {
+	return LedgerEntry{
+		ID:           id,
+		MemberID:     memberID,
+		Type:         entryType,
+		AmountCents:  amountCents,
+		CurrencyCode: "EUR",
+		CreateTime:   time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// testBranch creates a branch with the given id and display name.
+func testBranch(id, displayName string) Branch {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Branch{
+		ID:          id,
+		DisplayName: displayName,
+		CreateTime:  now,
+		UpdateTime:  now,
+	}
+}
+
+// testClosure creates a holiday of the branch from the start date to the end
+// date.
+func testClosure(branch, id, startDate, endDate string) Closure {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Closure{
+		Branch:     branch,
+		ID:         id,
+		Kind:       kindHoliday,
+		StartDate:  startDate,
+		EndDate:    endDate,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+}
+
+// testHold creates a waiting hold of the member on the book.
+func testHold(isbn, id, memberID string) Hold {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	return Hold{
+		ISBN:         isbn,
+		ID:           id,
+		MemberID:     memberID,
+		PickupBranch: "central",
+		State:        holdWaiting,
+		PlaceTime:    now,
+		UpdateTime:   now,
+	}
+}
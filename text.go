@@ -0,0 +1,115 @@
+package library
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// textRule is the validation rule of a free text field such as a name or a
+// title. The text is normalized by normalizeText before it is validated.
+type textRule struct {
+	maxLength   int    // The maximum number of characters
+	allowDigits bool   // Whether digits are allowed besides letters
+	anyGraphic  bool   // Whether any printable character is allowed
+	punctuation string // The punctuation allowed besides letters and spaces
+	description string // The description of the rule for a field violation
+}
+
+// The rules shared by several fields.
+var (
+	// personNameRule allows names like "Søren", "García Márquez", "O'Brien"
+	// and "Jean-Paul".
+	personNameRule = textRule{
+		maxLength:   100,
+		punctuation: "'’-.",
+		description: "must be 1 to 100 characters of words of letters," +
+			" which may contain apostrophes, hyphens and periods",
+	}
+	// organizationNameRule allows names like "Simon & Schuster",
+	// "Bonnier Förlag" and "Faber and Faber, Inc.".
+	organizationNameRule = textRule{
+		maxLength:   100,
+		allowDigits: true,
+		punctuation: "'’-.,&()!+/:",
+		description: "must be 1 to 100 characters of words of letters and" +
+			" digits, which may contain the punctuation ' ’ - . , & ( ) ! + / :",
+	}
+	// titleRule allows any printable characters.
+	titleRule = textRule{
+		maxLength:  300,
+		anyGraphic: true,
+		description: "must be 1 to 300 printable characters, with the words" +
+			" separated by single spaces",
+	}
+)
+
+// textField identifies a free text field by the collection of the resource
+// and the field path.
+type textField struct {
+	collection, path string
+}
+
+// textRules are the rules of all the free text fields. The fields are
+// validated the same way whether they are sent over gRPC or HTTP.
+var textRules = map[textField]textRule{
+	{"books", fieldTitle}:            titleRule,
+	{"authors", fieldFirstName}:      personNameRule,
+	{"authors", fieldLastName}:       personNameRule,
+	{"members", fieldFirstName}:      personNameRule,
+	{"members", fieldLastName}:       personNameRule,
+	{"publishers", fieldDisplayName}: organizationNameRule,
+}
+
+// normalizeText normalizes a free text field to the Unicode normalization form
+// NFC and trims the surrounding white space, so that the same text is always
+// stored the same way.
+func normalizeText(s string) string {
+	return norm.NFC.String(strings.TrimSpace(s))
+}
+
+// checkText validates the normalized text of a field against its rule. It
+// returns the description of the rule and false if the text is invalid. A
+// field without a rule is always valid.
+func checkText(collection, path, s string) (string, bool) {
+	rule, ok := textRules[textField{collection, path}]
+	if !ok {
+		return "", true
+	}
+	return rule.description, rule.valid(s)
+}
+
+// valid reports whether the normalized text s satisfies the rule. The text
+// must not be empty, must not contain control characters and its words must
+// be separated by single spaces. Unless any printable character is allowed,
+// the text must also have a letter or an allowed digit, so a name of only
+// punctuation such as "..." is invalid.
+func (r textRule) valid(s string) bool {
+	if s == "" || !utf8.ValidString(s) || utf8.RuneCountInString(s) > r.maxLength {
+		return false
+	}
+
+	previous := ' '
+	hasLetter := r.anyGraphic
+	for _, c := range s {
+		switch {
+		case c == ' ':
+			if previous == ' ' {
+				return false
+			}
+		case unicode.IsControl(c) || unicode.IsSpace(c):
+			return false
+		case unicode.IsLetter(c) || r.allowDigits && unicode.IsDigit(c):
+			hasLetter = true
+		case unicode.IsMark(c):
+		case strings.ContainsRune(r.punctuation, c):
+		case r.anyGraphic && unicode.IsGraphic(c):
+		default:
+			return false
+		}
+		previous = c
+	}
+	return hasLetter
+}
@@ -0,0 +1,53 @@
+package library
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckText(t *testing.T) {
+	for _, tc := range []struct {
+		collection, path, text string
+		want                   bool
+	}{
+		{"authors", fieldFirstName, "Søren", true},
+		{"authors", fieldLastName, "García Márquez", true},
+		{"authors", fieldLastName, "O'Brien", true},
+		{"authors", fieldFirstName, "Jean-Paul", true},
+		{"authors", fieldFirstName, "J.R.R.", true},
+		{"members", fieldLastName, "Kierkegaard", true},
+		{"authors", fieldFirstName, "", false},
+		{"authors", fieldFirstName, "R2D2", false},
+		{"authors", fieldLastName, "García  Márquez", false},
+		{"authors", fieldLastName, "Lucas\tJr", false},
+		{"members", fieldFirstName, "Bob\x00", false},
+		{"authors", fieldFirstName, "...", false},
+		{"authors", fieldLastName, "- '", false},
+		{"members", fieldLastName, "’", false},
+		{"publishers", fieldDisplayName, "Simon & Schuster", true},
+		{"publishers", fieldDisplayName, "Bonnier Förlag", true},
+		{"publishers", fieldDisplayName, "Faber and Faber, Inc.", true},
+		{"publishers", fieldDisplayName, "Penguin; DROP TABLE", false},
+		{"publishers", fieldDisplayName, "3M", true},
+		{"publishers", fieldDisplayName, "& (+)", false},
+		{"books", fieldTitle, "Star Wars: Episode IV – A New Hope", true},
+		{"books", fieldTitle, "1984", true},
+		{"books", fieldTitle, "...", true},
+		{"books", fieldTitle, "line\nbreak", false},
+		{"books", fieldTitle, string(make([]rune, 301)), false},
+		{"members", fieldEmail, "", true},
+	} {
+		t.Run(tc.collection+"/"+tc.path+"/"+tc.text, func(t *testing.T) {
+			_, ok := checkText(tc.collection, tc.path, normalizeText(tc.text))
+			require.Equal(t, tc.want, ok)
+		})
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	// the 'ø' is one code point, and the 'á' is decomposed into an 'a' and a
+	// combining acute accent which NFC composes
+	require.Equal(t, "S\u00f8ren", normalizeText("  S\u00f8ren "))
+	require.Equal(t, "M\u00e1rquez", normalizeText("Ma\u0301rquez"))
+}
@@ -0,0 +1,199 @@
+package library
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	librarypb "github.com/NicolaiMordrup/library/gen/proto/go/librarypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// the types of a book change
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+)
+
+// changeTypes maps the types of a book change to the event types.
+var changeTypes = map[string]librarypb.BookEvent_Type{
+	changeCreated: librarypb.BookEvent_TYPE_CREATED,
+	changeUpdated: librarypb.BookEvent_TYPE_UPDATED,
+	changeDeleted: librarypb.BookEvent_TYPE_DELETED,
+}
+
+const (
+	// watchBatchSize is the number of changes read from the store at once.
+	watchBatchSize = 100
+	// watchPollInterval is how often a watch looks for changes it was not
+	// notified of, such as those made by another server sharing the database.
+	watchPollInterval = 2 * time.Second
+)
+
+// BookChange is a change of a book. The seq numbers the changes in the order
+// they were made and is never reused, so a watch can resume after it.
+type BookChange struct {
+	Seq        int64     `json:"seq"`
+	ISBN       string    `json:"isbn"`
+	Type       string    `json:"type"`       // created, updated or deleted
+	RevisionID string    `json:"revisionId"` // The revision written by the change
+	ChangeTime time.Time `json:"changeTime"`
+}
+
+// changeNotifier wakes up the watches when books have been changed.
+type changeNotifier struct {
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// wait returns a channel which is closed at the next notify.
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.changed == nil {
+		n.changed = make(chan struct{})
+	}
+	return n.changed
+}
+
+// notify wakes up the watches waiting for a change.
+func (n *changeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.changed != nil {
+		close(n.changed)
+		n.changed = nil
+	}
+}
+
+// watchChecksum ties a resume token to WatchBooks, the way the lists tie their
+// page tokens to the collection by parsePageToken.
+var watchChecksum = listChecksum("", "watch", false)
+
+// resumeToken creates the resume token pointing after the change with the seq.
+func resumeToken(seq int64) string {
+	return encodePageToken(watchChecksum, []string{strconv.FormatInt(seq, 10)})
+}
+
+// errInvalidResumeToken is returned for a resume token which was not sent by
+// WatchBooks.
+var errInvalidResumeToken = &fieldError{"resume_token",
+	"must be the resume_token of a change sent by WatchBooks"}
+
+// parseResumeToken returns the seq of the change a resume token points after.
+func parseResumeToken(token string) (int64, error) {
+	after, err := parsePageToken(token, watchChecksum, 1)
+	if err != nil || after == nil {
+		return 0, invalidArgumentError(errInvalidResumeToken)
+	}
+	seq, err := strconv.ParseInt(after[0], 10, 64)
+	if err != nil || seq < 0 {
+		return 0, invalidArgumentError(errInvalidResumeToken)
+	}
+	return seq, nil
+}
+
+// WatchBooks streams the changes of the books until the client cancels the
+// call. Without a resume token the books which are not deleted are first
+// sent as created, all with the token of the latest change.
+func (s *libraryServiceServer) WatchBooks(req *librarypb.WatchBooksRequest,
+	stream librarypb.LibraryService_WatchBooksServer) error {
+	ctx := stream.Context()
+
+	var after int64
+	if req.GetResumeToken() != "" {
+		seq, err := parseResumeToken(req.GetResumeToken())
+		if err != nil {
+			return err
+		}
+		after = seq
+	} else {
+		books, seq, err := s.currentBooks(ctx)
+		if err != nil {
+			return s.toStatus(err)
+		}
+		token := resumeToken(seq)
+		for _, b := range books {
+			err := stream.Send(&librarypb.BookEvent{
+				Type:        librarypb.BookEvent_TYPE_CREATED,
+				Book:        b.AsProto(),
+				ResumeToken: token,
+				EventTime:   timestamppb.New(b.UpdateTime),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		after = seq
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		// taken before reading, so a change committed meanwhile is not missed
+		changed := s.changes.wait()
+		changes, err := s.store.ListBookChanges(ctx, after, watchBatchSize)
+		if err != nil {
+			return s.toStatus(err)
+		}
+		for _, c := range changes {
+			event, err := s.bookEvent(ctx, c)
+			if err != nil {
+				return s.toStatus(err)
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+			after = c.Seq
+		}
+		if len(changes) == watchBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// currentBooks returns the books which are not deleted and the seq of the
+// latest change, read in one transaction so no change is missed or repeated.
+func (s *libraryServiceServer) currentBooks(ctx context.Context) ([]Book, int64, error) {
+	var books []Book
+	var seq int64
+	err := s.store.RunInTransaction(ctx, func(tx BookStore) error {
+		var err error
+		if seq, err = tx.LastBookChange(ctx); err != nil {
+			return err
+		}
+		books, err = allBooks(ctx, tx, "", false)
+		return err
+	})
+	return books, seq, err
+}
+
+// bookEvent creates the event of a change, with the revision of the book it
+// wrote. Only the name is set if the book has since been purged.
+func (s *libraryServiceServer) bookEvent(ctx context.Context,
+	c BookChange) (*librarypb.BookEvent, error) {
+	book := &librarypb.Book{Name: c.ISBN}
+	revision, err := s.store.GetBookRevision(ctx, c.ISBN, c.RevisionID)
+	switch {
+	case err == nil:
+		book = revision.AsProto()
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+	return &librarypb.BookEvent{
+		Type:        changeTypes[c.Type],
+		Book:        book,
+		ResumeToken: resumeToken(c.Seq),
+		EventTime:   timestamppb.New(c.ChangeTime),
+	}, nil
+}